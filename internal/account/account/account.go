@@ -12,8 +12,12 @@ type Account struct {
 }
 
 func (a Account) ToProtoAccount() *proto.Account {
+	var u string
+	if a.URL != nil {
+		u = a.URL.String()
+	}
 	return &proto.Account{
 		Address: a.Address.ToBytes(),
-		Url:     a.URL.String(),
+		Url:     u,
 	}
 }
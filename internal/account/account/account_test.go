@@ -23,3 +23,16 @@ func TestAccount_ToProtoAccount(t *testing.T) {
 
 	require.Equal(t, want, got)
 }
+
+func TestAccount_ToProtoAccount_NoURL(t *testing.T) {
+	acct := Account{
+		Address: Address([20]byte{218, 113, 240, 116, 70, 237, 30, 202, 48, 68, 133, 221, 0, 196, 130, 126, 208, 152, 73, 152}),
+	}
+	got := acct.ToProtoAccount()
+
+	want := &proto.Account{
+		Address: []byte{218, 113, 240, 116, 70, 237, 30, 202, 48, 68, 133, 221, 0, 196, 130, 126, 208, 152, 73, 152},
+	}
+
+	require.Equal(t, want, got)
+}
@@ -61,3 +61,27 @@ func TestAddress_ToHexString(t *testing.T) {
 	got := addr.ToHexString()
 	require.Equal(t, want, got)
 }
+
+func FuzzNewAddressFromHexString(f *testing.F) {
+	for _, seed := range []string{
+		"",
+		"0x",
+		"6038dc01869425004ca0b8370f6c81cf464213b3",
+		"0x6038dc01869425004ca0b8370f6c81cf464213b3",
+		"0X6038DC01869425004CA0B8370F6C81CF464213B3",
+		"6038dc01869425004ca0b8370f6c81cf464213b",
+		"6038dc01869425004ca0b8370f6c81cf464213b3ff",
+		"not-hex",
+	} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, addr string) {
+		got, err := NewAddressFromHexString(addr)
+		if err != nil {
+			return
+		}
+		again, err := NewAddressFromHexString(got.ToHexString())
+		require.NoError(t, err)
+		require.Equal(t, got, again)
+	})
+}
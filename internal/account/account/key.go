@@ -3,12 +3,15 @@ package account
 import (
 	"crypto/ecdsa"
 	"crypto/elliptic"
+	"encoding/asn1"
 	"encoding/hex"
 	"errors"
 	"fmt"
 	"math/big"
 	"strings"
 
+	"quorum-account-plugin-pkcs-11/internal/secure"
+
 	"github.com/jpmorganchase/quorum/crypto/secp256k1"
 	"golang.org/x/crypto/sha3"
 )
@@ -22,13 +25,24 @@ const (
 // This function should not be used with direct user input as it performs minimal validation.
 // Auto-generated input should be used (i.e. generated keys retrieved direct from Vault) or user-input from Quorum that should have been validated at the Quorum-level.
 // Be careful if using direct user input as valid hex may not result in a valid ethereum private key.
+//
+// The decoded key bytes are held in a secure.Buffer which is wiped before returning.  The caller is responsible for
+// wiping the returned key's private component once it is no longer needed.
 func NewKeyFromHexString(key string) (*ecdsa.PrivateKey, error) {
-	key = strings.TrimPrefix(key, "0x")
-	byt, err := hex.DecodeString(key)
+	hexKey, err := secure.FromString(strings.TrimPrefix(key, "0x"))
+	if err != nil {
+		return nil, err
+	}
+	defer hexKey.Destroy()
+	byt, err := secure.NewBuffer(hex.DecodedLen(hexKey.Len()))
 	if err != nil {
+		return nil, err
+	}
+	defer byt.Destroy()
+	if _, err := hex.Decode(byt.Bytes(), hexKey.Bytes()); err != nil {
 		return nil, fmt.Errorf("invalid hex private key: %v", err)
 	}
-	return newKey(byt)
+	return newKey(byt.Bytes())
 }
 
 func newKey(byt []byte) (*ecdsa.PrivateKey, error) {
@@ -40,19 +54,46 @@ func newKey(byt []byte) (*ecdsa.PrivateKey, error) {
 		key   = new(ecdsa.PrivateKey)
 	)
 	key.D = new(big.Int).SetBytes(byt)
+	if key.D.Sign() == 0 || key.D.Cmp(curve.Params().N) >= 0 {
+		return nil, errors.New("invalid private key: must be greater than 0 and less than the order of secp256k1")
+	}
 	key.PublicKey.Curve = curve
 	key.PublicKey.X, key.PublicKey.Y = curve.ScalarBaseMult(byt)
 
 	return key, nil
 }
 
+// PublicKeyToAddress derives the account address of a public key.
 func PublicKeyToAddress(key *ecdsa.PublicKey) (Address, error) {
+	if key == nil || key.Curve == nil || key.X == nil || key.Y == nil {
+		return Address{}, errInvalidPublicKey
+	}
 	return PublicKeyBytesToAddress(elliptic.Marshal(key, key.X, key.Y))
 }
 
+// ECPointToPublicKey parses a secp256k1 public key from a PKCS#11 CKA_EC_POINT value, which is a DER OCTET STRING
+// containing the uncompressed point.  Some tokens return the point without the OCTET STRING, which is also accepted.
+func ECPointToPublicKey(ecPoint []byte) (*ecdsa.PublicKey, error) {
+	curve := secp256k1.S256()
+	var point []byte
+	if rest, err := asn1.Unmarshal(ecPoint, &point); err == nil && len(rest) == 0 {
+		if x, y := elliptic.Unmarshal(curve, point); x != nil {
+			return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+		}
+	}
+	if x, y := elliptic.Unmarshal(curve, ecPoint); x != nil {
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, errors.New("invalid EC point: expected an uncompressed secp256k1 point")
+}
+
+var errInvalidPublicKey = errors.New("invalid key: unable to derive address")
+
+// PublicKeyBytesToAddress derives the account address of a public key in the uncompressed form returned by
+// elliptic.Marshal.
 func PublicKeyBytesToAddress(key []byte) (Address, error) {
-	if key == nil {
-		return Address{}, errors.New("invalid key: unable to derive address")
+	if len(key) != 1+2*keyLen || key[0] != 4 {
+		return Address{}, errInvalidPublicKey
 	}
 
 	d := sha3.NewLegacyKeccak256()
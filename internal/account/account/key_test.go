@@ -39,6 +39,19 @@ func TestNewKeyFromHexString_TooShort(t *testing.T) {
 	require.EqualError(t, err, "private key must have length 32 bytes")
 }
 
+func TestNewKeyFromHexString_OutOfRange(t *testing.T) {
+	for name, key := range map[string]string{
+		"zero":  "0000000000000000000000000000000000000000000000000000000000000000",
+		"order": "fffffffffffffffffffffffffffffffebaaedce6af48a03bbfd25e8cd0364141",
+		"max":   "ffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff",
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := NewKeyFromHexString(key)
+			require.EqualError(t, err, "invalid private key: must be greater than 0 and less than the order of secp256k1")
+		})
+	}
+}
+
 func TestPublicKeyBytesToAddress(t *testing.T) {
 	byt, _ := hex.DecodeString("1fe8f1ad4053326db20529257ac9401f2e6c769ef1d736b8c2f5aba5f787c72b")
 	key := &ecdsa.PrivateKey{
@@ -59,6 +72,21 @@ func TestPublicKeyBytesToAddress(t *testing.T) {
 	require.Equal(t, want, got)
 }
 
+func TestPublicKeyBytesToAddress_InvalidKey(t *testing.T) {
+	for name, key := range map[string][]byte{
+		"nil":        nil,
+		"empty":      {},
+		"short":      {0x04, 0x01},
+		"compressed": append([]byte{0x02}, make([]byte, 32)...),
+		"prefix":     append([]byte{0x05}, make([]byte, 64)...),
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := PublicKeyBytesToAddress(key)
+			require.EqualError(t, err, "invalid key: unable to derive address")
+		})
+	}
+}
+
 func TestPublicKeyToAddress_InvalidKey(t *testing.T) {
 	var (
 		key    *ecdsa.PublicKey
@@ -80,3 +108,87 @@ func TestPublicKeyToAddress_InvalidKey(t *testing.T) {
 	_, gotErr = PublicKeyToAddress(key)
 	require.EqualError(t, gotErr, want)
 }
+
+func TestECPointToPublicKey(t *testing.T) {
+	key, err := NewKeyFromHexString("1fe8f1ad4053326db20529257ac9401f2e6c769ef1d736b8c2f5aba5f787c72b")
+	require.NoError(t, err)
+	point := elliptic.Marshal(secp256k1.S256(), key.X, key.Y)
+	der := append([]byte{0x04, byte(len(point))}, point...)
+
+	for name, ecPoint := range map[string][]byte{"DER": der, "raw": point} {
+		t.Run(name, func(t *testing.T) {
+			got, err := ECPointToPublicKey(ecPoint)
+			require.NoError(t, err)
+			require.Equal(t, key.X, got.X)
+			require.Equal(t, key.Y, got.Y)
+		})
+	}
+}
+
+func TestECPointToPublicKey_Invalid(t *testing.T) {
+	_, err := ECPointToPublicKey([]byte{0x04, 0x02, 0x01, 0x02})
+	require.EqualError(t, err, "invalid EC point: expected an uncompressed secp256k1 point")
+}
+
+func FuzzNewKeyFromHexString(f *testing.F) {
+	for _, seed := range []string{
+		"",
+		"0x",
+		"1fe8f1ad4053326db20529257ac9401f2e6c769ef1d736b8c2f5aba5f787c72b",
+		"0x1fe8f1ad4053326db20529257ac9401f2e6c769ef1d736b8c2f5aba5f787c72b",
+		"1fe8f1ad4053326db20529257ac9401f2e6c769ef1d736b8c2f5aba5f787c72",
+		"0000000000000000000000000000000000000000000000000000000000000000",
+		"fffffffffffffffffffffffffffffffebaaedce6af48a03bbfd25e8cd0364141",
+		"this-is-not-hex",
+	} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, hexKey string) {
+		key, err := NewKeyFromHexString(hexKey)
+		if err != nil {
+			return
+		}
+		require.True(t, key.Curve.IsOnCurve(key.X, key.Y))
+		_, err = PublicKeyToAddress(&key.PublicKey)
+		require.NoError(t, err)
+	})
+}
+
+func FuzzPublicKeyBytesToAddress(f *testing.F) {
+	key, err := NewKeyFromHexString("1fe8f1ad4053326db20529257ac9401f2e6c769ef1d736b8c2f5aba5f787c72b")
+	require.NoError(f, err)
+	for _, seed := range [][]byte{
+		nil,
+		{},
+		{0x04},
+		elliptic.Marshal(secp256k1.S256(), key.X, key.Y),
+		elliptic.MarshalCompressed(secp256k1.S256(), key.X, key.Y),
+	} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, key []byte) {
+		PublicKeyBytesToAddress(key)
+	})
+}
+
+func FuzzECPointToPublicKey(f *testing.F) {
+	key, err := NewKeyFromHexString("1fe8f1ad4053326db20529257ac9401f2e6c769ef1d736b8c2f5aba5f787c72b")
+	require.NoError(f, err)
+	point := elliptic.Marshal(secp256k1.S256(), key.X, key.Y)
+	for _, seed := range [][]byte{
+		nil,
+		point,
+		append([]byte{0x04, byte(len(point))}, point...),
+		{0x04, 0x02, 0x01, 0x02},
+	} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, ecPoint []byte) {
+		pub, err := ECPointToPublicKey(ecPoint)
+		if err != nil {
+			return
+		}
+		_, err = PublicKeyToAddress(pub)
+		require.NoError(t, err)
+	})
+}
@@ -0,0 +1,120 @@
+// Package admin implements the administrative commands of the plugin binary.  These are run directly by an operator
+// (e.g. `quorum-account-plugin-pkcs-11 token init ...`) rather than by Quorum, so that the setup of a node's HSM can be
+// scripted with the same tool that later uses it.
+package admin
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"sort"
+
+	"quorum-account-plugin-pkcs-11/internal/config"
+	"quorum-account-plugin-pkcs-11/internal/secure"
+)
+
+type command struct {
+	usage string
+	run   func(args []string, stdout, stderr io.Writer) error
+}
+
+var commands = map[string]map[string]command{
+	"config": configCommands,
+	"pin":    pinCommands,
+	"token":  tokenCommands,
+}
+
+// Run executes the admin command described by args (excluding the program name) and returns the exit code for the
+// process.
+func Run(args []string, stdout, stderr io.Writer) int {
+	if len(args) < 2 {
+		printUsage(stderr)
+		return 2
+	}
+	group, ok := commands[args[0]]
+	if !ok {
+		printUsage(stderr)
+		return 2
+	}
+	cmd, ok := group[args[1]]
+	if !ok {
+		printUsage(stderr)
+		return 2
+	}
+	if err := cmd.run(args[2:], stdout, stderr); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 2
+		}
+		fmt.Fprintf(stderr, "%v %v: %v\n", args[0], args[1], err)
+		return 1
+	}
+	return 0
+}
+
+func printUsage(w io.Writer) {
+	fmt.Fprintln(w, "usage: quorum-account-plugin-pkcs-11 <command> <subcommand> [flags]")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "commands:")
+	for _, g := range sortedKeys(commands) {
+		group := commands[g]
+		names := make([]string, 0, len(group))
+		for n := range group {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		for _, n := range names {
+			fmt.Fprintf(w, "  %-20v %v\n", g+" "+n, group[n].usage)
+		}
+	}
+}
+
+func sortedKeys(m map[string]map[string]command) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// newFlagSet creates a FlagSet for a subcommand which reports parse errors to the caller instead of exiting.
+func newFlagSet(name string, output io.Writer) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(output)
+	return fs
+}
+
+// libraryPath parses a file:// url to a PKCS#11 library, returning the path on the local filesystem.
+func libraryPath(s string) (string, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme != "file" || u.Host != "" || u.Path == "" {
+		return "", fmt.Errorf("-library %v", config.InvalidLibraryPath)
+	}
+	return u.Path, nil
+}
+
+// secret resolves an env:// reference to the value of the environment variable it names.  Secrets are never accepted
+// directly as command-line arguments so that they do not appear in the process list or shell history.  The caller must
+// destroy the returned Buffer.
+func secret(name, s string) (*secure.Buffer, error) {
+	if s == "" {
+		return nil, fmt.Errorf("-%v must be set", name)
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf("-%v: %v", name, err)
+	}
+	if u.Scheme != "env" {
+		return nil, fmt.Errorf("-%v must be an env:// reference to an environment variable", name)
+	}
+	env := config.EnvironmentVariable(*u)
+	if !env.IsSet() {
+		return nil, fmt.Errorf("-%v: environment variable %v is not set", name, u.Host)
+	}
+	return env.GetSecret()
+}
@@ -0,0 +1,101 @@
+package admin
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"quorum-account-plugin-pkcs-11/internal/config"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRun_UnknownCommand(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+
+	code := Run([]string{"token", "unknown"}, &stdout, &stderr)
+
+	require.Equal(t, 2, code)
+	require.Contains(t, stderr.String(), "token init")
+	require.Empty(t, stdout.String())
+}
+
+func TestRun_InvalidLibraryPath(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+
+	code := Run([]string{"token", "init-pin", "-library", "http://lib", "-label", "l"}, &stdout, &stderr)
+
+	require.Equal(t, 1, code)
+	require.Contains(t, stderr.String(), config.InvalidLibraryPath)
+}
+
+func TestRun_ConfigSchema(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+
+	code := Run([]string{"config", "schema"}, &stdout, &stderr)
+
+	require.Equal(t, 0, code)
+	want, err := config.Schema()
+	require.NoError(t, err)
+	require.Equal(t, string(want), stdout.String())
+}
+
+func TestRun_ConfigMigrate(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "config.json")
+	require.NoError(t, os.WriteFile(file, []byte(`{"Library": {"Path": "file:///lib.so", "SlotLabel": "env://SLOT_LABEL"}}`), 0600))
+	var stdout, stderr bytes.Buffer
+
+	code := Run([]string{"config", "migrate", "-file", file}, &stdout, &stderr)
+
+	require.Equal(t, 0, code, stderr.String())
+	require.Contains(t, stderr.String(), `warning: Library: field names should be in lower camel case, rename to "library"`)
+	got, err := os.ReadFile(file)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"version": 2, "library": {"path": "file:///lib.so", "slotLabel": "env://SLOT_LABEL"}}`, string(got))
+	info, err := os.Stat(file)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	stdout.Reset()
+	code = Run([]string{"config", "migrate", "-file", file}, &stdout, &stderr)
+
+	require.Equal(t, 0, code)
+	require.Contains(t, stdout.String(), "is already config version 2")
+}
+
+func TestRun_ConfigMigrate_UnknownField(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "config.json")
+	raw := []byte(`{"Library": {"Path": "file:///lib.so"}, "unlocks": []}`)
+	require.NoError(t, os.WriteFile(file, raw, 0600))
+	var stdout, stderr bytes.Buffer
+
+	code := Run([]string{"config", "migrate", "-file", file}, &stdout, &stderr)
+
+	require.Equal(t, 1, code)
+	require.Contains(t, stderr.String(), "migrated config is invalid: unlocks: unknown field")
+	got, err := os.ReadFile(file)
+	require.NoError(t, err)
+	require.Equal(t, raw, got)
+}
+
+func TestSecret(t *testing.T) {
+	defer os.Unsetenv("ADMIN_TEST_PIN")
+	os.Setenv("ADMIN_TEST_PIN", "1234")
+
+	got, err := secret("pin", "env://ADMIN_TEST_PIN")
+	require.NoError(t, err)
+	defer got.Destroy()
+	require.Equal(t, "1234", got.UnsafeString())
+}
+
+func TestSecret_Invalid(t *testing.T) {
+	_, err := secret("pin", "")
+	require.EqualError(t, err, "-pin must be set")
+
+	_, err = secret("pin", "1234")
+	require.EqualError(t, err, "-pin must be an env:// reference to an environment variable")
+
+	_, err = secret("pin", "env://ADMIN_TEST_UNSET_PIN")
+	require.EqualError(t, err, "-pin: environment variable ADMIN_TEST_UNSET_PIN is not set")
+}
@@ -0,0 +1,108 @@
+package admin
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"quorum-account-plugin-pkcs-11/internal/config"
+)
+
+var configCommands = map[string]command{
+	"migrate": {
+		usage: "rewrite a config file in the current config layout",
+		run:   migrateConfig,
+	},
+	"schema": {
+		usage: "print the JSON Schema of the plugin config",
+		run:   printSchema,
+	},
+}
+
+func printSchema(args []string, stdout, stderr io.Writer) error {
+	fs := newFlagSet("config schema", stderr)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	schema, err := config.Schema()
+	if err != nil {
+		return err
+	}
+	_, err = stdout.Write(schema)
+	return err
+}
+
+// migrateConfig upgrades a config file to config.CurrentVersion, replacing the file.  The fields of the rewritten file
+// are in alphabetical order.
+func migrateConfig(args []string, stdout, stderr io.Writer) error {
+	fs := newFlagSet("config migrate", stderr)
+	var (
+		file   = fs.String("file", "", "path of the config file")
+		dryRun = fs.Bool("dry-run", false, "print the migrated config instead of rewriting the file")
+	)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *file == "" {
+		return errors.New("-file must be set")
+	}
+	raw, err := os.ReadFile(*file)
+	if err != nil {
+		return err
+	}
+	migrated, warnings, err := config.Migrate(raw)
+	if err != nil {
+		return err
+	}
+	// the migrated config must be decodable, though it is not validated as the environment it is used in may differ
+	if err := json.Unmarshal(migrated, new(config.Config)); err != nil {
+		return fmt.Errorf("migrated config is invalid: %v", err)
+	}
+	for _, w := range warnings {
+		fmt.Fprintf(stderr, "warning: %v\n", w)
+	}
+
+	if *dryRun {
+		_, err := stdout.Write(migrated)
+		return err
+	}
+	if len(warnings) == 0 {
+		fmt.Fprintf(stdout, "%v is already config version %v\n", *file, config.CurrentVersion)
+		return nil
+	}
+	if err := writeFile(*file, migrated); err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "migrated %v to config version %v\n", *file, config.CurrentVersion)
+	return nil
+}
+
+// writeFile replaces the file at path, keeping its permissions.  The file is replaced rather than written to so that a
+// plugin watching it never reads a partial config.
+func writeFile(path string, b []byte) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, bytes.NewReader(b)); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(info.Mode().Perm()); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,48 @@
+package admin
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+
+	"quorum-account-plugin-pkcs-11/internal/control"
+)
+
+var pinCommands = map[string]command{
+	"rotate": {
+		usage: "change the user PIN used by a running plugin without restarting it",
+		run:   rotatePIN,
+	},
+}
+
+func rotatePIN(args []string, stdout, stderr io.Writer) error {
+	fs := newFlagSet("pin rotate", stderr)
+	var (
+		socket = fs.String("control", "", "file:// url of the running plugin's control socket")
+		newPIN = fs.String("new-pin", "", "env:// reference to the new user PIN")
+	)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	u, err := url.Parse(*socket)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "file" || u.Host != "" || u.Path == "" {
+		return errors.New("-control must be a valid absolute file url")
+	}
+	pin, err := secret("new-pin", *newPIN)
+	if err != nil {
+		return err
+	}
+	defer pin.Destroy()
+
+	if err := control.Call(u.Path, control.Request{Command: control.RotatePIN, NewPIN: pin.Bytes()}); err != nil {
+		return err
+	}
+	fmt.Fprintln(stdout, "rotated user PIN")
+	// the plugin keeps the new PIN across reconfiguration but reads the configured PIN again when it restarts
+	fmt.Fprintln(stdout, "update the environment variable referred to by library.slotPin before the plugin is restarted")
+	return nil
+}
@@ -0,0 +1,147 @@
+package admin
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"quorum-account-plugin-pkcs-11/internal/pkcs11"
+
+	p11 "github.com/miekg/pkcs11"
+)
+
+var tokenCommands = map[string]command{
+	"init": {
+		usage: "initialize a token with a label and Security Officer PIN (C_InitToken)",
+		run:   initToken,
+	},
+	"init-pin": {
+		usage: "set the user PIN of a token as Security Officer (C_InitPIN)",
+		run:   initPIN,
+	},
+	"set-pin": {
+		usage: "change the user or Security Officer PIN of a token (C_SetPIN)",
+		run:   setPIN,
+	},
+}
+
+func initToken(args []string, stdout, stderr io.Writer) error {
+	fs := newFlagSet("token init", stderr)
+	var (
+		library = fs.String("library", "", "file:// url of the PKCS#11 library")
+		slot    = fs.Int("slot", -1, "ID of the slot containing the token to initialize")
+		label   = fs.String("label", "", "label to give the token")
+		soPIN   = fs.String("so-pin", "", "env:// reference to the Security Officer PIN")
+	)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *slot < 0 {
+		return errors.New("-slot must be set")
+	}
+	libPath, err := libraryPath(*library)
+	if err != nil {
+		return err
+	}
+	so, err := secret("so-pin", *soPIN)
+	if err != nil {
+		return err
+	}
+	defer so.Destroy()
+
+	ta, err := pkcs11.NewTokenAdmin(libPath)
+	if err != nil {
+		return err
+	}
+	defer ta.Close()
+
+	if err := ta.InitToken(uint(*slot), so, *label); err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "initialized token %q in slot %v\n", *label, *slot)
+	return nil
+}
+
+func initPIN(args []string, stdout, stderr io.Writer) error {
+	fs := newFlagSet("token init-pin", stderr)
+	var (
+		library = fs.String("library", "", "file:// url of the PKCS#11 library")
+		label   = fs.String("label", "", "label of the token")
+		soPIN   = fs.String("so-pin", "", "env:// reference to the Security Officer PIN")
+		pin     = fs.String("pin", "", "env:// reference to the user PIN to set")
+	)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	libPath, err := libraryPath(*library)
+	if err != nil {
+		return err
+	}
+	so, err := secret("so-pin", *soPIN)
+	if err != nil {
+		return err
+	}
+	defer so.Destroy()
+	user, err := secret("pin", *pin)
+	if err != nil {
+		return err
+	}
+	defer user.Destroy()
+
+	ta, err := pkcs11.NewTokenAdmin(libPath)
+	if err != nil {
+		return err
+	}
+	defer ta.Close()
+
+	if err := ta.InitPIN(*label, so, user); err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "initialized user PIN of token %q\n", *label)
+	return nil
+}
+
+func setPIN(args []string, stdout, stderr io.Writer) error {
+	fs := newFlagSet("token set-pin", stderr)
+	var (
+		library = fs.String("library", "", "file:// url of the PKCS#11 library")
+		label   = fs.String("label", "", "label of the token")
+		so      = fs.Bool("so", false, "change the Security Officer PIN instead of the user PIN")
+		oldPIN  = fs.String("old-pin", "", "env:// reference to the current PIN")
+		newPIN  = fs.String("new-pin", "", "env:// reference to the new PIN")
+	)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	libPath, err := libraryPath(*library)
+	if err != nil {
+		return err
+	}
+	old, err := secret("old-pin", *oldPIN)
+	if err != nil {
+		return err
+	}
+	defer old.Destroy()
+	updated, err := secret("new-pin", *newPIN)
+	if err != nil {
+		return err
+	}
+	defer updated.Destroy()
+
+	userType, userName := uint(p11.CKU_USER), "user"
+	if *so {
+		userType, userName = p11.CKU_SO, "Security Officer"
+	}
+
+	ta, err := pkcs11.NewTokenAdmin(libPath)
+	if err != nil {
+		return err
+	}
+	defer ta.Close()
+
+	if err := ta.SetPIN(*label, userType, old, updated); err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "changed %v PIN of token %q\n", userName, *label)
+	return nil
+}
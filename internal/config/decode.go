@@ -0,0 +1,179 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"quorum-account-plugin-pkcs-11/internal/logging"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Parse decodes and validates a config, returning Errors describing every problem found.  A malformed document is
+// reported with the error from encoding/json.
+func Parse(raw []byte) (*Config, error) {
+	var errs Errors
+	c, err := decode(raw, &errs)
+	if err != nil {
+		return nil, err
+	}
+	c.validate(&errs)
+	if err := errs.err(); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// warned is the set of deprecation warnings already logged.  The config is decoded again each time it is reloaded, and
+// each warning is only logged the first time.
+var warned = struct {
+	sync.Mutex
+	m map[string]bool
+}{m: make(map[string]bool)}
+
+// deprecationWarned reports whether the deprecation warning w has already been logged, recording that it is about to be
+// if not.
+func deprecationWarned(w string) bool {
+	warned.Lock()
+	defer warned.Unlock()
+	if warned.m[w] {
+		return true
+	}
+	warned.m[w] = true
+	return false
+}
+
+// decode migrates raw to CurrentVersion and strictly decodes it, adding to errs any unknown fields, values of the wrong
+// type and values that cannot be converted.  The returned Config holds everything that could be decoded, so that it
+// can still be validated.
+func decode(raw []byte, errs *Errors) (Config, error) {
+	var v interface{}
+	if err := json.Unmarshal(raw, &v); err != nil {
+		return Config{}, err
+	}
+	doc, warnings := migrate(v, errs)
+	if doc == nil {
+		return Config{}, nil
+	}
+	for _, w := range warnings {
+		if deprecationWarned(w) {
+			continue
+		}
+		logging.L().Warn("config uses a deprecated layout, run the config migrate command to update it", "warning", w)
+	}
+	migrated, err := json.Marshal(doc)
+	if err != nil {
+		return Config{}, err
+	}
+	// the migrated document is checked as it is decoded, with all numbers as float64
+	if err := json.Unmarshal(migrated, &v); err != nil {
+		return Config{}, err
+	}
+	checkJSON("", v, reflect.TypeOf(configJSON{}), errs)
+
+	j := new(configJSON)
+	if err := json.Unmarshal(migrated, j); err != nil {
+		// values of the wrong type have been reported by checkJSON; the rest of the document is still decoded
+		var typeErr *json.UnmarshalTypeError
+		if !errors.As(err, &typeErr) {
+			return Config{}, err
+		}
+	}
+	return j.config(errs), nil
+}
+
+// stringForm is implemented by the JSON types of objects which can also be written as a string.
+type stringForm interface {
+	stringForm()
+}
+
+var stringFormType = reflect.TypeOf((*stringForm)(nil)).Elem()
+
+// checkJSON adds to errs the fields of v, the JSON value at path, which are unknown or of the wrong type to be decoded
+// into t.  Like encoding/json, field names are matched case-insensitively and null is the same as leaving a value out.
+func checkJSON(path string, v interface{}, t reflect.Type, errs *Errors) {
+	if v == nil {
+		return
+	}
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if _, ok := v.(string); ok && t.Implements(stringFormType) {
+		return
+	}
+	switch t.Kind() {
+	case reflect.Struct:
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			errs.add(path, "must be an object")
+			return
+		}
+		keys := make([]string, 0, len(obj))
+		for k := range obj {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			f, ok := fieldByName(t, k)
+			if !ok {
+				errs.add(field(path, k), "unknown field")
+				continue
+			}
+			checkJSON(field(path, jsonName(f)), obj[k], f.Type, errs)
+		}
+	case reflect.Map:
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			errs.add(path, "must be an object")
+			return
+		}
+		keys := make([]string, 0, len(obj))
+		for k := range obj {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			checkJSON(field(path, k), obj[k], t.Elem(), errs)
+		}
+	case reflect.Slice:
+		arr, ok := v.([]interface{})
+		if !ok {
+			errs.add(path, "must be an array")
+			return
+		}
+		for i, e := range arr {
+			checkJSON(index(path, i), e, t.Elem(), errs)
+		}
+	case reflect.String:
+		if _, ok := v.(string); !ok {
+			errs.add(path, "must be a string")
+		}
+	case reflect.Bool:
+		if _, ok := v.(bool); !ok {
+			errs.add(path, "must be true or false")
+		}
+	case reflect.Int:
+		if f, ok := v.(float64); !ok || f != float64(int(f)) {
+			errs.add(path, "must be a whole number")
+		}
+	}
+}
+
+// fieldByName returns the field of the struct type t that encoding/json decodes the object key name into.
+func fieldByName(t reflect.Type, name string) (reflect.StructField, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		if f := t.Field(i); f.IsExported() && strings.EqualFold(f.Name, name) {
+			return f, true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+// jsonName is the name a field is documented under, and reported in errors as: its Go name in lower camel case.
+func jsonName(f reflect.StructField) string {
+	r, n := utf8.DecodeRuneInString(f.Name)
+	return string(unicode.ToLower(r)) + f.Name[n:]
+}
@@ -0,0 +1,153 @@
+package config
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"quorum-account-plugin-pkcs-11/internal/testutil"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParse(t *testing.T) {
+	defer testutil.UnsetAll()
+	testutil.SetSlotLabel("my_label")
+
+	conf, err := Parse([]byte(`{
+		"Library": {"PATH": "file:///lib.so", "slotLabel": "env://SLOT_LABEL", "slotPin": null},
+		"healthCheck": {"interval": "1m"}
+	}`))
+
+	require.NoError(t, err)
+	require.Equal(t, "/lib.so", conf.Library.Path.Path)
+	require.Equal(t, time.Minute, conf.HealthCheck.Interval)
+}
+
+func TestParse_LibraryInitialization(t *testing.T) {
+	defer testutil.UnsetAll()
+	testutil.SetSlotLabel("my_label")
+
+	conf, err := Parse([]byte(`{
+		"version": 2,
+		"library": {
+			"path": "file:///lib.so",
+			"slotLabel": "env://SLOT_LABEL",
+			"initialize": {"libraryCantCreateOsThreads": true},
+			"environment": {"SOFTHSM2_CONF": "/etc/softhsm2.conf"}
+		}
+	}`))
+
+	require.NoError(t, err)
+	require.Equal(t, &InitializeArgs{OSLocking: true, LibraryCantCreateOSThreads: true}, conf.Library.Initialize)
+	require.Equal(t, map[string]string{"SOFTHSM2_CONF": "/etc/softhsm2.conf"}, conf.Library.Environment)
+
+	b, err := json.Marshal(conf)
+	require.NoError(t, err)
+	var got struct {
+		Library struct{ Initialize, Environment json.RawMessage }
+	}
+	require.NoError(t, json.Unmarshal(b, &got))
+	require.JSONEq(t, `{"OsLocking": true, "LibraryCantCreateOsThreads": true}`, string(got.Library.Initialize))
+	require.JSONEq(t, `{"SOFTHSM2_CONF": "/etc/softhsm2.conf"}`, string(got.Library.Environment))
+}
+
+func TestParse_LibraryInitialization_Invalid(t *testing.T) {
+	defer testutil.UnsetAll()
+	testutil.SetSlotLabel("my_label")
+
+	_, err := Parse([]byte(`{
+		"version": 2,
+		"library": {
+			"path": "file:///lib.so",
+			"slotLabel": "env://SLOT_LABEL",
+			"initialize": {"osLocking": "yes"},
+			"environment": {"SOFTHSM2_CONF": 1, "A=B": "c"}
+		}
+	}`))
+
+	require.Equal(t, Errors{
+		{Path: "library.environment.SOFTHSM2_CONF", Message: "must be a string"},
+		{Path: "library.initialize.osLocking", Message: "must be true or false"},
+		{Path: "library.environment.A=B", Message: InvalidEnvironmentName},
+	}, err)
+}
+
+func TestParse_ReportsEveryProblem(t *testing.T) {
+	defer testutil.UnsetAll()
+	testutil.SetSlotLabel("my_label")
+
+	_, err := Parse([]byte(`{
+		"library": {"path": "file:///lib.so", "slotLabel": "env://SLOT_LABEL", "slotPin": "http://SLOT_PIN", "slotPn": "env://SLOT_PIN"},
+		"unlock": ["0x4d6d744b6da435b5bbdde2526dc20e9a41cb72e5", "4d6d744b6da435b5bbdde2526dc20e9a41cb72e5", "0xnothex", 7],
+		"metrics": "127.0.0.1:9102",
+		"healthCheck": {"interval": "often"},
+		"tracing": {"exporter": "otlp", "endpoint": "127.0.0.1:4317", "insecure": true},
+		"logLevel": "verbose",
+		"verbose": true
+	}`))
+
+	require.Equal(t, Errors{
+		{Path: "library.slotPn", Message: "unknown field"},
+		{Path: "metrics", Message: "must be an object"},
+		{Path: "tracing.insecure", Message: "unknown field"},
+		{Path: "unlock[3]", Message: "must be an object"},
+		{Path: "verbose", Message: "unknown field"},
+		{Path: "healthCheck.interval", Message: `not a valid duration: "often"`},
+		{Path: "library.slotPin", Message: `unknown scheme "http"`},
+		{Path: "unlock[2]", Message: InvalidUnlockAddress},
+		{Path: "logLevel", Message: InvalidLogLevel},
+	}, err)
+}
+
+func TestParse_Malformed(t *testing.T) {
+	_, err := Parse([]byte(`{"library": `))
+
+	var syntaxErr *json.SyntaxError
+	require.ErrorAs(t, err, &syntaxErr)
+}
+
+func TestConfig_UnmarshalJSON_UnknownField(t *testing.T) {
+	var c Config
+	err := json.Unmarshal([]byte(`{"library": {"path": "file:///lib.so"}, "unlocks": []}`), &c)
+
+	require.EqualError(t, err, "unlocks: unknown field")
+}
+
+func FuzzConfig_UnmarshalJSON(f *testing.F) {
+	seeds, err := filepath.Glob(filepath.Join("testdata", "migrate", "*", "*.json"))
+	require.NoError(f, err)
+	for _, path := range seeds {
+		raw, err := os.ReadFile(path)
+		require.NoError(f, err)
+		f.Add(raw)
+	}
+	for _, seed := range []string{
+		``,
+		`null`,
+		`[]`,
+		`{}`,
+		`{"version": 1}`,
+		`{"version": -1}`,
+		`{"library": {"path": "file:///lib.so"}, "unlocks": []}`,
+		`{"library": {"path": "%zz"}}`,
+		`{"library": {"path": "file:///lib.so", "slotPin": "env://"}, "healthCheck": {"interval": "-1s"}}`,
+		`{"library": {"path": "file:///lib.so"}, "unlock": [{"account": "0x4d6d744b6da435b5bbdde2526dc20e9a41cb72e5"}, 1]}`,
+	} {
+		f.Add([]byte(seed))
+	}
+	f.Fuzz(func(t *testing.T, raw []byte) {
+		var c Config
+		if err := json.Unmarshal(raw, &c); err != nil {
+			return
+		}
+		// a decoded config can be written and decoded again
+		b, err := json.Marshal(&c)
+		if err != nil {
+			return
+		}
+		var again Config
+		require.NoError(t, json.Unmarshal(b, &again), "%s", b)
+	})
+}
@@ -0,0 +1,64 @@
+package config
+
+import "reflect"
+
+// The sections of a Config, named as in its JSON.
+const (
+	SectionLibrary       = "library"
+	SectionUnlock        = "unlock"
+	SectionControlSocket = "controlSocket"
+	SectionMetrics       = "metrics"
+	SectionLogLevel      = "logLevel"
+	SectionTracing       = "tracing"
+	SectionHealthCheck   = "healthCheck"
+	SectionSlotEvents    = "slotEvents"
+	SectionConfigFile    = "configFile"
+)
+
+// Sections lists all sections of a Config.
+var Sections = []string{
+	SectionLibrary,
+	SectionUnlock,
+	SectionControlSocket,
+	SectionMetrics,
+	SectionLogLevel,
+	SectionTracing,
+	SectionHealthCheck,
+	SectionSlotEvents,
+	SectionConfigFile,
+}
+
+// Diff returns the sections of new which differ from old, in the order of Sections.
+func Diff(old, new Config) []string {
+	var changed []string
+	for _, s := range Sections {
+		if !reflect.DeepEqual(old.section(s), new.section(s)) {
+			changed = append(changed, s)
+		}
+	}
+	return changed
+}
+
+func (c Config) section(name string) interface{} {
+	switch name {
+	case SectionLibrary:
+		return c.Library
+	case SectionUnlock:
+		return c.Unlock
+	case SectionControlSocket:
+		return c.ControlSocket
+	case SectionMetrics:
+		return c.Metrics
+	case SectionLogLevel:
+		return c.LogLevel
+	case SectionTracing:
+		return c.Tracing
+	case SectionHealthCheck:
+		return c.HealthCheck
+	case SectionSlotEvents:
+		return c.SlotEvents
+	case SectionConfigFile:
+		return c.ConfigFile
+	}
+	panic("unknown config section " + name)
+}
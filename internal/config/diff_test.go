@@ -0,0 +1,37 @@
+package config
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func parse(t *testing.T, s string) Config {
+	var c Config
+	require.NoError(t, json.Unmarshal([]byte(s), &c))
+	return c
+}
+
+func TestDiff(t *testing.T) {
+	old := parse(t, `{"library": {"path": "file:///lib.so", "slotLabel": "env://SLOT_LABEL"}, "unlock": ["0x4d6d744b6da435b5bbdde2526dc20e9a41cb72e5"], "logLevel": "info"}`)
+
+	require.Empty(t, Diff(old, parse(t, `{"library": {"path": "file:///lib.so", "slotLabel": "env://SLOT_LABEL"}, "unlock": ["0x4d6d744b6da435b5bbdde2526dc20e9a41cb72e5"], "logLevel": "info"}`)))
+
+	got := Diff(old, parse(t, `{"library": {"path": "file:///other.so", "slotLabel": "env://SLOT_LABEL"}, "logLevel": "debug", "metrics": {"listenAddress": "127.0.0.1:9102"}}`))
+	require.Equal(t, []string{SectionLibrary, SectionUnlock, SectionMetrics, SectionLogLevel}, got)
+}
+
+func TestDiff_AllSections(t *testing.T) {
+	require.Equal(t, Sections, Diff(Config{}, parse(t, `{
+		"library": {"path": "file:///lib.so", "slotLabel": "env://SLOT_LABEL"},
+		"unlock": ["0x4d6d744b6da435b5bbdde2526dc20e9a41cb72e5"],
+		"controlSocket": "file:///run/pkcs11.sock",
+		"metrics": {"listenAddress": "127.0.0.1:9102"},
+		"logLevel": "debug",
+		"tracing": {"exporter": "otlp", "endpoint": "127.0.0.1:4317"},
+		"healthCheck": {},
+		"slotEvents": {},
+		"configFile": "file:///etc/pkcs11.json"
+	}`)))
+}
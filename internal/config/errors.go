@@ -0,0 +1,66 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+// FieldError is a problem with the value at Path in the config JSON, e.g. "library.slotPin" or "unlock[2]".
+type FieldError struct {
+	Path    string
+	Message string
+}
+
+func (e FieldError) Error() string {
+	if e.Path == "" {
+		return e.Message
+	}
+	return e.Path + ": " + e.Message
+}
+
+// Errors is every problem found in a config, in the order they were found.
+type Errors []FieldError
+
+func (e Errors) Error() string {
+	msgs := make([]string, len(e))
+	for i, fe := range e {
+		msgs[i] = fe.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// add records a problem at path, unless one has already been recorded for path or any value containing it: once a
+// value is found to be wrong, anything derived from it is likely to be wrong too.
+func (e *Errors) add(path, msg string) {
+	for _, fe := range *e {
+		if fe.Path == path || strings.HasPrefix(path, fe.Path+".") || strings.HasPrefix(path, fe.Path+"[") {
+			return
+		}
+	}
+	*e = append(*e, FieldError{Path: path, Message: msg})
+}
+
+func (e *Errors) addf(path, format string, a ...interface{}) {
+	e.add(path, fmt.Sprintf(format, a...))
+}
+
+// err returns e, or nil if no problems were found.
+func (e Errors) err() error {
+	if len(e) == 0 {
+		return nil
+	}
+	return e
+}
+
+// field returns the path of the field name of the object at path.
+func field(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
+
+// index returns the path of element i of the array at path.
+func index(path string, i int) string {
+	return fmt.Sprintf("%v[%d]", path, i)
+}
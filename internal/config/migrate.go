@@ -0,0 +1,181 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// CurrentVersion is the version of the config layout decoded by Parse.  Configs with an older version, or none, are
+// migrated to it when they are read, and the changes needed are logged as deprecation warnings.
+const CurrentVersion = 2
+
+// migration upgrades a config document from version from to version from+1.
+type migration struct {
+	from int
+	// migrate changes doc in place, returning a warning for each deprecated part of the old layout.  It must only
+	// depend on the layouts of versions from and from+1, so that it keeps working as later versions are added.
+	migrate func(doc map[string]interface{}, errs *Errors) []string
+}
+
+// migrations are the steps from each version to the next, in order.  Each has golden tests in testdata/migrate/v<from>,
+// see TestMigrations.
+var migrations = []migration{
+	// version 0 had no version field, and field names could be written in any case
+	{from: 0, migrate: canonicalKeys(v1Keys, nil)},
+	// version 2 added the library's initialize args, environment and profile, and unlock entries which are objects
+	{from: 1, migrate: canonicalKeys(v2Keys, []string{"environment"})},
+}
+
+// Migrate upgrades the config document raw to CurrentVersion.  It returns the upgraded document and a warning for each
+// deprecated part of the old layout, which are empty if raw is already CurrentVersion.
+func Migrate(raw []byte) ([]byte, []string, error) {
+	var v interface{}
+	if err := json.Unmarshal(raw, &v); err != nil {
+		return nil, nil, err
+	}
+	var errs Errors
+	doc, warnings := migrate(v, &errs)
+	if err := errs.err(); err != nil {
+		return nil, nil, err
+	}
+	b, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return nil, nil, err
+	}
+	return append(b, '\n'), warnings, nil
+}
+
+// migrate applies the migrations from the version of v, the decoded config document, to CurrentVersion.  Any problems
+// are added to errs, in which case doc is nil.
+func migrate(v interface{}, errs *Errors) (doc map[string]interface{}, warnings []string) {
+	doc, ok := v.(map[string]interface{})
+	if !ok {
+		errs.add("", "must be an object")
+		return nil, nil
+	}
+	version, ok := docVersion(doc, errs)
+	if !ok {
+		return nil, nil
+	}
+	switch {
+	case version == CurrentVersion:
+		return doc, nil
+	case version == 0:
+		warnings = append(warnings, fmt.Sprintf("version is not set, the config is taken to be version 0 and migrated to version %v", CurrentVersion))
+	default:
+		warnings = append(warnings, fmt.Sprintf("version %v is deprecated, the config is migrated to version %v", version, CurrentVersion))
+	}
+	for _, m := range migrations {
+		if m.from < version {
+			continue
+		}
+		warnings = append(warnings, m.migrate(doc, errs)...)
+		if len(*errs) > 0 {
+			return nil, nil
+		}
+		doc["version"] = m.from + 1
+	}
+	return doc, warnings
+}
+
+// docVersion returns the version of the config document doc, which is 0 if it is not set.
+func docVersion(doc map[string]interface{}, errs *Errors) (int, bool) {
+	var (
+		v     interface{}
+		found bool
+	)
+	for k, kv := range doc {
+		if strings.EqualFold(k, "version") {
+			v, found = kv, true
+		}
+	}
+	if !found || v == nil {
+		return 0, true
+	}
+	f, ok := v.(float64)
+	if !ok || f != float64(int(f)) || f < 0 {
+		errs.add("version", "must be a whole number")
+		return 0, false
+	}
+	if int(f) > CurrentVersion {
+		errs.addf("version", "%v is newer than the newest supported version, %v", int(f), CurrentVersion)
+		return 0, false
+	}
+	return int(f), true
+}
+
+// v1Keys are the field names of version 1 configs.
+var v1Keys = []string{
+	"version", "library", "path", "slotLabel", "slotPin", "strictCapabilities", "unlock", "controlSocket", "metrics",
+	"listenAddress", "logLevel", "tracing", "exporter", "endpoint", "file", "healthCheck", "interval", "canaryAccount",
+	"slotEvents", "pollInterval", "onRemoval", "configFile",
+}
+
+// v2Keys are the field names of version 2 configs.
+var v2Keys = append(append([]string(nil), v1Keys...),
+	"initialize", "osLocking", "libraryCantCreateOsThreads", "environment", "profile", "account", "duration", "credential",
+	"optional",
+)
+
+// canonicalKeys returns a migration to a version whose field names are keys, renaming the fields written in another case
+// to lower camel case as in the JSON Schema.  Names are still matched case-insensitively when decoded, but only lower
+// camel case names are valid against the schema.  Fields which are not in keys are left as they are, as later versions
+// may give them content of any form, as is the content of the opaque fields, whose own names are values such as the
+// names of environment variables.
+func canonicalKeys(keys, opaque []string) func(doc map[string]interface{}, errs *Errors) []string {
+	return func(doc map[string]interface{}, errs *Errors) []string {
+		var warnings []string
+		var walk func(path string, v interface{})
+		walk = func(path string, v interface{}) {
+			switch v := v.(type) {
+			case map[string]interface{}:
+				names := make([]string, 0, len(v))
+				for k := range v {
+					names = append(names, k)
+				}
+				sort.Strings(names)
+				for _, k := range names {
+					name, known := k, false
+					for _, c := range keys {
+						if strings.EqualFold(k, c) {
+							name, known = c, true
+						}
+					}
+					if !known {
+						continue
+					}
+					if name != k {
+						if _, ok := v[name]; ok {
+							errs.addf(field(path, k), "duplicates %q", name)
+							continue
+						}
+						v[name] = v[k]
+						delete(v, k)
+						warnings = append(warnings, fmt.Sprintf("%v: field names should be in lower camel case, rename to %q", field(path, k), name))
+					}
+					if !contains(opaque, name) {
+						walk(field(path, name), v[name])
+					}
+				}
+			case []interface{}:
+				for i, e := range v {
+					walk(index(path, i), e)
+				}
+			}
+		}
+		walk("", doc)
+		return warnings
+	}
+}
+
+// contains reports whether name is one of names.
+func contains(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,275 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"quorum-account-plugin-pkcs-11/internal/logging"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/require"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files of the migration tests")
+
+// migrated is the content of a migration test's golden file
+type migrated struct {
+	Config   map[string]interface{} `json:"config"`
+	Warnings []string               `json:"warnings"`
+}
+
+// TestMigrations runs each migration step on the configs in testdata/migrate/v<from>, comparing the result with the
+// <name>.golden file alongside.  Run with -update to rewrite the golden files.
+func TestMigrations(t *testing.T) {
+	for _, m := range migrations {
+		inputs, err := filepath.Glob(filepath.Join("testdata", "migrate", fmt.Sprintf("v%v", m.from), "*.json"))
+		require.NoError(t, err)
+		require.NotEmpty(t, inputs, "migration from version %v has no golden tests", m.from)
+
+		for _, in := range inputs {
+			m, in := m, in
+			t.Run(fmt.Sprintf("v%v/%v", m.from, filepath.Base(in)), func(t *testing.T) {
+				raw, err := os.ReadFile(in)
+				require.NoError(t, err)
+				var doc map[string]interface{}
+				require.NoError(t, json.Unmarshal(raw, &doc))
+
+				var errs Errors
+				got := migrated{Warnings: m.migrate(doc, &errs), Config: doc}
+				require.NoError(t, errs.err())
+				b, err := json.MarshalIndent(got, "", "  ")
+				require.NoError(t, err)
+				b = append(b, '\n')
+
+				golden := strings.TrimSuffix(in, ".json") + ".golden"
+				if *update {
+					require.NoError(t, os.WriteFile(golden, b, 0644))
+				}
+				want, err := os.ReadFile(golden)
+				require.NoError(t, err)
+				require.Equal(t, string(want), string(b))
+			})
+		}
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	got, warnings, err := Migrate([]byte(`{"Library": {"Path": "file:///lib.so", "SlotLabel": "env://SLOT_LABEL"}}`))
+
+	require.NoError(t, err)
+	require.JSONEq(t, `{"version": 2, "library": {"path": "file:///lib.so", "slotLabel": "env://SLOT_LABEL"}}`, string(got))
+	require.Equal(t, []string{
+		"version is not set, the config is taken to be version 0 and migrated to version 2",
+		`Library: field names should be in lower camel case, rename to "library"`,
+		`library.Path: field names should be in lower camel case, rename to "path"`,
+		`library.SlotLabel: field names should be in lower camel case, rename to "slotLabel"`,
+	}, warnings)
+}
+
+func TestMigrate_CurrentVersion(t *testing.T) {
+	raw := `{"version": 2, "library": {"path": "file:///lib.so", "slotLabel": "env://SLOT_LABEL"}}`
+
+	got, warnings, err := Migrate([]byte(raw))
+
+	require.NoError(t, err)
+	require.JSONEq(t, raw, string(got))
+	require.Empty(t, warnings)
+}
+
+func TestMigrate_Invalid(t *testing.T) {
+	tests := map[string]string{
+		`[]`:                                    "must be an object",
+		`{"version": "1"}`:                      "version: must be a whole number",
+		`{"version": 1.5}`:                      "version: must be a whole number",
+		`{"version": 3}`:                        "version: 3 is newer than the newest supported version, 2",
+		`{"library": {}, "Library": {}}`:        `Library: duplicates "library"`,
+		`{"library": {"path": "", "PATH": ""}}`: `library.PATH: duplicates "path"`,
+	}
+	for raw, wantErr := range tests {
+		t.Run(raw, func(t *testing.T) {
+			_, _, err := Migrate([]byte(raw))
+			require.EqualError(t, err, wantErr)
+		})
+	}
+}
+
+// TestMigrate_ValidAgainstSchema migrates a version 0 config setting every field, with names in mixed case, and checks
+// the result is valid against the JSON Schema.
+func TestMigrate_ValidAgainstSchema(t *testing.T) {
+	raw := `{
+		"Library": {
+			"Path": "file:///usr/lib/softhsm/libsofthsm2.so",
+			"SlotLabel": "env://SLOT_LABEL",
+			"SlotPIN": "env://SLOT_PIN",
+			"StrictCapabilities": true,
+			"Profile": "softhsm2",
+			"Initialize": {"OSLocking": true, "LibraryCantCreateOSThreads": false},
+			"Environment": {"SOFTHSM2_CONF": "/etc/softhsm2.conf", "Path": "/usr/lib/softhsm"}
+		},
+		"Unlock": [
+			"0x4d6d744b6da435b5bbdde2526dc20e9a41cb72e5",
+			{"Account": "label:validator-*", "Duration": "1h", "Credential": "env://KEY_PIN", "Optional": true}
+		],
+		"ControlSocket": "file:///run/pkcs11/control.sock",
+		"Metrics": {"ListenAddress": "127.0.0.1:9102"},
+		"LogLevel": "debug",
+		"Tracing": {"Exporter": "file", "Endpoint": "127.0.0.1:4317", "File": "file:///var/log/pkcs11/spans.json"},
+		"HealthCheck": {"Interval": "30s", "CanaryAccount": "0x4d6d744b6da435b5bbdde2526dc20e9a41cb72e5"},
+		"SlotEvents": {"PollInterval": "5s", "OnRemoval": "keep"},
+		"ConfigFile": "file:///etc/pkcs11/config.json"
+	}`
+	got, _, err := Migrate([]byte(raw))
+	require.NoError(t, err)
+
+	b, err := Schema()
+	require.NoError(t, err)
+	var schema, doc map[string]interface{}
+	require.NoError(t, json.Unmarshal(b, &schema))
+	require.NoError(t, json.Unmarshal(got, &doc))
+
+	seen := make(map[string]bool)
+	require.NoError(t, validateSchema(schema, doc, "", seen))
+	require.Equal(t, schemaFields(schema, ""), seen, "the config must set every field of the schema")
+}
+
+// validateSchema checks v against schema, for the keywords used by Schema, adding the path of each field of v found in
+// the properties of schema to seen.  The elements of arrays all have the path of the array followed by [].
+func validateSchema(schema map[string]interface{}, v interface{}, path string, seen map[string]bool) error {
+	if typ, ok := schema["type"].(string); ok {
+		var ok bool
+		switch typ {
+		case "object":
+			_, ok = v.(map[string]interface{})
+		case "array":
+			_, ok = v.([]interface{})
+		case "string":
+			_, ok = v.(string)
+		case "boolean":
+			_, ok = v.(bool)
+		case "integer":
+			f, isNumber := v.(float64)
+			ok = isNumber && f == float64(int(f))
+		}
+		if !ok {
+			return fmt.Errorf("%v: must be of type %v", path, typ)
+		}
+	}
+	if c, ok := schema["const"]; ok && fmt.Sprint(c) != fmt.Sprint(v) {
+		return fmt.Errorf("%v: must be %v", path, c)
+	}
+	if enum, ok := schema["enum"].([]interface{}); ok {
+		found := false
+		for _, e := range enum {
+			found = found || e == v
+		}
+		if !found {
+			return fmt.Errorf("%v: must be one of %v", path, enum)
+		}
+	}
+	if pattern, ok := schema["pattern"].(string); ok && !regexp.MustCompile(pattern).MatchString(v.(string)) {
+		return fmt.Errorf("%v: must match %v", path, pattern)
+	}
+	if oneOf, ok := schema["oneOf"].([]interface{}); ok {
+		matched := 0
+		for _, s := range oneOf {
+			if validateSchema(s.(map[string]interface{}), v, path, seen) == nil {
+				matched++
+			}
+		}
+		if matched != 1 {
+			return fmt.Errorf("%v: must match exactly one schema of oneOf", path)
+		}
+	}
+	if items, ok := schema["items"].(map[string]interface{}); ok {
+		for _, e := range v.([]interface{}) {
+			if err := validateSchema(items, e, path+"[]", seen); err != nil {
+				return err
+			}
+		}
+	}
+	obj, ok := v.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	for _, r := range asSlice(schema["required"]) {
+		if _, ok := obj[r.(string)]; !ok {
+			return fmt.Errorf("%v: is required", field(path, r.(string)))
+		}
+	}
+	props, _ := schema["properties"].(map[string]interface{})
+	for k, e := range obj {
+		var s interface{}
+		if p, ok := props[k]; ok {
+			seen[field(path, k)] = true
+			s = p
+		} else {
+			s = schema["additionalProperties"]
+		}
+		switch s := s.(type) {
+		case bool:
+			if !s {
+				return fmt.Errorf("%v: is not allowed", field(path, k))
+			}
+		case map[string]interface{}:
+			if err := validateSchema(s, e, field(path, k), seen); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// schemaFields returns the paths of the fields in the properties of schema and of its items and oneOf schemas.
+func schemaFields(schema map[string]interface{}, path string) map[string]bool {
+	fields := make(map[string]bool)
+	add := func(sub map[string]bool) {
+		for f := range sub {
+			fields[f] = true
+		}
+	}
+	if props, ok := schema["properties"].(map[string]interface{}); ok {
+		for k, p := range props {
+			fields[field(path, k)] = true
+			add(schemaFields(p.(map[string]interface{}), field(path, k)))
+		}
+	}
+	if items, ok := schema["items"].(map[string]interface{}); ok {
+		add(schemaFields(items, path+"[]"))
+	}
+	for _, s := range asSlice(schema["oneOf"]) {
+		add(schemaFields(s.(map[string]interface{}), path))
+	}
+	return fields
+}
+
+func asSlice(v interface{}) []interface{} {
+	s, _ := v.([]interface{})
+	return s
+}
+
+func TestParse_MigratesOldVersions(t *testing.T) {
+	conf, err := Parse([]byte(`{"Library": {"Path": "file:///lib.so", "SlotLabel": "env://SLOT_LABEL"}, "LogLevel": "debug"}`))
+
+	require.Nil(t, conf)
+	require.EqualError(t, err, "library.slotLabel: environment variable SLOT_LABEL must be set")
+}
+
+func TestParse_WarnsOnce(t *testing.T) {
+	defer logging.SetDefault(logging.L())
+	var buf bytes.Buffer
+	logging.SetDefault(logging.New(&buf, hclog.Info))
+	warned.m = make(map[string]bool)
+
+	// as when the config is reloaded
+	for i := 0; i < 2; i++ {
+		_, _ = Parse([]byte(`{"library": {"path": "file:///lib.so", "slotLabel": "env://SLOT_LABEL"}}`))
+	}
+
+	require.Equal(t, 1, strings.Count(buf.String(), "version is not set"))
+}
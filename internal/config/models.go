@@ -2,13 +2,92 @@ package config
 
 import (
 	"encoding/json"
+	"errors"
 	"net/url"
 	"os"
+	"quorum-account-plugin-pkcs-11/internal/secure"
+	"time"
 )
 
 type Config struct {
 	Library Pkcs11Library
-	Unlock  []string
+	// Accounts to unlock once the session has been opened
+	Unlock []UnlockEntry
+
+	// Optional unix socket on which the plugin accepts admin commands (e.g. PIN rotation) while running
+	ControlSocket *url.URL
+
+	// Optional Prometheus metrics endpoint
+	Metrics *Metrics
+
+	// Optional log level: trace, debug, info (default), warn or error
+	LogLevel string
+
+	// Optional OpenTelemetry trace exporter
+	Tracing *Tracing
+
+	// Optional background health checks of the token
+	HealthCheck *HealthCheck
+
+	// Optional watching of the token's slot for removal and re-insertion of the token
+	SlotEvents *SlotEvents
+
+	// Optional file url of the file this config is read from.  If set, the file is re-read when it changes or the
+	// plugin receives SIGHUP, and the new config is applied without restarting Quorum.
+	ConfigFile *url.URL
+}
+
+type Metrics struct {
+	// ListenAddress is the host:port the HTTP listener serving /metrics binds to, e.g. 127.0.0.1:9102.  The host must be
+	// localhost or a loopback address as the metrics are served without authentication.
+	ListenAddress string `required:"true" description:"host:port the HTTP listener serving /metrics binds to, e.g. 127.0.0.1:9102; the host must be localhost or a loopback address"`
+}
+
+const (
+	// OTLPExporter sends spans to an OpenTelemetry collector over OTLP/gRPC
+	OTLPExporter = "otlp"
+	// FileExporter appends spans to a file, one JSON document per span
+	FileExporter = "file"
+)
+
+type Tracing struct {
+	// Exporter is OTLPExporter or FileExporter
+	Exporter string
+	// Endpoint is the host:port of the collector used by OTLPExporter, e.g. 127.0.0.1:4317.  The connection is not
+	// encrypted so the collector should be local.
+	Endpoint string
+	// File is the file url of the file used by FileExporter
+	File *url.URL
+}
+
+// DefaultHealthCheckInterval is used when HealthCheck.Interval is not set
+const DefaultHealthCheckInterval = 30 * time.Second
+
+type HealthCheck struct {
+	// Interval between checks, e.g. "30s"
+	Interval time.Duration
+	// Optional hex address of an account whose key is used to sign and verify random data on each check.  The account
+	// should be dedicated to health checks.
+	CanaryAccount string
+}
+
+const (
+	// DefaultSlotPollInterval is used when SlotEvents.PollInterval is not set
+	DefaultSlotPollInterval = 5 * time.Second
+
+	// LockOnRemoval locks all unlocked accounts when the token is removed
+	LockOnRemoval = "lock"
+	// KeepOnRemoval keeps accounts unlocked while the token is removed, so that they can sign as soon as it is
+	// re-inserted
+	KeepOnRemoval = "keep"
+)
+
+type SlotEvents struct {
+	// PollInterval between checks for the token, e.g. "5s".  The slots are also checked whenever the PKCS#11 library
+	// reports a slot event, unless it does not support blocking waits for them or may not create threads.
+	PollInterval time.Duration
+	// OnRemoval is LockOnRemoval (default) or KeepOnRemoval
+	OnRemoval string
 }
 
 type Pkcs11Library struct {
@@ -17,72 +96,219 @@ type Pkcs11Library struct {
 
 	// Optional Slot Login
 	SlotPin *EnvironmentVariable
+
+	// Optional: fail to open a session if the token cannot generate secp256k1 key pairs, rather than only failing
+	// NewAccount
+	StrictCapabilities bool
+
+	// Optional CK_C_INITIALIZE_ARGS flags the library is initialized with.  If not set, the library is initialized
+	// with OS locking allowed.
+	Initialize *InitializeArgs
+
+	// Optional environment variables the library reads its own config from, e.g. SOFTHSM2_CONF.  They are set while
+	// the library is loaded and initialized, and restored afterwards, so a library which reads them later does not
+	// see them.  The environment is shared by the whole process, so while they are set they are also seen by the rest
+	// of the plugin and by anything it starts.
+	Environment map[string]string
+
+	// Optional profile of the library's quirks, one of Profiles.  If not set, it is detected from the C_GetInfo of the
+	// library.
+	Profile string
+}
+
+// The built-in profiles of PKCS#11 modules.
+const (
+	ProfileSoftHSM2   = "softhsm2"
+	ProfileGeneric220 = "generic-2.20"
+	ProfileGeneric240 = "generic-2.40"
+	ProfileCloudHSM   = "cloud-hsm"
+)
+
+// Profiles are the names of the built-in profiles of PKCS#11 modules.
+var Profiles = []string{ProfileSoftHSM2, ProfileGeneric220, ProfileGeneric240, ProfileCloudHSM}
+
+// InitializeArgs are the flags of the CK_C_INITIALIZE_ARGS passed to C_Initialize.
+type InitializeArgs struct {
+	// OSLocking sets CKF_OS_LOCKING_OK: the library may use the operating system's locking primitives to protect
+	// itself from concurrent calls.  It must be set: the plugin calls the library concurrently, e.g. from the slot
+	// watcher and health checks while a request is being handled, and does not serialize its calls.
+	OSLocking bool
+	// LibraryCantCreateOSThreads sets CKF_LIBRARY_CANT_CREATE_OS_THREADS: the library must not create threads
+	LibraryCantCreateOSThreads bool
 }
 
 type NewAccount struct {
 	SecretName string
 }
 
+// configJSON is the JSON form of Config.  Its struct tags document the fields in the JSON Schema, see Schema.
 type configJSON struct {
-	Library pkcs11LibraryJSON
-	Unlock  []string
+	Version       int               `description:"Version of the config layout.  Older layouts are migrated when the config is read."`
+	Library       pkcs11LibraryJSON `required:"true" description:"The PKCS#11 library and the token it is used with"`
+	Unlock        []unlockEntryJSON `description:"Accounts to unlock once the session has been opened"`
+	ControlSocket string            `pattern:"^file:///" description:"File url of a unix socket on which the plugin accepts admin commands while running"`
+	Metrics       *Metrics          `description:"Prometheus metrics endpoint"`
+	LogLevel      string            `enum:"trace,debug,info,warn,error" description:"Log level, info by default"`
+	Tracing       *tracingJSON      `description:"OpenTelemetry trace exporter"`
+	HealthCheck   *healthCheckJSON  `description:"Background health checks of the token"`
+	SlotEvents    *slotEventsJSON   `description:"Watching of the token's slot for removal and re-insertion of the token"`
+	ConfigFile    string            `pattern:"^file:///" description:"File url of the file this config is read from, which is reloaded when it changes or the plugin receives SIGHUP"`
+}
+
+type slotEventsJSON struct {
+	PollInterval string `description:"Interval between checks for the token, e.g. 5s"`
+	OnRemoval    string `enum:"lock,keep" description:"Whether to lock all unlocked accounts when the token is removed, lock by default"`
+}
+
+type healthCheckJSON struct {
+	Interval      string `description:"Interval between checks, e.g. 30s"`
+	CanaryAccount string `pattern:"^(0x)?[0-9a-fA-F]{40}$" description:"Hex address of an account whose key is used to sign and verify random data on each check"`
+}
+
+type tracingJSON struct {
+	Exporter string `required:"true" enum:"otlp,file" description:"Where spans are sent"`
+	Endpoint string `description:"host:port of the collector used by the otlp exporter, e.g. 127.0.0.1:4317"`
+	File     string `pattern:"^file:///" description:"File url of the file used by the file exporter"`
 }
 
 type pkcs11LibraryJSON struct {
-	Path      string
-	SlotLabel string
-	SlotPin   string
+	Path               string              `required:"true" pattern:"^file:///" description:"File url of the PKCS#11 library"`
+	SlotLabel          string              `required:"true" pattern:"^env://" description:"env:// reference to the environment variable holding the label of the token"`
+	SlotPin            string              `pattern:"^env://" description:"env:// reference to the environment variable holding the user PIN of the token"`
+	StrictCapabilities bool                `description:"Fail to open a session if the token cannot generate secp256k1 key pairs, rather than only failing NewAccount"`
+	Initialize         *initializeArgsJSON `description:"CK_C_INITIALIZE_ARGS flags the library is initialized with"`
+	Environment        map[string]string   `description:"Environment variables the library reads its own config from, e.g. SOFTHSM2_CONF, set while it is loaded and initialized"`
+	Profile            string              `enum:"softhsm2,generic-2.20,generic-2.40,cloud-hsm" description:"Profile of the quirks of the library, detected from its manufacturer and PKCS#11 version by default"`
+}
+
+type initializeArgsJSON struct {
+	OsLocking                  *bool `description:"Allow the library to use the operating system's locking primitives (CKF_OS_LOCKING_OK).  Must be true, as the plugin calls the library concurrently"`
+	LibraryCantCreateOsThreads bool  `description:"Do not allow the library to create threads (CKF_LIBRARY_CANT_CREATE_OS_THREADS)"`
 }
 
+// UnmarshalJSON strictly decodes a config: unknown fields and values of the wrong type are errors.  It does not
+// validate the config, see Parse.
 func (c *Config) UnmarshalJSON(b []byte) error {
-	j := new(configJSON)
-	if err := json.Unmarshal(b, j); err != nil {
+	var errs Errors
+	vc, err := decode(b, &errs)
+	if err != nil {
 		return err
 	}
-	vc, err := j.config()
-	if err != nil {
+	if err := errs.err(); err != nil {
 		return err
 	}
 	*c = vc
 	return nil
 }
 
-func (c configJSON) config() (Config, error) {
-	library, err := c.Library.pkcs11Library()
-	if err != nil {
-		return Config{}, err
+// config converts the decoded JSON to a Config, adding to errs any values which cannot be converted.  Such values are
+// left unset.
+func (c configJSON) config(errs *Errors) Config {
+	var unlock []UnlockEntry
+	for i, u := range c.Unlock {
+		unlock = append(unlock, u.unlockEntry(index("unlock", i), errs))
+	}
+
+	var controlSocket *url.URL
+	if c.ControlSocket != "" {
+		controlSocket = parseURL("controlSocket", c.ControlSocket, errs)
+	}
+
+	var tracing *Tracing
+	if c.Tracing != nil {
+		tracing = &Tracing{Exporter: c.Tracing.Exporter, Endpoint: c.Tracing.Endpoint}
+		if c.Tracing.File != "" {
+			tracing.File = parseURL("tracing.file", c.Tracing.File, errs)
+		}
+	}
+
+	var healthCheck *HealthCheck
+	if c.HealthCheck != nil {
+		healthCheck = &HealthCheck{Interval: DefaultHealthCheckInterval, CanaryAccount: c.HealthCheck.CanaryAccount}
+		if c.HealthCheck.Interval != "" {
+			healthCheck.Interval = parseDuration("healthCheck.interval", c.HealthCheck.Interval, errs)
+		}
+	}
+
+	var configFile *url.URL
+	if c.ConfigFile != "" {
+		configFile = parseURL("configFile", c.ConfigFile, errs)
+	}
+
+	var slotEvents *SlotEvents
+	if c.SlotEvents != nil {
+		slotEvents = &SlotEvents{PollInterval: DefaultSlotPollInterval, OnRemoval: c.SlotEvents.OnRemoval}
+		if c.SlotEvents.PollInterval != "" {
+			slotEvents.PollInterval = parseDuration("slotEvents.pollInterval", c.SlotEvents.PollInterval, errs)
+		}
+		if slotEvents.OnRemoval == "" {
+			slotEvents.OnRemoval = LockOnRemoval
+		}
 	}
 
 	return Config{
-		Library: library,
-		Unlock:  c.Unlock,
-	}, nil
+		Library:       c.Library.pkcs11Library(errs),
+		Unlock:        unlock,
+		ControlSocket: controlSocket,
+		Metrics:       c.Metrics,
+		LogLevel:      c.LogLevel,
+		Tracing:       tracing,
+		HealthCheck:   healthCheck,
+		SlotEvents:    slotEvents,
+		ConfigFile:    configFile,
+	}
 }
 
-func (l pkcs11LibraryJSON) pkcs11Library() (Pkcs11Library, error) {
-	path, err := url.Parse(l.Path)
-	if err != nil {
-		return Pkcs11Library{}, err
+func (l pkcs11LibraryJSON) pkcs11Library(errs *Errors) Pkcs11Library {
+	var (
+		slotLabel = EnvironmentVariable(*orEmpty(parseURL("library.slotLabel", l.SlotLabel, errs)))
+		slotPIN   = EnvironmentVariable(*orEmpty(parseURL("library.slotPin", l.SlotPin, errs)))
+	)
+	return Pkcs11Library{
+		Path:               orEmpty(parseURL("library.path", l.Path, errs)),
+		SlotLabel:          &slotLabel,
+		SlotPin:            &slotPIN,
+		StrictCapabilities: l.StrictCapabilities,
+		Initialize:         l.Initialize.initializeArgs(),
+		Environment:        l.Environment,
+		Profile:            l.Profile,
 	}
-	slotLabel, err := url.Parse(l.SlotLabel)
-	if err != nil {
-		return Pkcs11Library{}, err
+}
+
+func (a *initializeArgsJSON) initializeArgs() *InitializeArgs {
+	if a == nil {
+		return nil
 	}
-	slotPIN, err := url.Parse(l.SlotPin)
+	return &InitializeArgs{
+		OSLocking:                  a.OsLocking == nil || *a.OsLocking,
+		LibraryCantCreateOSThreads: a.LibraryCantCreateOsThreads,
+	}
+}
+
+// parseURL parses the url s at path, adding to errs and returning nil if it is not valid.
+func parseURL(path, s string, errs *Errors) *url.URL {
+	u, err := url.Parse(s)
 	if err != nil {
-		return Pkcs11Library{}, err
+		errs.addf(path, "not a valid url: %v", errors.Unwrap(err))
+		return nil
 	}
+	return u
+}
 
-	var (
-		slotLabelEnv = EnvironmentVariable(*slotLabel)
-		slotPINEnv   = EnvironmentVariable(*slotPIN)
-	)
+// parseDuration parses the duration s at path, adding to errs and returning 0 if it is not valid.
+func parseDuration(path, s string, errs *Errors) time.Duration {
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		errs.addf(path, "not a valid duration: %q", s)
+	}
+	return d
+}
 
-	return Pkcs11Library{
-		Path:      path,
-		SlotLabel: &slotLabelEnv,
-		SlotPin:   &slotPINEnv,
-	}, nil
+func orEmpty(u *url.URL) *url.URL {
+	if u == nil {
+		return new(url.URL)
+	}
+	return u
 }
 
 func (c *Config) MarshalJSON() ([]byte, error) {
@@ -98,27 +324,90 @@ func (c Config) configJSON() (configJSON, error) {
 	if err != nil {
 		return configJSON{}, err
 	}
+	var unlock []unlockEntryJSON
+	for _, e := range c.Unlock {
+		unlock = append(unlock, e.unlockEntryJSON())
+	}
+	var controlSocket string
+	if c.ControlSocket != nil {
+		controlSocket = c.ControlSocket.String()
+	}
+	var tracing *tracingJSON
+	if c.Tracing != nil {
+		tracing = &tracingJSON{Exporter: c.Tracing.Exporter, Endpoint: c.Tracing.Endpoint}
+		if c.Tracing.File != nil {
+			tracing.File = c.Tracing.File.String()
+		}
+	}
+	var healthCheck *healthCheckJSON
+	if c.HealthCheck != nil {
+		healthCheck = &healthCheckJSON{Interval: c.HealthCheck.Interval.String(), CanaryAccount: c.HealthCheck.CanaryAccount}
+	}
+	var configFile string
+	if c.ConfigFile != nil {
+		configFile = c.ConfigFile.String()
+	}
+	var slotEvents *slotEventsJSON
+	if c.SlotEvents != nil {
+		slotEvents = &slotEventsJSON{PollInterval: c.SlotEvents.PollInterval.String(), OnRemoval: c.SlotEvents.OnRemoval}
+	}
 	return configJSON{
-		Library: library,
-		Unlock:  c.Unlock,
+		Version:       CurrentVersion,
+		Library:       library,
+		Unlock:        unlock,
+		ControlSocket: controlSocket,
+		Metrics:       c.Metrics,
+		LogLevel:      c.LogLevel,
+		Tracing:       tracing,
+		HealthCheck:   healthCheck,
+		SlotEvents:    slotEvents,
+		ConfigFile:    configFile,
 	}, nil
 }
 
 func (l Pkcs11Library) pkcs11LibraryJSON() (pkcs11LibraryJSON, error) {
 	return pkcs11LibraryJSON{
-		Path:      l.Path.String(),
-		SlotLabel: l.SlotLabel.String(),
-		SlotPin:   l.SlotPin.String(),
+		Path:               l.Path.String(),
+		SlotLabel:          l.SlotLabel.String(),
+		SlotPin:            l.SlotPin.String(),
+		StrictCapabilities: l.StrictCapabilities,
+		Initialize:         l.Initialize.initializeArgsJSON(),
+		Environment:        l.Environment,
+		Profile:            l.Profile,
 	}, nil
 }
 
+func (a *InitializeArgs) initializeArgsJSON() *initializeArgsJSON {
+	if a == nil {
+		return nil
+	}
+	osLocking := a.OSLocking
+	return &initializeArgsJSON{OsLocking: &osLocking, LibraryCantCreateOsThreads: a.LibraryCantCreateOSThreads}
+}
+
 type EnvironmentVariable url.URL
 
+// Name is the name of the environment variable.
+func (e EnvironmentVariable) Name() string {
+	return e.Host
+}
+
 func (e EnvironmentVariable) Get() string {
 	u := url.URL(e)
 	return os.Getenv(u.Host)
 }
 
+// GetSecret returns the value of the environment variable in a secure.Buffer, for use when the value is a secret such
+// as a PIN.  The caller must destroy the returned Buffer.
+//
+// Only the returned copy can be wiped: Go keeps the process environment as immutable strings, so the value stays in
+// memory for the life of the process, or until the variable is changed and the old string is garbage collected.
+// Secrets which arrive as bytes, e.g. on the control socket, are read directly into a secure.Buffer instead.
+func (e EnvironmentVariable) GetSecret() (*secure.Buffer, error) {
+	u := url.URL(e)
+	return secure.FromString(os.Getenv(u.Host))
+}
+
 func (e EnvironmentVariable) IsSet() bool {
 	u := url.URL(e)
 	if u.Host == "" {
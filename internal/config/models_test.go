@@ -0,0 +1,20 @@
+package config
+
+import (
+	"quorum-account-plugin-pkcs-11/internal/testutil"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEnvironmentVariable_GetSecret(t *testing.T) {
+	defer testutil.UnsetAll()
+	testutil.SetSlotPIN("123456")
+
+	pin, err := envVar(t, "env://SLOT_PIN").GetSecret()
+	require.NoError(t, err)
+	require.Equal(t, []byte("123456"), pin.Bytes())
+
+	pin.Destroy()
+	require.Nil(t, pin.Bytes())
+}
@@ -0,0 +1,95 @@
+package config
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+)
+
+// schemaURI identifies the JSON Schema dialect of Schema
+const schemaURI = "https://json-schema.org/draft/2020-12/schema"
+
+// Schema returns the JSON Schema of the plugin config.  It is generated from the types the config is decoded into,
+// using the struct tags:
+//
+//	description: the description of the field
+//	enum:        the comma-separated values the field can take
+//	pattern:     a regular expression the field must match
+//	required:    "true" if the field must be set
+//
+// The schema describes the field names in lower camel case, though they are matched case-insensitively when decoded.
+func Schema() ([]byte, error) {
+	s := typeSchema(reflect.TypeOf(configJSON{}))
+	s["$schema"] = schemaURI
+	s["title"] = "quorum-account-plugin-pkcs-11 config"
+	s["properties"].(map[string]interface{})["version"].(map[string]interface{})["const"] = CurrentVersion
+	b, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(b, '\n'), nil
+}
+
+func typeSchema(t reflect.Type) map[string]interface{} {
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.Struct:
+		props := make(map[string]interface{}, t.NumField())
+		var required []string
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if !f.IsExported() {
+				continue
+			}
+			name := jsonName(f)
+			props[name] = fieldSchema(f)
+			if f.Tag.Get("required") == "true" {
+				required = append(required, name)
+			}
+		}
+		s := map[string]interface{}{
+			"type":                 "object",
+			"properties":           props,
+			"additionalProperties": false,
+		}
+		if len(required) > 0 {
+			s["required"] = required
+		}
+		if t.Implements(stringFormType) {
+			return map[string]interface{}{"oneOf": []interface{}{map[string]interface{}{"type": "string"}, s}}
+		}
+		return s
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": typeSchema(t.Elem())}
+	case reflect.Slice:
+		return map[string]interface{}{"type": "array", "items": typeSchema(t.Elem())}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int:
+		return map[string]interface{}{"type": "integer"}
+	default:
+		return map[string]interface{}{"type": "string"}
+	}
+}
+
+func fieldSchema(f reflect.StructField) map[string]interface{} {
+	s := typeSchema(f.Type)
+	// the constraints of a slice field apply to its elements
+	item := s
+	if items, ok := s["items"].(map[string]interface{}); ok {
+		item = items
+	}
+	if d := f.Tag.Get("description"); d != "" {
+		s["description"] = d
+	}
+	if e := f.Tag.Get("enum"); e != "" {
+		item["enum"] = strings.Split(e, ",")
+	}
+	if p := f.Tag.Get("pattern"); p != "" {
+		item["pattern"] = p
+	}
+
+	return s
+}
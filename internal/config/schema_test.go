@@ -0,0 +1,19 @@
+package config
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestSchema_UpToDate checks the schema shipped with the plugin has been regenerated, with go generate, since the config
+// types last changed.
+func TestSchema_UpToDate(t *testing.T) {
+	want, err := os.ReadFile("../../config.schema.json")
+	require.NoError(t, err)
+
+	got, err := Schema()
+	require.NoError(t, err)
+	require.Equal(t, string(want), string(got))
+}
@@ -0,0 +1,187 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"path"
+	"quorum-account-plugin-pkcs-11/internal/account/account"
+	"strings"
+	"time"
+)
+
+const (
+	// LabelPrefix starts an UnlockEntry.Account selecting accounts by the label of their keys
+	LabelPrefix = "label:"
+	// URIPrefix starts an UnlockEntry.Account selecting accounts with a PKCS#11 URI
+	URIPrefix = "pkcs11:"
+)
+
+// UnlockEntry selects accounts to unlock once the session has been opened.  In JSON it is an object, or a string
+// holding only the Account selector.
+type UnlockEntry struct {
+	// Account selects the accounts to unlock.  It is one of:
+	//
+	//	a hex address, e.g. 0x4d6d744b6da435b5bbdde2526dc20e9a41cb72e5
+	//	label: and a pattern matched against the CKA_LABEL of the accounts' keys, e.g. label:validator-*, see path.Match
+	//	a PKCS#11 URI (RFC 7512) with object and/or id attributes, e.g. pkcs11:object=validator-1
+	Account string
+	// Duration the accounts are unlocked for, or 0 (default) to unlock them indefinitely
+	Duration time.Duration
+	// Optional env:// reference to the PIN used to authenticate each use of the accounts' keys, for keys with
+	// CKA_ALWAYS_AUTHENTICATE set
+	Credential *EnvironmentVariable
+	// Optional entries may select no accounts.  Otherwise, the session cannot be opened if the entry selects none.
+	Optional bool
+}
+
+// Selector is a parsed UnlockEntry.Account.
+type Selector struct {
+	// Address, if set, is the address of the only account selected
+	Address *account.Address
+	// Label, if set, is a path.Match pattern the label of the selected accounts' keys must match
+	Label string
+}
+
+// Selector parses e.Account.
+func (e UnlockEntry) Selector() (Selector, error) {
+	switch {
+	case strings.HasPrefix(e.Account, LabelPrefix):
+		label := strings.TrimPrefix(e.Account, LabelPrefix)
+		if _, err := path.Match(label, ""); err != nil || label == "" {
+			return Selector{}, errors.New(InvalidUnlockLabel)
+		}
+		return Selector{Label: label}, nil
+	case strings.HasPrefix(e.Account, URIPrefix):
+		return parsePKCS11URI(e.Account)
+	default:
+		addr, err := account.NewAddressFromHexString(e.Account)
+		if err != nil {
+			return Selector{}, errors.New(InvalidUnlockAddress)
+		}
+		return Selector{Address: &addr}, nil
+	}
+}
+
+// parsePKCS11URI parses a PKCS#11 URI selecting a key by its object (CKA_LABEL) and id (CKA_ID) attributes.  The
+// plugin sets the CKA_ID of each key to the hex account address.
+func parsePKCS11URI(s string) (Selector, error) {
+	attrs := strings.TrimPrefix(s, URIPrefix)
+	if i := strings.IndexByte(attrs, '?'); i >= 0 {
+		return Selector{}, fmt.Errorf(InvalidUnlockURI, "query attributes are not supported, use credential")
+	}
+	var sel Selector
+	for _, attr := range strings.Split(attrs, ";") {
+		name, value, ok := strings.Cut(attr, "=")
+		if !ok {
+			return Selector{}, fmt.Errorf(InvalidUnlockURI, fmt.Sprintf("attribute %q has no value", attr))
+		}
+		v, err := url.PathUnescape(value)
+		if err != nil {
+			return Selector{}, fmt.Errorf(InvalidUnlockURI, err)
+		}
+		switch name {
+		case "object":
+			sel.Label = escapeMatch(v)
+		case "id":
+			addr, err := account.NewAddressFromHexString(v)
+			if err != nil {
+				return Selector{}, fmt.Errorf(InvalidUnlockURI, "id is not an account address")
+			}
+			sel.Address = &addr
+		default:
+			return Selector{}, fmt.Errorf(InvalidUnlockURI, fmt.Sprintf("unsupported attribute %q", name))
+		}
+	}
+	return sel, nil
+}
+
+// escapeMatch escapes the characters of s that are special to path.Match.
+func escapeMatch(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if strings.ContainsRune(`*?[\`, r) {
+			b.WriteRune('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// Matches reports whether the account addr, whose key has the label label, is selected.
+func (s Selector) Matches(addr account.Address, label string) bool {
+	if s.Address != nil && *s.Address != addr {
+		return false
+	}
+	if s.Label != "" {
+		if ok, _ := path.Match(s.Label, label); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func (e UnlockEntry) validate(path string, errs *Errors) {
+	if _, err := e.Selector(); err != nil {
+		errs.add(path, err.Error())
+	}
+	if e.Duration < 0 {
+		errs.add(field(path, "duration"), InvalidUnlockDuration)
+	}
+	if e.Credential != nil && e.Credential.validate(field(path, "credential"), errs) && !e.Credential.IsSet() {
+		errs.addf(field(path, "credential"), UnsetEnvironmentVariable, e.Credential.Name())
+	}
+}
+
+// unlockEntryJSON is the JSON form of UnlockEntry.  It can also be written as a string holding only the account.
+type unlockEntryJSON struct {
+	Account    string `required:"true" description:"Hex address, label: and a pattern matched against the labels of keys, e.g. label:validator-*, or a PKCS#11 URI, e.g. pkcs11:object=validator-1"`
+	Duration   string `description:"Duration the accounts are unlocked for, e.g. 1h, indefinitely by default"`
+	Credential string `pattern:"^env://" description:"env:// reference to the environment variable holding the PIN used to authenticate each use of the keys, for keys with CKA_ALWAYS_AUTHENTICATE set"`
+	Optional   bool   `description:"Allow the entry to select no accounts"`
+}
+
+func (unlockEntryJSON) stringForm() {}
+
+func (u *unlockEntryJSON) UnmarshalJSON(b []byte) error {
+	var account string
+	if err := json.Unmarshal(b, &account); err == nil {
+		*u = unlockEntryJSON{Account: account}
+		return nil
+	}
+	type object unlockEntryJSON
+	return json.Unmarshal(b, (*object)(u))
+}
+
+// MarshalJSON writes entries which only have an account in the string form.
+func (u unlockEntryJSON) MarshalJSON() ([]byte, error) {
+	if u == (unlockEntryJSON{Account: u.Account}) {
+		return json.Marshal(u.Account)
+	}
+	type object unlockEntryJSON
+	return json.Marshal(object(u))
+}
+
+func (u unlockEntryJSON) unlockEntry(path string, errs *Errors) UnlockEntry {
+	e := UnlockEntry{Account: u.Account, Optional: u.Optional}
+	if u.Duration != "" {
+		e.Duration = parseDuration(field(path, "duration"), u.Duration, errs)
+	}
+	if u.Credential != "" {
+		credential := EnvironmentVariable(*orEmpty(parseURL(field(path, "credential"), u.Credential, errs)))
+		e.Credential = &credential
+	}
+	return e
+}
+
+func (e UnlockEntry) unlockEntryJSON() unlockEntryJSON {
+	u := unlockEntryJSON{Account: e.Account, Optional: e.Optional}
+	if e.Duration != 0 {
+		u.Duration = e.Duration.String()
+	}
+	if e.Credential != nil {
+		u.Credential = e.Credential.String()
+	}
+	return u
+}
@@ -0,0 +1,83 @@
+package config
+
+import (
+	"encoding/json"
+	"quorum-account-plugin-pkcs-11/internal/account/account"
+	"quorum-account-plugin-pkcs-11/internal/testutil"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSelector_Matches(t *testing.T) {
+	addr, err := account.NewAddressFromHexString("0x4d6d744b6da435b5bbdde2526dc20e9a41cb72e5")
+	require.NoError(t, err)
+	other, err := account.NewAddressFromHexString("0x0000000000000000000000000000000000000001")
+	require.NoError(t, err)
+
+	tests := map[string]struct {
+		account string
+		addr    account.Address
+		label   string
+		want    bool
+	}{
+		"address":              {account: "0x4d6d744b6da435b5bbdde2526dc20e9a41cb72e5", addr: addr, want: true},
+		"other address":        {account: "0x4d6d744b6da435b5bbdde2526dc20e9a41cb72e5", addr: other},
+		"label glob":           {account: "label:validator-*", addr: other, label: "validator-2", want: true},
+		"label glob no match":  {account: "label:validator-*", addr: other, label: "signer-1"},
+		"uri object":           {account: "pkcs11:object=validator-1", addr: other, label: "validator-1", want: true},
+		"uri object is exact":  {account: "pkcs11:object=validator-%2A", addr: other, label: "validator-1"},
+		"uri object escaped":   {account: "pkcs11:object=validator-%2A", addr: other, label: "validator-*", want: true},
+		"uri id":               {account: "pkcs11:id=%34%64%36%64%37%34%34%62%36%64%61%34%33%35%62%35%62%62%64%64%65%32%35%32%36%64%63%32%30%65%39%61%34%31%63%62%37%32%65%35", addr: addr, want: true},
+		"uri object and id":    {account: "pkcs11:object=validator-1;id=4d6d744b6da435b5bbdde2526dc20e9a41cb72e5", addr: addr, label: "validator-1", want: true},
+		"uri id, other object": {account: "pkcs11:object=validator-1;id=4d6d744b6da435b5bbdde2526dc20e9a41cb72e5", addr: addr, label: "validator-2"},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			sel, err := UnlockEntry{Account: tt.account}.Selector()
+			require.NoError(t, err)
+			require.Equal(t, tt.want, sel.Matches(tt.addr, tt.label))
+		})
+	}
+}
+
+func TestParse_Unlock(t *testing.T) {
+	defer testutil.UnsetAll()
+	testutil.SetSlotLabel("my_label")
+	testutil.SetSlotPIN("123456")
+
+	conf, err := Parse([]byte(`{
+		"version": 2,
+		"library": {"path": "file:///lib.so", "slotLabel": "env://SLOT_LABEL"},
+		"unlock": [
+			"0x4d6d744b6da435b5bbdde2526dc20e9a41cb72e5",
+			{"account": "label:validator-*", "duration": "1h", "credential": "env://SLOT_PIN", "optional": true}
+		]
+	}`))
+
+	require.NoError(t, err)
+	require.Equal(t, []UnlockEntry{
+		{Account: "0x4d6d744b6da435b5bbdde2526dc20e9a41cb72e5"},
+		{Account: "label:validator-*", Duration: time.Hour, Credential: envVar(t, "env://SLOT_PIN"), Optional: true},
+	}, conf.Unlock)
+
+	b, err := json.Marshal(conf)
+	require.NoError(t, err)
+	var got struct{ Unlock json.RawMessage }
+	require.NoError(t, json.Unmarshal(b, &got))
+	require.JSONEq(t, `["0x4d6d744b6da435b5bbdde2526dc20e9a41cb72e5", {"Account": "label:validator-*", "Duration": "1h0m0s", "Credential": "env://SLOT_PIN", "Optional": true}]`, string(got.Unlock))
+}
+
+func TestParse_Unlock_Invalid(t *testing.T) {
+	defer testutil.UnsetAll()
+	testutil.SetSlotLabel("my_label")
+
+	_, err := Parse([]byte(`{
+		"version": 2,
+		"library": {"path": "file:///lib.so", "slotLabel": "env://SLOT_LABEL"},
+		"unlock": ["label:v", {"account": "label:v", "for": "1h"}, {"account": "label:v", "duration": "forever"}, "0xnothex"]
+	}`))
+
+	require.EqualError(t, err, `unlock[1].for: unknown field; unlock[2].duration: not a valid duration: "forever"; unlock[3]: not a valid address`)
+}
@@ -2,30 +2,168 @@ package config
 
 import (
 	"errors"
+	"net"
 	"net/url"
+	"quorum-account-plugin-pkcs-11/internal/account/account"
+	"quorum-account-plugin-pkcs-11/internal/logging"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 )
 
+// The messages of the problems found by Validate.  Each is reported with the path of the value it applies to.
 const (
-	InvalidLibraryPath = "'path' must be a valid absolute file url"
-	MissingSlotLabel   = "the given given environment for 'SlotLabel' variables must be set"
-	InvalidSecretName  = "secretName must be set"
+	InvalidLibraryPath          = "must be a valid absolute file url"
+	MissingValue                = "must be set"
+	UnknownEnvScheme            = "unknown scheme %q"
+	InvalidEnvReference         = "must be an env:// reference to an environment variable, e.g. env://SLOT_LABEL"
+	UnsetEnvironmentVariable    = "environment variable %v must be set"
+	InvalidUnlockAddress        = "not a valid address"
+	InvalidUnlockLabel          = "not a valid label pattern"
+	InvalidUnlockURI            = "not a valid PKCS#11 URI: %v"
+	InvalidUnlockDuration       = "must not be negative"
+	InvalidEnvironmentName      = "not a valid environment variable name"
+	InvalidOSLocking            = "must be true, as the plugin calls the library from more than one thread"
+	InvalidProfile              = "must be one of softhsm2, generic-2.20, generic-2.40 or cloud-hsm"
+	InvalidSecretName           = "secretName must be set"
+	InvalidControlSocket        = "must be a valid absolute file url"
+	InvalidMetricsListenAddress = "must be a valid host:port"
+	NonLoopbackMetricsAddress   = "must be a loopback address, e.g. 127.0.0.1:9102, as metrics are served without authentication"
+	InvalidLogLevel             = "must be one of trace, debug, info, warn or error"
+	InvalidTracingExporter      = "must be otlp or file"
+	InvalidTracingEndpoint      = "must be a valid host:port"
+	InvalidTracingFile          = "must be a valid absolute file url"
+	InvalidHealthCheckInterval  = "must be at least 1s"
+	InvalidCanaryAccount        = "must be a valid hex account address"
+	InvalidSlotPollInterval     = "must be at least 100ms"
+	InvalidOnRemoval            = "must be lock or keep"
+	InvalidConfigFile           = "must be a valid absolute file url"
 )
 
+// Validate checks the config, returning Errors describing every problem found.
 func (c Config) Validate() error {
-	if err := c.Library.validate(); err != nil {
-		return err
+	var errs Errors
+	c.validate(&errs)
+	return errs.err()
+}
+
+func (c Config) validate(errs *Errors) {
+	c.Library.validate("library", errs)
+	for i, e := range c.Unlock {
+		e.validate(index("unlock", i), errs)
+	}
+	if c.ControlSocket != nil && !isValidAbsFileUrl(c.ControlSocket) {
+		errs.add("controlSocket", InvalidControlSocket)
+	}
+	if c.ConfigFile != nil && !isValidAbsFileUrl(c.ConfigFile) {
+		errs.add("configFile", InvalidConfigFile)
+	}
+	if c.Metrics != nil {
+		c.Metrics.validate("metrics", errs)
+	}
+	if c.LogLevel != "" {
+		if _, err := logging.ParseLevel(c.LogLevel); err != nil {
+			errs.add("logLevel", InvalidLogLevel)
+		}
+	}
+	if c.Tracing != nil {
+		c.Tracing.validate("tracing", errs)
+	}
+	if c.HealthCheck != nil {
+		c.HealthCheck.validate("healthCheck", errs)
+	}
+	if c.SlotEvents != nil {
+		c.SlotEvents.validate("slotEvents", errs)
 	}
-	return nil
 }
 
-func (l Pkcs11Library) validate() error {
+func (s SlotEvents) validate(path string, errs *Errors) {
+	if s.PollInterval < 100*time.Millisecond {
+		errs.add(field(path, "pollInterval"), InvalidSlotPollInterval)
+	}
+	if s.OnRemoval != LockOnRemoval && s.OnRemoval != KeepOnRemoval {
+		errs.add(field(path, "onRemoval"), InvalidOnRemoval)
+	}
+}
+
+func (h HealthCheck) validate(path string, errs *Errors) {
+	if h.Interval < time.Second {
+		errs.add(field(path, "interval"), InvalidHealthCheckInterval)
+	}
+	if h.CanaryAccount != "" {
+		if _, err := account.NewAddressFromHexString(h.CanaryAccount); err != nil {
+			errs.add(field(path, "canaryAccount"), InvalidCanaryAccount)
+		}
+	}
+}
+
+func (m Metrics) validate(path string, errs *Errors) {
+	if !isValidHostPort(m.ListenAddress) {
+		errs.add(field(path, "listenAddress"), InvalidMetricsListenAddress)
+	} else if !isLoopbackHostPort(m.ListenAddress) {
+		errs.add(field(path, "listenAddress"), NonLoopbackMetricsAddress)
+	}
+}
+
+func (t Tracing) validate(path string, errs *Errors) {
+	switch t.Exporter {
+	case OTLPExporter:
+		if !isValidHostPort(t.Endpoint) {
+			errs.add(field(path, "endpoint"), InvalidTracingEndpoint)
+		}
+	case FileExporter:
+		if t.File == nil || !isValidAbsFileUrl(t.File) {
+			errs.add(field(path, "file"), InvalidTracingFile)
+		}
+	default:
+		errs.add(field(path, "exporter"), InvalidTracingExporter)
+	}
+}
+
+func (l Pkcs11Library) validate(path string, errs *Errors) {
 	if l.Path == nil || l.Path.String() == "" || !isValidAbsFileUrl(l.Path) {
-		return errors.New(InvalidLibraryPath)
+		errs.add(field(path, "path"), InvalidLibraryPath)
 	}
-	if !l.SlotLabel.IsSet() {
-		return errors.New(MissingSlotLabel)
+	if l.SlotLabel == nil || l.SlotLabel.String() == "" {
+		errs.add(field(path, "slotLabel"), MissingValue)
+	} else if l.SlotLabel.validate(field(path, "slotLabel"), errs) && !l.SlotLabel.IsSet() {
+		errs.addf(field(path, "slotLabel"), UnsetEnvironmentVariable, l.SlotLabel.Name())
+	}
+	if l.SlotPin != nil && l.SlotPin.String() != "" {
+		l.SlotPin.validate(field(path, "slotPin"), errs)
+	}
+	switch l.Profile {
+	case "", ProfileSoftHSM2, ProfileGeneric220, ProfileGeneric240, ProfileCloudHSM:
+	default:
+		errs.add(field(path, "profile"), InvalidProfile)
+	}
+	if l.Initialize != nil && !l.Initialize.OSLocking {
+		errs.add(field(field(path, "initialize"), "osLocking"), InvalidOSLocking)
+	}
+	names := make([]string, 0, len(l.Environment))
+	for name := range l.Environment {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if name == "" || strings.ContainsAny(name, "=\x00") {
+			errs.add(field(field(path, "environment"), name), InvalidEnvironmentName)
+		}
 	}
-	return nil
+}
+
+// validate reports whether e is an env:// reference to an environment variable, adding to errs if not.
+func (e EnvironmentVariable) validate(path string, errs *Errors) bool {
+	switch {
+	case e.Scheme != "" && e.Scheme != "env":
+		errs.addf(path, UnknownEnvScheme, e.Scheme)
+	case e.Scheme == "" || e.Name() == "":
+		errs.add(path, InvalidEnvReference)
+	default:
+		return true
+	}
+	return false
 }
 
 func (c NewAccount) Validate() error {
@@ -38,3 +176,23 @@ func (c NewAccount) Validate() error {
 func isValidAbsFileUrl(u *url.URL) bool {
 	return u.Scheme == "file" && u.Host == "" && u.Path != ""
 }
+
+func isValidHostPort(s string) bool {
+	_, port, err := net.SplitHostPort(s)
+	if err != nil {
+		return false
+	}
+	p, err := strconv.Atoi(port)
+	return err == nil && p >= 0 && p <= 65535
+}
+
+// isLoopbackHostPort reports whether the host of the valid host:port s is localhost or a loopback IP address.  An empty
+// host binds to every interface.
+func isLoopbackHostPort(s string) bool {
+	host, _, _ := net.SplitHostPort(s)
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
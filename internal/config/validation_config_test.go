@@ -4,6 +4,7 @@ import (
 	"net/url"
 	"quorum-account-plugin-pkcs-11/internal/testutil"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 )
@@ -60,7 +61,7 @@ func TestVaultClient_Validate_libpath_Valid(t *testing.T) {
 }
 
 func TestVaultClient_Validate_libpath_Invalid(t *testing.T) {
-	wantErrMsg := InvalidLibraryPath
+	wantErrMsg := "library.path: " + InvalidLibraryPath
 	defer testutil.UnsetAll()
 	testutil.SetSlotLabel("my_label")
 
@@ -86,8 +87,287 @@ func TestVaultClient_Validate_libpath_Invalid(t *testing.T) {
 }
 
 func TestVaultClient_Validate_slotlabel_Undefined(t *testing.T) {
-	wantErrMsg := MissingSlotLabel
+	wantErrMsg := "library.slotLabel: environment variable SLOT_LABEL must be set"
 	config := minimumConfig(t)
 	gotErr := config.Validate()
 	require.EqualError(t, gotErr, wantErrMsg)
 }
+
+func TestVaultClient_Validate_controlsocket_Invalid(t *testing.T) {
+	defer testutil.UnsetAll()
+	testutil.SetSlotLabel("my_label")
+
+	for _, u := range []string{"noscheme", "unix:///tmp/plugin.sock", "file://host/tmp/plugin.sock"} {
+		t.Run(u, func(t *testing.T) {
+			config := minimumConfig(t)
+
+			controlSocket, err := url.Parse(u)
+			require.NoError(t, err)
+			config.ControlSocket = controlSocket
+
+			gotErr := config.Validate()
+			require.EqualError(t, gotErr, "controlSocket: "+InvalidControlSocket)
+		})
+	}
+}
+
+func TestVaultClient_Validate_configfile_Invalid(t *testing.T) {
+	defer testutil.UnsetAll()
+	testutil.SetSlotLabel("my_label")
+
+	for _, u := range []string{"config.json", "https://host/config.json", "file://host/etc/config.json"} {
+		t.Run(u, func(t *testing.T) {
+			config := minimumConfig(t)
+
+			configFile, err := url.Parse(u)
+			require.NoError(t, err)
+			config.ConfigFile = configFile
+
+			gotErr := config.Validate()
+			require.EqualError(t, gotErr, "configFile: "+InvalidConfigFile)
+		})
+	}
+}
+
+func TestVaultClient_Validate_metrics_Valid(t *testing.T) {
+	defer testutil.UnsetAll()
+	testutil.SetSlotLabel("my_label")
+
+	for _, addr := range []string{"127.0.0.1:9102", "localhost:9102", "[::1]:0"} {
+		t.Run(addr, func(t *testing.T) {
+			config := minimumConfig(t)
+			config.Metrics = &Metrics{ListenAddress: addr}
+
+			gotErr := config.Validate()
+			require.NoError(t, gotErr)
+		})
+	}
+}
+
+func TestVaultClient_Validate_metrics_Invalid(t *testing.T) {
+	defer testutil.UnsetAll()
+	testutil.SetSlotLabel("my_label")
+
+	for _, addr := range []string{"", "127.0.0.1", "127.0.0.1:http", "127.0.0.1:70000"} {
+		t.Run(addr, func(t *testing.T) {
+			config := minimumConfig(t)
+			config.Metrics = &Metrics{ListenAddress: addr}
+
+			gotErr := config.Validate()
+			require.EqualError(t, gotErr, "metrics.listenAddress: "+InvalidMetricsListenAddress)
+		})
+	}
+}
+
+func TestVaultClient_Validate_metrics_NotLoopback(t *testing.T) {
+	defer testutil.UnsetAll()
+	testutil.SetSlotLabel("my_label")
+
+	for _, addr := range []string{":9102", "0.0.0.0:9102", "[::]:9102", "10.0.0.1:9102", "metrics.example.com:9102"} {
+		t.Run(addr, func(t *testing.T) {
+			config := minimumConfig(t)
+			config.Metrics = &Metrics{ListenAddress: addr}
+
+			gotErr := config.Validate()
+			require.EqualError(t, gotErr, "metrics.listenAddress: "+NonLoopbackMetricsAddress)
+		})
+	}
+}
+
+func TestVaultClient_Validate_logLevel(t *testing.T) {
+	defer testutil.UnsetAll()
+	testutil.SetSlotLabel("my_label")
+
+	config := minimumConfig(t)
+	config.LogLevel = "debug"
+	require.NoError(t, config.Validate())
+
+	config.LogLevel = "verbose"
+	require.EqualError(t, config.Validate(), "logLevel: "+InvalidLogLevel)
+}
+
+func TestVaultClient_Validate_profile(t *testing.T) {
+	defer testutil.UnsetAll()
+	testutil.SetSlotLabel("my_label")
+
+	config := minimumConfig(t)
+	for _, p := range Profiles {
+		config.Library.Profile = p
+		require.NoError(t, config.Validate())
+	}
+
+	config.Library.Profile = "softhsm"
+	require.EqualError(t, config.Validate(), "library.profile: "+InvalidProfile)
+}
+
+func TestVaultClient_Validate_initialize(t *testing.T) {
+	defer testutil.UnsetAll()
+	testutil.SetSlotLabel("my_label")
+
+	config := minimumConfig(t)
+	config.Library.Initialize = &InitializeArgs{OSLocking: true, LibraryCantCreateOSThreads: true}
+	require.NoError(t, config.Validate())
+
+	config.Library.Initialize.OSLocking = false
+	require.EqualError(t, config.Validate(), "library.initialize.osLocking: "+InvalidOSLocking)
+}
+
+func TestVaultClient_Validate_tracing(t *testing.T) {
+	defer testutil.UnsetAll()
+	testutil.SetSlotLabel("my_label")
+
+	tests := map[string]struct {
+		tracing Tracing
+		wantErr string
+	}{
+		"otlp":               {tracing: Tracing{Exporter: OTLPExporter, Endpoint: "127.0.0.1:4317"}},
+		"file":               {tracing: Tracing{Exporter: FileExporter, File: &url.URL{Scheme: "file", Path: "/var/log/spans.json"}}},
+		"unknown exporter":   {tracing: Tracing{Exporter: "jaeger"}, wantErr: "tracing.exporter: " + InvalidTracingExporter},
+		"otlp no endpoint":   {tracing: Tracing{Exporter: OTLPExporter}, wantErr: "tracing.endpoint: " + InvalidTracingEndpoint},
+		"file no file":       {tracing: Tracing{Exporter: FileExporter}, wantErr: "tracing.file: " + InvalidTracingFile},
+		"file relative file": {tracing: Tracing{Exporter: FileExporter, File: &url.URL{Path: "spans.json"}}, wantErr: "tracing.file: " + InvalidTracingFile},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			config := minimumConfig(t)
+			config.Tracing = &tt.tracing
+
+			gotErr := config.Validate()
+			if tt.wantErr == "" {
+				require.NoError(t, gotErr)
+			} else {
+				require.EqualError(t, gotErr, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestVaultClient_Validate_healthCheck(t *testing.T) {
+	defer testutil.UnsetAll()
+	testutil.SetSlotLabel("my_label")
+
+	tests := map[string]struct {
+		healthCheck HealthCheck
+		wantErr     string
+	}{
+		"valid":            {healthCheck: HealthCheck{Interval: DefaultHealthCheckInterval}},
+		"canary":           {healthCheck: HealthCheck{Interval: time.Minute, CanaryAccount: "0x4d6d744b6da435b5bbdde2526dc20e9a41cb72e5"}},
+		"interval too low": {healthCheck: HealthCheck{Interval: 500 * time.Millisecond}, wantErr: "healthCheck.interval: " + InvalidHealthCheckInterval},
+		"invalid canary":   {healthCheck: HealthCheck{Interval: time.Minute, CanaryAccount: "0xnothex"}, wantErr: "healthCheck.canaryAccount: " + InvalidCanaryAccount},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			config := minimumConfig(t)
+			config.HealthCheck = &tt.healthCheck
+
+			gotErr := config.Validate()
+			if tt.wantErr == "" {
+				require.NoError(t, gotErr)
+			} else {
+				require.EqualError(t, gotErr, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestVaultClient_Validate_slotEvents(t *testing.T) {
+	defer testutil.UnsetAll()
+	testutil.SetSlotLabel("my_label")
+
+	tests := map[string]struct {
+		slotEvents SlotEvents
+		wantErr    string
+	}{
+		"lock":              {slotEvents: SlotEvents{PollInterval: DefaultSlotPollInterval, OnRemoval: LockOnRemoval}},
+		"keep":              {slotEvents: SlotEvents{PollInterval: time.Second, OnRemoval: KeepOnRemoval}},
+		"interval too low":  {slotEvents: SlotEvents{PollInterval: time.Millisecond, OnRemoval: LockOnRemoval}, wantErr: "slotEvents.pollInterval: " + InvalidSlotPollInterval},
+		"unknown onRemoval": {slotEvents: SlotEvents{PollInterval: time.Second, OnRemoval: "destroy"}, wantErr: "slotEvents.onRemoval: " + InvalidOnRemoval},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			config := minimumConfig(t)
+			config.SlotEvents = &tt.slotEvents
+
+			gotErr := config.Validate()
+			if tt.wantErr == "" {
+				require.NoError(t, gotErr)
+			} else {
+				require.EqualError(t, gotErr, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestVaultClient_Validate_slotlabel_Invalid(t *testing.T) {
+	tests := map[string]string{
+		"":                  "library.slotLabel: " + MissingValue,
+		"SLOT_LABEL":        "library.slotLabel: " + InvalidEnvReference,
+		"env://":            "library.slotLabel: " + InvalidEnvReference,
+		"http://SLOT_LABEL": `library.slotLabel: unknown scheme "http"`,
+	}
+	for u, wantErr := range tests {
+		t.Run(u, func(t *testing.T) {
+			config := minimumConfig(t)
+			config.Library.SlotLabel = envVar(t, u)
+
+			require.EqualError(t, config.Validate(), wantErr)
+		})
+	}
+}
+
+func TestVaultClient_Validate_unlock(t *testing.T) {
+	defer testutil.UnsetAll()
+	testutil.SetSlotLabel("my_label")
+	testutil.SetSlotPIN("123456")
+
+	tests := map[string]struct {
+		entry   UnlockEntry
+		wantErr string
+	}{
+		"address":            {entry: UnlockEntry{Account: "0x4d6d744b6da435b5bbdde2526dc20e9a41cb72e5"}},
+		"address no prefix":  {entry: UnlockEntry{Account: "4d6d744b6da435b5bbdde2526dc20e9a41cb72e5", Duration: time.Hour}},
+		"label":              {entry: UnlockEntry{Account: "label:validator-*", Credential: envVar(t, "env://SLOT_PIN")}},
+		"uri":                {entry: UnlockEntry{Account: "pkcs11:object=validator-1;id=4d6d744b6da435b5bbdde2526dc20e9a41cb72e5"}},
+		"not hex":            {entry: UnlockEntry{Account: "0xnothex"}, wantErr: "unlock[0]: " + InvalidUnlockAddress},
+		"short address":      {entry: UnlockEntry{Account: "0x4d6d"}, wantErr: "unlock[0]: " + InvalidUnlockAddress},
+		"empty label":        {entry: UnlockEntry{Account: "label:"}, wantErr: "unlock[0]: " + InvalidUnlockLabel},
+		"bad pattern":        {entry: UnlockEntry{Account: "label:validator-["}, wantErr: "unlock[0]: " + InvalidUnlockLabel},
+		"uri attribute":      {entry: UnlockEntry{Account: "pkcs11:token=t"}, wantErr: `unlock[0]: not a valid PKCS#11 URI: unsupported attribute "token"`},
+		"uri query":          {entry: UnlockEntry{Account: "pkcs11:object=v?pin-source=file:/pin"}, wantErr: "unlock[0]: not a valid PKCS#11 URI: query attributes are not supported, use credential"},
+		"negative duration":  {entry: UnlockEntry{Account: "label:v", Duration: -time.Second}, wantErr: "unlock[0].duration: " + InvalidUnlockDuration},
+		"unset credential":   {entry: UnlockEntry{Account: "label:v", Credential: envVar(t, "env://ACCOUNT_PIN")}, wantErr: "unlock[0].credential: environment variable ACCOUNT_PIN must be set"},
+		"invalid credential": {entry: UnlockEntry{Account: "label:v", Credential: envVar(t, "file:///pin")}, wantErr: `unlock[0].credential: unknown scheme "file"`},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			config := minimumConfig(t)
+			config.Unlock = []UnlockEntry{tt.entry}
+
+			gotErr := config.Validate()
+			if tt.wantErr == "" {
+				require.NoError(t, gotErr)
+			} else {
+				require.EqualError(t, gotErr, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestVaultClient_Validate_ReportsEveryProblem(t *testing.T) {
+	config := minimumConfig(t)
+	config.Library.Path = &url.URL{Scheme: "http", Host: "lib"}
+	config.Library.SlotPin = envVar(t, "http://SLOT_PIN")
+	config.LogLevel = "verbose"
+	config.SlotEvents = &SlotEvents{PollInterval: time.Millisecond, OnRemoval: "destroy"}
+
+	err := config.Validate()
+
+	require.Equal(t, Errors{
+		{Path: "library.path", Message: InvalidLibraryPath},
+		{Path: "library.slotLabel", Message: "environment variable SLOT_LABEL must be set"},
+		{Path: "library.slotPin", Message: `unknown scheme "http"`},
+		{Path: "logLevel", Message: InvalidLogLevel},
+		{Path: "slotEvents.pollInterval", Message: InvalidSlotPollInterval},
+		{Path: "slotEvents.onRemoval", Message: InvalidOnRemoval},
+	}, err)
+}
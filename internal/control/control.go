@@ -0,0 +1,234 @@
+// Package control implements the local channel used by the admin commands of the plugin binary to operate on a running
+// plugin.  Each connection to the control socket carries a single JSON Request answered by a single JSON Response.
+package control
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"quorum-account-plugin-pkcs-11/internal/logging"
+	"quorum-account-plugin-pkcs-11/internal/secure"
+	"time"
+)
+
+const (
+	// RotatePIN changes the user PIN of the token and the PIN held in memory by the plugin
+	RotatePIN = "rotatePIN"
+
+	requestTimeout = 30 * time.Second
+	// maxRequestSize is the size of the largest request accepted, including the newline which ends it
+	maxRequestSize = 4096
+)
+
+// Request is a command sent on the control socket.  Requests are encoded and decoded in secure.Buffers, rather than
+// with a json.Encoder or json.Decoder, whose own buffers would keep copies of any secret they hold.
+type Request struct {
+	Command string
+	// NewPIN is the new PIN for RotatePIN.  It is sent base64 encoded, and wiped by the plugin once it has been used.
+	NewPIN []byte `json:",omitempty"`
+}
+
+type Response struct {
+	Error string `json:",omitempty"`
+}
+
+// Handler carries out the commands received on the control socket.  Secrets are passed to the Handler in a
+// secure.Buffer which the Handler takes ownership of.
+type Handler interface {
+	RotatePIN(ctx context.Context, newPIN *secure.Buffer) error
+}
+
+// Listen creates the control socket at path, removing a stale socket left behind by a previous plugin process.  The
+// socket is only accessible to the owner of the plugin process.  It is created in a new directory only accessible to
+// the owner, and only moved to path once its permissions are set, so that it cannot be connected to before then.  The
+// socket is removed when the returned listener is closed.
+func Listen(path string) (net.Listener, error) {
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("control socket path %v exists and is not a socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+
+	dir, err := os.MkdirTemp(filepath.Dir(path), ".control-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	tmp := filepath.Join(dir, "control.sock")
+	l, err := net.Listen("unix", tmp)
+	if err != nil {
+		return nil, err
+	}
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	if err := os.Chmod(tmp, 0600); err != nil {
+		l.Close()
+		return nil, err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return &listener{Listener: l, path: path}, nil
+}
+
+// listener removes the control socket when it is closed.
+type listener struct {
+	net.Listener
+	path string
+}
+
+func (l *listener) Close() error {
+	err := l.Listener.Close()
+	if rmErr := os.Remove(l.path); err == nil && !os.IsNotExist(rmErr) {
+		err = rmErr
+	}
+	return err
+}
+
+// Serve accepts connections on l and passes their requests to h until l is closed.
+func Serve(l net.Listener, h Handler) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				logging.L().Error("control socket closed", "error", err)
+			}
+			return
+		}
+		go handle(conn, h)
+	}
+}
+
+func handle(conn net.Conn, h Handler) {
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(requestTimeout))
+
+	req, err := readRequest(conn)
+	if err != nil {
+		logging.L().Error("invalid control request", "error", err)
+		return
+	}
+	defer secure.Wipe(req.NewPIN)
+
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	var resp Response
+	if err := dispatch(ctx, req, h); err != nil {
+		resp.Error = err.Error()
+	}
+	if err := json.NewEncoder(conn).Encode(resp); err != nil {
+		logging.L().Error("unable to write control response", "error", err)
+	}
+}
+
+func dispatch(ctx context.Context, req Request, h Handler) error {
+	switch req.Command {
+	case RotatePIN:
+		logging.L().Info("PIN rotation requested on control socket")
+		newPIN, err := secure.FromBytes(req.NewPIN)
+		if err != nil {
+			return err
+		}
+		return h.RotatePIN(ctx, newPIN)
+	default:
+		return fmt.Errorf("unknown command %q", req.Command)
+	}
+}
+
+// Call sends req to the plugin listening on the control socket at path and waits for its response.
+func Call(path string, req Request) error {
+	conn, err := net.DialTimeout("unix", path, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(requestTimeout))
+
+	msg, err := encodeRequest(req)
+	if err != nil {
+		return err
+	}
+	defer msg.Destroy()
+	if _, err := conn.Write(msg.Bytes()); err != nil {
+		return err
+	}
+	var resp Response
+	if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+		return err
+	}
+	if resp.Error != "" {
+		return errors.New(resp.Error)
+	}
+	return nil
+}
+
+// encodeRequest encodes req as a line of JSON.  NewPIN is base64 encoded directly into the returned buffer.
+func encodeRequest(req Request) (*secure.Buffer, error) {
+	pin := req.NewPIN
+	req.NewPIN = nil
+	head, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	if len(pin) == 0 {
+		return secure.FromBytes(append(head, '\n'))
+	}
+
+	const field = `,"NewPIN":"`
+	head = head[:len(head)-1]
+	msg, err := secure.NewBuffer(len(head) + len(field) + base64.StdEncoding.EncodedLen(len(pin)) + len("\"}\n"))
+	if err != nil {
+		return nil, err
+	}
+	b := msg.Bytes()
+	n := copy(b, head)
+	n += copy(b[n:], field)
+	base64.StdEncoding.Encode(b[n:], pin)
+	n += base64.StdEncoding.EncodedLen(len(pin))
+	copy(b[n:], "\"}\n")
+	return msg, nil
+}
+
+// readRequest reads a line of JSON from r into a buffer which is wiped once the request has been decoded.  The decoded
+// NewPIN must be wiped by the caller.
+func readRequest(r io.Reader) (Request, error) {
+	buf, err := secure.NewBuffer(maxRequestSize)
+	if err != nil {
+		return Request{}, err
+	}
+	defer buf.Destroy()
+
+	b, n := buf.Bytes(), 0
+	for {
+		if n == len(b) {
+			return Request{}, fmt.Errorf("request larger than %v bytes", maxRequestSize)
+		}
+		m, err := r.Read(b[n:])
+		if i := bytes.IndexByte(b[n:n+m], '\n'); i >= 0 {
+			n += i
+			break
+		}
+		n += m
+		if err != nil {
+			return Request{}, err
+		}
+	}
+
+	var req Request
+	if err := json.Unmarshal(b[:n], &req); err != nil {
+		secure.Wipe(req.NewPIN)
+		return Request{}, err
+	}
+	return req, nil
+}
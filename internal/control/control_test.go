@@ -0,0 +1,101 @@
+package control
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"quorum-account-plugin-pkcs-11/internal/secure"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+type stubHandler struct {
+	gotPIN      string
+	gotDeadline bool
+	err         error
+}
+
+func (h *stubHandler) RotatePIN(ctx context.Context, newPIN *secure.Buffer) error {
+	defer newPIN.Destroy()
+	h.gotPIN = string(newPIN.Bytes())
+	_, h.gotDeadline = ctx.Deadline()
+	return h.err
+}
+
+func startServer(t *testing.T, h Handler) string {
+	path := filepath.Join(t.TempDir(), "control.sock")
+	l, err := Listen(path)
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+	go Serve(l, h)
+	return path
+}
+
+func TestCall_RotatePIN(t *testing.T) {
+	h := &stubHandler{}
+	path := startServer(t, h)
+
+	err := Call(path, Request{Command: RotatePIN, NewPIN: []byte("654321")})
+	require.NoError(t, err)
+	require.True(t, h.gotDeadline, "the request is bounded by the request timeout")
+	require.Equal(t, "654321", h.gotPIN)
+}
+
+func TestCall_HandlerError(t *testing.T) {
+	h := &stubHandler{err: errors.New("PIN rolled back")}
+	path := startServer(t, h)
+
+	err := Call(path, Request{Command: RotatePIN, NewPIN: []byte("654321")})
+	require.EqualError(t, err, "PIN rolled back")
+}
+
+func TestCall_UnknownCommand(t *testing.T) {
+	path := startServer(t, &stubHandler{})
+
+	err := Call(path, Request{Command: "unknown"})
+	require.EqualError(t, err, `unknown command "unknown"`)
+}
+
+func TestListen(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "control.sock")
+	l, err := Listen(path)
+	require.NoError(t, err)
+
+	fi, err := os.Stat(path)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0600), fi.Mode().Perm())
+	// the directory the socket was created in is removed
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+
+	require.NoError(t, l.Close())
+	_, err = os.Stat(path)
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestRequest_RoundTrip(t *testing.T) {
+	for name, req := range map[string]Request{
+		"no PIN": {Command: "unknown"},
+		"PIN":    {Command: RotatePIN, NewPIN: []byte(`6543"21\`)},
+	} {
+		t.Run(name, func(t *testing.T) {
+			msg, err := encodeRequest(req)
+			require.NoError(t, err)
+			defer msg.Destroy()
+
+			got, err := readRequest(bytes.NewReader(msg.Bytes()))
+			require.NoError(t, err)
+			require.Equal(t, req, got)
+		})
+	}
+}
+
+func TestReadRequest_TooLarge(t *testing.T) {
+	_, err := readRequest(bytes.NewReader(make([]byte, maxRequestSize+1)))
+	require.EqualError(t, err, "request larger than 4096 bytes")
+}
@@ -0,0 +1,164 @@
+// Package logging provides the plugin's logger.  Quorum reads the plugin's stderr and parses JSON log lines to
+// determine their level, so all output is written as JSON with hclog.  Stdout must never be written to as go-plugin
+// uses it for its handshake.
+package logging
+
+import (
+	"crypto/ecdsa"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/hashicorp/go-hclog"
+)
+
+const name = "pkcs11"
+
+var (
+	mu     sync.RWMutex
+	logger = New(os.Stderr, hclog.Info)
+)
+
+// New creates a JSON logger writing to w.  Arguments which could hold secrets are redacted, see Redact.
+func New(w io.Writer, level hclog.Level) hclog.Logger {
+	return &redactingLogger{Logger: hclog.New(&hclog.LoggerOptions{
+		Name:       name,
+		Level:      level,
+		Output:     w,
+		JSONFormat: true,
+	})}
+}
+
+// L returns the plugin's logger.
+func L() hclog.Logger {
+	mu.RLock()
+	defer mu.RUnlock()
+	return logger
+}
+
+// Audit logs a security-relevant event, such as the removal of the token, at info level.  Audit entries are written by
+// the "audit" sub-logger so that they can be told apart from diagnostic entries.
+func Audit(msg string, args ...interface{}) {
+	L().Named("audit").Info(msg, args...)
+}
+
+// SetDefault replaces the plugin's logger and redirects the standard library logger, used by dependencies, to it.
+func SetDefault(l hclog.Logger) {
+	mu.Lock()
+	defer mu.Unlock()
+	logger = l
+	log.SetFlags(0)
+	log.SetPrefix("")
+	log.SetOutput(l.StandardWriter(&hclog.StandardLoggerOptions{InferLevels: true}))
+}
+
+// SetLevel sets the level of the plugin's logger from its name: trace, debug, info, warn or error.
+func SetLevel(level string) error {
+	l, err := ParseLevel(level)
+	if err != nil {
+		return err
+	}
+	L().SetLevel(l)
+	return nil
+}
+
+// ParseLevel returns the hclog.Level named level.
+func ParseLevel(level string) (hclog.Level, error) {
+	l := hclog.LevelFromString(level)
+	if l == hclog.NoLevel || l == hclog.Off {
+		return hclog.NoLevel, fmt.Errorf("unknown log level %q", level)
+	}
+	return l, nil
+}
+
+// redactingLogger passes all arguments through Redact before logging them.
+type redactingLogger struct {
+	hclog.Logger
+}
+
+func (l *redactingLogger) Log(level hclog.Level, msg string, args ...interface{}) {
+	l.Logger.Log(level, msg, Redact(args)...)
+}
+
+func (l *redactingLogger) Trace(msg string, args ...interface{}) {
+	l.Logger.Trace(msg, Redact(args)...)
+}
+
+func (l *redactingLogger) Debug(msg string, args ...interface{}) {
+	l.Logger.Debug(msg, Redact(args)...)
+}
+
+func (l *redactingLogger) Info(msg string, args ...interface{}) {
+	l.Logger.Info(msg, Redact(args)...)
+}
+
+func (l *redactingLogger) Warn(msg string, args ...interface{}) {
+	l.Logger.Warn(msg, Redact(args)...)
+}
+
+func (l *redactingLogger) Error(msg string, args ...interface{}) {
+	l.Logger.Error(msg, Redact(args)...)
+}
+
+func (l *redactingLogger) With(args ...interface{}) hclog.Logger {
+	return &redactingLogger{Logger: l.Logger.With(Redact(args)...)}
+}
+
+func (l *redactingLogger) Named(name string) hclog.Logger {
+	return &redactingLogger{Logger: l.Logger.Named(name)}
+}
+
+func (l *redactingLogger) ResetNamed(name string) hclog.Logger {
+	return &redactingLogger{Logger: l.Logger.ResetNamed(name)}
+}
+
+// Redacted replaces the value of any argument which could hold a secret.
+const Redacted = "[REDACTED]"
+
+// secretKeys are the substrings of argument names whose values are always redacted.
+var secretKeys = []string{"pin", "passw", "secret", "key"}
+
+// secret is implemented by secure.Buffer.
+type secret interface {
+	UnsafeString() string
+}
+
+// Redact returns a copy of the key/value pairs args in which the values of arguments that could hold a secret are
+// replaced by Redacted.  A value is redacted if its name contains one of the secretKeys, or if it is raw bytes, a
+// secure buffer, a big integer or a private key, the types in which the plugin handles PINs and key material.
+func Redact(args []interface{}) []interface{} {
+	redacted := make([]interface{}, len(args))
+	copy(redacted, args)
+	for i := 0; i+1 < len(redacted); i += 2 {
+		if isSecretKey(redacted[i]) || isSecretValue(redacted[i+1]) {
+			redacted[i+1] = Redacted
+		}
+	}
+	return redacted
+}
+
+func isSecretKey(k interface{}) bool {
+	s, ok := k.(string)
+	if !ok {
+		return false
+	}
+	s = strings.ToLower(s)
+	for _, secretKey := range secretKeys {
+		if strings.Contains(s, secretKey) {
+			return true
+		}
+	}
+	return false
+}
+
+func isSecretValue(v interface{}) bool {
+	switch v.(type) {
+	case []byte, secret, *big.Int, *ecdsa.PrivateKey:
+		return true
+	}
+	return false
+}
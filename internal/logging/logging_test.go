@@ -0,0 +1,90 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"math/big"
+	"testing"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/require"
+)
+
+type stubSecret struct{}
+
+func (stubSecret) UnsafeString() string { return "1234" }
+
+func TestRedact(t *testing.T) {
+	args := []interface{}{
+		"operation", "Sign",
+		"pin", "1234",
+		"newPIN", "1234",
+		"privateKey", "abcd",
+		"value", []byte{1, 2, 3},
+		"d", big.NewInt(42),
+		"buf", stubSecret{},
+		"address", "4d6d744b6da435b5bbdde2526dc20e9a41cb72e5",
+	}
+
+	got := Redact(args)
+
+	require.Equal(t, []interface{}{
+		"operation", "Sign",
+		"pin", Redacted,
+		"newPIN", Redacted,
+		"privateKey", Redacted,
+		"value", Redacted,
+		"d", Redacted,
+		"buf", Redacted,
+		"address", "4d6d744b6da435b5bbdde2526dc20e9a41cb72e5",
+	}, got)
+	require.Equal(t, "1234", args[3], "args must not be modified")
+}
+
+func TestRedact_OddArgs(t *testing.T) {
+	got := Redact([]interface{}{"pin", "1234", "dangling"})
+
+	require.Equal(t, []interface{}{"pin", Redacted, "dangling"}, got)
+}
+
+func TestNew_JSON(t *testing.T) {
+	var buf bytes.Buffer
+	l := New(&buf, hclog.Info)
+
+	l.With("slot", 1).Info("opened session", "pin", "1234")
+	l.Debug("not logged")
+
+	var line map[string]interface{}
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &line))
+	require.Equal(t, "info", line["@level"])
+	require.Equal(t, "opened session", line["@message"])
+	require.Equal(t, Redacted, line["pin"])
+	require.EqualValues(t, 1, line["slot"])
+	require.NotContains(t, buf.String(), "1234")
+	require.NotContains(t, buf.String(), "not logged")
+}
+
+func TestParseLevel(t *testing.T) {
+	l, err := ParseLevel("DEBUG")
+	require.NoError(t, err)
+	require.Equal(t, hclog.Debug, l)
+
+	_, err = ParseLevel("verbose")
+	require.EqualError(t, err, `unknown log level "verbose"`)
+
+	_, err = ParseLevel("off")
+	require.Error(t, err)
+}
+
+func TestAudit(t *testing.T) {
+	defer SetDefault(L())
+	var buf bytes.Buffer
+	SetDefault(New(&buf, hclog.Info))
+
+	Audit("token removed", "slot", 1)
+
+	var line map[string]interface{}
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &line))
+	require.Equal(t, "pkcs11.audit", line["@module"])
+	require.Equal(t, "token removed", line["@message"])
+}
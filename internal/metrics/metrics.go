@@ -0,0 +1,122 @@
+// Package metrics exposes Prometheus metrics describing the plugin's gRPC operations and the state of its PKCS#11
+// token.  All label values are drawn from bounded sets: operations are the plugin's gRPC methods and error codes are
+// the reasons documented in the server package, with unrecognised PKCS#11 return values collapsed into CKR_UNKNOWN.
+package metrics
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"quorum-account-plugin-pkcs-11/internal/logging"
+	"quorum-account-plugin-pkcs-11/internal/pkcs11"
+	"strings"
+	"time"
+
+	p11 "github.com/miekg/pkcs11"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "pkcs11_plugin"
+
+// Source provides the state of the token reported on each scrape.
+type Source interface {
+	UnlockedCount() int
+	LoginState() pkcs11.LoginState
+	Sessions() pkcs11.SessionStats
+	TokenInfo() (p11.TokenInfo, error)
+	Health() *pkcs11.Health
+}
+
+// Metrics holds the plugin's metrics.  A nil *Metrics is valid and records nothing.
+type Metrics struct {
+	registry   *prometheus.Registry
+	operations *prometheus.CounterVec
+	duration   *prometheus.HistogramVec
+	errors     *prometheus.CounterVec
+}
+
+// New creates the plugin's metrics.  source is called on each scrape and may return nil if the plugin has not been
+// initialized yet, in which case no token metrics are reported.
+func New(source func() Source) *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		operations: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "operations_total",
+			Help:      "Number of gRPC operations handled by the plugin, by operation and result (success or error).",
+		}, []string{"operation", "result"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "operation_duration_seconds",
+			Help:      "Duration of the gRPC operations handled by the plugin.",
+			// 1ms to ~16s: HSM signing is normally in the low milliseconds
+			Buckets: prometheus.ExponentialBuckets(0.001, 2, 15),
+		}, []string{"operation"}),
+		errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "errors_total",
+			Help:      "Number of failed gRPC operations, by operation and error code (a plugin error reason or PKCS#11 CKR_ name).",
+		}, []string{"operation", "code"}),
+	}
+	m.registry.MustRegister(
+		m.operations,
+		m.duration,
+		m.errors,
+		newTokenCollector(source),
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	return m
+}
+
+// Observe records an operation which started at start.  code is empty if the operation succeeded, otherwise it is the
+// reason for the failure.
+func (m *Metrics) Observe(op string, start time.Time, code string) {
+	if m == nil {
+		return
+	}
+	m.duration.WithLabelValues(op).Observe(time.Since(start).Seconds())
+	if code == "" {
+		m.operations.WithLabelValues(op, "success").Inc()
+		return
+	}
+	m.operations.WithLabelValues(op, "error").Inc()
+	m.errors.WithLabelValues(op, boundedCode(code)).Inc()
+}
+
+// Handler returns the HTTP handler serving the metrics in the Prometheus exposition format.
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// Serve serves the metrics on /metrics of an HTTP listener bound to addr until the returned io.Closer is closed.
+func (m *Metrics) Serve(addr string) (io.Closer, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", m.Handler())
+	srv := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		if err := srv.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logging.L().Error("metrics listener closed", "error", err)
+		}
+	}()
+	logging.L().Info("serving metrics", "address", l.Addr().String())
+	return srv, nil
+}
+
+// boundedCode returns code, or CKR_UNKNOWN for PKCS#11 return values without a name, e.g. vendor defined values.
+func boundedCode(code string) string {
+	if strings.HasPrefix(code, "CKR_0x") {
+		return "CKR_UNKNOWN"
+	}
+	return code
+}
@@ -0,0 +1,84 @@
+package metrics
+
+import (
+	"io"
+	"net/http/httptest"
+	"quorum-account-plugin-pkcs-11/internal/pkcs11"
+	"testing"
+	"time"
+
+	p11 "github.com/miekg/pkcs11"
+	"github.com/stretchr/testify/require"
+)
+
+type stubSource struct{}
+
+func (stubSource) UnlockedCount() int { return 2 }
+
+func (stubSource) LoginState() pkcs11.LoginState {
+	return pkcs11.LoginState{LoggedIn: true}
+}
+
+func (stubSource) Sessions() pkcs11.SessionStats {
+	return pkcs11.SessionStats{Open: 1, InUse: 1, Waiting: 3}
+}
+
+func (stubSource) Health() *pkcs11.Health {
+	return &pkcs11.Health{State: pkcs11.HealthDegraded, Failures: 1}
+}
+
+func (stubSource) TokenInfo() (p11.TokenInfo, error) {
+	return p11.TokenInfo{
+		FreePublicMemory:   1024,
+		TotalPublicMemory:  p11.CK_UNAVAILABLE_INFORMATION,
+		FreePrivateMemory:  512,
+		TotalPrivateMemory: 2048,
+	}, nil
+}
+
+func scrape(t *testing.T, m *Metrics) string {
+	rec := httptest.NewRecorder()
+	m.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	b, err := io.ReadAll(rec.Body)
+	require.NoError(t, err)
+	return string(b)
+}
+
+func TestMetrics_Observe(t *testing.T) {
+	m := New(func() Source { return nil })
+
+	m.Observe("Sign", time.Now(), "")
+	m.Observe("Sign", time.Now(), "CKR_DEVICE_ERROR")
+	m.Observe("Sign", time.Now(), "CKR_0x80000001")
+
+	got := scrape(t, m)
+	require.Contains(t, got, `pkcs11_plugin_operations_total{operation="Sign",result="success"} 1`)
+	require.Contains(t, got, `pkcs11_plugin_operations_total{operation="Sign",result="error"} 2`)
+	require.Contains(t, got, `pkcs11_plugin_errors_total{code="CKR_DEVICE_ERROR",operation="Sign"} 1`)
+	require.Contains(t, got, `pkcs11_plugin_errors_total{code="CKR_UNKNOWN",operation="Sign"} 1`)
+	require.Contains(t, got, `pkcs11_plugin_operation_duration_seconds_count{operation="Sign"} 3`)
+	require.NotContains(t, got, "pkcs11_plugin_unlocked_accounts")
+}
+
+func TestMetrics_Observe_NilMetrics(t *testing.T) {
+	var m *Metrics
+	m.Observe("Sign", time.Now(), "")
+}
+
+func TestMetrics_Token(t *testing.T) {
+	m := New(func() Source { return stubSource{} })
+
+	got := scrape(t, m)
+	require.Contains(t, got, "pkcs11_plugin_unlocked_accounts 2")
+	require.Contains(t, got, `pkcs11_plugin_sessions{state="open"} 1`)
+	require.Contains(t, got, `pkcs11_plugin_sessions{state="in_use"} 1`)
+	require.Contains(t, got, `pkcs11_plugin_sessions{state="waiting"} 3`)
+	require.Contains(t, got, "pkcs11_plugin_logged_in 1")
+	require.Contains(t, got, "pkcs11_plugin_login_blocked 0")
+	require.Contains(t, got, `pkcs11_plugin_token_memory_bytes{state="free",type="public"} 1024`)
+	require.Contains(t, got, `pkcs11_plugin_token_memory_bytes{state="total",type="private"} 2048`)
+	require.NotContains(t, got, `pkcs11_plugin_token_memory_bytes{state="total",type="public"}`)
+	require.Contains(t, got, `pkcs11_plugin_health{state="degraded"} 1`)
+	require.Contains(t, got, `pkcs11_plugin_health{state="healthy"} 0`)
+	require.Contains(t, got, "pkcs11_plugin_health_check_failures 1")
+}
@@ -0,0 +1,105 @@
+package metrics
+
+import (
+	"quorum-account-plugin-pkcs-11/internal/pkcs11"
+
+	p11 "github.com/miekg/pkcs11"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// tokenCollector reads the state of the token from its Source on each scrape.
+type tokenCollector struct {
+	source func() Source
+
+	unlocked     *prometheus.Desc
+	sessions     *prometheus.Desc
+	loggedIn     *prometheus.Desc
+	loginBlocked *prometheus.Desc
+	loginFailed  *prometheus.Desc
+	memory       *prometheus.Desc
+	health       *prometheus.Desc
+	healthFailed *prometheus.Desc
+}
+
+func newTokenCollector(source func() Source) *tokenCollector {
+	return &tokenCollector{
+		source: source,
+		unlocked: prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "unlocked_accounts"),
+			"Number of accounts currently unlocked.", nil, nil),
+		sessions: prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "sessions"),
+			"Number of PKCS#11 sessions by state: open, in_use (running an operation) or waiting (callers queued for the session).", []string{"state"}, nil),
+		loggedIn: prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "logged_in"),
+			"1 if the plugin is logged in to the token, otherwise 0.", nil, nil),
+		loginBlocked: prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "login_blocked"),
+			"1 if the plugin will not attempt to login with the configured PIN, otherwise 0.", nil, nil),
+		loginFailed: prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "login_failures"),
+			"Number of failed logins since the last successful login.", nil, nil),
+		memory: prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "token_memory_bytes"),
+			"Memory of the token as reported by C_GetTokenInfo, by type (public or private) and state (free or total).", []string{"type", "state"}, nil),
+		health: prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "health"),
+			"1 for the current health state of the token (unknown, healthy, degraded or down), otherwise 0.  Only reported if health checks are enabled.", []string{"state"}, nil),
+		healthFailed: prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "health_check_failures"),
+			"Number of consecutive failed health checks.", nil, nil),
+	}
+}
+
+func (c *tokenCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.unlocked
+	ch <- c.sessions
+	ch <- c.loggedIn
+	ch <- c.loginBlocked
+	ch <- c.loginFailed
+	ch <- c.memory
+	ch <- c.health
+	ch <- c.healthFailed
+}
+
+func (c *tokenCollector) Collect(ch chan<- prometheus.Metric) {
+	src := c.source()
+	if src == nil {
+		return
+	}
+
+	ch <- prometheus.MustNewConstMetric(c.unlocked, prometheus.GaugeValue, float64(src.UnlockedCount()))
+
+	sessions := src.Sessions()
+	ch <- prometheus.MustNewConstMetric(c.sessions, prometheus.GaugeValue, float64(sessions.Open), "open")
+	ch <- prometheus.MustNewConstMetric(c.sessions, prometheus.GaugeValue, float64(sessions.InUse), "in_use")
+	ch <- prometheus.MustNewConstMetric(c.sessions, prometheus.GaugeValue, float64(sessions.Waiting), "waiting")
+
+	login := src.LoginState()
+	ch <- prometheus.MustNewConstMetric(c.loggedIn, prometheus.GaugeValue, boolValue(login.LoggedIn))
+	ch <- prometheus.MustNewConstMetric(c.loginBlocked, prometheus.GaugeValue, boolValue(login.Blocked))
+	ch <- prometheus.MustNewConstMetric(c.loginFailed, prometheus.GaugeValue, float64(login.Failures))
+
+	if health := src.Health(); health != nil {
+		for _, state := range []pkcs11.HealthState{pkcs11.HealthUnknown, pkcs11.HealthHealthy, pkcs11.HealthDegraded, pkcs11.HealthDown} {
+			ch <- prometheus.MustNewConstMetric(c.health, prometheus.GaugeValue, boolValue(health.State == state), string(state))
+		}
+		ch <- prometheus.MustNewConstMetric(c.healthFailed, prometheus.GaugeValue, float64(health.Failures))
+	}
+
+	info, err := src.TokenInfo()
+	if err != nil {
+		return
+	}
+	c.collectMemory(ch, info.FreePublicMemory, "public", "free")
+	c.collectMemory(ch, info.TotalPublicMemory, "public", "total")
+	c.collectMemory(ch, info.FreePrivateMemory, "private", "free")
+	c.collectMemory(ch, info.TotalPrivateMemory, "private", "total")
+}
+
+func (c *tokenCollector) collectMemory(ch chan<- prometheus.Metric, v uint, labels ...string) {
+	// tokens report CK_UNAVAILABLE_INFORMATION for values they do not track
+	if v == p11.CK_UNAVAILABLE_INFORMATION {
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(c.memory, prometheus.GaugeValue, float64(v), labels...)
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -1,138 +1,244 @@
 package pkcs11
 
 import (
+	"context"
 	"crypto/ecdsa"
 	"errors"
 	"fmt"
-	"log"
 	"quorum-account-plugin-pkcs-11/internal/account/account"
 	"quorum-account-plugin-pkcs-11/internal/config"
+	"quorum-account-plugin-pkcs-11/internal/logging"
+	"quorum-account-plugin-pkcs-11/internal/secure"
+	"sort"
 	"strings"
 	"sync"
 	"time"
+
+	"github.com/miekg/pkcs11"
+	"go.opentelemetry.io/otel/trace"
 )
 
+// NewAccountManager returns an AccountManager for the token used by wrapper, configured with config.
 func NewAccountManager(wrapper Cryptoki, config config.Config) (AccountManager, error) {
 	if wrapper == nil {
-		panic("")
+		return nil, errors.New("a Cryptoki is required to create an AccountManager")
 	}
 
 	a := &accountManager{
 		wrapper:  wrapper,
 		unlocked: make(map[string]*lockableKey),
 	}
-
-	for _, toUnlock := range config.Unlock {
-		addr, err := account.NewAddressFromHexString(toUnlock)
-		if err != nil {
-			log.Printf("[INFO] unable to unlock %v, err = %v", toUnlock, err)
-		}
-		if err := a.TimedUnlock(addr, 0); err != nil {
-			log.Printf("[INFO] unable to unlock %v, err = %v", toUnlock, err)
-		}
+	if err := a.Reconfigure(context.Background(), config); err != nil {
+		return nil, err
 	}
-
 	return a, nil
 }
 
 type AccountManager interface {
-	Open() error
-	Close() error
-	Status() (string, error)
-	Accounts() ([]account.Account, error)
-	Contains(acctAddr account.Address) bool
-	Sign(acctAddr account.Address, toSign []byte) ([]byte, error)
-	UnlockAndSign(acctAddr account.Address, toSign []byte) ([]byte, error)
-	TimedUnlock(acctAddr account.Address, duration time.Duration) error
-	Lock(acctAddr account.Address)
-	NewAccount(conf config.NewAccount) (account.Account, error)
-	ImportPrivateKey(privateKeyECDSA *ecdsa.PrivateKey, conf config.NewAccount) (account.Account, error)
+	Open(ctx context.Context) error
+	Close(ctx context.Context) error
+	Status(ctx context.Context) (Status, error)
+	Accounts(ctx context.Context) ([]account.Account, error)
+	Contains(ctx context.Context, acctAddr account.Address) bool
+	Sign(ctx context.Context, acctAddr account.Address, toSign []byte) ([]byte, error)
+	UnlockAndSign(ctx context.Context, acctAddr account.Address, toSign []byte) ([]byte, error)
+	TimedUnlock(ctx context.Context, acctAddr account.Address, duration time.Duration) error
+	Lock(ctx context.Context, acctAddr account.Address)
+	NewAccount(ctx context.Context, conf config.NewAccount) (account.Account, error)
+	ImportPrivateKey(ctx context.Context, privateKeyECDSA *ecdsa.PrivateKey, conf config.NewAccount) (account.Account, error)
+	RotatePIN(ctx context.Context, newPIN *secure.Buffer) error
+	UnlockedCount() int
+	LoginState() LoginState
+	Sessions() SessionStats
+	TokenInfo() (pkcs11.TokenInfo, error)
+	// Health returns the outcome of the background health checks, or nil if they are not enabled.
+	Health() *Health
+	// Reconfigure applies the unlock list, health check and slot event settings of conf, which do not need the session
+	// to be reopened.  If the session is open, the accounts selected by unlock list entries which have been added or
+	// changed are unlocked, and accounts unlocked by the previous list which are not selected by the new one are
+	// locked; otherwise the changes are applied when the session is opened.
+	Reconfigure(ctx context.Context, conf config.Config) error
+	// Shutdown stops the AccountManager's background work, locks all accounts and finalizes its Cryptoki.  It must be
+	// called before the AccountManager is discarded.  If ctx is done before the Cryptoki has been finalized, Shutdown
+	// returns and finalization continues in the background.
+	Shutdown(ctx context.Context) error
 }
 
 type accountManager struct {
 	wrapper  Cryptoki
 	unlocked map[string]*lockableKey
-	mu       sync.Mutex
+	// mu guards unlocked, health, unlockList, appliedList, listApplied, listUnlocked and credentials
+	mu     sync.Mutex
+	health *healthMonitor
+
+	// unlockList is the config.Config unlock list last given to Reconfigure.  It is applied when the session is first
+	// opened, and its changes when Reconfigure is called or the session is next opened, see applyUnlockList.
+	unlockList []config.UnlockEntry
+	// appliedList is the unlock list as it was last applied, if listApplied is set
+	appliedList []config.UnlockEntry
+	listApplied bool
+	// listUnlocked are the accounts unlocked when the unlock list was last applied
+	listUnlocked map[account.Address]bool
+	// credentials authenticate each use of the accounts' keys, see config.UnlockEntry.Credential
+	credentials map[account.Address]*config.EnvironmentVariable
+	// onRemoval is the config.SlotEvents policy applied to unlocked accounts when the token is removed
+	onRemoval string
+	stopWatch func()
 }
 
 type lockableKey struct {
 	cancel chan struct{}
+	// expires is when the account will be locked, or zero if it is unlocked indefinitely
+	expires time.Time
 }
 
-func (a *accountManager) Open() error {
-	return a.wrapper.OpenSession()
+// Open opens the session and applies the unlock list, or its changes if it has already been applied, see
+// applyUnlockList.  If the unlock list cannot be applied the session is closed again.
+func (a *accountManager) Open(ctx context.Context) (err error) {
+	ctx, span := tracer.Start(ctx, "AccountManager.Open")
+	defer endSpan(span, &err)
+	if err := a.wrapper.OpenSession(ctx); err != nil {
+		return err
+	}
+	if err := a.applyUnlockList(ctx); err != nil {
+		if closeErr := a.wrapper.CloseSession(ctx); closeErr != nil {
+			logging.L().Warn("unable to close session", "error", closeErr)
+		}
+		return err
+	}
+	return nil
 }
 
-func (a *accountManager) Close() error {
-	return a.wrapper.CloseSession()
+func (a *accountManager) Close(ctx context.Context) (err error) {
+	ctx, span := tracer.Start(ctx, "AccountManager.Close")
+	defer endSpan(span, &err)
+	return a.wrapper.CloseSession(ctx)
 }
 
-func (a *accountManager) Status() (string, error) {
-	a.mu.Lock()
-	defer a.mu.Unlock()
+// Status describes the library, token, login and sessions in use and the unlocked accounts.  Information which cannot
+// be read from the token is reported in Status.Errors rather than failing the whole Status.
+func (a *accountManager) Status(ctx context.Context) (_ Status, err error) {
+	_, span := tracer.Start(ctx, "AccountManager.Status")
+	defer endSpan(span, &err)
 
-	unlockedCount := len(a.unlocked)
+	status := Status{
+		Login:        newLoginStatus(a.wrapper.LoginState()),
+		Sessions:     a.wrapper.Sessions(),
+		Unlocked:     a.unlockedAccounts(time.Now()),
+		Health:       a.Health(),
+		Capabilities: a.wrapper.Capabilities(),
+	}
 
-	status := fmt.Sprintf("%v unlocked account(s)", unlockedCount)
-	if unlockedCount != 0 {
-		var unlockedAddrs []string
-		for addr, _ := range a.unlocked {
-			unlockedAddrs = append(unlockedAddrs, fmt.Sprintf("0x%v", addr))
-		}
-		status = fmt.Sprintf("%v: %v", status, unlockedAddrs)
+	if info, err := a.wrapper.LibraryInfo(); err != nil {
+		status.Errors = append(status.Errors, fmt.Sprintf("library: %v", err))
+	} else {
+		status.Library = newLibraryStatus(info, a.wrapper.Profile())
+	}
+	if id, info, err := a.wrapper.SlotInfo(); err != nil {
+		status.Errors = append(status.Errors, fmt.Sprintf("slot: %v", err))
+	} else {
+		status.Slot = newSlotStatus(id, info)
+	}
+	if info, err := a.wrapper.TokenInfo(); err != nil {
+		status.Errors = append(status.Errors, fmt.Sprintf("token: %v", err))
+	} else {
+		status.Token = newTokenStatus(info)
 	}
 
 	return status, nil
 }
 
-func (a *accountManager) Accounts() ([]account.Account, error) {
-	return a.wrapper.Accounts()
+// unlockedAccounts returns the unlocked accounts in address order.
+func (a *accountManager) unlockedAccounts(now time.Time) []UnlockedAccount {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	unlocked := make([]UnlockedAccount, 0, len(a.unlocked))
+	for addr, key := range a.unlocked {
+		u := UnlockedAccount{Address: fmt.Sprintf("0x%v", addr)}
+		if !key.expires.IsZero() {
+			expires := key.expires
+			u.Expires = &expires
+			u.Remaining = expires.Sub(now).Round(time.Second).String()
+		}
+		unlocked = append(unlocked, u)
+	}
+	sort.Slice(unlocked, func(i, j int) bool {
+		return unlocked[i].Address < unlocked[j].Address
+	})
+	return unlocked
+}
+
+func (a *accountManager) Accounts(ctx context.Context) (_ []account.Account, err error) {
+	ctx, span := tracer.Start(ctx, "AccountManager.Accounts")
+	defer endSpan(span, &err)
+	return a.wrapper.Accounts(ctx)
 }
 
-func (a *accountManager) Contains(acctAddr account.Address) bool {
-	return a.wrapper.Contains(acctAddr)
+func (a *accountManager) Contains(ctx context.Context, acctAddr account.Address) bool {
+	ctx, span := tracer.Start(ctx, "AccountManager.Contains", trace.WithAttributes(attrAddress.String(acctAddr.ToHexString())))
+	defer span.End()
+	return a.wrapper.Contains(ctx, acctAddr)
 }
 
-func (a *accountManager) Sign(acctAddr account.Address, toSign []byte) ([]byte, error) {
-	if !a.Contains(acctAddr) {
-		return nil, errors.New("account does not exist")
+// Sign signs toSign, the Keccak-256 hash Quorum computes of a transaction or message, with the key of the unlocked
+// account acctAddr.  The signature is returned in the [R || S || V] form used by ecrecover, see Cryptoki.SignHash.
+func (a *accountManager) Sign(ctx context.Context, acctAddr account.Address, toSign []byte) (_ []byte, err error) {
+	ctx, span := tracer.Start(ctx, "AccountManager.Sign", trace.WithAttributes(attrAddress.String(acctAddr.ToHexString())))
+	defer endSpan(span, &err)
+
+	if !a.Contains(ctx, acctAddr) {
+		return nil, ErrAccountNotFound
 	}
 	a.mu.Lock()
 	_, ok := a.unlocked[acctAddr.ToHexString()]
 	a.mu.Unlock()
 	if !ok {
-		return nil, errors.New("account locked")
+		return nil, ErrAccountLocked
 	}
-	return a.wrapper.Sign(toSign, acctAddr)
+	return a.wrapper.SignHash(a.withAccountCredential(ctx, acctAddr), toSign, acctAddr)
 }
 
-func (a *accountManager) UnlockAndSign(acctAddr account.Address, toSign []byte) ([]byte, error) {
-	if !a.Contains(acctAddr) {
-		return nil, errors.New("account does not exist")
+// UnlockAndSign signs toSign as Sign, unlocking the account for the signature if it is locked.
+func (a *accountManager) UnlockAndSign(ctx context.Context, acctAddr account.Address, toSign []byte) (_ []byte, err error) {
+	ctx, span := tracer.Start(ctx, "AccountManager.UnlockAndSign", trace.WithAttributes(attrAddress.String(acctAddr.ToHexString())))
+	defer endSpan(span, &err)
+
+	if !a.Contains(ctx, acctAddr) {
+		return nil, ErrAccountNotFound
 	}
 	a.mu.Lock()
 	_, unlocked := a.unlocked[acctAddr.ToHexString()]
 	a.mu.Unlock()
 	if !unlocked {
-		if err := a.TimedUnlock(acctAddr, 0); err != nil {
+		if err := a.TimedUnlock(ctx, acctAddr, 0); err != nil {
 			return nil, err
 		}
-		defer a.Lock(acctAddr)
+		defer a.Lock(ctx, acctAddr)
 		_, _ = a.unlocked[acctAddr.ToHexString()]
 	}
-	return a.wrapper.Sign(toSign, acctAddr)
+	return a.wrapper.SignHash(a.withAccountCredential(ctx, acctAddr), toSign, acctAddr)
 }
 
-func (a *accountManager) TimedUnlock(acctAddr account.Address, duration time.Duration) error {
-	if !a.Contains(acctAddr) {
-		return errors.New("account does not exist")
+func (a *accountManager) TimedUnlock(ctx context.Context, acctAddr account.Address, duration time.Duration) (err error) {
+	ctx, span := tracer.Start(ctx, "AccountManager.TimedUnlock", trace.WithAttributes(attrAddress.String(acctAddr.ToHexString())))
+	defer endSpan(span, &err)
+
+	if !a.Contains(ctx, acctAddr) {
+		return ErrAccountNotFound
 	}
+	a.unlock(acctAddr, duration)
+	return nil
+}
 
+// unlock unlocks the account for duration, or indefinitely if duration is 0.
+func (a *accountManager) unlock(acctAddr account.Address, duration time.Duration) {
 	lockableKey := &lockableKey{
 		//key: key,
 	}
 
 	if duration > 0 {
+		lockableKey.expires = time.Now().Add(duration)
 		go a.lockAfter(acctAddr.ToHexString(), lockableKey, duration)
 	}
 
@@ -140,8 +246,6 @@ func (a *accountManager) TimedUnlock(acctAddr account.Address, duration time.Dur
 	addr := strings.TrimPrefix(acctAddr.ToHexString(), "0x")
 	a.unlocked[addr] = lockableKey
 	a.mu.Unlock()
-
-	return nil
 }
 
 func (a *accountManager) lockAfter(addr string, key *lockableKey, duration time.Duration) {
@@ -160,7 +264,10 @@ func (a *accountManager) lockAfter(addr string, key *lockableKey, duration time.
 	}
 }
 
-func (a *accountManager) Lock(acctAddr account.Address) {
+func (a *accountManager) Lock(ctx context.Context, acctAddr account.Address) {
+	_, span := tracer.Start(ctx, "AccountManager.Lock", trace.WithAttributes(attrAddress.String(acctAddr.ToHexString())))
+	defer span.End()
+
 	addrHex := acctAddr.ToHexString()
 	a.mu.Lock()
 	lockable, ok := a.unlocked[addrHex]
@@ -171,10 +278,156 @@ func (a *accountManager) Lock(acctAddr account.Address) {
 	}
 }
 
-func (a *accountManager) NewAccount(conf config.NewAccount) (account.Account, error) {
-	return a.wrapper.NewAccount(conf)
+func (a *accountManager) NewAccount(ctx context.Context, conf config.NewAccount) (_ account.Account, err error) {
+	ctx, span := tracer.Start(ctx, "AccountManager.NewAccount")
+	defer endSpan(span, &err)
+	return a.wrapper.NewAccount(ctx, conf)
+}
+
+func (a *accountManager) ImportPrivateKey(ctx context.Context, privateKeyECDSA *ecdsa.PrivateKey, conf config.NewAccount) (_ account.Account, err error) {
+	ctx, span := tracer.Start(ctx, "AccountManager.ImportPrivateKey")
+	defer endSpan(span, &err)
+	return a.wrapper.ImportPrivateKey(ctx, privateKeyECDSA, conf)
+}
+
+func (a *accountManager) UnlockedCount() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return len(a.unlocked)
+}
+
+func (a *accountManager) LoginState() LoginState {
+	return a.wrapper.LoginState()
+}
+
+func (a *accountManager) Sessions() SessionStats {
+	return a.wrapper.Sessions()
+}
+
+func (a *accountManager) TokenInfo() (pkcs11.TokenInfo, error) {
+	return a.wrapper.TokenInfo()
+}
+
+func (a *accountManager) Health() *Health {
+	a.mu.Lock()
+	m := a.health
+	a.mu.Unlock()
+	if m == nil {
+		return nil
+	}
+	h := m.current()
+	return &h
+}
+
+func (a *accountManager) Reconfigure(ctx context.Context, conf config.Config) (err error) {
+	ctx, span := tracer.Start(ctx, "AccountManager.Reconfigure")
+	defer endSpan(span, &err)
+
+	var health *healthMonitor
+	if conf.HealthCheck != nil {
+		if health, err = newHealthMonitor(a.wrapper, *conf.HealthCheck); err != nil {
+			return err
+		}
+	}
+
+	a.stopBackground()
+	if health != nil {
+		health.start()
+	}
+	a.mu.Lock()
+	a.health = health
+	a.mu.Unlock()
+	if conf.SlotEvents != nil {
+		a.onRemoval = conf.SlotEvents.OnRemoval
+		a.stopWatch = a.wrapper.WatchToken(conf.SlotEvents.PollInterval, a.tokenChanged)
+	}
+
+	a.mu.Lock()
+	a.unlockList = conf.Unlock
+	a.mu.Unlock()
+	if a.wrapper.Sessions().Open > 0 {
+		return a.applyUnlockList(ctx)
+	}
+	return nil
 }
 
-func (a *accountManager) ImportPrivateKey(privateKeyECDSA *ecdsa.PrivateKey, conf config.NewAccount) (account.Account, error) {
-	return a.wrapper.ImportPrivateKey(privateKeyECDSA, conf)
+// stopBackground stops the health monitor and slot watcher, if they are running.
+func (a *accountManager) stopBackground() {
+	a.mu.Lock()
+	health := a.health
+	a.health = nil
+	a.mu.Unlock()
+	if health != nil {
+		health.shutdown()
+	}
+	if a.stopWatch != nil {
+		a.stopWatch()
+		a.stopWatch = nil
+	}
+}
+
+func (a *accountManager) Shutdown(ctx context.Context) (err error) {
+	ctx, span := tracer.Start(ctx, "AccountManager.Shutdown")
+	defer endSpan(span, &err)
+
+	a.stopBackground()
+	a.lockAll()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- a.wrapper.Finalize(context.WithoutCancel(ctx))
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return fmt.Errorf("PKCS#11 library not finalized: %w", ctx.Err())
+	}
+}
+
+// tokenChanged applies the onRemoval policy when the token is removed.  When it is re-inserted only changes to the unlock
+// list made while it was removed are applied, so the accounts locked on removal stay locked.
+func (a *accountManager) tokenChanged(ev TokenEvent) {
+	if ev.Present {
+		if ev.Err != nil {
+			logging.L().Error("token re-inserted but the session could not be reopened", "slot", ev.Slot, "error", ev.Err)
+			logging.Audit("token re-inserted", "slot", ev.Slot, "sessionReopened", false)
+			return
+		}
+		logging.L().Info("token re-inserted", "slot", ev.Slot)
+		logging.Audit("token re-inserted", "slot", ev.Slot, "sessionReopened", true)
+		if err := a.applyUnlockList(context.Background()); err != nil {
+			logging.L().Error("unable to apply unlock list", "error", err)
+		}
+		return
+	}
+
+	logging.L().Warn("token removed, accounts are unavailable until it is re-inserted")
+	if a.onRemoval != config.LockOnRemoval {
+		logging.Audit("token removed", "unlockedAccountsLocked", 0)
+		return
+	}
+	logging.Audit("token removed", "unlockedAccountsLocked", a.lockAll())
+}
+
+// lockAll locks all unlocked accounts and returns how many were locked.
+func (a *accountManager) lockAll() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	n := len(a.unlocked)
+	for addr := range a.unlocked {
+		delete(a.unlocked, addr)
+	}
+	return n
+}
+
+// RotatePIN changes the token's user PIN without affecting the unlocked accounts.
+func (a *accountManager) RotatePIN(ctx context.Context, newPIN *secure.Buffer) error {
+	if err := a.wrapper.RotatePIN(ctx, newPIN); err != nil {
+		return err
+	}
+	logging.L().Info("user PIN rotated")
+	logging.L().Warn("the rotated user PIN is only held in memory: update the configured PIN source before the plugin is restarted")
+	return nil
 }
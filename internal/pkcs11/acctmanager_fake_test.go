@@ -0,0 +1,173 @@
+package pkcs11_test
+
+import (
+	"bytes"
+	"context"
+	"quorum-account-plugin-pkcs-11/internal/account/account"
+	"quorum-account-plugin-pkcs-11/internal/config"
+	"quorum-account-plugin-pkcs-11/internal/pkcs11"
+	"quorum-account-plugin-pkcs-11/internal/pkcs11/pkcs11test"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// toSign is a 32 byte hash, as Quorum signs
+var toSign = bytes.Repeat([]byte{0x42}, 32)
+
+// newManager returns an AccountManager configured with conf, using a fake token holding one account, and opens it.
+func newManager(t *testing.T, conf config.Config) (pkcs11.AccountManager, *pkcs11test.Cryptoki, account.Address) {
+	token := pkcs11test.New("test")
+	acct, err := account.NewKeyFromHexString("0x1fe8f1ad4053326db20529257ac9401f2e6c769ef1d736b8c2f5aba5f787c72b")
+	require.NoError(t, err)
+	addr := token.AddKey(acct, "validator-1")
+
+	am, err := pkcs11.NewAccountManager(token, conf)
+	require.NoError(t, err)
+	t.Cleanup(func() { am.Shutdown(context.Background()) })
+	require.NoError(t, am.Open(context.Background()))
+	return am, token, addr
+}
+
+func TestNewAccountManager_NoCryptoki(t *testing.T) {
+	_, err := pkcs11.NewAccountManager(nil, config.Config{})
+	require.Error(t, err)
+}
+
+func TestAccountManager_SignRequiresUnlock(t *testing.T) {
+	ctx := context.Background()
+	am, _, addr := newManager(t, config.Config{})
+
+	_, err := am.Sign(ctx, addr, toSign)
+	require.ErrorIs(t, err, pkcs11.ErrAccountLocked)
+
+	require.NoError(t, am.TimedUnlock(ctx, addr, 0))
+	sig, err := am.Sign(ctx, addr, toSign)
+	require.NoError(t, err)
+	require.Len(t, sig, 65)
+
+	am.Lock(ctx, addr)
+	_, err = am.Sign(ctx, addr, toSign)
+	require.ErrorIs(t, err, pkcs11.ErrAccountLocked)
+}
+
+func TestAccountManager_UnknownAccount(t *testing.T) {
+	ctx := context.Background()
+	am, _, _ := newManager(t, config.Config{})
+	unknown := account.Address{1}
+
+	require.False(t, am.Contains(ctx, unknown))
+	require.ErrorIs(t, am.TimedUnlock(ctx, unknown, 0), pkcs11.ErrAccountNotFound)
+	_, err := am.Sign(ctx, unknown, toSign)
+	require.ErrorIs(t, err, pkcs11.ErrAccountNotFound)
+	_, err = am.UnlockAndSign(ctx, unknown, toSign)
+	require.ErrorIs(t, err, pkcs11.ErrAccountNotFound)
+}
+
+func TestAccountManager_SignInvalidHash(t *testing.T) {
+	ctx := context.Background()
+	am, _, addr := newManager(t, config.Config{})
+	require.NoError(t, am.TimedUnlock(ctx, addr, 0))
+
+	_, err := am.Sign(ctx, addr, []byte("msg"))
+
+	require.ErrorIs(t, err, pkcs11.ErrInvalidHash)
+}
+
+func TestAccountManager_TimedUnlockExpires(t *testing.T) {
+	ctx := context.Background()
+	am, _, addr := newManager(t, config.Config{})
+
+	require.NoError(t, am.TimedUnlock(ctx, addr, 50*time.Millisecond))
+	require.Equal(t, 1, am.UnlockedCount())
+
+	require.Eventually(t, func() bool { return am.UnlockedCount() == 0 }, time.Second, 10*time.Millisecond)
+	_, err := am.Sign(ctx, addr, toSign)
+	require.ErrorIs(t, err, pkcs11.ErrAccountLocked)
+}
+
+func TestAccountManager_UnlockAndSignLeavesAccountLocked(t *testing.T) {
+	ctx := context.Background()
+	am, _, addr := newManager(t, config.Config{})
+
+	_, err := am.UnlockAndSign(ctx, addr, toSign)
+
+	require.NoError(t, err)
+	require.Zero(t, am.UnlockedCount())
+}
+
+func TestAccountManager_UnlockList(t *testing.T) {
+	am, _, addr := newManager(t, config.Config{Unlock: []config.UnlockEntry{{Account: "label:validator-*"}}})
+
+	_, err := am.Sign(context.Background(), addr, toSign)
+
+	require.NoError(t, err)
+	require.Equal(t, 1, am.UnlockedCount())
+}
+
+func TestAccountManager_OnRemoval(t *testing.T) {
+	tests := map[string]struct {
+		onRemoval    string
+		wantUnlocked int
+	}{
+		"lock": {onRemoval: config.LockOnRemoval, wantUnlocked: 0},
+		"keep": {onRemoval: config.KeepOnRemoval, wantUnlocked: 1},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			am, token, addr := newManager(t, config.Config{SlotEvents: &config.SlotEvents{PollInterval: time.Second, OnRemoval: tt.onRemoval}})
+			require.NoError(t, am.TimedUnlock(ctx, addr, 0))
+
+			token.RemoveToken()
+			require.Equal(t, tt.wantUnlocked, am.UnlockedCount())
+			_, err := am.Sign(ctx, addr, toSign)
+			require.Error(t, err)
+
+			token.InsertToken()
+			_, err = am.UnlockAndSign(ctx, addr, toSign)
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestAccountManager_UnlockListAppliedOnce(t *testing.T) {
+	ctx := context.Background()
+	conf := config.Config{
+		Unlock:     []config.UnlockEntry{{Account: "label:validator-1"}},
+		SlotEvents: &config.SlotEvents{PollInterval: time.Second, OnRemoval: config.LockOnRemoval},
+	}
+	am, token, addr := newManager(t, conf)
+	require.Equal(t, 1, am.UnlockedCount())
+
+	am.Lock(ctx, addr)
+	// a change to another section, the session being reopened and the token being re-inserted leave the unlock list
+	// as it was applied
+	conf.HealthCheck = &config.HealthCheck{Interval: time.Hour}
+	require.NoError(t, am.Reconfigure(ctx, conf))
+	require.NoError(t, am.Close(ctx))
+	require.NoError(t, am.Open(ctx))
+	token.RemoveToken()
+	token.InsertToken()
+	require.Equal(t, 0, am.UnlockedCount())
+
+	// a changed entry is applied
+	conf.Unlock = []config.UnlockEntry{{Account: "label:validator-1", Duration: time.Hour}}
+	require.NoError(t, am.Reconfigure(ctx, conf))
+	require.Equal(t, 1, am.UnlockedCount())
+}
+
+func TestAccountManager_SignFails(t *testing.T) {
+	ctx := context.Background()
+	am, token, addr := newManager(t, config.Config{})
+	require.NoError(t, am.TimedUnlock(ctx, addr, 0))
+	token.FailNext("SignHash", pkcs11.ErrKeyNotFound)
+
+	_, err := am.Sign(ctx, addr, toSign)
+
+	require.ErrorIs(t, err, pkcs11.ErrKeyNotFound)
+	// the account stays unlocked
+	_, err = am.Sign(ctx, addr, toSign)
+	require.NoError(t, err)
+}
@@ -0,0 +1,39 @@
+package pkcs11
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// stubFinalize is a Cryptoki whose Finalize blocks until release is closed.  Calling any other method panics.
+type stubFinalize struct {
+	Cryptoki
+	release chan struct{}
+}
+
+func (s *stubFinalize) Finalize(context.Context) error {
+	<-s.release
+	return nil
+}
+
+func TestAccountManager_Shutdown(t *testing.T) {
+	w := &stubFinalize{release: make(chan struct{})}
+	close(w.release)
+	a := &accountManager{wrapper: w, unlocked: map[string]*lockableKey{"aa": {}}}
+
+	require.NoError(t, a.Shutdown(context.Background()))
+	require.Zero(t, a.UnlockedCount())
+}
+
+func TestAccountManager_Shutdown_Deadline(t *testing.T) {
+	w := &stubFinalize{release: make(chan struct{})}
+	defer close(w.release)
+	a := &accountManager{wrapper: w, unlocked: map[string]*lockableKey{}}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	require.ErrorIs(t, a.Shutdown(ctx), context.DeadlineExceeded)
+}
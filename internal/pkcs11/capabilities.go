@@ -0,0 +1,144 @@
+package pkcs11
+
+import (
+	"context"
+	"encoding/asn1"
+	"fmt"
+	"quorum-account-plugin-pkcs-11/internal/logging"
+
+	"github.com/miekg/pkcs11"
+)
+
+const (
+	// signMechanism is the mechanism used by Sign
+	signMechanism     = pkcs11.CKM_ECDSA_SHA256
+	signMechanismName = "CKM_ECDSA_SHA256"
+
+	// ecKeySize is the size in bits of secp256k1 keys
+	ecKeySize = 256
+)
+
+// Capabilities describes which of the plugin's features are supported by the token, as found when the session was
+// opened.
+type Capabilities struct {
+	// KeyGeneration is set if the token can generate secp256k1 key pairs.  NewAccount fails with ErrUnsupported if it
+	// cannot.
+	KeyGeneration bool `json:"keyGeneration"`
+	// Signing is set if the token supports the mechanism used by Sign.  A session is not opened if it does not.
+	Signing bool `json:"signing"`
+	// RawECDSA is set if the token supports CKM_ECDSA, i.e. signing a hash computed outside the token as Quorum signs
+	// transactions.  AccountManager.Sign fails with ErrUnsupported if it does not.
+	RawECDSA bool `json:"rawECDSA"`
+	// Wrap and Unwrap are set if the token supports any mechanism that can wrap or unwrap keys, as needed to export or
+	// import keys under encryption
+	Wrap   bool `json:"wrap"`
+	Unwrap bool `json:"unwrap"`
+	// Missing explains why each unsupported feature is not supported
+	Missing []string `json:"missing,omitempty"`
+}
+
+// log writes the capability report.  Key generation is logged as "generate" because the logger redacts the values of
+// arguments whose names contain "key".
+func (c Capabilities) log() {
+	logging.L().Info("token capabilities", "generate", c.KeyGeneration, "signing", c.Signing, "rawECDSA", c.RawECDSA,
+		"wrap", c.Wrap, "unwrap", c.Unwrap)
+	for _, m := range c.Missing {
+		logging.L().Warn("token lacks a capability", "missing", m)
+	}
+}
+
+// mechanismSource is the part of the PKCS#11 API used to detect capabilities.  It is implemented by *pkcs11.Ctx.
+type mechanismSource interface {
+	GetMechanismList(slotID uint) ([]*pkcs11.Mechanism, error)
+	GetMechanismInfo(slotID uint, m []*pkcs11.Mechanism) (pkcs11.MechanismInfo, error)
+}
+
+// detectCapabilities finds the capabilities of the token in slot from the mechanisms it supports.  Support for the
+// secp256k1 curve is not reported by C_GetMechanismInfo, see probeCurve.
+func detectCapabilities(src mechanismSource, slot uint) (Capabilities, error) {
+	mechs, err := src.GetMechanismList(slot)
+	if err != nil {
+		return Capabilities{}, err
+	}
+	infos := make(map[uint]pkcs11.MechanismInfo, len(mechs))
+	for _, m := range mechs {
+		info, err := src.GetMechanismInfo(slot, []*pkcs11.Mechanism{m})
+		if err != nil {
+			return Capabilities{}, fmt.Errorf("unable to get info of mechanism 0x%X: %w", m.Mechanism, err)
+		}
+		infos[m.Mechanism] = info
+	}
+
+	var c Capabilities
+	c.KeyGeneration = c.require(infos, "key generation", pkcs11.CKM_EC_KEY_PAIR_GEN, "CKM_EC_KEY_PAIR_GEN", pkcs11.CKF_GENERATE_KEY_PAIR, "CKF_GENERATE_KEY_PAIR")
+	c.Signing = c.require(infos, "signing", signMechanism, signMechanismName, pkcs11.CKF_SIGN, "CKF_SIGN")
+	if info, ok := infos[pkcs11.CKM_ECDSA]; ok {
+		c.RawECDSA = info.Flags&pkcs11.CKF_SIGN != 0 && supportsKeySize(info)
+	}
+	for _, info := range infos {
+		c.Wrap = c.Wrap || info.Flags&pkcs11.CKF_WRAP != 0
+		c.Unwrap = c.Unwrap || info.Flags&pkcs11.CKF_UNWRAP != 0
+	}
+	return c, nil
+}
+
+// require reports whether infos contains mech, with flag set and supporting ecKeySize keys.  If not, the reason feature
+// is unsupported is added to c.Missing.
+func (c *Capabilities) require(infos map[uint]pkcs11.MechanismInfo, feature string, mech uint, mechName string, flag uint, flagName string) bool {
+	info, ok := infos[mech]
+	switch {
+	case !ok:
+		c.Missing = append(c.Missing, fmt.Sprintf("%v: %v is not supported", feature, mechName))
+	case info.Flags&flag == 0:
+		c.Missing = append(c.Missing, fmt.Sprintf("%v: %v does not have %v set", feature, mechName, flagName))
+	case !supportsKeySize(info):
+		c.Missing = append(c.Missing, fmt.Sprintf("%v: %v supports %v to %v bit keys, not %v bit keys", feature, mechName, info.MinKeySize, info.MaxKeySize, ecKeySize))
+	default:
+		return true
+	}
+	return false
+}
+
+// supportsKeySize reports whether the key sizes of an EC mechanism include ecKeySize.  Some libraries do not report key
+// sizes, leaving both as 0, in which case any size is assumed to be supported.
+func supportsKeySize(info pkcs11.MechanismInfo) bool {
+	if info.MinKeySize == 0 && info.MaxKeySize == 0 {
+		return true
+	}
+	return info.MinKeySize <= ecKeySize && ecKeySize <= info.MaxKeySize
+}
+
+// probeCurve generates, and then destroys, a secp256k1 session key pair: support for a curve can only be found by
+// using it.  p.mu must be held and the session logged in.
+func (p *pkcs11Wrapper) probeCurve(ctx context.Context) (err error) {
+	marshaledOID, err := asn1.Marshal(asn1.ObjectIdentifier{1, 3, 132, 0, 10}) // secp256k1 oid
+	if err != nil {
+		return err
+	}
+	publicKeyTemplate := p.profile.template(
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PUBLIC_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_EC),
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, false),
+		pkcs11.NewAttribute(pkcs11.CKA_VERIFY, true),
+		pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, marshaledOID),
+	)
+	privateKeyTemplate := p.profile.template(
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PRIVATE_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, false),
+		pkcs11.NewAttribute(pkcs11.CKA_SIGN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_SENSITIVE, true),
+		pkcs11.NewAttribute(pkcs11.CKA_EXTRACTABLE, false),
+	)
+	call := p.startCall(ctx, "C_GenerateKeyPair", attrMechanism.String("CKM_EC_KEY_PAIR_GEN"))
+	pubK, privK, err := p.Context.GenerateKeyPair(p.Session, []*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_EC_KEY_PAIR_GEN, nil)},
+		publicKeyTemplate,
+		privateKeyTemplate)
+	endSpan(call, &err)
+	if err != nil {
+		return err
+	}
+
+	// session objects are destroyed with the session anyway, so failing to destroy them now is not an error
+	p.destroyObjects(ctx, pubK, privK)
+	return nil
+}
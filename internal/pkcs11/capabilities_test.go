@@ -0,0 +1,80 @@
+package pkcs11
+
+import (
+	"bytes"
+	"encoding/json"
+	"quorum-account-plugin-pkcs-11/internal/logging"
+	"testing"
+
+	"github.com/hashicorp/go-hclog"
+
+	"github.com/miekg/pkcs11"
+	"github.com/stretchr/testify/require"
+)
+
+type stubMechanisms map[uint]pkcs11.MechanismInfo
+
+func (s stubMechanisms) GetMechanismList(uint) ([]*pkcs11.Mechanism, error) {
+	var mechs []*pkcs11.Mechanism
+	for m := range s {
+		mechs = append(mechs, pkcs11.NewMechanism(m, nil))
+	}
+	return mechs, nil
+}
+
+func (s stubMechanisms) GetMechanismInfo(_ uint, m []*pkcs11.Mechanism) (pkcs11.MechanismInfo, error) {
+	return s[m[0].Mechanism], nil
+}
+
+func TestDetectCapabilities(t *testing.T) {
+	got, err := detectCapabilities(stubMechanisms{
+		pkcs11.CKM_EC_KEY_PAIR_GEN: {MinKeySize: 256, MaxKeySize: 521, Flags: pkcs11.CKF_GENERATE_KEY_PAIR | pkcs11.CKF_EC_NAMEDCURVE},
+		pkcs11.CKM_ECDSA_SHA256:    {MinKeySize: 256, MaxKeySize: 521, Flags: pkcs11.CKF_SIGN | pkcs11.CKF_VERIFY},
+		pkcs11.CKM_ECDSA:           {Flags: pkcs11.CKF_SIGN},
+		pkcs11.CKM_AES_KEY_WRAP:    {MinKeySize: 16, MaxKeySize: 32, Flags: pkcs11.CKF_WRAP},
+	}, 0)
+
+	require.NoError(t, err)
+	require.Equal(t, Capabilities{KeyGeneration: true, Signing: true, RawECDSA: true, Wrap: true}, got)
+}
+
+func TestDetectCapabilities_Missing(t *testing.T) {
+	got, err := detectCapabilities(stubMechanisms{
+		pkcs11.CKM_EC_KEY_PAIR_GEN: {MinKeySize: 384, MaxKeySize: 521, Flags: pkcs11.CKF_GENERATE_KEY_PAIR},
+		pkcs11.CKM_ECDSA_SHA256:    {MinKeySize: 256, MaxKeySize: 521, Flags: pkcs11.CKF_VERIFY},
+	}, 0)
+
+	require.NoError(t, err)
+	require.False(t, got.KeyGeneration)
+	require.False(t, got.Signing)
+	require.False(t, got.RawECDSA)
+	require.Equal(t, []string{
+		"key generation: CKM_EC_KEY_PAIR_GEN supports 384 to 521 bit keys, not 256 bit keys",
+		"signing: CKM_ECDSA_SHA256 does not have CKF_SIGN set",
+	}, got.Missing)
+}
+
+func TestDetectCapabilities_NoMechanisms(t *testing.T) {
+	got, err := detectCapabilities(stubMechanisms{}, 0)
+
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		"key generation: CKM_EC_KEY_PAIR_GEN is not supported",
+		"signing: CKM_ECDSA_SHA256 is not supported",
+	}, got.Missing)
+}
+
+func TestCapabilities_Log(t *testing.T) {
+	defer logging.SetDefault(logging.L())
+	var buf bytes.Buffer
+	logging.SetDefault(logging.New(&buf, hclog.Info))
+
+	Capabilities{KeyGeneration: true, Signing: true}.log()
+
+	var line map[string]interface{}
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &line))
+	require.Equal(t, "token capabilities", line["@message"])
+	require.Equal(t, true, line["generate"])
+	require.Equal(t, true, line["signing"])
+	require.Equal(t, false, line["rawECDSA"])
+}
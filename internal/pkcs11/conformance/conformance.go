@@ -0,0 +1,470 @@
+// Package conformance checks that a PKCS#11 module works with the plugin end to end, as is required before the module
+// of a new HSM vendor is approved.  Run checks each capability the plugin needs against any configured module and
+// reports whether it passed.  TestConformance runs the checks against SoftHSM, or against the module configured by
+// ConfigEnv at a vendor's site.
+package conformance
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"quorum-account-plugin-pkcs-11/internal/account/account"
+	"quorum-account-plugin-pkcs-11/internal/config"
+	"quorum-account-plugin-pkcs-11/internal/pkcs11"
+	"strings"
+	"sync"
+	"testing"
+	"text/tabwriter"
+	"time"
+
+	"github.com/jpmorganchase/quorum/crypto/secp256k1"
+	"golang.org/x/crypto/sha3"
+)
+
+const (
+	// ConfigEnv is the environment variable which, if set, is the path of the plugin config file whose library is
+	// checked by TestConformance rather than a new SoftHSM token
+	ConfigEnv = "PKCS11_CONFORMANCE_CONFIG"
+	// ReportEnv is the environment variable which, if set, is the path TestConformance writes its report to as JSON
+	ReportEnv = "PKCS11_CONFORMANCE_REPORT"
+)
+
+// The capabilities checked by Run, in the order they are checked.
+const (
+	KeyGeneration     = "key generation"
+	AddressDerivation = "address derivation"
+	KeyImport         = "key import"
+	Signing           = "signing"
+	RawECDSA          = "raw ECDSA signing"
+	Listing           = "listing"
+	ConcurrentSigning = "concurrent signing"
+	SessionRecovery   = "session recovery"
+	Cleanup           = "cleanup"
+)
+
+// Options configures Run.  Fields which are not set take their default value.
+type Options struct {
+	// Keys is the number of key pairs created to check listing, which must be more than are returned by a single
+	// C_FindObjects call.  The default is 150.
+	Keys int
+	// Signers is the number of goroutines which sign concurrently, and Signatures the number of signatures each makes.
+	// The defaults are 8 and 10.
+	Signers, Signatures int
+}
+
+func (o Options) withDefaults() Options {
+	if o.Keys == 0 {
+		o.Keys = 150
+	}
+	if o.Signers == 0 {
+		o.Signers = 8
+	}
+	if o.Signatures == 0 {
+		o.Signatures = 10
+	}
+	return o
+}
+
+// Status is the outcome of checking a capability.
+type Status string
+
+const (
+	Passed Status = "pass"
+	Failed Status = "fail"
+	// Skipped is the status of a check which needs a key that an earlier, failed, check should have created
+	Skipped Status = "skip"
+)
+
+// Result is the result of checking a capability.
+type Result struct {
+	Capability string `json:"capability"`
+	Status     Status `json:"status"`
+	// Detail explains why the check failed or was skipped
+	Detail   string        `json:"detail,omitempty"`
+	Duration time.Duration `json:"duration"`
+}
+
+// Report is the result of checking each capability of a module.
+type Report struct {
+	// Library describes the PKCS#11 library, and Token the token, as reported by C_GetInfo and C_GetTokenInfo
+	Library string `json:"library"`
+	Token   string `json:"token"`
+	// Profile is the profile of the library's quirks used by the plugin
+	Profile string   `json:"profile"`
+	Results []Result `json:"results"`
+}
+
+// Passed reports whether no check failed.
+func (r Report) Passed() bool {
+	for _, res := range r.Results {
+		if res.Status == Failed {
+			return false
+		}
+	}
+	return true
+}
+
+// WriteText writes r as a table with a line per capability.
+func (r Report) WriteText(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "library:\t%v\ntoken:\t%v\nprofile:\t%v\n\n", r.Library, r.Token, r.Profile)
+	fmt.Fprintln(tw, "CAPABILITY\tSTATUS\tDURATION\tDETAIL")
+	for _, res := range r.Results {
+		fmt.Fprintf(tw, "%v\t%v\t%v\t%v\n", res.Capability, res.Status, res.Duration.Round(time.Millisecond), res.Detail)
+	}
+	return tw.Flush()
+}
+
+// skipError is returned by a check which cannot be performed.
+type skipError string
+
+func (e skipError) Error() string {
+	return string(e)
+}
+
+// suite holds the state shared by the checks.
+type suite struct {
+	opts Options
+	c    pkcs11.Cryptoki
+	// admin is a second handle on the module, used by cleanup to destroy the keys the Cryptoki cannot
+	admin *pkcs11.TokenAdmin
+	// label is the CKA_LABEL of every key created by the checks, so that they can all be found and destroyed
+	label string
+	// key is the account used by the checks which sign, generated or else imported
+	key     account.Address
+	created []account.Address
+}
+
+// checks are the checks made by Run, in order.
+var checks = []struct {
+	capability string
+	check      func(s *suite, ctx context.Context) error
+}{
+	{KeyGeneration, (*suite).keyGeneration},
+	{AddressDerivation, (*suite).addressDerivation},
+	{KeyImport, (*suite).keyImport},
+	{Signing, (*suite).signing},
+	{RawECDSA, (*suite).rawECDSA},
+	{Listing, (*suite).listing},
+	{ConcurrentSigning, (*suite).concurrentSigning},
+	{SessionRecovery, (*suite).sessionRecovery},
+	{Cleanup, (*suite).cleanup},
+}
+
+// Run checks each capability of the module configured by l in turn, and finally destroys the keys created by the
+// checks.  It returns an error, and no report, only if the module cannot be loaded or a session opened on its token.
+func Run(ctx context.Context, l config.Pkcs11Library, opts Options) (Report, error) {
+	c, err := pkcs11.NewCryptoki(l)
+	if err != nil {
+		return Report{}, fmt.Errorf("unable to load PKCS#11 library: %w", err)
+	}
+	defer c.Finalize(ctx)
+	if err := c.OpenSession(ctx); err != nil {
+		return Report{}, fmt.Errorf("unable to open session: %w", err)
+	}
+	admin, err := pkcs11.NewLibraryTokenAdmin(l)
+	if err != nil {
+		return Report{}, err
+	}
+	defer admin.Close()
+
+	label := make([]byte, 8)
+	if _, err := rand.Read(label); err != nil {
+		return Report{}, err
+	}
+	s := &suite{
+		opts:  opts.withDefaults(),
+		c:     c,
+		admin: admin,
+		label: "conformance-" + hex.EncodeToString(label),
+	}
+
+	var report Report
+	if info, err := c.LibraryInfo(); err == nil {
+		report.Library = fmt.Sprintf("%v %v.%v (%v)", strings.TrimSpace(info.LibraryDescription), info.LibraryVersion.Major,
+			info.LibraryVersion.Minor, strings.TrimSpace(info.ManufacturerID))
+	}
+	if info, err := c.TokenInfo(); err == nil {
+		report.Token = fmt.Sprintf("%v %v firmware %v.%v (%v)", strings.TrimSpace(info.ManufacturerID), strings.TrimSpace(info.Model),
+			info.FirmwareVersion.Major, info.FirmwareVersion.Minor, strings.TrimSpace(info.Label))
+	}
+	report.Profile = c.Profile().Name
+
+	for _, ch := range checks {
+		start := time.Now()
+		err := ch.check(s, ctx)
+		res := Result{Capability: ch.capability, Status: Passed, Duration: time.Since(start)}
+		var skip skipError
+		switch {
+		case errors.As(err, &skip):
+			res.Status, res.Detail = Skipped, err.Error()
+		case err != nil:
+			res.Status, res.Detail = Failed, err.Error()
+		}
+		report.Results = append(report.Results, res)
+	}
+	return report, nil
+}
+
+// Test checks the module configured by l with Run, as a subtest of t per capability, and returns the report.
+func Test(t *testing.T, l config.Pkcs11Library, opts Options) Report {
+	t.Helper()
+	report, err := Run(context.Background(), l, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, res := range report.Results {
+		res := res
+		t.Run(res.Capability, func(t *testing.T) {
+			switch res.Status {
+			case Failed:
+				t.Error(res.Detail)
+			case Skipped:
+				t.Skip(res.Detail)
+			}
+		})
+	}
+	return report
+}
+
+func (s *suite) newAccount() config.NewAccount {
+	return config.NewAccount{SecretName: s.label}
+}
+
+func (s *suite) keyGeneration(ctx context.Context) error {
+	if caps := s.c.Capabilities(); !caps.KeyGeneration {
+		return fmt.Errorf("unsupported: %v", strings.Join(caps.Missing, "; "))
+	}
+	acct, err := s.c.NewAccount(ctx, s.newAccount())
+	if err != nil {
+		return err
+	}
+	s.key = acct.Address
+	s.created = append(s.created, acct.Address)
+	return nil
+}
+
+func (s *suite) addressDerivation(ctx context.Context) error {
+	if s.key == (account.Address{}) {
+		return skipError("no key was generated")
+	}
+	pub, err := s.c.PublicKey(ctx, s.key)
+	if err != nil {
+		return err
+	}
+	addr, err := account.PublicKeyToAddress(pub)
+	if err != nil {
+		return err
+	}
+	if addr != s.key {
+		return fmt.Errorf("account %v has public key with address %v", s.key.ToHexString(), addr.ToHexString())
+	}
+	return nil
+}
+
+func (s *suite) keyImport(ctx context.Context) error {
+	key, err := ecdsa.GenerateKey(secp256k1.S256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	want, err := account.PublicKeyToAddress(&key.PublicKey)
+	if err != nil {
+		return err
+	}
+	// ImportPrivateKey zeroes the key
+	acct, err := s.c.ImportPrivateKey(ctx, key, s.newAccount())
+	if err != nil {
+		return err
+	}
+	s.created = append(s.created, acct.Address)
+	if acct.Address != want {
+		return fmt.Errorf("imported key has account %v, not %v", acct.Address.ToHexString(), want.ToHexString())
+	}
+	if !s.c.Contains(ctx, want) {
+		return errors.New("imported key not found")
+	}
+	if s.key == (account.Address{}) {
+		s.key = want
+	}
+	return nil
+}
+
+func (s *suite) signing(ctx context.Context) error {
+	if s.key == (account.Address{}) {
+		return skipError("no key was generated or imported")
+	}
+	return s.sign(ctx, []byte("conformance"))
+}
+
+// sign signs msg with Cryptoki.Sign and verifies the signature.
+func (s *suite) sign(ctx context.Context, msg []byte) error {
+	sig, err := s.c.Sign(ctx, msg, s.key)
+	if err != nil {
+		return err
+	}
+	pub, err := s.c.PublicKey(ctx, s.key)
+	if err != nil {
+		return err
+	}
+	if len(sig) != 64 {
+		return fmt.Errorf("signature is %v bytes, not 64", len(sig))
+	}
+	hash := sha256.Sum256(msg)
+	if !ecdsa.Verify(pub, hash[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])) {
+		return errors.New("signature does not verify")
+	}
+	return nil
+}
+
+// rawECDSA signs a Keccak-256 hash computed outside the token with Cryptoki.SignHash, as Quorum signs transactions, and
+// checks that ecrecover recovers the account address from the signature.
+func (s *suite) rawECDSA(ctx context.Context) error {
+	if s.key == (account.Address{}) {
+		return skipError("no key was generated or imported")
+	}
+	if caps := s.c.Capabilities(); !caps.RawECDSA {
+		return errors.New("unsupported: CKM_ECDSA is not supported")
+	}
+	d := sha3.NewLegacyKeccak256()
+	d.Write([]byte("conformance"))
+	hash := d.Sum(nil)
+
+	sig, err := s.c.SignHash(ctx, hash, s.key)
+	if err != nil {
+		return err
+	}
+	recovered, err := secp256k1.RecoverPubkey(hash, sig)
+	if err != nil {
+		return fmt.Errorf("ecrecover: %w", err)
+	}
+	addr, err := account.PublicKeyBytesToAddress(recovered)
+	if err != nil {
+		return err
+	}
+	if addr != s.key {
+		return fmt.Errorf("ecrecover returned address %v, not %v", addr.ToHexString(), s.key.ToHexString())
+	}
+	return nil
+}
+
+func (s *suite) listing(ctx context.Context) error {
+	caps := s.c.Capabilities()
+	for i := 0; i < s.opts.Keys; i++ {
+		var (
+			acct account.Account
+			err  error
+		)
+		if caps.KeyGeneration {
+			acct, err = s.c.NewAccount(ctx, s.newAccount())
+		} else {
+			var key *ecdsa.PrivateKey
+			if key, err = ecdsa.GenerateKey(secp256k1.S256(), rand.Reader); err == nil {
+				acct, err = s.c.ImportPrivateKey(ctx, key, s.newAccount())
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("unable to create key %v of %v: %w", i+1, s.opts.Keys, err)
+		}
+		s.created = append(s.created, acct.Address)
+	}
+
+	accts, err := s.c.Accounts(ctx)
+	if err != nil {
+		return err
+	}
+	listed := make(map[account.Address]bool, len(accts))
+	for _, a := range accts {
+		listed[a.Address] = true
+	}
+	var missing int
+	for _, a := range s.created {
+		if !listed[a] {
+			missing++
+		}
+	}
+	if missing > 0 {
+		return fmt.Errorf("%v of %v accounts created are not listed, %v accounts listed", missing, len(s.created), len(accts))
+	}
+	return nil
+}
+
+func (s *suite) concurrentSigning(ctx context.Context) error {
+	if s.key == (account.Address{}) {
+		return skipError("no key was generated or imported")
+	}
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		errs []string
+	)
+	for i := 0; i < s.opts.Signers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < s.opts.Signatures; j++ {
+				if err := s.sign(ctx, []byte(fmt.Sprintf("conformance %v %v", i, j))); err != nil {
+					mu.Lock()
+					errs = append(errs, err.Error())
+					mu.Unlock()
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	if len(errs) > 0 {
+		return fmt.Errorf("%v of %v signers failed: %v", len(errs), s.opts.Signers, errs[0])
+	}
+	return nil
+}
+
+func (s *suite) sessionRecovery(ctx context.Context) error {
+	if err := s.c.CheckSession(ctx); err != nil {
+		return fmt.Errorf("session check failed before recovery: %w", err)
+	}
+	if err := s.c.RecoverSession(ctx); err != nil {
+		return err
+	}
+	if err := s.c.CheckSession(ctx); err != nil {
+		return fmt.Errorf("session check failed after recovery: %w", err)
+	}
+	if s.key != (account.Address{}) {
+		if err := s.sign(ctx, []byte("conformance")); err != nil {
+			return fmt.Errorf("unable to sign after recovery: %w", err)
+		}
+	}
+	return nil
+}
+
+// cleanup destroys every key created by the checks, including any created by a check which then failed, and checks
+// that their accounts are gone.
+func (s *suite) cleanup(ctx context.Context) error {
+	slot, _, err := s.c.SlotInfo()
+	if err != nil {
+		return err
+	}
+	if _, err := s.admin.DestroyObjects(slot, s.label); err != nil {
+		return fmt.Errorf("unable to destroy keys: %w", err)
+	}
+
+	accts, err := s.c.Accounts(ctx)
+	if err != nil {
+		return err
+	}
+	created := make(map[account.Address]bool, len(s.created))
+	for _, a := range s.created {
+		created[a] = true
+	}
+	for _, a := range accts {
+		if created[a.Address] {
+			return fmt.Errorf("account %v is still listed", a.Address.ToHexString())
+		}
+	}
+	return nil
+}
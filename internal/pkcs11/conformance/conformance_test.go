@@ -0,0 +1,49 @@
+package conformance
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"quorum-account-plugin-pkcs-11/internal/config"
+	"quorum-account-plugin-pkcs-11/internal/test/softhsm"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestConformance(t *testing.T) {
+	var l config.Pkcs11Library
+	if path, ok := os.LookupEnv(ConfigEnv); ok {
+		raw, err := os.ReadFile(path)
+		require.NoError(t, err)
+		conf, err := config.Parse(raw)
+		require.NoError(t, err)
+		l = conf.Library
+	} else {
+		l = softhsm.NewToken(t).Library
+	}
+
+	report := Test(t, l, Options{})
+
+	var text bytes.Buffer
+	require.NoError(t, report.WriteText(&text))
+	t.Log("\n" + text.String())
+	if path, ok := os.LookupEnv(ReportEnv); ok {
+		raw, err := json.MarshalIndent(report, "", "  ")
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(path, raw, 0644))
+	}
+}
+
+func TestReport_Passed(t *testing.T) {
+	r := Report{Results: []Result{{Capability: Signing, Status: Passed}, {Capability: RawECDSA, Status: Skipped}}}
+	require.True(t, r.Passed())
+
+	r.Results = append(r.Results, Result{Capability: Listing, Status: Failed, Detail: "1 of 151 accounts created are not listed"})
+	require.False(t, r.Passed())
+
+	var text bytes.Buffer
+	require.NoError(t, r.WriteText(&text))
+	require.Contains(t, text.String(), "listing")
+	require.Contains(t, text.String(), "1 of 151 accounts created are not listed")
+}
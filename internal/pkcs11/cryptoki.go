@@ -1,6 +1,7 @@
 package pkcs11
 
 import (
+	"context"
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"encoding/asn1"
@@ -10,7 +11,15 @@ import (
 	"os"
 	"quorum-account-plugin-pkcs-11/internal/account/account"
 	"quorum-account-plugin-pkcs-11/internal/config"
+	"quorum-account-plugin-pkcs-11/internal/logging"
+	"quorum-account-plugin-pkcs-11/internal/secure"
 	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
 )
 
 func NewCryptoki(config config.Pkcs11Library) (Cryptoki, error) {
@@ -18,84 +27,331 @@ func NewCryptoki(config config.Pkcs11Library) (Cryptoki, error) {
 		return nil, err
 	}
 
-	ctx := pkcs11.New(config.Path.Path)
-	err := ctx.Initialize()
+	ctx, err := loadModule(config)
+	if err != nil {
+		return nil, err
+	}
+	p, err := newCryptoki(config, ctx)
+	if err != nil {
+		unloadModule(config.Path.Path, ctx, ctx.Finalize)
+		return nil, err
+	}
+	return p, nil
+}
+
+// newCryptoki returns a Cryptoki using ctx, the loaded and initialized library config.
+func newCryptoki(config config.Pkcs11Library, ctx pkcs11API) (*pkcs11Wrapper, error) {
+	profile, err := selectProfile(ctx, config.Profile)
+	if err != nil {
+		return nil, err
+	}
+	logging.L().Info("using PKCS#11 module profile", "profile", profile.Name, "configured", config.Profile != "")
+
+	var configured *secure.Buffer
+	if config.SlotPin.IsSet() {
+		configured, err = config.SlotPin.GetSecret()
+	} else {
+		configured, err = secure.NewBuffer(0)
+	}
+	if err != nil {
+		return nil, err
+	}
+	configuredPIN, err := configured.Copy()
 	if err != nil {
+		configured.Destroy()
 		return nil, err
 	}
 
 	p := &pkcs11Wrapper{
-		Library: config,
-		Context: ctx,
+		Library:       config,
+		Context:       ctx,
+		profile:       profile,
+		token:         tokenStateFor(config),
+		slot:          -1,
+		configuredPIN: configuredPIN,
 	}
+	p.guard = &p.token.guard
+	if p.slotPIN, err = p.token.pin(configured); err != nil {
+		p.token.release()
+		configuredPIN.Destroy()
+		return nil, err
+	}
+	// Finalize must be called once the Cryptoki is no longer needed; the finalizer only prevents the library from being
+	// left initialized if it is not
 	runtime.SetFinalizer(p, func(a *pkcs11Wrapper) {
-		p.Context.Finalize()
-		p.Context.Destroy()
+		a.token.release()
+		a.slotPIN.Destroy()
+		a.configuredPIN.Destroy()
+		unloadModule(a.Library.Path.Path, a.Context, a.Context.Finalize)
 	})
 
 	return p, nil
 }
 
+// Cryptoki performs the plugin's operations on a PKCS#11 token.  The context passed to each operation carries the trace
+// its PKCS#11 calls are recorded in.
 type Cryptoki interface {
-	OpenSession() error
-	CloseSession() error
-	Accounts() ([]account.Account, error)
-	Contains(acctAddr account.Address) bool
-	Sign(toSign []byte, acctAddr account.Address) ([]byte, error)
-	NewAccount(conf config.NewAccount) (account.Account, error)
-	ImportPrivateKey(privateKeyECDSA *ecdsa.PrivateKey, conf config.NewAccount) (account.Account, error)
+	OpenSession(ctx context.Context) error
+	CloseSession(ctx context.Context) error
+	Accounts(ctx context.Context) ([]account.Account, error)
+	Contains(ctx context.Context, acctAddr account.Address) bool
+	Sign(ctx context.Context, toSign []byte, acctAddr account.Address) ([]byte, error)
+	// SignHash signs a 32 byte hash computed outside the token with CKM_ECDSA, returning the signature in the
+	// [R || S || V] form used by ecrecover.  It fails with ErrInvalidHash if hash is not 32 bytes, and with
+	// ErrUnsupported if the token does not support CKM_ECDSA.
+	SignHash(ctx context.Context, hash []byte, acctAddr account.Address) ([]byte, error)
+	NewAccount(ctx context.Context, conf config.NewAccount) (account.Account, error)
+	ImportPrivateKey(ctx context.Context, privateKeyECDSA *ecdsa.PrivateKey, conf config.NewAccount) (account.Account, error)
+	// RotatePIN changes the user PIN of the token to newPIN and uses it for all subsequent logins, including those of a
+	// Cryptoki rebuilt for the same token until its configured PIN changes.  The Cryptoki takes ownership of newPIN.
+	RotatePIN(ctx context.Context, newPIN *secure.Buffer) error
+	LoginState() LoginState
+	Sessions() SessionStats
+	// TokenInfo returns the C_GetTokenInfo information of the token the session is open on.
+	TokenInfo() (pkcs11.TokenInfo, error)
+	// SlotInfo returns the ID and C_GetSlotInfo information of the slot the session is open on.
+	SlotInfo() (uint, pkcs11.SlotInfo, error)
+	// LibraryInfo returns the C_GetInfo information of the PKCS#11 library.
+	LibraryInfo() (pkcs11.Info, error)
+	// CheckSession checks that the session opened by OpenSession is still usable and logged in.
+	CheckSession(ctx context.Context) error
+	// RecoverSession replaces the session opened by OpenSession with a new one, e.g. after CheckSession fails.
+	RecoverSession(ctx context.Context) error
+	// PublicKey returns the public key of the account.
+	PublicKey(ctx context.Context, acctAddr account.Address) (*ecdsa.PublicKey, error)
+	// KeyLabels returns the CKA_LABEL of the private key of each account on the token.
+	KeyLabels(ctx context.Context) (map[account.Address]string, error)
+	// WatchToken watches for the removal and re-insertion of the token, checking for it at least every interval, until
+	// the returned func is called.  While the token is removed operations fail with ErrTokenRemoved.  The session
+	// opened by OpenSession is closed when the token is removed and reopened when it is re-inserted, after which
+	// changed is called.
+	WatchToken(interval time.Duration, changed func(TokenEvent)) (stop func())
+	// Capabilities returns the capabilities of the token found when the session was last opened, or nil if a session
+	// has not been opened.
+	Capabilities() *Capabilities
+	// Profile returns the profile of the library's quirks, configured or detected when it was loaded.
+	Profile() *Profile
+	// Finalize waits for any operation in progress, logs out and closes the session, and finalizes and unloads the
+	// library.  Operations fail with ErrFinalized afterwards.  The func returned by WatchToken must be called first.
+	Finalize(ctx context.Context) error
 }
 
+// SessionStats describes the use of the Cryptoki's PKCS#11 sessions.
+type SessionStats struct {
+	Open  int `json:"open"`
+	InUse int `json:"inUse"`
+	// Waiting is the number of operations waiting for the session to be free
+	Waiting int `json:"waiting"`
+}
+
+// pkcs11API is the part of the PKCS#11 API used by pkcs11Wrapper.  It is implemented by *pkcs11.Ctx, and by
+// moduletest.Module in tests.
+type pkcs11API interface {
+	slotEventSource
+	mechanismSource
+	infoSource
+	objectFinder
+	GetSlotInfo(slotID uint) (pkcs11.SlotInfo, error)
+	OpenSession(slotID uint, flags uint) (pkcs11.SessionHandle, error)
+	CloseSession(sh pkcs11.SessionHandle) error
+	GetSessionInfo(sh pkcs11.SessionHandle) (pkcs11.SessionInfo, error)
+	Login(sh pkcs11.SessionHandle, userType uint, pin string) error
+	Logout(sh pkcs11.SessionHandle) error
+	SetPIN(sh pkcs11.SessionHandle, oldpin string, newpin string) error
+	GenerateKeyPair(sh pkcs11.SessionHandle, m []*pkcs11.Mechanism, public, private []*pkcs11.Attribute) (pkcs11.ObjectHandle, pkcs11.ObjectHandle, error)
+	CreateObject(sh pkcs11.SessionHandle, temp []*pkcs11.Attribute) (pkcs11.ObjectHandle, error)
+	DestroyObject(sh pkcs11.SessionHandle, oh pkcs11.ObjectHandle) error
+	GetAttributeValue(sh pkcs11.SessionHandle, o pkcs11.ObjectHandle, a []*pkcs11.Attribute) ([]*pkcs11.Attribute, error)
+	SetAttributeValue(sh pkcs11.SessionHandle, o pkcs11.ObjectHandle, a []*pkcs11.Attribute) error
+	FindObjectsInit(sh pkcs11.SessionHandle, temp []*pkcs11.Attribute) error
+	FindObjectsFinal(sh pkcs11.SessionHandle) error
+	SignInit(sh pkcs11.SessionHandle, m []*pkcs11.Mechanism, o pkcs11.ObjectHandle) error
+	Sign(sh pkcs11.SessionHandle, message []byte) ([]byte, error)
+	Finalize() error
+	// Destroy unloads the library
+	Destroy()
+}
+
+var _ pkcs11API = (*pkcs11.Ctx)(nil)
+
 type pkcs11Wrapper struct {
 	Library config.Pkcs11Library
-	Context *pkcs11.Ctx
+	Context pkcs11API
 	Session pkcs11.SessionHandle
+	// profile is the profile of the library, which is fixed once it is loaded
+	profile *Profile
+
+	// slotPIN is the user PIN used to login to the token.  It is the configured PIN, or the PIN set by a previous
+	// RotatePIN, and is then only changed by RotatePIN.  configuredPIN is a copy of the configured PIN.
+	slotPIN       *secure.Buffer
+	configuredPIN *secure.Buffer
+	// token is the state of the token kept when the Cryptoki is rebuilt
+	token *tokenState
+	// slot is the ID of the slot the session was opened on, or -1 before a session has been opened.  It is accessed
+	// atomically so that it can be read without waiting for the session.
+	slot int64
+	// mu serialises use of Session as PKCS#11 sessions must not be used concurrently
+	mu sync.Mutex
+	// guard is the login guard of the token, kept with its failed logins when the Cryptoki is rebuilt
+	guard *loginGuard
+	// active is set by OpenSession and cleared by CloseSession; RecoverSession only replaces an active session.  It is
+	// guarded by mu.
+	active bool
+	// removed is set while the token is removed from its slot.  It is guarded by mu.
+	removed bool
+	// caps is set each time a session is opened
+	caps atomic.Pointer[Capabilities]
+	// finalized is set by Finalize.  It is guarded by both mu and infoMu, so that it can be read by operations using
+	// the session and by those that do not wait for it, e.g. TokenInfo.
+	finalized bool
+	infoMu    sync.RWMutex
+
+	// open, inUse and waiting are accessed atomically and count sessions for SessionStats
+	open, inUse, waiting int32
 }
 
-func (p *pkcs11Wrapper) OpenSession() error {
-	slots, err := p.Context.GetSlotList(true)
-	if err != nil {
+// lock acquires exclusive use of the session and returns a func to release it.
+func (p *pkcs11Wrapper) lock() func() {
+	atomic.AddInt32(&p.waiting, 1)
+	p.mu.Lock()
+	atomic.AddInt32(&p.waiting, -1)
+	atomic.StoreInt32(&p.inUse, 1)
+	return func() {
+		atomic.StoreInt32(&p.inUse, 0)
+		p.mu.Unlock()
+	}
+}
+
+func (p *pkcs11Wrapper) OpenSession(ctx context.Context) (err error) {
+	ctx, span := tracer.Start(ctx, "Cryptoki.OpenSession")
+	defer endSpan(span, &err)
+	defer p.lock()()
+	defer p.annotate("OpenSession", &err)
+
+	if p.finalized {
+		return ErrFinalized
+	}
+	if err := p.openSession(ctx); err != nil {
 		return err
 	}
+	p.active = true
+	return nil
+}
 
-	for _, s := range slots {
-		info, err := p.Context.GetTokenInfo(s)
-		if err != nil || p.Library.SlotLabel.Get() != info.Label {
-			continue
-		}
+// openSession finds the token, opens a session on it and logs in.  p.mu must be held.
+func (p *pkcs11Wrapper) openSession(ctx context.Context) error {
+	if err := p.guard.check(p.slotPIN); err != nil {
+		return err
+	}
 
-		p.Session, err = p.Context.OpenSession(s, pkcs11.CKF_SERIAL_SESSION|pkcs11.CKF_RW_SESSION)
-		if err != nil {
-			return err
-		}
+	call := p.startCall(ctx, "C_GetSlotList")
+	slot, err := findSlot(p.Context, p.Library.SlotLabel.Get())
+	endSpan(call, &err)
+	if err != nil {
+		return err
+	}
+	atomic.StoreInt64(&p.slot, int64(slot))
+	call = p.startCall(ctx, "C_GetTokenInfo")
+	info, err := p.Context.GetTokenInfo(slot)
+	endSpan(call, &err)
+	if err != nil {
+		return err
+	}
+	if err := p.guard.checkTokenFlags(p.slotPIN, info.Flags); err != nil {
+		return err
 	}
 
-	var slotPIN = ""
-	if p.Library.SlotPin.IsSet() {
-		slotPIN = p.Library.SlotPin.Get()
+	call = p.startCall(ctx, "C_GetMechanismList")
+	caps, err := detectCapabilities(p.Context, slot)
+	endSpan(call, &err)
+	if err != nil {
+		return fmt.Errorf("unable to detect token capabilities: %w", err)
+	}
+	if caps.KeyGeneration && p.profile.ImmutableID {
+		caps.KeyGeneration = false
+		caps.Missing = append(caps.Missing, fmt.Sprintf("key generation: the %v profile does not allow the CKA_ID of a generated key pair to be set", p.profile.Name))
 	}
-	err = p.Context.Login(p.Session, pkcs11.CKU_USER, slotPIN)
+	if !caps.Signing {
+		caps.log()
+		return fmt.Errorf("%w: %v", ErrUnsupported, strings.Join(caps.Missing, "; "))
+	}
+
+	call = p.startCall(ctx, "C_OpenSession")
+	p.Session, err = p.Context.OpenSession(slot, pkcs11.CKF_SERIAL_SESSION|pkcs11.CKF_RW_SESSION)
+	endSpan(call, &err)
 	if err != nil {
 		return err
 	}
+
+	call = p.startCall(ctx, "C_Login")
+	err = p.Context.Login(p.Session, pkcs11.CKU_USER, p.slotPIN.UnsafeString())
+	endSpan(call, &err)
+	if err != nil && err != pkcs11.Error(pkcs11.CKR_USER_ALREADY_LOGGED_IN) {
+		p.Context.CloseSession(p.Session)
+		return p.guard.failed(p.slotPIN, err)
+	}
+
+	if caps.KeyGeneration {
+		if err := p.token.curveSupport(func() error { return p.probeCurve(ctx) }); err != nil {
+			caps.KeyGeneration = false
+			caps.Missing = append(caps.Missing, fmt.Sprintf("key generation: unable to generate a secp256k1 key pair: %v", err))
+		}
+	}
+	caps.log()
+	if !caps.KeyGeneration && p.Library.StrictCapabilities {
+		p.Context.Logout(p.Session)
+		p.Context.CloseSession(p.Session)
+		return fmt.Errorf("%w: %v", ErrUnsupported, strings.Join(caps.Missing, "; "))
+	}
+	p.caps.Store(&caps)
+
+	p.guard.succeeded()
+	p.removed = false
+	atomic.StoreInt32(&p.open, 1)
+	logging.L().Debug("opened session", "slot", slot, "slotLabel", p.Library.SlotLabel.Get())
 	return nil
 }
 
-func (p *pkcs11Wrapper) CloseSession() error {
-	err := p.Context.Logout(p.Session)
+func (p *pkcs11Wrapper) CloseSession(ctx context.Context) (err error) {
+	ctx, span := tracer.Start(ctx, "Cryptoki.CloseSession")
+	defer endSpan(span, &err)
+	defer p.lock()()
+	defer p.annotate("CloseSession", &err)
+
+	p.active = false
+	if p.removed || p.finalized {
+		// the session has already been closed
+		return nil
+	}
+	call := p.startCall(ctx, "C_Logout")
+	err = p.Context.Logout(p.Session)
+	endSpan(call, &err)
 	if err != nil {
 		return err
 	}
+	p.guard.loggedOut()
+	atomic.StoreInt32(&p.open, 0)
+	call = p.startCall(ctx, "C_CloseSession")
 	err = p.Context.CloseSession(p.Session)
+	endSpan(call, &err)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-func (p *pkcs11Wrapper) Accounts() ([]account.Account, error) {
+func (p *pkcs11Wrapper) Accounts(ctx context.Context) (_ []account.Account, err error) {
+	ctx, span := tracer.Start(ctx, "Cryptoki.Accounts")
+	defer endSpan(span, &err)
+	defer p.lock()()
+	defer p.annotate("Accounts", &err)
+
+	if err := p.usable(); err != nil {
+		return nil, err
+	}
+
 	var (
-		w, _  = p.findAllKeys()
+		w, _  = p.findAllKeys(ctx)
 		accts = make([]account.Account, 0, len(w))
 		acct  account.Account
 	)
@@ -103,13 +359,16 @@ func (p *pkcs11Wrapper) Accounts() ([]account.Account, error) {
 		idTemplate := []*pkcs11.Attribute{
 			pkcs11.NewAttribute(pkcs11.CKA_ID, nil),
 		}
+		call := p.startCall(ctx, "C_GetAttributeValue")
 		addrAttr, err := p.Context.GetAttributeValue(p.Session, acctHandle, idTemplate)
+		endSpan(call, &err)
 		if err != nil {
 			return []account.Account{}, err
 		}
-		addr, err := account.NewAddress(addrAttr[0].Value)
+		// keys not created by the plugin, whose CKA_ID is not the hex account address, are not accounts
+		addr, err := account.NewAddressFromHexString(string(addrAttr[0].Value))
 		if err != nil {
-			return []account.Account{}, err
+			continue
 		}
 		acct = account.Account{
 			Address: addr,
@@ -120,34 +379,64 @@ func (p *pkcs11Wrapper) Accounts() ([]account.Account, error) {
 	return accts, nil
 }
 
-func (p *pkcs11Wrapper) findAllKeys() ([]pkcs11.ObjectHandle, error) {
+func (p *pkcs11Wrapper) findAllKeys(ctx context.Context) ([]pkcs11.ObjectHandle, error) {
 	findTemplate := []*pkcs11.Attribute{
 		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PUBLIC_KEY),
 	}
-	err := p.Context.FindObjectsInit(p.Session, findTemplate)
-	if err != nil {
-		return nil, err
-	}
-	defer p.Context.FindObjectsFinal(p.Session)
-	keys, _, err := p.Context.FindObjects(p.Session, 100)
+	return p.findObjects(ctx, findTemplate, 0)
+}
+
+// findObjects returns up to max handles, or all handles if max is 0, of the objects matching template.
+func (p *pkcs11Wrapper) findObjects(ctx context.Context, template []*pkcs11.Attribute, max int) (_ []pkcs11.ObjectHandle, err error) {
+	call := p.startCall(ctx, "C_FindObjectsInit")
+	err = p.Context.FindObjectsInit(p.Session, template)
+	endSpan(call, &err)
 	if err != nil {
 		return nil, err
 	}
-	return keys, nil
+	defer func() {
+		call := p.startCall(ctx, "C_FindObjectsFinal")
+		err := p.Context.FindObjectsFinal(p.Session)
+		endSpan(call, &err)
+	}()
+
+	call = p.startCall(ctx, "C_FindObjects")
+	keys, err := findObjectHandles(p.Context, p.Session, max, p.profile.FindObjectsBatch)
+	endSpan(call, &err)
+	return keys, err
 }
 
-func (p *pkcs11Wrapper) Contains(acctAddr account.Address) bool {
-	_, err := p.findPrivateKey(acctAddr)
-	return err != nil
+func (p *pkcs11Wrapper) Contains(ctx context.Context, acctAddr account.Address) bool {
+	ctx, span := tracer.Start(ctx, "Cryptoki.Contains", trace.WithAttributes(attrAddress.String(acctAddr.ToHexString())))
+	defer span.End()
+	defer p.lock()()
+
+	if p.usable() != nil {
+		return false
+	}
+	_, err := p.findPrivateKey(ctx, acctAddr)
+	return err == nil
 }
 
-func (p *pkcs11Wrapper) NewAccount(conf config.NewAccount) (account.Account, error) {
+func (p *pkcs11Wrapper) NewAccount(ctx context.Context, conf config.NewAccount) (_ account.Account, err error) {
+	ctx, span := tracer.Start(ctx, "Cryptoki.NewAccount")
+	defer endSpan(span, &err)
+	defer p.lock()()
+	defer p.annotate("NewAccount", &err)
+
+	if err := p.usable(); err != nil {
+		return account.Account{}, err
+	}
+	if caps := p.caps.Load(); caps != nil && !caps.KeyGeneration {
+		return account.Account{}, fmt.Errorf("%w: %v", ErrUnsupported, strings.Join(caps.Missing, "; "))
+	}
+
 	marshaledOID, err := asn1.Marshal(asn1.ObjectIdentifier{1, 3, 132, 0, 10}) // secp256k1 oid
 	if err != nil {
 		return account.Account{}, err
 	}
 
-	publicKeyTemplate := []*pkcs11.Attribute{
+	publicKeyTemplate := p.profile.template(
 		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PUBLIC_KEY),
 		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_EC),
 		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
@@ -156,8 +445,8 @@ func (p *pkcs11Wrapper) NewAccount(conf config.NewAccount) (account.Account, err
 		pkcs11.NewAttribute(pkcs11.CKA_WRAP, false),
 		pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, marshaledOID),
 		pkcs11.NewAttribute(pkcs11.CKA_LABEL, conf.SecretName),
-	}
-	privateKeyTemplate := []*pkcs11.Attribute{
+	)
+	privateKeyTemplate := p.profile.template(
 		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PRIVATE_KEY),
 		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
 		pkcs11.NewAttribute(pkcs11.CKA_SIGN, true),
@@ -166,53 +455,116 @@ func (p *pkcs11Wrapper) NewAccount(conf config.NewAccount) (account.Account, err
 		pkcs11.NewAttribute(pkcs11.CKA_SENSITIVE, true),
 		pkcs11.NewAttribute(pkcs11.CKA_EXTRACTABLE, false),
 		pkcs11.NewAttribute(pkcs11.CKA_PRIVATE, true),
-	}
+	)
+	call := p.startCall(ctx, "C_GenerateKeyPair", attrMechanism.String("CKM_EC_KEY_PAIR_GEN"))
 	pubK, privK, err := p.Context.GenerateKeyPair(p.Session, []*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_EC_KEY_PAIR_GEN, nil)},
 		publicKeyTemplate,
 		privateKeyTemplate)
+	endSpan(call, &err)
 	if err != nil {
 		return account.Account{}, err
 	}
 
-	attr, err := p.Context.GetAttributeValue(p.Session, pubK, []*pkcs11.Attribute{pkcs11.NewAttribute(pkcs11.CKA_PUBLIC_KEY_INFO, nil)})
+	addr, err := p.setKeyPairID(ctx, pubK, privK)
 	if err != nil {
+		// a key pair without its CKA_ID is not an account, and would never be found again
+		p.destroyObjects(ctx, pubK, privK)
 		return account.Account{}, err
 	}
-	pubRaw := attr[0].Value
-	addr, err := account.PublicKeyBytesToAddress(pubRaw)
+
+	logging.L().Info("generated key pair", "label", conf.SecretName, "address", addr.ToHexString(), "slot", atomic.LoadInt64(&p.slot))
+	return account.Account{Address: addr}, nil
+}
+
+// setKeyPairID derives the account address from the public key pubK and sets it as the CKA_ID of both keys of the
+// pair.
+func (p *pkcs11Wrapper) setKeyPairID(ctx context.Context, pubK, privK pkcs11.ObjectHandle) (_ account.Address, err error) {
+	pub, err := p.readPublicKey(ctx, pubK)
 	if err != nil {
-		return account.Account{}, err
+		return account.Address{}, err
+	}
+	addr, err := account.PublicKeyToAddress(pub)
+	if err != nil {
+		return account.Address{}, err
 	}
 
 	keyPairIdUpdateTemplate := []*pkcs11.Attribute{
 		pkcs11.NewAttribute(pkcs11.CKA_ID, addr.ToHexString()),
 	}
-	err = p.Context.SetAttributeValue(p.Session, pubK, keyPairIdUpdateTemplate)
-	if err != nil {
-		return account.Account{}, err
-	}
-	err = p.Context.SetAttributeValue(p.Session, privK, keyPairIdUpdateTemplate)
-	if err != nil {
-		return account.Account{}, err
+	for _, k := range []pkcs11.ObjectHandle{pubK, privK} {
+		call := p.startCall(ctx, "C_SetAttributeValue")
+		err = p.Context.SetAttributeValue(p.Session, k, keyPairIdUpdateTemplate)
+		endSpan(call, &err)
+		if err != nil {
+			return account.Address{}, err
+		}
 	}
+	return addr, nil
+}
 
-	return account.Account{Address: addr}, nil
+// readPublicKey reads the public key pubK from the attribute given by the profile.  Modules which do not fill in
+// CKA_PUBLIC_KEY_INFO, which is optional for generated keys, have the key read from CKA_EC_POINT.
+func (p *pkcs11Wrapper) readPublicKey(ctx context.Context, pubK pkcs11.ObjectHandle) (*ecdsa.PublicKey, error) {
+	attrType := p.profile.publicKeyAttribute()
+	for {
+		call := p.startCall(ctx, "C_GetAttributeValue")
+		attr, err := p.Context.GetAttributeValue(p.Session, pubK, []*pkcs11.Attribute{pkcs11.NewAttribute(attrType, nil)})
+		endSpan(call, &err)
+		if err == nil && len(attr[0].Value) > 0 {
+			return publicKey(attr[0])
+		}
+		if attrType == pkcs11.CKA_EC_POINT {
+			if err == nil {
+				err = errors.New("CKA_EC_POINT of the public key is empty")
+			}
+			return nil, err
+		}
+		attrType = pkcs11.CKA_EC_POINT
+	}
 }
 
-func (p *pkcs11Wrapper) ImportPrivateKey(key *ecdsa.PrivateKey, conf config.NewAccount) (account.Account, error) {
+func (p *pkcs11Wrapper) ImportPrivateKey(ctx context.Context, key *ecdsa.PrivateKey, conf config.NewAccount) (_ account.Account, err error) {
 	defer zeroKey(key)
 
+	ctx, span := tracer.Start(ctx, "Cryptoki.ImportPrivateKey")
+	defer endSpan(span, &err)
+	defer p.lock()()
+	defer p.annotate("ImportPrivateKey", &err)
+
+	if err := p.usable(); err != nil {
+		return account.Account{}, err
+	}
+
 	marshaledOID, err := asn1.Marshal(asn1.ObjectIdentifier{1, 3, 132, 0, 10}) // secp256k1 oid
 	if err != nil {
 		return account.Account{}, err
 	}
 
+	// copy the private component into locked memory rather than using key.D.Bytes(), which would leave a copy on the heap
+	d, err := secure.NewBuffer(32)
+	if err != nil {
+		return account.Account{}, err
+	}
+	defer d.Destroy()
+	key.D.FillBytes(d.Bytes())
+
 	// pubkey import
 	ecPt := elliptic.Marshal(key.PublicKey.Curve, key.PublicKey.X, key.PublicKey.Y)
 	// Add DER encoding for the CKA_EC_POINT
 	ecPt = append([]byte{0x04, byte(len(ecPt))}, ecPt...)
 
-	keyTemplate := []*pkcs11.Attribute{
+	// the address of an imported key is known before it is created, so it is created with its CKA_ID on modules which
+	// do not allow it to be set afterwards
+	var id []*pkcs11.Attribute
+	if p.profile.ImmutableID {
+		addr, err := account.PublicKeyToAddress(&key.PublicKey)
+		if err != nil {
+			return account.Account{}, err
+		}
+		id = append(id, pkcs11.NewAttribute(pkcs11.CKA_ID, addr.ToHexString()))
+	}
+
+	keyTemplate := p.profile.template(append([]*pkcs11.Attribute{
 		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_EC),
 		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PUBLIC_KEY),
 		pkcs11.NewAttribute(pkcs11.CKA_PRIVATE, false),
@@ -222,16 +574,16 @@ func (p *pkcs11Wrapper) ImportPrivateKey(key *ecdsa.PrivateKey, conf config.NewA
 
 		pkcs11.NewAttribute(pkcs11.CKA_LABEL, conf.SecretName),
 		pkcs11.NewAttribute(pkcs11.CKA_EC_POINT, ecPt),
-	}
+	}, id...)...)
 
+	call := p.startCall(ctx, "C_CreateObject")
 	pubK, err := p.Context.CreateObject(p.Session, keyTemplate)
+	endSpan(call, &err)
 	if err != nil {
 		return account.Account{}, err
-	} else {
-		fmt.Printf("Object was imported with CKA_LABEL:%s", conf.SecretName)
 	}
 
-	keyTemplate = []*pkcs11.Attribute{
+	keyTemplate = p.profile.template(append([]*pkcs11.Attribute{
 		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_EC),
 		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PRIVATE_KEY),
 		pkcs11.NewAttribute(pkcs11.CKA_PRIVATE, true),
@@ -240,85 +592,529 @@ func (p *pkcs11Wrapper) ImportPrivateKey(key *ecdsa.PrivateKey, conf config.NewA
 		pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, marshaledOID),
 
 		pkcs11.NewAttribute(pkcs11.CKA_LABEL, conf.SecretName),
-		pkcs11.NewAttribute(pkcs11.CKR_ATTRIBUTE_SENSITIVE, false),
-		pkcs11.NewAttribute(pkcs11.CKA_EXTRACTABLE, true),
-		pkcs11.NewAttribute(pkcs11.CKA_VALUE, key.D.Bytes()),
-	}
+		pkcs11.NewAttribute(pkcs11.CKA_SENSITIVE, true),
+		pkcs11.NewAttribute(pkcs11.CKA_EXTRACTABLE, false),
+		pkcs11.NewAttribute(pkcs11.CKA_VALUE, d.Bytes()),
+	}, id...)...)
 
+	call = p.startCall(ctx, "C_CreateObject")
 	privK, err := p.Context.CreateObject(p.Session, keyTemplate)
+	endSpan(call, &err)
 	if err != nil {
+		p.destroyObjects(ctx, pubK)
 		return account.Account{}, err
-	} else {
-		fmt.Printf("Object was imported with CKA_LABEL:%s", conf.SecretName)
 	}
 
-	attr, err := p.Context.GetAttributeValue(p.Session, pubK, []*pkcs11.Attribute{pkcs11.NewAttribute(pkcs11.CKA_PUBLIC_KEY_INFO, nil)})
+	var addr account.Address
+	if p.profile.ImmutableID {
+		addr, err = account.PublicKeyToAddress(&key.PublicKey)
+	} else {
+		addr, err = p.setKeyPairID(ctx, pubK, privK)
+	}
 	if err != nil {
+		p.destroyObjects(ctx, pubK, privK)
 		return account.Account{}, err
 	}
-	pubRaw := attr[0].Value
-	addr, err := account.PublicKeyBytesToAddress(pubRaw)
+
+	logging.L().Info("imported key pair", "label", conf.SecretName, "address", addr.ToHexString(), "slot", atomic.LoadInt64(&p.slot))
+	return account.Account{Address: addr}, nil
+}
+
+func (p *pkcs11Wrapper) Sign(ctx context.Context, toSign []byte, acctAddr account.Address) (_ []byte, err error) {
+	ctx, span := tracer.Start(ctx, "Cryptoki.Sign", trace.WithAttributes(attrAddress.String(acctAddr.ToHexString())))
+	defer endSpan(span, &err)
+	defer p.lock()()
+	defer p.annotate("Sign", &err)
+
+	return p.sign(ctx, signMechanism, signMechanismName, toSign, acctAddr)
+}
+
+// SignHash signs hash, a Keccak-256 hash computed outside the token as Quorum signs transactions, with CKM_ECDSA.  The
+// signature is returned in the [R || S || V] form used by ecrecover, with the low S value Ethereum requires.
+func (p *pkcs11Wrapper) SignHash(ctx context.Context, hash []byte, acctAddr account.Address) (_ []byte, err error) {
+	ctx, span := tracer.Start(ctx, "Cryptoki.SignHash", trace.WithAttributes(attrAddress.String(acctAddr.ToHexString())))
+	defer endSpan(span, &err)
+	defer p.lock()()
+	defer p.annotate("SignHash", &err)
+
+	if len(hash) != hashSize {
+		return nil, fmt.Errorf("%w, not %v bytes", ErrInvalidHash, len(hash))
+	}
+	if caps := p.caps.Load(); caps != nil && !caps.RawECDSA {
+		return nil, fmt.Errorf("%w: CKM_ECDSA is not supported by the token", ErrUnsupported)
+	}
+	sig, err := p.sign(ctx, pkcs11.CKM_ECDSA, "CKM_ECDSA", hash, acctAddr)
 	if err != nil {
-		return account.Account{}, err
+		return nil, err
+	}
+	pub, err := p.publicKey(ctx, acctAddr)
+	if err != nil {
+		return nil, err
 	}
+	return recoverableSignature(sig, hash, pub)
+}
 
-	keyPairIdUpdateTemplate := []*pkcs11.Attribute{
-		pkcs11.NewAttribute(pkcs11.CKA_ID, addr.ToHexString()),
+// sign signs data with the private key of the account using mechanism, returning the signature as r || s.  p.mu must be
+// held.
+func (p *pkcs11Wrapper) sign(ctx context.Context, mechanism uint, mechanismName string, data []byte, acctAddr account.Address) ([]byte, error) {
+	if err := p.usable(); err != nil {
+		return nil, err
+	}
+
+	credential := credentialFrom(ctx)
+	if credential != nil && !p.profile.ContextSpecificLogin {
+		return nil, fmt.Errorf("%w: the %v profile does not support authenticating the use of a key with a credential", ErrUnsupported, p.profile.Name)
 	}
-	err = p.Context.SetAttributeValue(p.Session, pubK, keyPairIdUpdateTemplate)
+	key, err := p.findPrivateKey(ctx, acctAddr)
 	if err != nil {
-		return account.Account{}, err
+		return nil, err
 	}
-	err = p.Context.SetAttributeValue(p.Session, privK, keyPairIdUpdateTemplate)
+
+	attrMech := attrMechanism.String(mechanismName)
+	call := p.startCall(ctx, "C_SignInit", attrMech)
+	err = p.Context.SignInit(p.Session, []*pkcs11.Mechanism{pkcs11.NewMechanism(mechanism, nil)}, key)
+	endSpan(call, &err)
 	if err != nil {
-		return account.Account{}, err
+		return nil, err
+	}
+	if credential != nil {
+		if err := p.contextLogin(ctx, credential); err != nil {
+			// C_Sign ends the signing operation whether or not it succeeds, so that the session can be used again
+			p.Context.Sign(p.Session, data)
+			return nil, err
+		}
 	}
 
-	return account.Account{Address: addr}, nil
+	call = p.startCall(ctx, "C_Sign", attrMech)
+	sig, err := p.Context.Sign(p.Session, data)
+	endSpan(call, &err)
+	if err != nil {
+		return nil, err
+	}
+	return p.profile.signature(sig)
+}
+
+// RotatePIN changes the user PIN with C_SetPIN and confirms the new PIN by logging in again with it.  If the new PIN
+// cannot be confirmed the change is reverted and the session is logged back in with the old PIN.  The new PIN is kept
+// in memory for the token, and used in place of the configured PIN when the Cryptoki is rebuilt, until the configured
+// PIN changes.  It is not kept when the plugin restarts, so the PIN source must be updated before then.
+func (p *pkcs11Wrapper) RotatePIN(ctx context.Context, newPINBuf *secure.Buffer) (err error) {
+	ctx, span := tracer.Start(ctx, "Cryptoki.RotatePIN")
+	defer endSpan(span, &err)
+	defer p.lock()()
+	defer p.annotate("RotatePIN", &err)
+
+	if err := p.usable(); err != nil {
+		newPINBuf.Destroy()
+		return err
+	}
+	if newPINBuf.Len() == 0 {
+		newPINBuf.Destroy()
+		return errors.New("new PIN must be set")
+	}
+	var (
+		oldPIN = p.slotPIN.UnsafeString()
+		newPIN = newPINBuf.UnsafeString()
+	)
+
+	call := p.startCall(ctx, "C_SetPIN")
+	err = p.Context.SetPIN(p.Session, oldPIN, newPIN)
+	endSpan(call, &err)
+	if err != nil {
+		newPINBuf.Destroy()
+		return fmt.Errorf("unable to change PIN: %w", err)
+	}
+
+	// login state is shared by all of the application's sessions, so a fresh login is only a real check of the new
+	// PIN once the existing login has been dropped
+	call = p.startCall(ctx, "C_Logout")
+	err = p.Context.Logout(p.Session)
+	endSpan(call, &err)
+	if err != nil {
+		defer newPINBuf.Destroy()
+		return p.rollbackPIN(ctx, newPIN, oldPIN, fmt.Errorf("unable to logout to confirm new PIN: %w", err))
+	}
+	call = p.startCall(ctx, "C_Login")
+	err = p.Context.Login(p.Session, pkcs11.CKU_USER, newPIN)
+	endSpan(call, &err)
+	if err != nil {
+		defer newPINBuf.Destroy()
+		return p.rollbackPIN(ctx, newPIN, oldPIN, fmt.Errorf("unable to login with new PIN: %w", err))
+	}
+
+	p.slotPIN.Destroy()
+	p.slotPIN = newPINBuf
+	p.guard.succeeded()
+	if err := p.token.rotated(newPINBuf, p.configuredPIN); err != nil {
+		logging.L().Warn("unable to keep the rotated PIN for when the plugin is reconfigured", "error", err)
+	}
+	return nil
+}
+
+func (p *pkcs11Wrapper) LoginState() LoginState {
+	return p.guard.loginState()
+}
+
+func (p *pkcs11Wrapper) Sessions() SessionStats {
+	return SessionStats{
+		Open:    int(atomic.LoadInt32(&p.open)),
+		InUse:   int(atomic.LoadInt32(&p.inUse)),
+		Waiting: int(atomic.LoadInt32(&p.waiting)),
+	}
+}
+
+// TokenInfo does not use the session and so does not wait for it to be free.
+func (p *pkcs11Wrapper) TokenInfo() (pkcs11.TokenInfo, error) {
+	p.infoMu.RLock()
+	defer p.infoMu.RUnlock()
+	if p.finalized {
+		return pkcs11.TokenInfo{}, ErrFinalized
+	}
+
+	slot := atomic.LoadInt64(&p.slot)
+	if slot < 0 {
+		return pkcs11.TokenInfo{}, errNoSession
+	}
+	return p.Context.GetTokenInfo(uint(slot))
+}
+
+// SlotInfo does not use the session and so does not wait for it to be free.
+func (p *pkcs11Wrapper) SlotInfo() (uint, pkcs11.SlotInfo, error) {
+	p.infoMu.RLock()
+	defer p.infoMu.RUnlock()
+	if p.finalized {
+		return 0, pkcs11.SlotInfo{}, ErrFinalized
+	}
+
+	slot := atomic.LoadInt64(&p.slot)
+	if slot < 0 {
+		return 0, pkcs11.SlotInfo{}, errNoSession
+	}
+	info, err := p.Context.GetSlotInfo(uint(slot))
+	return uint(slot), info, err
+}
+
+func (p *pkcs11Wrapper) Capabilities() *Capabilities {
+	return p.caps.Load()
+}
+
+func (p *pkcs11Wrapper) Profile() *Profile {
+	return p.profile
+}
+
+func (p *pkcs11Wrapper) LibraryInfo() (pkcs11.Info, error) {
+	p.infoMu.RLock()
+	defer p.infoMu.RUnlock()
+	if p.finalized {
+		return pkcs11.Info{}, ErrFinalized
+	}
+	return p.Context.GetInfo()
+}
+
+func (p *pkcs11Wrapper) Finalize(ctx context.Context) (err error) {
+	ctx, span := tracer.Start(ctx, "Cryptoki.Finalize")
+	defer endSpan(span, &err)
+	defer p.lock()()
+	defer p.annotate("Finalize", &err)
+
+	if p.finalized {
+		return nil
+	}
+
+	// login state is shared by all of the process's sessions on the token, so while a Cryptoki built to replace this
+	// one uses the token the session is closed without logging out
+	shared := p.token.release()
+
+	// failing to logout or close the session must not prevent the library from being finalized, which closes all of
+	// its sessions anyway
+	if atomic.LoadInt32(&p.open) == 1 {
+		var logoutErr error
+		if !shared {
+			call := p.startCall(ctx, "C_Logout")
+			logoutErr = p.Context.Logout(p.Session)
+			endSpan(call, &logoutErr)
+		}
+		call := p.startCall(ctx, "C_CloseSession")
+		closeErr := p.Context.CloseSession(p.Session)
+		endSpan(call, &closeErr)
+		if logoutErr != nil || closeErr != nil {
+			logging.L().Warn("unable to close session cleanly", "logoutError", logoutErr, "closeError", closeErr)
+		}
+		if !shared {
+			p.guard.loggedOut()
+		}
+		atomic.StoreInt32(&p.open, 0)
+	}
+	p.active = false
+
+	p.infoMu.Lock()
+	defer p.infoMu.Unlock()
+	p.finalized = true
+	runtime.SetFinalizer(p, nil)
+	p.slotPIN.Destroy()
+	p.configuredPIN.Destroy()
+
+	err = unloadModule(p.Library.Path.Path, p.Context, func() (err error) {
+		call := p.startCall(ctx, "C_Finalize")
+		defer endSpan(call, &err)
+		return p.Context.Finalize()
+	})
+	logging.L().Info("finalized PKCS#11 library", "path", p.Library.Path.Path)
+	return err
+}
+
+func (p *pkcs11Wrapper) CheckSession(ctx context.Context) (err error) {
+	ctx, span := tracer.Start(ctx, "Cryptoki.CheckSession")
+	defer endSpan(span, &err)
+	defer p.lock()()
+	defer p.annotate("CheckSession", &err)
+
+	if !p.active {
+		return errNoSession
+	}
+	if err := p.usable(); err != nil {
+		return err
+	}
+
+	call := p.startCall(ctx, "C_GetSessionInfo")
+	info, err := p.Context.GetSessionInfo(p.Session)
+	endSpan(call, &err)
+	if err != nil {
+		return err
+	}
+	if info.State != pkcs11.CKS_RW_USER_FUNCTIONS && info.State != pkcs11.CKS_RO_USER_FUNCTIONS {
+		return fmt.Errorf("session is not logged in: state %v", info.State)
+	}
+
+	call = p.startCall(ctx, "C_GetTokenInfo")
+	_, err = p.Context.GetTokenInfo(info.SlotID)
+	endSpan(call, &err)
+	return err
 }
 
-func (p *pkcs11Wrapper) Sign(toSign []byte, acctAddr account.Address) ([]byte, error) {
-	key, err := p.findPrivateKey(acctAddr)
+func (p *pkcs11Wrapper) RecoverSession(ctx context.Context) (err error) {
+	ctx, span := tracer.Start(ctx, "Cryptoki.RecoverSession")
+	defer endSpan(span, &err)
+	defer p.lock()()
+	defer p.annotate("RecoverSession", &err)
+
+	if !p.active {
+		return errNoSession
+	}
+	if err := p.usable(); err != nil {
+		// the session is reopened by WatchToken when the token is re-inserted
+		return err
+	}
+
+	// the old session is most likely already invalid, e.g. because the token was removed, so failing to close it is
+	// expected
+	if atomic.LoadInt32(&p.open) == 1 {
+		call := p.startCall(ctx, "C_CloseSession")
+		closeErr := p.Context.CloseSession(p.Session)
+		endSpan(call, &closeErr)
+		p.guard.loggedOut()
+		atomic.StoreInt32(&p.open, 0)
+	}
+	return p.openSession(ctx)
+}
+
+func (p *pkcs11Wrapper) PublicKey(ctx context.Context, acctAddr account.Address) (_ *ecdsa.PublicKey, err error) {
+	ctx, span := tracer.Start(ctx, "Cryptoki.PublicKey", trace.WithAttributes(attrAddress.String(acctAddr.ToHexString())))
+	defer endSpan(span, &err)
+	defer p.lock()()
+	defer p.annotate("PublicKey", &err)
+
+	if err := p.usable(); err != nil {
+		return nil, err
+	}
+	return p.publicKey(ctx, acctAddr)
+}
+
+// publicKey reads the public key of the account from the token.  p.mu must be held.
+func (p *pkcs11Wrapper) publicKey(ctx context.Context, acctAddr account.Address) (*ecdsa.PublicKey, error) {
+	findTemplate := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_ID, acctAddr.ToHexString()),
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PUBLIC_KEY),
+	}
+	keys, err := p.findObjects(ctx, findTemplate, 1)
 	if err != nil {
 		return nil, err
+	} else if len(keys) == 0 {
+		return nil, ErrKeyNotFound
 	}
 
-	err = p.Context.SignInit(p.Session, []*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_ECDSA_SHA256, nil)}, key)
+	call := p.startCall(ctx, "C_GetAttributeValue")
+	attr, err := p.Context.GetAttributeValue(p.Session, keys[0], []*pkcs11.Attribute{pkcs11.NewAttribute(pkcs11.CKA_EC_POINT, nil)})
+	endSpan(call, &err)
 	if err != nil {
 		return nil, err
 	}
+	return account.ECPointToPublicKey(attr[0].Value)
+}
 
-	return p.Context.Sign(p.Session, toSign)
+func (p *pkcs11Wrapper) KeyLabels(ctx context.Context) (_ map[account.Address]string, err error) {
+	ctx, span := tracer.Start(ctx, "Cryptoki.KeyLabels")
+	defer endSpan(span, &err)
+	defer p.lock()()
+	defer p.annotate("KeyLabels", &err)
+
+	if err := p.usable(); err != nil {
+		return nil, err
+	}
+
+	keys, err := p.findObjects(ctx, []*pkcs11.Attribute{pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PRIVATE_KEY)}, 0)
+	if err != nil {
+		return nil, err
+	}
+	labels := make(map[account.Address]string, len(keys))
+	for _, k := range keys {
+		call := p.startCall(ctx, "C_GetAttributeValue")
+		attrs, err := p.Context.GetAttributeValue(p.Session, k, []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_ID, nil),
+			pkcs11.NewAttribute(pkcs11.CKA_LABEL, nil),
+		})
+		endSpan(call, &err)
+		if err != nil {
+			return nil, err
+		}
+		// keys not created by the plugin, whose CKA_ID is not the hex account address, are not accounts
+		addr, err := account.NewAddressFromHexString(string(attrs[0].Value))
+		if err != nil {
+			continue
+		}
+		labels[addr] = string(attrs[1].Value)
+	}
+	return labels, nil
 }
 
-func (p *pkcs11Wrapper) findPrivateKey(acctAddr account.Address) (pkcs11.ObjectHandle, error) {
+func (p *pkcs11Wrapper) WatchToken(interval time.Duration, changed func(TokenEvent)) func() {
+	w := newSlotWatcher(p.Context, moduleSlotEvents(p.Library), p.Library.SlotLabel.Get(), interval, func(present bool, slot uint) {
+		ev := TokenEvent{Present: present, Slot: slot}
+		if present {
+			ev.Err = p.tokenInserted(context.Background())
+		} else {
+			p.tokenRemoved(context.Background())
+		}
+		changed(ev)
+	})
+	w.start()
+	return w.shutdown
+}
+
+// tokenRemoved closes the session, which can no longer be used, and fails all operations until the token is
+// re-inserted.
+func (p *pkcs11Wrapper) tokenRemoved(ctx context.Context) {
+	ctx, span := tracer.Start(ctx, "Cryptoki.TokenRemoved")
+	defer span.End()
+	defer p.lock()()
+
+	if p.finalized {
+		return
+	}
+	p.removed = true
+	if atomic.LoadInt32(&p.open) == 1 {
+		// most libraries close all sessions on the token when it is removed, so failing to close it is expected
+		call := p.startCall(ctx, "C_CloseSession")
+		closeErr := p.Context.CloseSession(p.Session)
+		endSpan(call, &closeErr)
+		p.guard.loggedOut()
+		atomic.StoreInt32(&p.open, 0)
+	}
+}
+
+// tokenInserted reopens the session, and logs in again, if the session was open when the token was removed.
+func (p *pkcs11Wrapper) tokenInserted(ctx context.Context) (err error) {
+	ctx, span := tracer.Start(ctx, "Cryptoki.TokenInserted")
+	defer endSpan(span, &err)
+	defer p.lock()()
+	defer p.annotate("TokenInserted", &err)
+
+	if !p.removed || p.finalized {
+		// the session has already been reopened, e.g. by OpenSession, or is no longer needed
+		return nil
+	}
+	p.removed = false
+	if !p.active {
+		return nil
+	}
+	return p.openSession(ctx)
+}
+
+// rollbackPIN restores oldPIN after a failed rotation and logs the session back in with it.  cause is returned
+// annotated with the outcome of the rollback.
+func (p *pkcs11Wrapper) rollbackPIN(ctx context.Context, newPIN, oldPIN string, cause error) (err error) {
+	// C_SetPIN is permitted in both R/W public and R/W user sessions so the rollback does not depend on whether the
+	// logout succeeded
+	call := p.startCall(ctx, "C_SetPIN")
+	err = p.Context.SetPIN(p.Session, newPIN, oldPIN)
+	endSpan(call, &err)
+	if err != nil {
+		return fmt.Errorf("%w: rollback to old PIN failed: %v", cause, err)
+	}
+	call = p.startCall(ctx, "C_Login")
+	err = p.Context.Login(p.Session, pkcs11.CKU_USER, oldPIN)
+	if err == pkcs11.Error(pkcs11.CKR_USER_ALREADY_LOGGED_IN) {
+		err = nil
+	}
+	endSpan(call, &err)
+	if err != nil {
+		return fmt.Errorf("%w: PIN rolled back but unable to login with old PIN: %v", cause, err)
+	}
+	return fmt.Errorf("%w: PIN rolled back", cause)
+}
+
+// usable returns an error if the session cannot be used because the library has been finalized or the token removed.
+// p.mu must be held.
+func (p *pkcs11Wrapper) usable() error {
+	switch {
+	case p.finalized:
+		return ErrFinalized
+	case p.removed:
+		return ErrTokenRemoved
+	}
+	return nil
+}
+
+// annotate wraps a non-nil *err in an OperationError for op.
+func (p *pkcs11Wrapper) annotate(op string, err *error) {
+	if *err == nil {
+		return
+	}
+	*err = &OperationError{
+		Op:        op,
+		Slot:      int(atomic.LoadInt64(&p.slot)),
+		SlotLabel: p.Library.SlotLabel.Get(),
+		Err:       *err,
+	}
+}
+
+func (p *pkcs11Wrapper) findPrivateKey(ctx context.Context, acctAddr account.Address) (pkcs11.ObjectHandle, error) {
 	findTemplate := []*pkcs11.Attribute{
 		pkcs11.NewAttribute(pkcs11.CKA_ID, acctAddr.ToHexString()),
 		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PRIVATE_KEY),
 	}
-	err := p.Context.FindObjectsInit(p.Session, findTemplate)
-	if err != nil {
-		return 0, err
-	}
-	defer p.Context.FindObjectsFinal(p.Session)
-	keys, _, err := p.Context.FindObjects(p.Session, 1)
+	keys, err := p.findObjects(ctx, findTemplate, 1)
 	if err != nil {
 		return 0, err
 	} else if len(keys) == 0 {
-		return 0, errors.New("key not found")
+		return 0, ErrKeyNotFound
 	}
 	return keys[0], nil
 }
 
-func zeroKey(key *ecdsa.PrivateKey) {
-	b := key.D.Bits()
-	for i := range b {
-		b[i] = 0
+// destroyObjects destroys objects created by an operation which then failed.  Failing to destroy them is only logged,
+// so that the error of the operation is returned.
+func (p *pkcs11Wrapper) destroyObjects(ctx context.Context, objects ...pkcs11.ObjectHandle) {
+	for _, o := range objects {
+		call := p.startCall(ctx, "C_DestroyObject")
+		err := p.Context.DestroyObject(p.Session, o)
+		endSpan(call, &err)
+		if err != nil {
+			logging.L().Warn("unable to destroy object", "handle", o, "error", err)
+		}
 	}
 }
 
-func zero(byt []byte) {
-	for i := range byt {
-		byt[i] = 0
-	}
+func zeroKey(key *ecdsa.PrivateKey) {
+	secure.WipeBigInt(key.D)
 }
@@ -0,0 +1,454 @@
+package pkcs11
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/asn1"
+	"errors"
+	"math/big"
+	"net/url"
+	"quorum-account-plugin-pkcs-11/internal/account/account"
+	"quorum-account-plugin-pkcs-11/internal/config"
+	"quorum-account-plugin-pkcs-11/internal/pkcs11/moduletest"
+	"quorum-account-plugin-pkcs-11/internal/secure"
+	"testing"
+
+	"github.com/jpmorganchase/quorum/crypto/secp256k1"
+	"github.com/miekg/pkcs11"
+	"github.com/stretchr/testify/require"
+)
+
+// openSessionCalls are the calls made by OpenSession to a moduletest.Module, which supports key generation.
+var openSessionCalls = []string{
+	"C_GetSlotList", "C_GetTokenInfo", "C_GetTokenInfo",
+	"C_GetMechanismList", "C_GetMechanismInfo", "C_GetMechanismInfo", "C_GetMechanismInfo",
+	"C_OpenSession", "C_Login",
+	"C_GenerateKeyPair", "C_DestroyObject", "C_DestroyObject",
+}
+
+// reopenSessionCalls are the calls made when the session is reopened, e.g. by RecoverSession: the token was probed for
+// secp256k1 key generation when it was first opened.
+var reopenSessionCalls = openSessionCalls[:len(openSessionCalls)-3]
+
+func envVar(t *testing.T, name, value string) *config.EnvironmentVariable {
+	t.Setenv(name, value)
+	return &config.EnvironmentVariable{Scheme: "env", Host: name}
+}
+
+// newModuleCryptoki returns a Cryptoki using the profile profile and a moduletest.Module, which is returned with no
+// calls recorded.
+func newModuleCryptoki(t *testing.T, profile string) (*pkcs11Wrapper, *moduletest.Module) {
+	m := moduletest.New("test", "1234")
+	p, err := newCryptoki(config.Pkcs11Library{
+		Path:      &url.URL{Scheme: "file", Path: t.TempDir() + "/lib.so"},
+		SlotLabel: envVar(t, "TEST_SLOT_LABEL", "test"),
+		SlotPin:   envVar(t, "TEST_SLOT_PIN", "1234"),
+		Profile:   profile,
+	}, m)
+	require.NoError(t, err)
+	t.Cleanup(func() { p.Finalize(context.Background()) })
+	m.Reset()
+	return p, m
+}
+
+// openModuleCryptoki returns a Cryptoki as newModuleCryptoki, with its session open.
+func openModuleCryptoki(t *testing.T, profile string) (*pkcs11Wrapper, *moduletest.Module) {
+	p, m := newModuleCryptoki(t, profile)
+	require.NoError(t, p.OpenSession(context.Background()))
+	m.Reset()
+	return p, m
+}
+
+func TestCryptoki_OpenSession_Calls(t *testing.T) {
+	p, m := newModuleCryptoki(t, config.ProfileGeneric220)
+
+	require.NoError(t, p.OpenSession(context.Background()))
+
+	require.Equal(t, openSessionCalls, m.Fns())
+	login := m.Calls()[8]
+	require.Equal(t, uint(pkcs11.CKU_USER), login.UserType)
+	require.Equal(t, []*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_EC_KEY_PAIR_GEN, nil)}, m.Calls()[9].Mechanisms)
+	// the probe's key pair is destroyed
+	require.Empty(t, m.Objects())
+}
+
+func TestCryptoki_NewAccount_Calls(t *testing.T) {
+	p, m := openModuleCryptoki(t, config.ProfileGeneric220)
+
+	acct, err := p.NewAccount(context.Background(), config.NewAccount{SecretName: "validator-1"})
+
+	require.NoError(t, err)
+	require.Equal(t, []string{"C_GenerateKeyPair", "C_GetAttributeValue", "C_SetAttributeValue", "C_SetAttributeValue"}, m.Fns())
+	calls := m.Calls()
+	oid, err := asn1.Marshal(asn1.ObjectIdentifier{1, 3, 132, 0, 10})
+	require.NoError(t, err)
+	require.Equal(t, []*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_EC_KEY_PAIR_GEN, nil)}, calls[0].Mechanisms)
+	require.Equal(t, [][]*pkcs11.Attribute{
+		{
+			pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PUBLIC_KEY),
+			pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_EC),
+			pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+			pkcs11.NewAttribute(pkcs11.CKA_VERIFY, true),
+			pkcs11.NewAttribute(pkcs11.CKA_ENCRYPT, false),
+			pkcs11.NewAttribute(pkcs11.CKA_WRAP, false),
+			pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, oid),
+			pkcs11.NewAttribute(pkcs11.CKA_LABEL, "validator-1"),
+		},
+		{
+			pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PRIVATE_KEY),
+			pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+			pkcs11.NewAttribute(pkcs11.CKA_SIGN, true),
+			pkcs11.NewAttribute(pkcs11.CKA_DECRYPT, false),
+			pkcs11.NewAttribute(pkcs11.CKA_LABEL, "validator-1"),
+			pkcs11.NewAttribute(pkcs11.CKA_SENSITIVE, true),
+			pkcs11.NewAttribute(pkcs11.CKA_EXTRACTABLE, false),
+			pkcs11.NewAttribute(pkcs11.CKA_PRIVATE, true),
+		},
+	}, calls[0].Templates)
+	require.Equal(t, [][]*pkcs11.Attribute{{pkcs11.NewAttribute(pkcs11.CKA_EC_POINT, nil)}}, calls[1].Templates)
+
+	id := []*pkcs11.Attribute{pkcs11.NewAttribute(pkcs11.CKA_ID, acct.Address.ToHexString())}
+	objects := m.Objects()
+	require.Len(t, objects, 2)
+	for i, o := range objects {
+		require.Equal(t, o, calls[2+i].Object)
+		require.Equal(t, [][]*pkcs11.Attribute{id}, calls[2+i].Templates)
+	}
+}
+
+func TestCryptoki_NewAccount_SetAttributeValueFails(t *testing.T) {
+	tests := map[string][]moduletest.Result{
+		"public key":  {{Err: pkcs11.Error(pkcs11.CKR_ATTRIBUTE_READ_ONLY)}},
+		"private key": {{}, {Err: pkcs11.Error(pkcs11.CKR_ATTRIBUTE_READ_ONLY)}},
+	}
+	for name, results := range tests {
+		t.Run(name, func(t *testing.T) {
+			p, m := openModuleCryptoki(t, config.ProfileGeneric220)
+			m.Queue("C_SetAttributeValue", results...)
+
+			_, err := p.NewAccount(context.Background(), config.NewAccount{SecretName: "validator-1"})
+
+			require.True(t, errors.Is(err, pkcs11.Error(pkcs11.CKR_ATTRIBUTE_READ_ONLY)))
+			want := []string{"C_GenerateKeyPair", "C_GetAttributeValue"}
+			for range results {
+				want = append(want, "C_SetAttributeValue")
+			}
+			want = append(want, "C_DestroyObject", "C_DestroyObject")
+			require.Equal(t, want, m.Fns())
+			// the key pair, which has no account address, is not left on the token
+			require.Empty(t, m.Objects())
+		})
+	}
+}
+
+func TestCryptoki_NewAccount_GenerateKeyPairPartiallyFails(t *testing.T) {
+	p, m := openModuleCryptoki(t, config.ProfileGeneric220)
+	m.Queue("C_GenerateKeyPair", moduletest.Result{Err: pkcs11.Error(pkcs11.CKR_DEVICE_ERROR), Apply: true})
+
+	_, err := p.NewAccount(context.Background(), config.NewAccount{SecretName: "validator-1"})
+
+	require.True(t, errors.Is(err, pkcs11.Error(pkcs11.CKR_DEVICE_ERROR)))
+	require.Equal(t, []string{"C_GenerateKeyPair"}, m.Fns())
+	// the handles of the key pair are not returned, so it cannot be destroyed; it has no account address, so is not
+	// found as an account
+	require.Len(t, m.Objects(), 2)
+	accts, err := p.Accounts(context.Background())
+	require.NoError(t, err)
+	require.Empty(t, accts)
+}
+
+func TestCryptoki_ImportPrivateKey_Sensitive(t *testing.T) {
+	p, m := openModuleCryptoki(t, config.ProfileGeneric220)
+
+	_, err := p.ImportPrivateKey(context.Background(), testKey(t), config.NewAccount{SecretName: "validator-1"})
+	require.NoError(t, err)
+
+	// the imported private key cannot be read back from the token
+	calls := m.Calls()
+	require.Equal(t, "C_CreateObject", calls[1].Fn)
+	require.Contains(t, calls[1].Templates[0], pkcs11.NewAttribute(pkcs11.CKA_SENSITIVE, true))
+	require.Contains(t, calls[1].Templates[0], pkcs11.NewAttribute(pkcs11.CKA_EXTRACTABLE, false))
+}
+
+func TestCryptoki_ImportPrivateKey_CreateObjectFails(t *testing.T) {
+	p, m := openModuleCryptoki(t, config.ProfileGeneric220)
+	m.Queue("C_CreateObject", moduletest.Result{}, moduletest.Result{Err: pkcs11.Error(pkcs11.CKR_TEMPLATE_INCONSISTENT)})
+
+	_, err := p.ImportPrivateKey(context.Background(), testKey(t), config.NewAccount{SecretName: "validator-1"})
+
+	require.True(t, errors.Is(err, pkcs11.Error(pkcs11.CKR_TEMPLATE_INCONSISTENT)))
+	require.Equal(t, []string{"C_CreateObject", "C_CreateObject", "C_DestroyObject"}, m.Fns())
+	require.Empty(t, m.Objects())
+}
+
+func TestCryptoki_Sign_Calls(t *testing.T) {
+	p, m := openModuleCryptoki(t, config.ProfileGeneric220)
+	key := testKey(t)
+	_, priv := m.AddKey(key, "validator-1")
+	addr, err := account.PublicKeyToAddress(&key.PublicKey)
+	require.NoError(t, err)
+
+	sig, err := p.Sign(context.Background(), []byte("msg"), addr)
+
+	require.NoError(t, err)
+	require.Equal(t, []string{"C_FindObjectsInit", "C_FindObjects", "C_FindObjectsFinal", "C_SignInit", "C_Sign"}, m.Fns())
+	calls := m.Calls()
+	require.Equal(t, [][]*pkcs11.Attribute{{
+		pkcs11.NewAttribute(pkcs11.CKA_ID, addr.ToHexString()),
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PRIVATE_KEY),
+	}}, calls[0].Templates)
+	require.Equal(t, 1, calls[1].Max)
+	require.Equal(t, priv, calls[3].Object)
+	require.Equal(t, []*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_ECDSA_SHA256, nil)}, calls[3].Mechanisms)
+
+	hash := sha256.Sum256([]byte("msg"))
+	require.True(t, ecdsa.Verify(&key.PublicKey, hash[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])))
+}
+
+func TestCryptoki_SignHash(t *testing.T) {
+	p, m := openModuleCryptoki(t, config.ProfileGeneric220)
+	key := testKey(t)
+	m.AddKey(key, "validator-1")
+	addr, err := account.PublicKeyToAddress(&key.PublicKey)
+	require.NoError(t, err)
+	hash := make([]byte, hashSize)
+	_, err = rand.Read(hash)
+	require.NoError(t, err)
+
+	sig, err := p.SignHash(context.Background(), hash, addr)
+
+	require.NoError(t, err)
+	require.Equal(t, []*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_ECDSA, nil)}, m.Calls()[3].Mechanisms)
+	recovered, err := secp256k1.RecoverPubkey(hash, sig)
+	require.NoError(t, err)
+	got, err := account.PublicKeyBytesToAddress(recovered)
+	require.NoError(t, err)
+	require.Equal(t, addr, got)
+
+	_, err = p.SignHash(context.Background(), hash[1:], addr)
+	require.Error(t, err)
+}
+
+func TestCryptoki_SignHash_Unsupported(t *testing.T) {
+	p, m := newModuleCryptoki(t, config.ProfileGeneric220)
+	delete(m.Mechanisms, pkcs11.CKM_ECDSA)
+	require.NoError(t, p.OpenSession(context.Background()))
+	key := testKey(t)
+	m.AddKey(key, "validator-1")
+	addr, err := account.PublicKeyToAddress(&key.PublicKey)
+	require.NoError(t, err)
+
+	_, err = p.SignHash(context.Background(), make([]byte, hashSize), addr)
+
+	require.ErrorIs(t, err, ErrUnsupported)
+}
+
+func TestCryptoki_SessionHandleInvalid(t *testing.T) {
+	ctx := context.Background()
+	p, m := openModuleCryptoki(t, config.ProfileGeneric220)
+	key := testKey(t)
+	m.AddKey(key, "validator-1")
+	addr, err := account.PublicKeyToAddress(&key.PublicKey)
+	require.NoError(t, err)
+	m.CloseAllSessions()
+
+	_, err = p.Sign(ctx, []byte("msg"), addr)
+	require.True(t, errors.Is(err, pkcs11.Error(pkcs11.CKR_SESSION_HANDLE_INVALID)))
+	require.Equal(t, []string{"C_FindObjectsInit"}, m.Fns())
+
+	m.Reset()
+	err = p.CheckSession(ctx)
+	require.True(t, errors.Is(err, pkcs11.Error(pkcs11.CKR_SESSION_HANDLE_INVALID)))
+	require.Equal(t, []string{"C_GetSessionInfo"}, m.Fns())
+
+	// closing the invalid session fails, but a new session is opened regardless
+	m.Reset()
+	require.NoError(t, p.RecoverSession(ctx))
+	require.Equal(t, append([]string{"C_CloseSession"}, reopenSessionCalls...), m.Fns())
+	require.True(t, p.Capabilities().KeyGeneration)
+
+	_, err = p.Sign(ctx, []byte("msg"), addr)
+	require.NoError(t, err)
+}
+
+func TestCryptoki_Accounts_FindObjectsPaging(t *testing.T) {
+	tests := map[string]struct {
+		profile   string
+		keys      int
+		wantMax   []int
+		wantAccts int
+	}{
+		"one call":      {profile: config.ProfileGeneric220, keys: 70, wantMax: []int{100}, wantAccts: 70},
+		"batches":       {profile: config.ProfileCloudHSM, keys: 70, wantMax: []int{32, 32, 32}, wantAccts: 70},
+		"more than 100": {profile: config.ProfileGeneric220, keys: 120, wantMax: []int{100, 100}, wantAccts: 120},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			p, m := openModuleCryptoki(t, tt.profile)
+			for i := 0; i < tt.keys; i++ {
+				key, err := ecdsa.GenerateKey(secp256k1.S256(), rand.Reader)
+				require.NoError(t, err)
+				m.AddKey(key, "")
+			}
+
+			accts, err := p.Accounts(context.Background())
+
+			require.NoError(t, err)
+			require.Len(t, accts, tt.wantAccts)
+			var gotMax []int
+			for _, c := range m.Calls() {
+				if c.Fn == "C_FindObjects" {
+					gotMax = append(gotMax, c.Max)
+				}
+			}
+			require.Equal(t, tt.wantMax, gotMax)
+			require.Equal(t, "C_FindObjectsFinal", m.Fns()[len(tt.wantMax)+1])
+		})
+	}
+}
+
+func TestCryptoki_Accounts_ObjectHandleInvalid(t *testing.T) {
+	p, m := openModuleCryptoki(t, config.ProfileGeneric220)
+	m.Queue("C_FindObjects", moduletest.Result{Handles: []pkcs11.ObjectHandle{999}})
+
+	_, err := p.Accounts(context.Background())
+
+	require.True(t, errors.Is(err, pkcs11.Error(pkcs11.CKR_OBJECT_HANDLE_INVALID)))
+	require.Equal(t, []string{"C_FindObjectsInit", "C_FindObjects", "C_FindObjectsFinal", "C_GetAttributeValue"}, m.Fns())
+	require.Equal(t, pkcs11.ObjectHandle(999), m.Calls()[3].Object)
+}
+
+func TestCryptoki_Accounts_ForeignKeys(t *testing.T) {
+	p, m := openModuleCryptoki(t, config.ProfileGeneric220)
+	key, err := ecdsa.GenerateKey(secp256k1.S256(), rand.Reader)
+	require.NoError(t, err)
+	m.AddKey(key, "validator-1")
+	addr, err := account.PublicKeyToAddress(&key.PublicKey)
+	require.NoError(t, err)
+	// a key pair not created by the plugin, whose CKA_ID is not a hex address
+	foreign, err := ecdsa.GenerateKey(secp256k1.S256(), rand.Reader)
+	require.NoError(t, err)
+	pub, priv := m.AddKey(foreign, "other")
+	for _, o := range []pkcs11.ObjectHandle{pub, priv} {
+		require.NoError(t, m.SetAttributeValue(p.Session, o, []*pkcs11.Attribute{pkcs11.NewAttribute(pkcs11.CKA_ID, []byte{1, 2, 3})}))
+	}
+
+	accts, err := p.Accounts(context.Background())
+
+	require.NoError(t, err)
+	require.Len(t, accts, 1)
+	require.Equal(t, addr, accts[0].Address)
+}
+
+func TestCryptoki_Contains(t *testing.T) {
+	ctx := context.Background()
+	p, m := openModuleCryptoki(t, config.ProfileGeneric220)
+	key, err := ecdsa.GenerateKey(secp256k1.S256(), rand.Reader)
+	require.NoError(t, err)
+	m.AddKey(key, "validator-1")
+	addr, err := account.PublicKeyToAddress(&key.PublicKey)
+	require.NoError(t, err)
+
+	require.True(t, p.Contains(ctx, addr))
+	require.False(t, p.Contains(ctx, account.Address{1}))
+}
+
+func TestCryptoki_RotatePIN_Rebuild(t *testing.T) {
+	ctx := context.Background()
+	m := moduletest.New("test", "1234")
+	l := config.Pkcs11Library{
+		Path:      &url.URL{Scheme: "file", Path: t.TempDir() + "/lib.so"},
+		SlotLabel: envVar(t, "TEST_SLOT_LABEL", "test"),
+		SlotPin:   envVar(t, "TEST_SLOT_PIN", "1234"),
+		Profile:   config.ProfileGeneric220,
+	}
+	// open returns a new Cryptoki for the token, as the plugin builds when it is reconfigured, with its session open
+	open := func() (*pkcs11Wrapper, error) {
+		p, err := newCryptoki(l, m)
+		require.NoError(t, err)
+		t.Cleanup(func() { p.Finalize(ctx) })
+		return p, p.OpenSession(ctx)
+	}
+
+	p, err := open()
+	require.NoError(t, err)
+	newPIN, err := secure.FromString("5678")
+	require.NoError(t, err)
+	require.NoError(t, p.RotatePIN(ctx, newPIN))
+	require.NoError(t, p.Finalize(ctx))
+
+	// the rotated PIN is used rather than the configured PIN, which is no longer the token's PIN
+	p, err = open()
+	require.NoError(t, err)
+	require.NoError(t, p.Finalize(ctx))
+
+	// once the operator updates the PIN source the configured PIN is used again
+	t.Setenv("TEST_SLOT_PIN", "5678")
+	p, err = open()
+	require.NoError(t, err)
+	require.NoError(t, p.Finalize(ctx))
+	t.Setenv("TEST_SLOT_PIN", "1234")
+	_, err = open()
+	require.True(t, errors.Is(err, pkcs11.Error(pkcs11.CKR_PIN_INCORRECT)), "%v", err)
+}
+
+func TestCryptoki_Finalize_SharedToken(t *testing.T) {
+	ctx := context.Background()
+	m := moduletest.New("test", "1234")
+	l := config.Pkcs11Library{
+		Path:      &url.URL{Scheme: "file", Path: t.TempDir() + "/lib.so"},
+		SlotLabel: envVar(t, "TEST_SLOT_LABEL", "test"),
+		SlotPin:   envVar(t, "TEST_SLOT_PIN", "1234"),
+		Profile:   config.ProfileGeneric220,
+	}
+	old, err := newCryptoki(l, m)
+	require.NoError(t, err)
+	require.NoError(t, old.OpenSession(ctx))
+	// the Cryptoki replacing it while the plugin is reconfigured
+	rebuilt, err := newCryptoki(l, m)
+	require.NoError(t, err)
+	require.NoError(t, rebuilt.OpenSession(ctx))
+
+	m.Reset()
+	require.NoError(t, old.Finalize(ctx))
+	require.NotContains(t, m.Fns(), "C_Logout")
+	require.True(t, rebuilt.LoginState().LoggedIn)
+	require.NoError(t, rebuilt.CheckSession(ctx))
+
+	require.NoError(t, rebuilt.Finalize(ctx))
+	require.Contains(t, m.Fns(), "C_Logout")
+	require.False(t, rebuilt.LoginState().LoggedIn)
+}
+
+func TestCryptoki_LoginGuard_Rebuild(t *testing.T) {
+	ctx := context.Background()
+	m := moduletest.New("test", "1234")
+	l := config.Pkcs11Library{
+		Path:      &url.URL{Scheme: "file", Path: t.TempDir() + "/lib.so"},
+		SlotLabel: envVar(t, "TEST_SLOT_LABEL", "test"),
+		SlotPin:   envVar(t, "TEST_SLOT_PIN", "0000"),
+		Profile:   config.ProfileGeneric220,
+	}
+	open := func() error {
+		p, err := newCryptoki(l, m)
+		require.NoError(t, err)
+		defer p.Finalize(ctx)
+		m.Reset()
+		return p.OpenSession(ctx)
+	}
+
+	err := open()
+	require.True(t, errors.Is(err, pkcs11.Error(pkcs11.CKR_PIN_INCORRECT)), "%v", err)
+
+	// a rebuilt Cryptoki with the same PIN does not retry it
+	err = open()
+	require.True(t, errors.Is(err, ErrLoginBlocked), "%v", err)
+	require.NotContains(t, m.Fns(), "C_Login")
+
+	// changing the configured PIN unblocks the login
+	t.Setenv("TEST_SLOT_PIN", "1234")
+	require.NoError(t, open())
+	require.Contains(t, m.Fns(), "C_Login")
+}
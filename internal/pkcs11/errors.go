@@ -0,0 +1,57 @@
+package pkcs11
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/miekg/pkcs11"
+)
+
+var (
+	ErrAccountNotFound = errors.New("account does not exist")
+	ErrAccountLocked   = errors.New("account locked")
+	ErrKeyNotFound     = errors.New("key not found")
+	ErrTokenNotFound   = errors.New("no token with the configured label found")
+	// ErrTokenRemoved is returned while the token is removed from its slot.  It wraps ErrTokenNotFound.
+	ErrTokenRemoved = fmt.Errorf("%w: the token has been removed", ErrTokenNotFound)
+	// ErrFinalized is returned after the Cryptoki has been finalized, e.g. while the plugin is being reconfigured
+	ErrFinalized = errors.New("the PKCS#11 library has been finalized")
+	// ErrUnsupported is returned when the token lacks a mechanism needed by an operation, see Capabilities
+	ErrUnsupported = errors.New("not supported by the token")
+	// ErrUnlockUnresolved is returned when an unlock entry that is not optional selects no account on the token
+	ErrUnlockUnresolved = errors.New("unlock entry selects no account")
+	// ErrInvalidHash is returned when the data to sign is not a 32 byte hash, as Quorum signs transactions
+	ErrInvalidHash = errors.New("the data to sign must be a 32 byte hash")
+
+	errNoSession = errors.New("no session has been opened")
+)
+
+// OperationError records the Cryptoki operation and slot in which an error occurred.  Its message is that of the
+// underlying error.
+type OperationError struct {
+	Op string
+	// Slot is the ID of the slot in use, or -1 if a slot had not been found when the error occurred
+	Slot      int
+	SlotLabel string
+	Err       error
+}
+
+func (e *OperationError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *OperationError) Unwrap() error {
+	return e.Err
+}
+
+// CKRName returns the CKR_ name of a PKCS#11 return value, e.g. CKR_PIN_INCORRECT.  Values without a name, such as
+// vendor defined values, are returned in hex, e.g. CKR_0x80000001.
+func CKRName(e pkcs11.Error) string {
+	// pkcs11.Error does not expose its name, only a message of the form "pkcs11: 0x000000A0: CKR_PIN_INCORRECT"
+	msg := e.Error()
+	if i := strings.LastIndex(msg, ": "); i >= 0 && strings.HasPrefix(msg[i+2:], "CKR_") {
+		return msg[i+2:]
+	}
+	return fmt.Sprintf("CKR_0x%08X", uint(e))
+}
@@ -0,0 +1,16 @@
+package pkcs11
+
+import (
+	"testing"
+
+	"github.com/miekg/pkcs11"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCKRName(t *testing.T) {
+	require.Equal(t, "CKR_PIN_INCORRECT", CKRName(pkcs11.CKR_PIN_INCORRECT))
+}
+
+func TestCKRName_Unknown(t *testing.T) {
+	require.Equal(t, "CKR_0x8FFFFFFF", CKRName(pkcs11.Error(0x8FFFFFFF)))
+}
@@ -0,0 +1,197 @@
+package pkcs11
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"quorum-account-plugin-pkcs-11/internal/account/account"
+	"quorum-account-plugin-pkcs-11/internal/config"
+	"quorum-account-plugin-pkcs-11/internal/logging"
+	"sync"
+	"time"
+
+	"github.com/jpmorganchase/quorum/crypto/secp256k1"
+)
+
+type HealthState string
+
+const (
+	// HealthUnknown is reported until the first check, and while no session is open
+	HealthUnknown HealthState = "unknown"
+	HealthHealthy HealthState = "healthy"
+	// HealthDegraded is reported after a failed check, e.g. if the session had to be recovered or the canary signature
+	// failed
+	HealthDegraded HealthState = "degraded"
+	// HealthDown is reported after downAfter consecutive failed checks, or if the session could not be recovered
+	HealthDown HealthState = "down"
+)
+
+// downAfter is the number of consecutive failed checks after which the token is considered down.
+const downAfter = 3
+
+// Health is the outcome of the background health checks of the token.
+type Health struct {
+	State HealthState `json:"state"`
+	// Since is when the token entered State
+	Since       *time.Time `json:"since,omitempty"`
+	LastCheck   *time.Time `json:"lastCheck,omitempty"`
+	LastSuccess *time.Time `json:"lastSuccess,omitempty"`
+	Failures    int        `json:"consecutiveFailures"`
+	LastError   string     `json:"lastError,omitempty"`
+}
+
+// healthMonitor periodically checks that the session is usable and, if a canary account is configured, that the token
+// can sign with it.  A failed session check triggers recovery of the session so that it is replaced before a real
+// request needs it.
+type healthMonitor struct {
+	wrapper  Cryptoki
+	interval time.Duration
+	canary   *account.Address
+
+	mu     sync.Mutex
+	health Health
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func newHealthMonitor(wrapper Cryptoki, conf config.HealthCheck) (*healthMonitor, error) {
+	m := &healthMonitor{
+		wrapper:  wrapper,
+		interval: conf.Interval,
+		health:   Health{State: HealthUnknown},
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	if conf.CanaryAccount != "" {
+		canary, err := account.NewAddressFromHexString(conf.CanaryAccount)
+		if err != nil {
+			return nil, err
+		}
+		m.canary = &canary
+	}
+	return m, nil
+}
+
+func (m *healthMonitor) start() {
+	go func() {
+		defer close(m.done)
+
+		t := time.NewTicker(m.interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-m.stop:
+				return
+			case <-t.C:
+				m.check(context.Background())
+			}
+		}
+	}()
+}
+
+// shutdown stops the checks, waiting for any check in progress to finish.
+func (m *healthMonitor) shutdown() {
+	close(m.stop)
+	<-m.done
+}
+
+func (m *healthMonitor) check(ctx context.Context) {
+	ctx, span := tracer.Start(ctx, "HealthMonitor.Check")
+	var err error
+	defer endSpan(span, &err)
+
+	err = m.wrapper.CheckSession(ctx)
+	switch {
+	case errors.Is(err, errNoSession):
+		m.record(HealthUnknown, err)
+		return
+	case err != nil:
+		logging.L().Warn("health check failed, recovering session", "error", err)
+		if rErr := m.wrapper.RecoverSession(ctx); rErr != nil {
+			err = fmt.Errorf("%v: session recovery failed: %w", err, rErr)
+			m.record(HealthDown, err)
+			return
+		}
+		logging.L().Info("session recovered")
+		m.record(HealthDegraded, err)
+		return
+	}
+
+	if m.canary != nil {
+		if err = m.signCanary(ctx); err != nil {
+			m.record(HealthDegraded, err)
+			return
+		}
+	}
+	m.record(HealthHealthy, nil)
+}
+
+// signCanary signs a random hash with the canary account, as the Sign RPC signs, and checks the canary account's public
+// key is recovered from the signature.
+func (m *healthMonitor) signCanary(ctx context.Context) error {
+	hash := make([]byte, hashSize)
+	if _, err := rand.Read(hash); err != nil {
+		return err
+	}
+	sig, err := m.wrapper.SignHash(ctx, hash, *m.canary)
+	if err != nil {
+		return fmt.Errorf("canary signature failed: %w", err)
+	}
+	pub, err := m.wrapper.PublicKey(ctx, *m.canary)
+	if err != nil {
+		return fmt.Errorf("canary public key unavailable: %w", err)
+	}
+	if !verify(pub, hash, sig) {
+		return errors.New("canary signature does not verify")
+	}
+	return nil
+}
+
+// verify reports whether pub is recovered from sig, a signature of hash in the [R || S || V] form returned by
+// Cryptoki.SignHash.
+func verify(pub *ecdsa.PublicKey, hash, sig []byte) bool {
+	got, err := secp256k1.RecoverPubkey(hash, sig)
+	return err == nil && bytes.Equal(got, elliptic.Marshal(pub.Curve, pub.X, pub.Y))
+}
+
+// record updates the health with the outcome of a check.  Failures reported as HealthDegraded become HealthDown once
+// downAfter consecutive checks have failed.
+func (m *healthMonitor) record(state HealthState, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	m.health.LastCheck = &now
+	switch {
+	case err == nil:
+		m.health.Failures = 0
+		m.health.LastError = ""
+		m.health.LastSuccess = &now
+	case state == HealthUnknown:
+		m.health.LastError = err.Error()
+	default:
+		m.health.Failures++
+		m.health.LastError = err.Error()
+		if m.health.Failures >= downAfter {
+			state = HealthDown
+		}
+	}
+
+	if state != m.health.State {
+		logging.L().Info("token health changed", "from", string(m.health.State), "to", string(state), "error", m.health.LastError)
+		m.health.State = state
+		m.health.Since = &now
+	}
+}
+
+func (m *healthMonitor) current() Health {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.health
+}
@@ -0,0 +1,111 @@
+package pkcs11
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"testing"
+
+	"github.com/jpmorganchase/quorum/crypto/secp256k1"
+	"github.com/stretchr/testify/require"
+)
+
+// stubSession is a Cryptoki whose session checks fail with checkErr and whose session recovery fails with recoverErr.
+// Calling any other method panics.
+type stubSession struct {
+	Cryptoki
+	checkErr, recoverErr error
+	recovered            int
+}
+
+func (s *stubSession) CheckSession(context.Context) error {
+	return s.checkErr
+}
+
+func (s *stubSession) RecoverSession(context.Context) error {
+	s.recovered++
+	return s.recoverErr
+}
+
+func TestHealthMonitor_Check(t *testing.T) {
+	tests := map[string]struct {
+		checkErr, recoverErr error
+		want                 HealthState
+		wantRecovered        int
+	}{
+		"healthy":         {want: HealthHealthy},
+		"no session":      {checkErr: errNoSession, want: HealthUnknown},
+		"recovered":       {checkErr: errors.New("CKR_SESSION_HANDLE_INVALID"), want: HealthDegraded, wantRecovered: 1},
+		"recovery failed": {checkErr: errors.New("CKR_SESSION_HANDLE_INVALID"), recoverErr: errors.New("CKR_DEVICE_REMOVED"), want: HealthDown, wantRecovered: 1},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			s := &stubSession{checkErr: tt.checkErr, recoverErr: tt.recoverErr}
+			m := &healthMonitor{wrapper: s, health: Health{State: HealthUnknown}}
+
+			m.check(context.Background())
+
+			got := m.current()
+			require.Equal(t, tt.want, got.State)
+			require.NotNil(t, got.LastCheck)
+			require.Equal(t, tt.wantRecovered, s.recovered)
+		})
+	}
+}
+
+func TestHealthMonitor_Record_DownAfterConsecutiveFailures(t *testing.T) {
+	m := &healthMonitor{health: Health{State: HealthUnknown}}
+
+	m.record(HealthHealthy, nil)
+	require.Equal(t, HealthHealthy, m.current().State)
+	require.NotNil(t, m.current().LastSuccess)
+
+	for i := 1; i < downAfter; i++ {
+		m.record(HealthDegraded, errors.New("failed"))
+		require.Equal(t, HealthDegraded, m.current().State)
+		require.Equal(t, i, m.current().Failures)
+	}
+	m.record(HealthDegraded, errors.New("failed"))
+	require.Equal(t, HealthDown, m.current().State)
+
+	m.record(HealthHealthy, nil)
+	got := m.current()
+	require.Equal(t, HealthHealthy, got.State)
+	require.Zero(t, got.Failures)
+	require.Empty(t, got.LastError)
+}
+
+func TestHealthMonitor_Record_UnknownIsNotAFailure(t *testing.T) {
+	m := &healthMonitor{health: Health{State: HealthUnknown}}
+
+	m.record(HealthUnknown, errNoSession)
+
+	got := m.current()
+	require.Equal(t, HealthUnknown, got.State)
+	require.Zero(t, got.Failures)
+	require.Nil(t, got.Since)
+}
+
+func TestVerify(t *testing.T) {
+	key, err := ecdsa.GenerateKey(secp256k1.S256(), rand.Reader)
+	require.NoError(t, err)
+	other, err := ecdsa.GenerateKey(secp256k1.S256(), rand.Reader)
+	require.NoError(t, err)
+	hash := sha256.Sum256([]byte("canary"))
+	r, s, err := ecdsa.Sign(rand.Reader, key, hash[:])
+	require.NoError(t, err)
+	rs := make([]byte, 64)
+	r.FillBytes(rs[:32])
+	s.FillBytes(rs[32:])
+	sig, err := recoverableSignature(rs, hash[:], &key.PublicKey)
+	require.NoError(t, err)
+
+	require.True(t, verify(&key.PublicKey, hash[:], sig))
+	require.False(t, verify(&other.PublicKey, hash[:], sig))
+	otherHash := sha256.Sum256([]byte("other"))
+	require.False(t, verify(&key.PublicKey, otherHash[:], sig))
+	require.False(t, verify(&key.PublicKey, hash[:], sig[:64]))
+	require.False(t, verify(&key.PublicKey, hash[:], nil))
+}
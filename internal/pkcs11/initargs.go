@@ -0,0 +1,83 @@
+package pkcs11
+
+/*
+#cgo linux LDFLAGS: -ldl
+#cgo darwin LDFLAGS: -ldl
+#cgo freebsd LDFLAGS: -ldl
+
+#include <dlfcn.h>
+#include <stdlib.h>
+
+// Only the parts of pkcs11.h needed to call C_Initialize with arguments are declared.  github.com/miekg/pkcs11 always
+// passes CKF_OS_LOCKING_OK.
+typedef unsigned long ck_rv;
+
+typedef struct {
+	void *create_mutex;
+	void *destroy_mutex;
+	void *lock_mutex;
+	void *unlock_mutex;
+	unsigned long flags;
+	void *reserved;
+} ck_c_initialize_args;
+
+typedef struct {
+	unsigned char major;
+	unsigned char minor;
+} ck_version;
+
+typedef struct {
+	ck_version version;
+	ck_rv (*C_Initialize)(void *args);
+} ck_function_list;
+
+#define CKR_OK 0
+#define CKR_GENERAL_ERROR 5
+
+// initialize calls C_Initialize of the module, which must already be loaded, with the flags.
+static ck_rv initialize(const char *module, unsigned long flags)
+{
+	void *handle = dlopen(module, RTLD_LAZY | RTLD_NOLOAD);
+	if (handle == NULL) {
+		return CKR_GENERAL_ERROR;
+	}
+	ck_rv (*get_function_list)(ck_function_list **) = dlsym(handle, "C_GetFunctionList");
+	ck_function_list *list = NULL;
+	ck_rv rv = get_function_list == NULL ? CKR_GENERAL_ERROR : get_function_list(&list);
+	if (rv == CKR_OK) {
+		ck_c_initialize_args args = {0};
+		args.flags = flags;
+		rv = list->C_Initialize(&args);
+	}
+	dlclose(handle);
+	return rv;
+}
+*/
+import "C"
+
+import (
+	"github.com/miekg/pkcs11"
+	"quorum-account-plugin-pkcs-11/internal/config"
+	"unsafe"
+)
+
+// initialize initializes the module at path, which ctx has loaded, with args.  The defaults, OS locking allowed and
+// the library free to create threads, are what ctx.Initialize passes.
+func initialize(ctx *pkcs11.Ctx, path string, args *config.InitializeArgs) error {
+	if args == nil || (args.OSLocking && !args.LibraryCantCreateOSThreads) {
+		return ctx.Initialize()
+	}
+	var flags C.ulong
+	if args.OSLocking {
+		flags |= pkcs11.CKF_OS_LOCKING_OK
+	}
+	if args.LibraryCantCreateOSThreads {
+		flags |= pkcs11.CKF_LIBRARY_CANT_CREATE_OS_THREADS
+	}
+	module := C.CString(path)
+	defer C.free(unsafe.Pointer(module))
+	if rv := C.initialize(module, flags); rv != C.CKR_OK {
+		return pkcs11.Error(rv)
+	}
+	return nil
+}
@@ -0,0 +1,295 @@
+package pkcs11
+
+import (
+	"errors"
+	"fmt"
+	"quorum-account-plugin-pkcs-11/internal/config"
+	"quorum-account-plugin-pkcs-11/internal/logging"
+	"quorum-account-plugin-pkcs-11/internal/secure"
+	"sync"
+	"time"
+
+	"github.com/miekg/pkcs11"
+)
+
+var (
+	ErrPINLocked    = errors.New("user PIN is locked on the token and must be reset by the Security Officer")
+	ErrPINFinalTry  = errors.New("the next failed login would lock the user PIN: automatic login is disabled until the configured PIN changes")
+	ErrLoginBlocked = errors.New("login with the configured PIN previously failed: automatic login is disabled until the configured PIN changes")
+)
+
+// LoginState describes the outcome of the plugin's logins to the token.
+type LoginState struct {
+	LoggedIn bool
+	// Blocked is set when the plugin will not attempt to login with the configured PIN
+	Blocked     bool
+	Failures    int
+	LastFailure time.Time
+	LastError   string
+	// PINCountLow and PINFinalTry reflect the CKF_USER_PIN_COUNT_LOW and CKF_USER_PIN_FINAL_TRY token flags as last read
+	PINCountLow bool
+	PINFinalTry bool
+}
+
+func (s LoginState) String() string {
+	switch {
+	case s.LoggedIn:
+		return "logged in"
+	case s.Blocked:
+		return fmt.Sprintf("login blocked after %v failed attempt(s): %v", s.Failures, s.LastError)
+	case s.Failures > 0:
+		return fmt.Sprintf("not logged in, %v failed attempt(s): %v", s.Failures, s.LastError)
+	default:
+		return "not logged in"
+	}
+}
+
+// loginGuard tracks failed logins to prevent the plugin from locking the user PIN by retrying a PIN which is known to
+// be wrong, e.g. because Quorum repeatedly calls Open or the plugin is re-initialized.  The blocked PIN is kept in a
+// secure.Buffer, as a digest of a short PIN held in ordinary memory could be brute-forced from a heap or core dump.
+// There is a guard per token, see tokenState.
+type loginGuard struct {
+	mu    sync.Mutex
+	state LoginState
+	// blockedPIN is the PIN blocked, or nil if it could not be copied, in which case the block is kept until the plugin
+	// is restarted rather than risk locking the PIN
+	blockedPIN  *secure.Buffer
+	blockReason error
+}
+
+// check returns an error if logging in with pin must not be attempted.
+func (g *loginGuard) check(pin *secure.Buffer) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if !g.state.Blocked {
+		return nil
+	}
+	if g.blockedPIN != nil && !pin.Equal(g.blockedPIN) {
+		// the configured PIN has changed so allow another attempt
+		g.state.Blocked = false
+		g.blockedPIN.Destroy()
+		g.blockedPIN = nil
+		return nil
+	}
+	return g.blockReason
+}
+
+// checkTokenFlags records the PIN counter flags of the token and returns an error if logging in with pin must not be
+// attempted.
+func (g *loginGuard) checkTokenFlags(pin *secure.Buffer, flags uint) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.state.PINCountLow = flags&pkcs11.CKF_USER_PIN_COUNT_LOW != 0
+	g.state.PINFinalTry = flags&pkcs11.CKF_USER_PIN_FINAL_TRY != 0
+
+	switch {
+	case flags&pkcs11.CKF_USER_PIN_LOCKED != 0:
+		g.blockLocked(pin, ErrPINLocked)
+		return ErrPINLocked
+	case g.state.PINFinalTry:
+		g.blockLocked(pin, ErrPINFinalTry)
+		return ErrPINFinalTry
+	case g.state.PINCountLow:
+		logging.L().Warn("the token reports that an incorrect user PIN has been entered at least once since the last successful login")
+	}
+	return nil
+}
+
+func (g *loginGuard) succeeded() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.state = LoginState{LoggedIn: true}
+	g.blockedPIN.Destroy()
+	g.blockedPIN = nil
+}
+
+func (g *loginGuard) loggedOut() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.state.LoggedIn = false
+}
+
+// failed records a failed login with pin and returns the error to report for it.  Failures caused by the PIN itself
+// block further attempts with the same PIN.
+func (g *loginGuard) failed(pin *secure.Buffer, err error) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.state.LoggedIn = false
+	g.state.Failures++
+	g.state.LastFailure = time.Now()
+	g.state.LastError = err.Error()
+
+	if isPINError(err) {
+		g.state.Blocked = true
+		g.block(pin)
+		g.blockReason = fmt.Errorf("%w: %v", ErrLoginBlocked, err)
+		if err == pkcs11.Error(pkcs11.CKR_PIN_LOCKED) {
+			g.blockReason = fmt.Errorf("%w: %v", ErrPINLocked, err)
+		}
+	}
+	logging.L().Error("login to token failed", "failures", g.state.Failures, "error", err)
+
+	if err == pkcs11.Error(pkcs11.CKR_PIN_LOCKED) {
+		return g.blockReason
+	}
+	return err
+}
+
+// blockLocked blocks pin without counting a failed attempt, as no login was attempted.  g.mu must be held.
+func (g *loginGuard) blockLocked(pin *secure.Buffer, reason error) {
+	g.state.LoggedIn = false
+	g.state.Blocked = true
+	g.state.LastError = reason.Error()
+	g.block(pin)
+	g.blockReason = reason
+	logging.L().Error("login to token not attempted", "error", reason)
+}
+
+// block records pin as the blocked PIN.  g.mu must be held.
+func (g *loginGuard) block(pin *secure.Buffer) {
+	c, err := pin.Copy()
+	if err != nil {
+		logging.L().Error("unable to keep a copy of the blocked PIN, login stays blocked until the plugin is restarted", "error", err)
+	}
+	g.blockedPIN.Destroy()
+	g.blockedPIN = c
+}
+
+func (g *loginGuard) loginState() LoginState {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	return g.state
+}
+
+func isPINError(err error) bool {
+	var ckr pkcs11.Error
+	if !errors.As(err, &ckr) {
+		return false
+	}
+	switch ckr {
+	case pkcs11.CKR_PIN_INCORRECT, pkcs11.CKR_PIN_INVALID, pkcs11.CKR_PIN_LEN_RANGE, pkcs11.CKR_PIN_EXPIRED, pkcs11.CKR_PIN_LOCKED:
+		return true
+	}
+	return false
+}
+
+// tokenKey identifies a token by the path of its library and its slot label.
+type tokenKey struct {
+	path, slotLabel string
+}
+
+// tokenState is the state of a token which must outlive the Cryptoki using it, as the Cryptoki is rebuilt when the
+// plugin is re-initialized or its library config is reloaded.
+type tokenState struct {
+	// users is the number of Cryptokis using the token.  More than one uses it while the plugin is being reconfigured,
+	// and as login state is shared by all of the process's sessions on the token, only the last may logout.  It is
+	// guarded by tokens' mutex.
+	users int
+
+	// guard tracks the failed logins to the token.  Each rebuilt Cryptoki checks its freshly loaded PIN against it, so
+	// that a PIN known to be wrong stays blocked until the configured PIN changes.
+	guard loginGuard
+
+	mu sync.Mutex
+	// rotatedPIN is the PIN last set by RotatePIN, or nil if the PIN has not been rotated.  configuredPIN is a copy of
+	// the configured PIN it replaced: the rotated PIN is used in its place until the configured PIN
+	// changes, i.e. until the operator has updated the PIN source.
+	rotatedPIN    *secure.Buffer
+	configuredPIN *secure.Buffer
+	// curveErr is the outcome of the probe for secp256k1 key generation once curveProbed is set, see curveSupport
+	curveProbed bool
+	curveErr    error
+}
+
+// tokens is the state of each token used by this process.
+var tokens = struct {
+	sync.Mutex
+	m map[tokenKey]*tokenState
+}{m: make(map[tokenKey]*tokenState)}
+
+// tokenStateFor returns the state of the token configured by l, counting the caller as a user of the token until it
+// calls release.
+func tokenStateFor(l config.Pkcs11Library) *tokenState {
+	key := tokenKey{path: modulePath(l.Path.Path), slotLabel: l.SlotLabel.Get()}
+	tokens.Lock()
+	defer tokens.Unlock()
+
+	s, ok := tokens.m[key]
+	if !ok {
+		s = new(tokenState)
+		tokens.m[key] = s
+	}
+	s.users++
+	return s
+}
+
+// release stops counting the caller as a user of the token, reporting whether any other Cryptoki still uses it.  The
+// state itself is kept for the next Cryptoki built for the token.
+func (s *tokenState) release() (shared bool) {
+	tokens.Lock()
+	defer tokens.Unlock()
+
+	s.users--
+	return s.users > 0
+}
+
+// pin returns the PIN to login with, taking ownership of configured, the PIN read from the config.  This is the PIN last
+// set by RotatePIN unless the configured PIN has changed since.
+func (s *tokenState) pin(configured *secure.Buffer) (*secure.Buffer, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.rotatedPIN == nil {
+		return configured, nil
+	}
+	if !configured.Equal(s.configuredPIN) {
+		logging.L().Info("the configured user PIN has changed since the PIN was rotated, using the configured PIN")
+		s.rotatedPIN.Destroy()
+		s.configuredPIN.Destroy()
+		s.rotatedPIN, s.configuredPIN = nil, nil
+		return configured, nil
+	}
+	configured.Destroy()
+	logging.L().Info("using the user PIN set by the last PIN rotation rather than the configured PIN")
+	return s.rotatedPIN.Copy()
+}
+
+// rotated records copies of pin, set by RotatePIN in place of the configured PIN configured.
+func (s *tokenState) rotated(pin, configured *secure.Buffer) error {
+	c, err := pin.Copy()
+	if err != nil {
+		return err
+	}
+	cc, err := configured.Copy()
+	if err != nil {
+		c.Destroy()
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.rotatedPIN.Destroy()
+	s.configuredPIN.Destroy()
+	s.rotatedPIN, s.configuredPIN = c, cc
+	return nil
+}
+
+// curveSupport returns the outcome of probe, the probe for secp256k1 key generation, calling it only if the token has
+// not been probed before.  The probe generates a key pair, which is slow on a network HSM, so it is made when a session
+// is first opened rather than each time one is reopened, e.g. by RecoverSession.
+func (s *tokenState) curveSupport(probe func() error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.curveProbed {
+		s.curveErr = probe()
+		s.curveProbed = true
+	}
+	return s.curveErr
+}
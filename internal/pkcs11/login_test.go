@@ -0,0 +1,98 @@
+package pkcs11
+
+import (
+	"errors"
+	"quorum-account-plugin-pkcs-11/internal/secure"
+	"testing"
+
+	"github.com/miekg/pkcs11"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoginGuard_IncorrectPINBlocksSamePIN(t *testing.T) {
+	var g loginGuard
+
+	err := g.failed(testPIN(t, "1234"), pkcs11.Error(pkcs11.CKR_PIN_INCORRECT))
+	require.Equal(t, pkcs11.Error(pkcs11.CKR_PIN_INCORRECT), err)
+
+	err = g.check(testPIN(t, "1234"))
+	require.True(t, errors.Is(err, ErrLoginBlocked))
+
+	state := g.loginState()
+	require.True(t, state.Blocked)
+	require.Equal(t, 1, state.Failures)
+}
+
+func TestLoginGuard_ChangedPINUnblocks(t *testing.T) {
+	var g loginGuard
+
+	_ = g.failed(testPIN(t, "1234"), pkcs11.Error(pkcs11.CKR_PIN_INCORRECT))
+
+	require.NoError(t, g.check(testPIN(t, "5678")))
+	require.False(t, g.loginState().Blocked)
+}
+
+func TestLoginGuard_NonPINErrorDoesNotBlock(t *testing.T) {
+	var g loginGuard
+
+	_ = g.failed(testPIN(t, "1234"), pkcs11.Error(pkcs11.CKR_DEVICE_ERROR))
+
+	require.NoError(t, g.check(testPIN(t, "1234")))
+	require.Equal(t, 1, g.loginState().Failures)
+}
+
+func TestLoginGuard_PINLocked(t *testing.T) {
+	var g loginGuard
+
+	err := g.failed(testPIN(t, "1234"), pkcs11.Error(pkcs11.CKR_PIN_LOCKED))
+	require.True(t, errors.Is(err, ErrPINLocked))
+
+	err = g.check(testPIN(t, "1234"))
+	require.True(t, errors.Is(err, ErrPINLocked))
+}
+
+func TestLoginGuard_TokenFlags(t *testing.T) {
+	var g loginGuard
+
+	require.NoError(t, g.checkTokenFlags(testPIN(t, "1234"), pkcs11.CKF_USER_PIN_COUNT_LOW))
+	require.True(t, g.loginState().PINCountLow)
+
+	err := g.checkTokenFlags(testPIN(t, "1234"), pkcs11.CKF_USER_PIN_COUNT_LOW|pkcs11.CKF_USER_PIN_FINAL_TRY)
+	require.Equal(t, ErrPINFinalTry, err)
+	require.Equal(t, ErrPINFinalTry, g.check(testPIN(t, "1234")))
+	require.Equal(t, 0, g.loginState().Failures)
+
+	err = g.checkTokenFlags(testPIN(t, "1234"), pkcs11.CKF_USER_PIN_LOCKED)
+	require.Equal(t, ErrPINLocked, err)
+}
+
+func TestLoginGuard_SuccessResets(t *testing.T) {
+	var g loginGuard
+
+	_ = g.failed(testPIN(t, "1234"), pkcs11.Error(pkcs11.CKR_PIN_INCORRECT))
+	g.succeeded()
+
+	require.NoError(t, g.check(testPIN(t, "1234")))
+	require.Equal(t, LoginState{LoggedIn: true}, g.loginState())
+}
+
+func TestLoginGuard_SuccessDestroysBlockedPIN(t *testing.T) {
+	var g loginGuard
+	pin := testPIN(t, "1234")
+
+	_ = g.failed(pin, pkcs11.Error(pkcs11.CKR_PIN_INCORRECT))
+	// the guard keeps its own copy of the PIN, which is wiped once it is no longer blocked
+	blocked := g.blockedPIN
+	require.True(t, blocked.Equal(pin))
+	g.succeeded()
+
+	require.Nil(t, g.blockedPIN)
+	require.Zero(t, blocked.Len())
+}
+
+func testPIN(t *testing.T, pin string) *secure.Buffer {
+	b, err := secure.FromString(pin)
+	require.NoError(t, err)
+	t.Cleanup(b.Destroy)
+	return b
+}
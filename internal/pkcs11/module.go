@@ -0,0 +1,160 @@
+package pkcs11
+
+import (
+	"errors"
+	"fmt"
+	"github.com/miekg/pkcs11"
+	"os"
+	"path/filepath"
+	"quorum-account-plugin-pkcs-11/internal/config"
+	"quorum-account-plugin-pkcs-11/internal/logging"
+	"reflect"
+	"sync"
+)
+
+// The PKCS#11 calls made to load and initialize a module, replaced in tests.
+var (
+	loadLibrary       = pkcs11.New
+	initializeLibrary = initialize
+)
+
+// module is a PKCS#11 module in use by this process.
+type module struct {
+	// refs is the number of Cryptokis using the module
+	refs int
+	// initialized is whether the module was initialized by the first of them, rather than by other code in this
+	// process, and so should be finalized by the last
+	initialized bool
+	// initArgs and env are the initialize args and environment the module was initialized with
+	initArgs *config.InitializeArgs
+	env      map[string]string
+	// events waits for the slot events of the module for the watchers of its tokens
+	events *slotEvents
+}
+
+// modules are the PKCS#11 modules in use, by the real path of their library.  A module is loaded once per process and
+// can only be initialized once, so a module used by more than one Cryptoki, e.g. while the plugin is being
+// reconfigured, is initialized by the first and finalized by the last.
+var modules = struct {
+	sync.Mutex
+	m map[string]*module
+}{m: make(map[string]*module)}
+
+// modulePath returns the real path of the library at path, so that a module loaded through different symlinks is
+// recognized.
+func modulePath(path string) string {
+	if p, err := filepath.EvalSymlinks(path); err == nil {
+		return p
+	}
+	return path
+}
+
+// loadModule loads the library l and initializes it, unless it is already in use.  Each loadModule must be matched by
+// an unloadModule.
+func loadModule(l config.Pkcs11Library) (*pkcs11.Ctx, error) {
+	path := modulePath(l.Path.Path)
+	modules.Lock()
+	defer modules.Unlock()
+
+	m, ok := modules.m[path]
+	if ok {
+		ctx := loadLibrary(l.Path.Path)
+		if ctx == nil {
+			return nil, fmt.Errorf("unable to load PKCS#11 library %v", l.Path.Path)
+		}
+		if !reflect.DeepEqual(l.Initialize, m.initArgs) || !reflect.DeepEqual(l.Environment, m.env) {
+			logging.L().Warn("PKCS#11 library is already initialized, its new initialize args and environment take effect once it is no longer in use, e.g. when the plugin is restarted", "path", l.Path.Path)
+		}
+		m.refs++
+		return ctx, nil
+	}
+
+	restore, err := setEnvironment(l.Environment)
+	if err != nil {
+		return nil, err
+	}
+	defer restore()
+
+	ctx := loadLibrary(l.Path.Path)
+	if ctx == nil {
+		return nil, fmt.Errorf("unable to load PKCS#11 library %v", l.Path.Path)
+	}
+	m = &module{refs: 1, initialized: true, initArgs: l.Initialize, env: l.Environment}
+	if err := initializeLibrary(ctx, l.Path.Path, l.Initialize); errors.Is(err, pkcs11.Error(pkcs11.CKR_CRYPTOKI_ALREADY_INITIALIZED)) {
+		// other code in this process, e.g. another plugin, is using the module; finalizing it would break that code
+		logging.L().Warn("PKCS#11 library was already initialized by another user in this process, it will be left initialized", "path", l.Path.Path)
+		m.initialized = false
+	} else if err != nil {
+		ctx.Destroy()
+		return nil, err
+	}
+	modules.m[path] = m
+	return ctx, nil
+}
+
+// moduleSlotEvents returns the slotEvents shared by the watchers of the tokens of the library l, or nil if the library
+// may not create threads, as it then cannot support blocking waits for slot events.
+func moduleSlotEvents(l config.Pkcs11Library) *slotEvents {
+	if l.Initialize != nil && l.Initialize.LibraryCantCreateOSThreads {
+		return nil
+	}
+	modules.Lock()
+	defer modules.Unlock()
+
+	m, ok := modules.m[modulePath(l.Path.Path)]
+	if !ok {
+		// the module was not loaded by loadModule, as in tests
+		return newSlotEvents()
+	}
+	if m.events == nil {
+		m.events = newSlotEvents()
+	}
+	return m.events
+}
+
+// unloadModule releases ctx, loaded by loadModule for the library at path.  If ctx is the last user of the module,
+// finalize is called to finalize it and its error returned.
+func unloadModule(path string, ctx pkcs11API, finalize func() error) error {
+	path = modulePath(path)
+	modules.Lock()
+	defer modules.Unlock()
+	defer ctx.Destroy()
+
+	m, ok := modules.m[path]
+	if !ok {
+		return nil
+	}
+	if m.refs--; m.refs > 0 {
+		return nil
+	}
+	delete(modules.m, path)
+	if !m.initialized {
+		return nil
+	}
+	return finalize()
+}
+
+// setEnvironment sets the environment variables env, returning a function which restores their previous values.  The
+// variables are set for the whole process with os.Setenv, as a library reads them with getenv, so loadModule only sets
+// them while it holds the modules lock and restores them as soon as the library is initialized.
+func setEnvironment(env map[string]string) (restore func(), err error) {
+	var restores []func()
+	restore = func() {
+		for _, r := range restores {
+			r()
+		}
+	}
+	for name, value := range env {
+		name := name
+		if prev, ok := os.LookupEnv(name); ok {
+			restores = append(restores, func() { os.Setenv(name, prev) })
+		} else {
+			restores = append(restores, func() { os.Unsetenv(name) })
+		}
+		if err := os.Setenv(name, value); err != nil {
+			restore()
+			return nil, fmt.Errorf("unable to set environment variable %v: %w", name, err)
+		}
+	}
+	return restore, nil
+}
@@ -0,0 +1,155 @@
+package pkcs11
+
+import (
+	"net/url"
+	"os"
+	"quorum-account-plugin-pkcs-11/internal/config"
+	"testing"
+
+	"github.com/miekg/pkcs11"
+	"github.com/stretchr/testify/require"
+)
+
+// stubModule replaces the loading and initialization of PKCS#11 modules for the duration of a test.  Each
+// initialization records the value of SOFTHSM2_CONF and the args, and fails with initErr.
+type stubModule struct {
+	initErr     error
+	initialized int
+	finalized   int
+	env         string
+	args        *config.InitializeArgs
+}
+
+func newStubModule(t *testing.T) *stubModule {
+	m := &stubModule{}
+	load, init := loadLibrary, initializeLibrary
+	t.Cleanup(func() { loadLibrary, initializeLibrary = load, init })
+	loadLibrary = func(string) *pkcs11.Ctx {
+		return new(pkcs11.Ctx)
+	}
+	initializeLibrary = func(_ *pkcs11.Ctx, _ string, args *config.InitializeArgs) error {
+		m.initialized++
+		m.env, m.args = os.Getenv("SOFTHSM2_CONF"), args
+		return m.initErr
+	}
+	return m
+}
+
+func (m *stubModule) finalize() error {
+	m.finalized++
+	return nil
+}
+
+func library(t *testing.T) config.Pkcs11Library {
+	return config.Pkcs11Library{Path: &url.URL{Scheme: "file", Path: t.TempDir() + "/lib.so"}}
+}
+
+func TestLoadModule_InitializesOnce(t *testing.T) {
+	m := newStubModule(t)
+	l := library(t)
+
+	first, err := loadModule(l)
+	require.NoError(t, err)
+	second, err := loadModule(l)
+	require.NoError(t, err)
+	require.Equal(t, 1, m.initialized)
+
+	require.NoError(t, unloadModule(l.Path.Path, first, m.finalize))
+	require.Equal(t, 0, m.finalized)
+	require.NoError(t, unloadModule(l.Path.Path, second, m.finalize))
+	require.Equal(t, 1, m.finalized)
+
+	// the module can be initialized again once it has been finalized
+	third, err := loadModule(l)
+	require.NoError(t, err)
+	require.Equal(t, 2, m.initialized)
+	require.NoError(t, unloadModule(l.Path.Path, third, m.finalize))
+}
+
+func TestLoadModule_AlreadyInitialized(t *testing.T) {
+	m := newStubModule(t)
+	m.initErr = pkcs11.Error(pkcs11.CKR_CRYPTOKI_ALREADY_INITIALIZED)
+	l := library(t)
+
+	ctx, err := loadModule(l)
+	require.NoError(t, err)
+
+	// the module is left initialized for the code in this process which initialized it
+	require.NoError(t, unloadModule(l.Path.Path, ctx, m.finalize))
+	require.Equal(t, 0, m.finalized)
+}
+
+func TestLoadModule_InitializeFails(t *testing.T) {
+	m := newStubModule(t)
+	m.initErr = pkcs11.Error(pkcs11.CKR_GENERAL_ERROR)
+	l := library(t)
+
+	_, err := loadModule(l)
+	require.EqualError(t, err, "pkcs11: 0x5: CKR_GENERAL_ERROR")
+
+	m.initErr = nil
+	ctx, err := loadModule(l)
+	require.NoError(t, err)
+	require.NoError(t, unloadModule(l.Path.Path, ctx, m.finalize))
+	require.Equal(t, 1, m.finalized)
+}
+
+func TestLoadModule_LoadFails(t *testing.T) {
+	newStubModule(t)
+	loadLibrary = func(string) *pkcs11.Ctx { return nil }
+	l := library(t)
+
+	_, err := loadModule(l)
+	require.EqualError(t, err, "unable to load PKCS#11 library "+l.Path.Path)
+}
+
+func TestLoadModule_InitializeArgsAndEnvironment(t *testing.T) {
+	m := newStubModule(t)
+	t.Setenv("SOFTHSM2_CONF", "/etc/softhsm2.conf")
+	l := library(t)
+	l.Initialize = &config.InitializeArgs{LibraryCantCreateOSThreads: true}
+	l.Environment = map[string]string{"SOFTHSM2_CONF": "/opt/softhsm2.conf"}
+
+	ctx, err := loadModule(l)
+	require.NoError(t, err)
+	defer unloadModule(l.Path.Path, ctx, m.finalize)
+
+	require.Equal(t, "/opt/softhsm2.conf", m.env)
+	require.Equal(t, l.Initialize, m.args)
+	require.Equal(t, "/etc/softhsm2.conf", os.Getenv("SOFTHSM2_CONF"))
+}
+
+func TestModuleSlotEvents(t *testing.T) {
+	m := newStubModule(t)
+	l := library(t)
+	ctx, err := loadModule(l)
+	require.NoError(t, err)
+	defer unloadModule(l.Path.Path, ctx, m.finalize)
+
+	// the watchers of the module's tokens share its blocking waits
+	events := moduleSlotEvents(l)
+	require.NotNil(t, events)
+	require.Same(t, events, moduleSlotEvents(l))
+
+	// a library which may not create threads is only polled
+	l.Initialize = &config.InitializeArgs{LibraryCantCreateOSThreads: true}
+	require.Nil(t, moduleSlotEvents(l))
+}
+
+func TestSetEnvironment_Restores(t *testing.T) {
+	t.Setenv("SET_VAR", "before")
+	os.Unsetenv("UNSET_VAR")
+
+	restore, err := setEnvironment(map[string]string{"SET_VAR": "during", "UNSET_VAR": "during"})
+	require.NoError(t, err)
+	require.Equal(t, "during", os.Getenv("SET_VAR"))
+	require.Equal(t, "during", os.Getenv("UNSET_VAR"))
+
+	restore()
+	require.Equal(t, "before", os.Getenv("SET_VAR"))
+	_, ok := os.LookupEnv("UNSET_VAR")
+	require.False(t, ok)
+
+	_, err = setEnvironment(map[string]string{"": "x"})
+	require.Error(t, err)
+}
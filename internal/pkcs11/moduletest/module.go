@@ -0,0 +1,868 @@
+// Package moduletest provides a scriptable in-memory PKCS#11 module, implementing the part of the PKCS#11 API used by
+// the plugin, for testing how the plugin calls the API and how it reacts to the errors of individual calls.
+package moduletest
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/asn1"
+	"math/big"
+	"quorum-account-plugin-pkcs-11/internal/account/account"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/jpmorganchase/quorum/crypto/secp256k1"
+	"github.com/miekg/pkcs11"
+)
+
+// SlotID is the ID of the slot holding the module's token.
+const SlotID = 1
+
+// Call is a PKCS#11 function call made to a Module.  The templates and mechanisms passed to the call are copied when it
+// is made, so they are the exact values sent.
+type Call struct {
+	// Fn is the name of the function, e.g. "C_Sign"
+	Fn      string
+	Session pkcs11.SessionHandle
+	// Object is the object handle passed to C_DestroyObject, C_GetAttributeValue, C_SetAttributeValue or C_SignInit
+	Object     pkcs11.ObjectHandle
+	Mechanisms []*pkcs11.Mechanism
+	// Templates are the templates passed to the call.  C_GenerateKeyPair is passed the public then the private key
+	// template.
+	Templates [][]*pkcs11.Attribute
+	// Max is the max passed to C_FindObjects
+	Max int
+	// UserType is the user type passed to C_Login
+	UserType uint
+	// Flags are the flags passed to C_WaitForSlotEvent
+	Flags uint
+}
+
+// Result is the scripted result of a call, see Queue.
+type Result struct {
+	// Err is returned by the call
+	Err error
+	// Apply makes the call take effect even though it fails with Err, as when a module partially completes an
+	// operation.  Otherwise a call failing with Err has no effect.
+	Apply bool
+	// Handles, if not nil, are returned by C_FindObjects in place of the handles found by the search
+	Handles []pkcs11.ObjectHandle
+}
+
+// Module is an in-memory PKCS#11 module with one slot, SlotID, holding an initialized token.  It generates secp256k1
+// keys with CKM_EC_KEY_PAIR_GEN and signs with CKM_ECDSA_SHA256 or CKM_ECDSA, returning signatures as r || s.  Every
+// call is recorded, and the results of the next calls of a function can be scripted with Queue.
+//
+// The zero value is not usable, see New.
+type Module struct {
+	// Info is returned by C_GetInfo
+	Info pkcs11.Info
+	// Token is returned by C_GetTokenInfo
+	Token pkcs11.TokenInfo
+	// Mechanisms are the mechanisms supported by the token
+	Mechanisms map[uint]pkcs11.MechanismInfo
+	// PIN is the user PIN of the token
+	PIN string
+
+	mu        sync.Mutex
+	calls     []Call
+	queued    map[string][]Result
+	objects   map[pkcs11.ObjectHandle]*object
+	sessions  map[pkcs11.SessionHandle]*session
+	handles   uint
+	loggedIn  bool
+	removed   bool
+	finalized bool
+	events    []chan pkcs11.SlotEvent
+	// result is the result applied to the call in progress
+	result Result
+}
+
+type object struct {
+	attrs []*pkcs11.Attribute
+	// key is the key of a private key object
+	key *ecdsa.PrivateKey
+	// session is the session which created a session object, or 0 for a token object
+	session pkcs11.SessionHandle
+}
+
+type session struct {
+	// found are the handles of a search in progress not yet returned by C_FindObjects, and searching whether a search
+	// is in progress
+	found     []pkcs11.ObjectHandle
+	searching bool
+	// signKey is the key of a signing operation in progress, using mechanism
+	signKey   *ecdsa.PrivateKey
+	mechanism uint
+}
+
+// New returns a module whose token is labelled label, has the user PIN pin and supports the mechanisms needed by all of
+// the plugin's features.
+func New(label, pin string) *Module {
+	return &Module{
+		Info: pkcs11.Info{
+			CryptokiVersion: pkcs11.Version{Major: 2, Minor: 20},
+			ManufacturerID:  "moduletest",
+		},
+		Token: pkcs11.TokenInfo{
+			Label: label,
+			Flags: pkcs11.CKF_TOKEN_INITIALIZED | pkcs11.CKF_USER_PIN_INITIALIZED | pkcs11.CKF_LOGIN_REQUIRED,
+		},
+		Mechanisms: map[uint]pkcs11.MechanismInfo{
+			pkcs11.CKM_EC_KEY_PAIR_GEN: {Flags: pkcs11.CKF_GENERATE_KEY_PAIR},
+			pkcs11.CKM_ECDSA:           {Flags: pkcs11.CKF_SIGN},
+			pkcs11.CKM_ECDSA_SHA256:    {Flags: pkcs11.CKF_SIGN},
+		},
+		PIN:      pin,
+		queued:   make(map[string][]Result),
+		objects:  make(map[pkcs11.ObjectHandle]*object),
+		sessions: make(map[pkcs11.SessionHandle]*session),
+	}
+}
+
+// Queue scripts the results of the next calls of the function fn, e.g. "C_FindObjects", one result per call.  Calls
+// made once the queued results have been used behave normally.
+func (m *Module) Queue(fn string, results ...Result) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.queued[fn] = append(m.queued[fn], results...)
+}
+
+// Fail makes the next call of fn fail with err, without taking effect.
+func (m *Module) Fail(fn string, err error) {
+	m.Queue(fn, Result{Err: err})
+}
+
+// Calls returns the calls made to the module since it was created or Reset.
+func (m *Module) Calls() []Call {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]Call(nil), m.calls...)
+}
+
+// Fns returns the names of the functions called since the module was created or Reset, in the order they were called.
+func (m *Module) Fns() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	fns := make([]string, len(m.calls))
+	for i, c := range m.calls {
+		fns[i] = c.Fn
+	}
+	return fns
+}
+
+// Reset forgets the calls made so far, so that the calls of the next operation can be checked on their own.
+func (m *Module) Reset() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.calls = nil
+}
+
+// AddKey stores key on the token as a key pair labelled label, with the hex account address as the CKA_ID of both
+// keys, as created by the plugin.  It returns the handles of the public and private key.
+func (m *Module) AddKey(key *ecdsa.PrivateKey, label string) (pkcs11.ObjectHandle, pkcs11.ObjectHandle) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	addr, err := account.PublicKeyToAddress(&key.PublicKey)
+	if err != nil {
+		panic(err)
+	}
+	attrs := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_ID, addr.ToHexString()),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, label),
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+	}
+	pub := m.store(&object{attrs: append(cloneAttributes(attrs),
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PUBLIC_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_EC_POINT, ecPoint(&key.PublicKey)),
+	)})
+	priv := m.store(&object{key: key, attrs: append(cloneAttributes(attrs),
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PRIVATE_KEY),
+	)})
+	return pub, priv
+}
+
+// Objects returns the handles of the objects on the token, including session objects, in the order they were created.
+func (m *Module) Objects() []pkcs11.ObjectHandle {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.find(nil)
+}
+
+// Attribute returns the value of the attribute attrType of the object o, or nil if it does not have the attribute.
+func (m *Module) Attribute(o pkcs11.ObjectHandle, attrType uint) []byte {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if obj, ok := m.objects[o]; ok {
+		if a := attribute(obj.attrs, attrType); a != nil {
+			return a.Value
+		}
+	}
+	return nil
+}
+
+// CloseAllSessions closes all sessions, as when the module is restarted or loses its connection to the token, so that
+// calls using them fail with CKR_SESSION_HANDLE_INVALID.
+func (m *Module) CloseAllSessions() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.closeAllSessions()
+}
+
+// RemoveToken removes the token from its slot, closing all sessions, and InsertToken re-inserts it.  Both send a slot
+// event to any C_WaitForSlotEvent in progress.
+func (m *Module) RemoveToken() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.removed = true
+	m.closeAllSessions()
+	m.slotEvent()
+}
+
+func (m *Module) InsertToken() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.removed = false
+	m.slotEvent()
+}
+
+// Waits returns the number of blocking C_WaitForSlotEvent calls in progress.
+func (m *Module) Waits() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.events)
+}
+
+func (m *Module) GetInfo() (pkcs11.Info, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.begin(Call{Fn: "C_GetInfo"}); err != nil {
+		return pkcs11.Info{}, err
+	}
+	return m.Info, m.end()
+}
+
+func (m *Module) GetSlotList(tokenPresent bool) ([]uint, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.begin(Call{Fn: "C_GetSlotList"}); err != nil {
+		return nil, err
+	}
+	if tokenPresent && m.removed {
+		return []uint{}, m.end()
+	}
+	return []uint{SlotID}, m.end()
+}
+
+func (m *Module) GetSlotInfo(slotID uint) (pkcs11.SlotInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.begin(Call{Fn: "C_GetSlotInfo"}); err != nil {
+		return pkcs11.SlotInfo{}, err
+	}
+	if slotID != SlotID {
+		return pkcs11.SlotInfo{}, pkcs11.Error(pkcs11.CKR_SLOT_ID_INVALID)
+	}
+	info := pkcs11.SlotInfo{SlotDescription: "moduletest slot", Flags: pkcs11.CKF_REMOVABLE_DEVICE}
+	if !m.removed {
+		info.Flags |= pkcs11.CKF_TOKEN_PRESENT
+	}
+	return info, m.end()
+}
+
+func (m *Module) GetTokenInfo(slotID uint) (pkcs11.TokenInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.begin(Call{Fn: "C_GetTokenInfo"}); err != nil {
+		return pkcs11.TokenInfo{}, err
+	}
+	if err := m.slot(slotID); err != nil {
+		return pkcs11.TokenInfo{}, err
+	}
+	return m.Token, m.end()
+}
+
+// WaitForSlotEvent returns a channel which receives the next slot event, sent when the token is removed or inserted,
+// and which is closed when the module is finalized.  With CKF_DONT_BLOCK the channel is closed straight away, as the
+// fake does not queue events, as it is if the call fails, e.g. with a queued CKR_FUNCTION_NOT_SUPPORTED.
+func (m *Module) WaitForSlotEvent(flags uint) chan pkcs11.SlotEvent {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ch := make(chan pkcs11.SlotEvent, 1)
+	if err := m.begin(Call{Fn: "C_WaitForSlotEvent", Flags: flags}); err != nil || flags&pkcs11.CKF_DONT_BLOCK != 0 {
+		// as *pkcs11.Ctx, which does not return the error
+		close(ch)
+		return ch
+	}
+	m.events = append(m.events, ch)
+	return ch
+}
+
+func (m *Module) GetMechanismList(slotID uint) ([]*pkcs11.Mechanism, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.begin(Call{Fn: "C_GetMechanismList"}); err != nil {
+		return nil, err
+	}
+	if err := m.slot(slotID); err != nil {
+		return nil, err
+	}
+	types := make([]uint, 0, len(m.Mechanisms))
+	for t := range m.Mechanisms {
+		types = append(types, t)
+	}
+	sort.Slice(types, func(i, j int) bool { return types[i] < types[j] })
+	mechs := make([]*pkcs11.Mechanism, len(types))
+	for i, t := range types {
+		mechs[i] = pkcs11.NewMechanism(t, nil)
+	}
+	return mechs, m.end()
+}
+
+func (m *Module) GetMechanismInfo(slotID uint, mechs []*pkcs11.Mechanism) (pkcs11.MechanismInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.begin(Call{Fn: "C_GetMechanismInfo", Mechanisms: cloneMechanisms(mechs)}); err != nil {
+		return pkcs11.MechanismInfo{}, err
+	}
+	if err := m.slot(slotID); err != nil {
+		return pkcs11.MechanismInfo{}, err
+	}
+	info, ok := m.Mechanisms[mechs[0].Mechanism]
+	if !ok {
+		return pkcs11.MechanismInfo{}, pkcs11.Error(pkcs11.CKR_MECHANISM_INVALID)
+	}
+	return info, m.end()
+}
+
+func (m *Module) OpenSession(slotID uint, _ uint) (pkcs11.SessionHandle, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.begin(Call{Fn: "C_OpenSession"}); err != nil {
+		return 0, err
+	}
+	if err := m.slot(slotID); err != nil {
+		return 0, err
+	}
+	m.handles++
+	sh := pkcs11.SessionHandle(m.handles)
+	m.sessions[sh] = &session{}
+	return sh, m.end()
+}
+
+func (m *Module) CloseSession(sh pkcs11.SessionHandle) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.begin(Call{Fn: "C_CloseSession", Session: sh}); err != nil {
+		return err
+	}
+	if _, err := m.session(sh); err != nil {
+		return err
+	}
+	m.closeSession(sh)
+	if len(m.sessions) == 0 {
+		m.loggedIn = false
+	}
+	return m.end()
+}
+
+func (m *Module) GetSessionInfo(sh pkcs11.SessionHandle) (pkcs11.SessionInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.begin(Call{Fn: "C_GetSessionInfo", Session: sh}); err != nil {
+		return pkcs11.SessionInfo{}, err
+	}
+	if _, err := m.session(sh); err != nil {
+		return pkcs11.SessionInfo{}, err
+	}
+	info := pkcs11.SessionInfo{SlotID: SlotID, State: pkcs11.CKS_RW_PUBLIC_SESSION, Flags: pkcs11.CKF_SERIAL_SESSION | pkcs11.CKF_RW_SESSION}
+	if m.loggedIn {
+		info.State = pkcs11.CKS_RW_USER_FUNCTIONS
+	}
+	return info, m.end()
+}
+
+func (m *Module) Login(sh pkcs11.SessionHandle, userType uint, pin string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.begin(Call{Fn: "C_Login", Session: sh, UserType: userType}); err != nil {
+		return err
+	}
+	s, err := m.session(sh)
+	if err != nil {
+		return err
+	}
+	switch {
+	case userType == pkcs11.CKU_CONTEXT_SPECIFIC && s.signKey == nil:
+		return pkcs11.Error(pkcs11.CKR_OPERATION_NOT_INITIALIZED)
+	case userType == pkcs11.CKU_USER && m.loggedIn:
+		return pkcs11.Error(pkcs11.CKR_USER_ALREADY_LOGGED_IN)
+	case userType != pkcs11.CKU_USER && userType != pkcs11.CKU_CONTEXT_SPECIFIC:
+		return pkcs11.Error(pkcs11.CKR_USER_TYPE_INVALID)
+	case pin != m.PIN:
+		return pkcs11.Error(pkcs11.CKR_PIN_INCORRECT)
+	}
+	m.loggedIn = true
+	return m.end()
+}
+
+func (m *Module) Logout(sh pkcs11.SessionHandle) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.begin(Call{Fn: "C_Logout", Session: sh}); err != nil {
+		return err
+	}
+	if _, err := m.session(sh); err != nil {
+		return err
+	}
+	if !m.loggedIn {
+		return pkcs11.Error(pkcs11.CKR_USER_NOT_LOGGED_IN)
+	}
+	m.loggedIn = false
+	return m.end()
+}
+
+func (m *Module) SetPIN(sh pkcs11.SessionHandle, oldPIN string, newPIN string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.begin(Call{Fn: "C_SetPIN", Session: sh}); err != nil {
+		return err
+	}
+	if _, err := m.session(sh); err != nil {
+		return err
+	}
+	if oldPIN != m.PIN {
+		return pkcs11.Error(pkcs11.CKR_PIN_INCORRECT)
+	}
+	// the PIN may alias memory the caller wipes, as the PINs passed by the plugin do
+	m.PIN = strings.Clone(newPIN)
+	return m.end()
+}
+
+func (m *Module) GenerateKeyPair(sh pkcs11.SessionHandle, mechs []*pkcs11.Mechanism, public, private []*pkcs11.Attribute) (pkcs11.ObjectHandle, pkcs11.ObjectHandle, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	err := m.begin(Call{Fn: "C_GenerateKeyPair", Session: sh, Mechanisms: cloneMechanisms(mechs),
+		Templates: [][]*pkcs11.Attribute{cloneAttributes(public), cloneAttributes(private)}})
+	if err != nil {
+		return 0, 0, err
+	}
+	if _, err := m.session(sh); err != nil {
+		return 0, 0, err
+	}
+	if len(mechs) != 1 || mechs[0].Mechanism != pkcs11.CKM_EC_KEY_PAIR_GEN {
+		return 0, 0, pkcs11.Error(pkcs11.CKR_MECHANISM_INVALID)
+	}
+	key, err := ecdsa.GenerateKey(secp256k1.S256(), rand.Reader)
+	if err != nil {
+		return 0, 0, pkcs11.Error(pkcs11.CKR_DEVICE_ERROR)
+	}
+	pub := m.store(&object{
+		attrs:   append(keyAttributes(public), pkcs11.NewAttribute(pkcs11.CKA_EC_POINT, ecPoint(&key.PublicKey))),
+		session: m.owner(sh, public),
+	})
+	priv := m.store(&object{attrs: keyAttributes(private), key: key, session: m.owner(sh, private)})
+	if err := m.end(); err != nil {
+		// as *pkcs11.Ctx, which does not return the handles of a failed call
+		return 0, 0, err
+	}
+	return pub, priv, nil
+}
+
+func (m *Module) CreateObject(sh pkcs11.SessionHandle, template []*pkcs11.Attribute) (pkcs11.ObjectHandle, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.begin(Call{Fn: "C_CreateObject", Session: sh, Templates: [][]*pkcs11.Attribute{cloneAttributes(template)}}); err != nil {
+		return 0, err
+	}
+	if _, err := m.session(sh); err != nil {
+		return 0, err
+	}
+	obj := &object{session: m.owner(sh, template)}
+	for _, a := range template {
+		// the private key is kept as a key rather than an attribute, as it cannot be read back
+		if a.Type == pkcs11.CKA_VALUE {
+			curve := secp256k1.S256()
+			obj.key = &ecdsa.PrivateKey{PublicKey: ecdsa.PublicKey{Curve: curve}, D: new(big.Int).SetBytes(a.Value)}
+			obj.key.X, obj.key.Y = curve.ScalarBaseMult(a.Value)
+			continue
+		}
+		obj.attrs = append(obj.attrs, cloneAttribute(a))
+	}
+	obj.attrs = keyAttributes(obj.attrs)
+	o := m.store(obj)
+	if err := m.end(); err != nil {
+		return 0, err
+	}
+	return o, nil
+}
+
+func (m *Module) DestroyObject(sh pkcs11.SessionHandle, o pkcs11.ObjectHandle) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.begin(Call{Fn: "C_DestroyObject", Session: sh, Object: o}); err != nil {
+		return err
+	}
+	if _, err := m.object(sh, o); err != nil {
+		return err
+	}
+	delete(m.objects, o)
+	return m.end()
+}
+
+func (m *Module) GetAttributeValue(sh pkcs11.SessionHandle, o pkcs11.ObjectHandle, template []*pkcs11.Attribute) ([]*pkcs11.Attribute, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.begin(Call{Fn: "C_GetAttributeValue", Session: sh, Object: o, Templates: [][]*pkcs11.Attribute{cloneAttributes(template)}}); err != nil {
+		return nil, err
+	}
+	obj, err := m.object(sh, o)
+	if err != nil {
+		return nil, err
+	}
+	attrs := make([]*pkcs11.Attribute, len(template))
+	for i, t := range template {
+		a := attribute(obj.attrs, t.Type)
+		if a == nil {
+			// as *pkcs11.Ctx, which does not return the attributes which were found
+			return nil, pkcs11.Error(pkcs11.CKR_ATTRIBUTE_TYPE_INVALID)
+		}
+		attrs[i] = cloneAttribute(a)
+	}
+	return attrs, m.end()
+}
+
+func (m *Module) SetAttributeValue(sh pkcs11.SessionHandle, o pkcs11.ObjectHandle, template []*pkcs11.Attribute) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.begin(Call{Fn: "C_SetAttributeValue", Session: sh, Object: o, Templates: [][]*pkcs11.Attribute{cloneAttributes(template)}}); err != nil {
+		return err
+	}
+	obj, err := m.object(sh, o)
+	if err != nil {
+		return err
+	}
+	for _, t := range template {
+		if a := attribute(obj.attrs, t.Type); a != nil {
+			a.Value = append([]byte(nil), t.Value...)
+		} else {
+			obj.attrs = append(obj.attrs, cloneAttribute(t))
+		}
+	}
+	return m.end()
+}
+
+func (m *Module) FindObjectsInit(sh pkcs11.SessionHandle, template []*pkcs11.Attribute) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.begin(Call{Fn: "C_FindObjectsInit", Session: sh, Templates: [][]*pkcs11.Attribute{cloneAttributes(template)}}); err != nil {
+		return err
+	}
+	s, err := m.session(sh)
+	if err != nil {
+		return err
+	}
+	if s.searching {
+		return pkcs11.Error(pkcs11.CKR_OPERATION_ACTIVE)
+	}
+	s.searching, s.found = true, m.find(template)
+	return m.end()
+}
+
+func (m *Module) FindObjects(sh pkcs11.SessionHandle, max int) ([]pkcs11.ObjectHandle, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.begin(Call{Fn: "C_FindObjects", Session: sh, Max: max}); err != nil {
+		return nil, false, err
+	}
+	s, err := m.session(sh)
+	if err != nil {
+		return nil, false, err
+	}
+	if !s.searching {
+		return nil, false, pkcs11.Error(pkcs11.CKR_OPERATION_NOT_INITIALIZED)
+	}
+	n := max
+	if n > len(s.found) {
+		n = len(s.found)
+	}
+	handles := s.found[:n]
+	s.found = s.found[n:]
+	if m.result.Handles != nil {
+		handles = m.result.Handles
+	}
+	if err := m.end(); err != nil {
+		return nil, false, err
+	}
+	return handles, false, nil
+}
+
+func (m *Module) FindObjectsFinal(sh pkcs11.SessionHandle) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.begin(Call{Fn: "C_FindObjectsFinal", Session: sh}); err != nil {
+		return err
+	}
+	s, err := m.session(sh)
+	if err != nil {
+		return err
+	}
+	if !s.searching {
+		return pkcs11.Error(pkcs11.CKR_OPERATION_NOT_INITIALIZED)
+	}
+	s.searching, s.found = false, nil
+	return m.end()
+}
+
+func (m *Module) SignInit(sh pkcs11.SessionHandle, mechs []*pkcs11.Mechanism, o pkcs11.ObjectHandle) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.begin(Call{Fn: "C_SignInit", Session: sh, Object: o, Mechanisms: cloneMechanisms(mechs)}); err != nil {
+		return err
+	}
+	obj, err := m.object(sh, o)
+	if err != nil {
+		return err
+	}
+	s := m.sessions[sh]
+	switch {
+	case s.signKey != nil:
+		return pkcs11.Error(pkcs11.CKR_OPERATION_ACTIVE)
+	case obj.key == nil:
+		return pkcs11.Error(pkcs11.CKR_KEY_TYPE_INCONSISTENT)
+	case len(mechs) != 1 || (mechs[0].Mechanism != pkcs11.CKM_ECDSA && mechs[0].Mechanism != pkcs11.CKM_ECDSA_SHA256):
+		return pkcs11.Error(pkcs11.CKR_MECHANISM_INVALID)
+	}
+	s.signKey, s.mechanism = obj.key, mechs[0].Mechanism
+	return m.end()
+}
+
+// Sign ends the signing operation whether or not it succeeds.
+func (m *Module) Sign(sh pkcs11.SessionHandle, message []byte) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.begin(Call{Fn: "C_Sign", Session: sh}); err != nil {
+		return nil, err
+	}
+	s, err := m.session(sh)
+	if err != nil {
+		return nil, err
+	}
+	key, mechanism := s.signKey, s.mechanism
+	s.signKey = nil
+	if key == nil {
+		return nil, pkcs11.Error(pkcs11.CKR_OPERATION_NOT_INITIALIZED)
+	}
+	if mechanism == pkcs11.CKM_ECDSA_SHA256 {
+		hash := sha256.Sum256(message)
+		message = hash[:]
+	}
+	r, sig, err := ecdsa.Sign(rand.Reader, key, message)
+	if err != nil {
+		return nil, pkcs11.Error(pkcs11.CKR_FUNCTION_FAILED)
+	}
+	raw := make([]byte, 64)
+	r.FillBytes(raw[:32])
+	sig.FillBytes(raw[32:])
+	return raw, m.end()
+}
+
+func (m *Module) Finalize() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.begin(Call{Fn: "C_Finalize"}); err != nil {
+		return err
+	}
+	m.closeAllSessions()
+	m.finalized = true
+	for _, ch := range m.events {
+		close(ch)
+	}
+	m.events = nil
+	return m.end()
+}
+
+// Destroy is recorded as a call of "Destroy", which unloads the module rather than being a PKCS#11 function.
+func (m *Module) Destroy() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.calls = append(m.calls, Call{Fn: "Destroy"})
+}
+
+// begin records c and applies the result queued for it, returning an error if the call must fail without taking
+// effect.  A call which takes effect must return m.end() on success, which returns the error of an applied result.
+// m.mu must be held.
+func (m *Module) begin(c Call) error {
+	r := m.next(c.Fn)
+	m.calls = append(m.calls, c)
+	if r.Err != nil && !r.Apply {
+		return r.Err
+	}
+	m.result = r
+	return m.initialized()
+}
+
+// end returns the error of the result applied to the call in progress.  m.mu must be held.
+func (m *Module) end() error {
+	err := m.result.Err
+	m.result = Result{}
+	return err
+}
+
+// next removes and returns the result queued for the next call of fn, if any.  m.mu must be held.
+func (m *Module) next(fn string) Result {
+	q := m.queued[fn]
+	if len(q) == 0 {
+		return Result{}
+	}
+	m.queued[fn] = q[1:]
+	return q[0]
+}
+
+func (m *Module) initialized() error {
+	if m.finalized {
+		return pkcs11.Error(pkcs11.CKR_CRYPTOKI_NOT_INITIALIZED)
+	}
+	return nil
+}
+
+func (m *Module) slot(slotID uint) error {
+	switch {
+	case slotID != SlotID:
+		return pkcs11.Error(pkcs11.CKR_SLOT_ID_INVALID)
+	case m.removed:
+		return pkcs11.Error(pkcs11.CKR_TOKEN_NOT_PRESENT)
+	}
+	return nil
+}
+
+func (m *Module) session(sh pkcs11.SessionHandle) (*session, error) {
+	s, ok := m.sessions[sh]
+	if !ok {
+		return nil, pkcs11.Error(pkcs11.CKR_SESSION_HANDLE_INVALID)
+	}
+	return s, nil
+}
+
+func (m *Module) object(sh pkcs11.SessionHandle, o pkcs11.ObjectHandle) (*object, error) {
+	if _, err := m.session(sh); err != nil {
+		return nil, err
+	}
+	obj, ok := m.objects[o]
+	if !ok {
+		return nil, pkcs11.Error(pkcs11.CKR_OBJECT_HANDLE_INVALID)
+	}
+	return obj, nil
+}
+
+// owner returns sh if template is for a session object, or 0 if it is for a token object.
+func (m *Module) owner(sh pkcs11.SessionHandle, template []*pkcs11.Attribute) pkcs11.SessionHandle {
+	if a := attribute(template, pkcs11.CKA_TOKEN); a != nil && bytes.Equal(a.Value, pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true).Value) {
+		return 0
+	}
+	return sh
+}
+
+func (m *Module) store(obj *object) pkcs11.ObjectHandle {
+	m.handles++
+	o := pkcs11.ObjectHandle(m.handles)
+	m.objects[o] = obj
+	return o
+}
+
+// find returns the handles of the objects with all of the attributes in template, in the order they were created.
+func (m *Module) find(template []*pkcs11.Attribute) []pkcs11.ObjectHandle {
+	var found []pkcs11.ObjectHandle
+	for o, obj := range m.objects {
+		matches := true
+		for _, t := range template {
+			if a := attribute(obj.attrs, t.Type); a == nil || !bytes.Equal(a.Value, t.Value) {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			found = append(found, o)
+		}
+	}
+	sort.Slice(found, func(i, j int) bool { return found[i] < found[j] })
+	return found
+}
+
+func (m *Module) closeSession(sh pkcs11.SessionHandle) {
+	delete(m.sessions, sh)
+	for o, obj := range m.objects {
+		if obj.session == sh {
+			delete(m.objects, o)
+		}
+	}
+}
+
+func (m *Module) closeAllSessions() {
+	for sh := range m.sessions {
+		m.closeSession(sh)
+	}
+	m.loggedIn = false
+}
+
+func (m *Module) slotEvent() {
+	for _, ch := range m.events {
+		ch <- pkcs11.SlotEvent{SlotID: SlotID}
+	}
+	m.events = nil
+}
+
+func attribute(attrs []*pkcs11.Attribute, attrType uint) *pkcs11.Attribute {
+	for _, a := range attrs {
+		if a.Type == attrType {
+			return a
+		}
+	}
+	return nil
+}
+
+// keyAttributes returns a copy of the template of a key, with the attributes of keys a template may leave out set to
+// their default, empty, values.
+func keyAttributes(template []*pkcs11.Attribute) []*pkcs11.Attribute {
+	attrs := cloneAttributes(template)
+	for _, t := range []uint{pkcs11.CKA_ID, pkcs11.CKA_LABEL} {
+		if attribute(attrs, t) == nil {
+			attrs = append(attrs, pkcs11.NewAttribute(t, nil))
+		}
+	}
+	return attrs
+}
+
+func cloneAttribute(a *pkcs11.Attribute) *pkcs11.Attribute {
+	return &pkcs11.Attribute{Type: a.Type, Value: append([]byte(nil), a.Value...)}
+}
+
+func cloneAttributes(attrs []*pkcs11.Attribute) []*pkcs11.Attribute {
+	clone := make([]*pkcs11.Attribute, len(attrs))
+	for i, a := range attrs {
+		clone[i] = cloneAttribute(a)
+	}
+	return clone
+}
+
+func cloneMechanisms(mechs []*pkcs11.Mechanism) []*pkcs11.Mechanism {
+	clone := make([]*pkcs11.Mechanism, len(mechs))
+	for i, m := range mechs {
+		c := *m
+		clone[i] = &c
+	}
+	return clone
+}
+
+// ecPoint returns the CKA_EC_POINT of key: the uncompressed point as a DER OCTET STRING.
+func ecPoint(key *ecdsa.PublicKey) []byte {
+	point, err := asn1.Marshal(elliptic.Marshal(key.Curve, key.X, key.Y))
+	if err != nil {
+		panic(err)
+	}
+	return point
+}
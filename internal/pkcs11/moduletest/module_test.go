@@ -0,0 +1,82 @@
+package moduletest
+
+import (
+	"testing"
+
+	"github.com/miekg/pkcs11"
+	"github.com/stretchr/testify/require"
+)
+
+func login(t *testing.T) (*Module, pkcs11.SessionHandle) {
+	m := New("test", "1234")
+	sh, err := m.OpenSession(SlotID, pkcs11.CKF_SERIAL_SESSION|pkcs11.CKF_RW_SESSION)
+	require.NoError(t, err)
+	require.NoError(t, m.Login(sh, pkcs11.CKU_USER, "1234"))
+	m.Reset()
+	return m, sh
+}
+
+func TestModule_Queue(t *testing.T) {
+	m, sh := login(t)
+	template := []*pkcs11.Attribute{pkcs11.NewAttribute(pkcs11.CKA_LABEL, "a")}
+	m.Queue("C_CreateObject",
+		Result{Err: pkcs11.Error(pkcs11.CKR_DEVICE_ERROR)},
+		Result{Err: pkcs11.Error(pkcs11.CKR_DEVICE_ERROR), Apply: true},
+	)
+
+	_, err := m.CreateObject(sh, template)
+	require.Equal(t, pkcs11.Error(pkcs11.CKR_DEVICE_ERROR), err)
+	require.Empty(t, m.Objects())
+
+	_, err = m.CreateObject(sh, template)
+	require.Equal(t, pkcs11.Error(pkcs11.CKR_DEVICE_ERROR), err)
+	require.Len(t, m.Objects(), 1)
+
+	_, err = m.CreateObject(sh, template)
+	require.NoError(t, err)
+	require.Len(t, m.Objects(), 2)
+	require.Equal(t, []string{"C_CreateObject", "C_CreateObject", "C_CreateObject"}, m.Fns())
+}
+
+func TestModule_RecordsCopies(t *testing.T) {
+	m, sh := login(t)
+	template := []*pkcs11.Attribute{pkcs11.NewAttribute(pkcs11.CKA_LABEL, "a")}
+
+	_, err := m.CreateObject(sh, template)
+	require.NoError(t, err)
+	template[0].Value[0] = 'b'
+
+	require.Equal(t, [][]*pkcs11.Attribute{{pkcs11.NewAttribute(pkcs11.CKA_LABEL, "a")}}, m.Calls()[0].Templates)
+}
+
+func TestModule_FindObjects(t *testing.T) {
+	m, sh := login(t)
+	for i := 0; i < 3; i++ {
+		_, err := m.CreateObject(sh, []*pkcs11.Attribute{pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true)})
+		require.NoError(t, err)
+	}
+	m.Queue("C_FindObjects", Result{}, Result{Handles: []pkcs11.ObjectHandle{9}})
+
+	require.NoError(t, m.FindObjectsInit(sh, []*pkcs11.Attribute{pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true)}))
+	found, _, err := m.FindObjects(sh, 2)
+	require.NoError(t, err)
+	require.Len(t, found, 2)
+	found, _, err = m.FindObjects(sh, 2)
+	require.NoError(t, err)
+	require.Equal(t, []pkcs11.ObjectHandle{9}, found)
+	require.NoError(t, m.FindObjectsFinal(sh))
+	require.Equal(t, pkcs11.Error(pkcs11.CKR_OPERATION_NOT_INITIALIZED), m.FindObjectsFinal(sh))
+}
+
+func TestModule_CloseAllSessions(t *testing.T) {
+	m, sh := login(t)
+	_, err := m.CreateObject(sh, []*pkcs11.Attribute{pkcs11.NewAttribute(pkcs11.CKA_TOKEN, false)})
+	require.NoError(t, err)
+
+	m.CloseAllSessions()
+
+	_, err = m.GetSessionInfo(sh)
+	require.Equal(t, pkcs11.Error(pkcs11.CKR_SESSION_HANDLE_INVALID), err)
+	// session objects are destroyed with their session
+	require.Empty(t, m.Objects())
+}
@@ -0,0 +1,538 @@
+// Package pkcs11test provides an in-memory pkcs11.Cryptoki for tests which do not need a PKCS#11 library.
+package pkcs11test
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"math/big"
+	"quorum-account-plugin-pkcs-11/internal/account/account"
+	"quorum-account-plugin-pkcs-11/internal/config"
+	"quorum-account-plugin-pkcs-11/internal/pkcs11"
+	"quorum-account-plugin-pkcs-11/internal/secure"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jpmorganchase/quorum/crypto/secp256k1"
+	p11 "github.com/miekg/pkcs11"
+)
+
+// SlotID is the ID of the slot holding the fake token.
+const SlotID = 0
+
+var errNoSession = errors.New("no session has been opened")
+
+// Cryptoki is a pkcs11.Cryptoki holding secp256k1 keys in memory.  It generates keys and signs with them as a token
+// using CKM_EC_KEY_PAIR_GEN and CKM_ECDSA_SHA256 would, returning signatures as r || s.  Errors are returned as
+// *pkcs11.OperationError, as by the Cryptoki returned by pkcs11.NewCryptoki.
+//
+// The zero value is not usable, see New.
+type Cryptoki struct {
+	// Label is the label of the token
+	Label string
+	// Latency is added to each operation which uses the session, which is held for its duration
+	Latency time.Duration
+	// MaxKeys is the most key pairs the token can hold, or 0 if there is no limit.  NewAccount and ImportPrivateKey
+	// fail with CKR_DEVICE_MEMORY once the token is full.
+	MaxKeys int
+	// Caps are the capabilities of the token, reported once a session has been opened
+	Caps pkcs11.Capabilities
+
+	// session is held for the duration of each operation using the session, as by the real Cryptoki
+	session sync.Mutex
+
+	mu        sync.Mutex
+	keys      map[account.Address]*key
+	failures  map[string][]error
+	calls     map[string]int
+	open      bool
+	removed   bool
+	finalized bool
+	loggedIn  bool
+	pin       *secure.Buffer
+	changed   func(pkcs11.TokenEvent)
+	wasOpen   bool
+}
+
+type key struct {
+	priv  *ecdsa.PrivateKey
+	label string
+}
+
+var _ pkcs11.Cryptoki = (*Cryptoki)(nil)
+
+// New returns an empty token labelled label, with the capabilities needed by all of the plugin's features.
+func New(label string) *Cryptoki {
+	return &Cryptoki{
+		Label:    label,
+		Caps:     pkcs11.Capabilities{KeyGeneration: true, Signing: true, RawECDSA: true},
+		keys:     make(map[account.Address]*key),
+		failures: make(map[string][]error),
+		calls:    make(map[string]int),
+	}
+}
+
+// AddKey stores key on the token, with the CKA_LABEL label, and returns the address of its account.
+func (c *Cryptoki) AddKey(key *ecdsa.PrivateKey, label string) account.Address {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	addr, err := c.store(key, label)
+	if err != nil {
+		panic(err)
+	}
+	return addr
+}
+
+// FailNext makes the next call of the operation op, e.g. "Sign", fail with err.  Failures queued for the same
+// operation are returned by successive calls.
+func (c *Cryptoki) FailNext(op string, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.failures[op] = append(c.failures[op], err)
+}
+
+// Calls returns the number of times the operation op has been called.
+func (c *Cryptoki) Calls(op string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.calls[op]
+}
+
+// RemoveToken simulates the removal of the token from its slot: the session is closed and operations fail with
+// pkcs11.ErrTokenRemoved until InsertToken is called.  The func given to WatchToken is called.
+func (c *Cryptoki) RemoveToken() {
+	c.mu.Lock()
+	if !c.removed {
+		c.wasOpen = c.open
+	}
+	c.removed, c.open, c.loggedIn = true, false, false
+	changed := c.changed
+	c.mu.Unlock()
+	if changed != nil {
+		changed(pkcs11.TokenEvent{})
+	}
+}
+
+// InsertToken simulates the re-insertion of the token after RemoveToken.  The session is reopened if it was open when
+// the token was removed, and the func given to WatchToken is called.
+func (c *Cryptoki) InsertToken() {
+	c.mu.Lock()
+	c.removed, c.open, c.loggedIn = false, c.wasOpen, c.wasOpen
+	changed := c.changed
+	c.mu.Unlock()
+	if changed != nil {
+		changed(pkcs11.TokenEvent{Present: true, Slot: SlotID})
+	}
+}
+
+// begin records a call of op and returns the error it must fail with, if any.  If op uses the session it is held
+// until the returned func is called.  Both must be called without c.mu held.
+func (c *Cryptoki) begin(op string, useSession bool) (end func(), err error) {
+	end = func() {}
+	if useSession {
+		c.session.Lock()
+		time.Sleep(c.Latency)
+		end = c.session.Unlock
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.calls[op]++
+	if queued := c.failures[op]; len(queued) > 0 {
+		c.failures[op] = queued[1:]
+		return end, c.annotate(op, queued[0])
+	}
+	return end, nil
+}
+
+// usable returns the error operations using the session fail with.  c.mu must be held.
+func (c *Cryptoki) usable(op string) error {
+	switch {
+	case c.finalized:
+		return c.annotate(op, pkcs11.ErrFinalized)
+	case c.removed:
+		return c.annotate(op, pkcs11.ErrTokenRemoved)
+	case !c.open:
+		return c.annotate(op, errNoSession)
+	}
+	return nil
+}
+
+func (c *Cryptoki) annotate(op string, err error) error {
+	return &pkcs11.OperationError{Op: op, Slot: SlotID, SlotLabel: c.Label, Err: err}
+}
+
+// store adds key to the token.  c.mu must be held.
+func (c *Cryptoki) store(k *ecdsa.PrivateKey, label string) (account.Address, error) {
+	if c.MaxKeys > 0 && len(c.keys) >= c.MaxKeys {
+		return account.Address{}, p11.Error(p11.CKR_DEVICE_MEMORY)
+	}
+	addr, err := account.PublicKeyToAddress(&k.PublicKey)
+	if err != nil {
+		return account.Address{}, err
+	}
+	c.keys[addr] = &key{priv: k, label: label}
+	return addr, nil
+}
+
+func (c *Cryptoki) OpenSession(context.Context) error {
+	end, err := c.begin("OpenSession", true)
+	defer end()
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch {
+	case c.finalized:
+		return c.annotate("OpenSession", pkcs11.ErrFinalized)
+	case c.removed:
+		return c.annotate("OpenSession", fmt.Errorf("%w: %q", pkcs11.ErrTokenNotFound, c.Label))
+	}
+	c.open, c.loggedIn = true, true
+	return nil
+}
+
+func (c *Cryptoki) CloseSession(context.Context) error {
+	end, err := c.begin("CloseSession", true)
+	defer end()
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.open, c.loggedIn = false, false
+	return nil
+}
+
+func (c *Cryptoki) Accounts(context.Context) ([]account.Account, error) {
+	end, err := c.begin("Accounts", true)
+	defer end()
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.usable("Accounts"); err != nil {
+		return nil, err
+	}
+	accts := make([]account.Account, 0, len(c.keys))
+	for addr := range c.keys {
+		accts = append(accts, account.Account{Address: addr})
+	}
+	sort.Slice(accts, func(i, j int) bool {
+		return accts[i].Address.ToHexString() < accts[j].Address.ToHexString()
+	})
+	return accts, nil
+}
+
+func (c *Cryptoki) Contains(_ context.Context, acctAddr account.Address) bool {
+	end, err := c.begin("Contains", true)
+	defer end()
+	if err != nil {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.keys[acctAddr]
+	return ok && c.usable("Contains") == nil
+}
+
+func (c *Cryptoki) Sign(_ context.Context, toSign []byte, acctAddr account.Address) ([]byte, error) {
+	end, err := c.begin("Sign", true)
+	defer end()
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.usable("Sign"); err != nil {
+		return nil, err
+	}
+	k, ok := c.keys[acctAddr]
+	if !ok {
+		return nil, c.annotate("Sign", pkcs11.ErrKeyNotFound)
+	}
+	hash := sha256.Sum256(toSign)
+	r, s, err := ecdsa.Sign(rand.Reader, k.priv, hash[:])
+	if err != nil {
+		return nil, c.annotate("Sign", err)
+	}
+	sig := make([]byte, 64)
+	r.FillBytes(sig[:32])
+	s.FillBytes(sig[32:])
+	return sig, nil
+}
+
+// SignHash signs hash as a token using CKM_ECDSA would, returning the signature as [R || S || V] with the low S value.
+func (c *Cryptoki) SignHash(_ context.Context, hash []byte, acctAddr account.Address) ([]byte, error) {
+	end, err := c.begin("SignHash", true)
+	defer end()
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.usable("SignHash"); err != nil {
+		return nil, err
+	}
+	k, ok := c.keys[acctAddr]
+	if !ok {
+		return nil, c.annotate("SignHash", pkcs11.ErrKeyNotFound)
+	}
+	if len(hash) != 32 {
+		return nil, c.annotate("SignHash", fmt.Errorf("%w, not %v bytes", pkcs11.ErrInvalidHash, len(hash)))
+	}
+	r, s, err := ecdsa.Sign(rand.Reader, k.priv, hash)
+	if err != nil {
+		return nil, c.annotate("SignHash", err)
+	}
+	n := secp256k1.S256().Params().N
+	if s.Cmp(new(big.Int).Rsh(n, 1)) > 0 {
+		s.Sub(n, s)
+	}
+	sig := make([]byte, 65)
+	r.FillBytes(sig[:32])
+	s.FillBytes(sig[32:64])
+	want := elliptic.Marshal(k.priv.Curve, k.priv.X, k.priv.Y)
+	for v := byte(0); v < 2; v++ {
+		sig[64] = v
+		if got, err := secp256k1.RecoverPubkey(hash, sig); err == nil && bytes.Equal(got, want) {
+			return sig, nil
+		}
+	}
+	return nil, c.annotate("SignHash", errors.New("unable to find the recovery ID of the signature"))
+}
+
+func (c *Cryptoki) NewAccount(_ context.Context, conf config.NewAccount) (account.Account, error) {
+	end, err := c.begin("NewAccount", true)
+	defer end()
+	if err != nil {
+		return account.Account{}, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.usable("NewAccount"); err != nil {
+		return account.Account{}, err
+	}
+	if !c.Caps.KeyGeneration {
+		return account.Account{}, c.annotate("NewAccount", pkcs11.ErrUnsupported)
+	}
+	k, err := ecdsa.GenerateKey(secp256k1.S256(), rand.Reader)
+	if err != nil {
+		return account.Account{}, c.annotate("NewAccount", err)
+	}
+	addr, err := c.store(k, conf.SecretName)
+	if err != nil {
+		return account.Account{}, c.annotate("NewAccount", err)
+	}
+	return account.Account{Address: addr}, nil
+}
+
+// ImportPrivateKey stores privateKeyECDSA.  Unlike the real Cryptoki, it does not wipe the key, which remains in use.
+func (c *Cryptoki) ImportPrivateKey(_ context.Context, privateKeyECDSA *ecdsa.PrivateKey, conf config.NewAccount) (account.Account, error) {
+	end, err := c.begin("ImportPrivateKey", true)
+	defer end()
+	if err != nil {
+		return account.Account{}, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.usable("ImportPrivateKey"); err != nil {
+		return account.Account{}, err
+	}
+	addr, err := c.store(privateKeyECDSA, conf.SecretName)
+	if err != nil {
+		return account.Account{}, c.annotate("ImportPrivateKey", err)
+	}
+	return account.Account{Address: addr}, nil
+}
+
+func (c *Cryptoki) RotatePIN(_ context.Context, newPIN *secure.Buffer) error {
+	end, err := c.begin("RotatePIN", true)
+	defer end()
+	if err != nil {
+		newPIN.Destroy()
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.usable("RotatePIN"); err != nil {
+		newPIN.Destroy()
+		return err
+	}
+	c.pin.Destroy()
+	c.pin = newPIN
+	return nil
+}
+
+// PIN returns the user PIN last set by RotatePIN, or "" if it has not been called.
+func (c *Cryptoki) PIN() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.pin == nil {
+		return ""
+	}
+	return string(c.pin.Bytes())
+}
+
+func (c *Cryptoki) LoginState() pkcs11.LoginState {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return pkcs11.LoginState{LoggedIn: c.loggedIn}
+}
+
+func (c *Cryptoki) Sessions() pkcs11.SessionStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.open {
+		return pkcs11.SessionStats{Open: 1}
+	}
+	return pkcs11.SessionStats{}
+}
+
+func (c *Cryptoki) TokenInfo() (p11.TokenInfo, error) {
+	if _, err := c.begin("TokenInfo", false); err != nil {
+		return p11.TokenInfo{}, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.usable("TokenInfo"); err != nil {
+		return p11.TokenInfo{}, err
+	}
+	return p11.TokenInfo{Label: c.Label, ManufacturerID: "pkcs11test", Model: "in-memory", Flags: p11.CKF_TOKEN_INITIALIZED | p11.CKF_USER_PIN_INITIALIZED | p11.CKF_LOGIN_REQUIRED}, nil
+}
+
+func (c *Cryptoki) SlotInfo() (uint, p11.SlotInfo, error) {
+	if _, err := c.begin("SlotInfo", false); err != nil {
+		return 0, p11.SlotInfo{}, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.usable("SlotInfo"); err != nil {
+		return 0, p11.SlotInfo{}, err
+	}
+	return SlotID, p11.SlotInfo{SlotDescription: "pkcs11test", Flags: p11.CKF_TOKEN_PRESENT}, nil
+}
+
+func (c *Cryptoki) LibraryInfo() (p11.Info, error) {
+	if _, err := c.begin("LibraryInfo", false); err != nil {
+		return p11.Info{}, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.finalized {
+		return p11.Info{}, c.annotate("LibraryInfo", pkcs11.ErrFinalized)
+	}
+	return p11.Info{CryptokiVersion: p11.Version{Major: 2, Minor: 40}, ManufacturerID: "pkcs11test", LibraryDescription: "in-memory"}, nil
+}
+
+func (c *Cryptoki) CheckSession(context.Context) error {
+	end, err := c.begin("CheckSession", true)
+	defer end()
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.usable("CheckSession")
+}
+
+func (c *Cryptoki) RecoverSession(context.Context) error {
+	end, err := c.begin("RecoverSession", true)
+	defer end()
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.finalized || c.removed {
+		return c.usable("RecoverSession")
+	}
+	c.open, c.loggedIn = true, true
+	return nil
+}
+
+func (c *Cryptoki) PublicKey(_ context.Context, acctAddr account.Address) (*ecdsa.PublicKey, error) {
+	end, err := c.begin("PublicKey", true)
+	defer end()
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.usable("PublicKey"); err != nil {
+		return nil, err
+	}
+	k, ok := c.keys[acctAddr]
+	if !ok {
+		return nil, c.annotate("PublicKey", pkcs11.ErrKeyNotFound)
+	}
+	pub := k.priv.PublicKey
+	return &pub, nil
+}
+
+func (c *Cryptoki) KeyLabels(context.Context) (map[account.Address]string, error) {
+	end, err := c.begin("KeyLabels", true)
+	defer end()
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.usable("KeyLabels"); err != nil {
+		return nil, err
+	}
+	labels := make(map[account.Address]string, len(c.keys))
+	for addr, k := range c.keys {
+		labels[addr] = k.label
+	}
+	return labels, nil
+}
+
+// WatchToken calls changed when RemoveToken and InsertToken are called, until stop is called.  The interval is
+// ignored.
+func (c *Cryptoki) WatchToken(_ time.Duration, changed func(pkcs11.TokenEvent)) (stop func()) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.changed = changed
+	return func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.changed = nil
+	}
+}
+
+func (c *Cryptoki) Capabilities() *pkcs11.Capabilities {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.open {
+		return nil
+	}
+	caps := c.Caps
+	return &caps
+}
+
+// Profile returns a profile with no quirks.
+func (c *Cryptoki) Profile() *pkcs11.Profile {
+	return &pkcs11.Profile{Name: "pkcs11test", ContextSpecificLogin: true}
+}
+
+func (c *Cryptoki) Finalize(context.Context) error {
+	end, err := c.begin("Finalize", true)
+	defer end()
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.open, c.loggedIn, c.finalized = false, false, true
+	c.pin.Destroy()
+	c.pin = nil
+	return nil
+}
@@ -0,0 +1,121 @@
+package pkcs11test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"errors"
+	"math/big"
+	"quorum-account-plugin-pkcs-11/internal/config"
+	"quorum-account-plugin-pkcs-11/internal/pkcs11"
+	"testing"
+	"time"
+
+	p11 "github.com/miekg/pkcs11"
+	"github.com/stretchr/testify/require"
+)
+
+func open(t *testing.T) *Cryptoki {
+	c := New("test")
+	require.NoError(t, c.OpenSession(context.Background()))
+	return c
+}
+
+func TestCryptoki_Sign(t *testing.T) {
+	ctx := context.Background()
+	c := open(t)
+	acct, err := c.NewAccount(ctx, config.NewAccount{SecretName: "validator-1"})
+	require.NoError(t, err)
+
+	sig, err := c.Sign(ctx, []byte("msg"), acct.Address)
+
+	require.NoError(t, err)
+	require.Len(t, sig, 64)
+	pub, err := c.PublicKey(ctx, acct.Address)
+	require.NoError(t, err)
+	hash := sha256.Sum256([]byte("msg"))
+	require.True(t, ecdsa.Verify(pub, hash[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])))
+	require.True(t, c.Contains(ctx, acct.Address))
+	labels, err := c.KeyLabels(ctx)
+	require.NoError(t, err)
+	require.Equal(t, "validator-1", labels[acct.Address])
+}
+
+func TestCryptoki_MaxKeys(t *testing.T) {
+	ctx := context.Background()
+	c := open(t)
+	c.MaxKeys = 1
+
+	_, err := c.NewAccount(ctx, config.NewAccount{SecretName: "a"})
+	require.NoError(t, err)
+	_, err = c.NewAccount(ctx, config.NewAccount{SecretName: "b"})
+	require.True(t, errors.Is(err, p11.Error(p11.CKR_DEVICE_MEMORY)))
+}
+
+func TestCryptoki_FailNext(t *testing.T) {
+	ctx := context.Background()
+	c := open(t)
+	c.FailNext("Accounts", p11.Error(p11.CKR_DEVICE_ERROR))
+
+	_, err := c.Accounts(ctx)
+	var opErr *pkcs11.OperationError
+	require.ErrorAs(t, err, &opErr)
+	require.Equal(t, "Accounts", opErr.Op)
+	require.True(t, errors.Is(err, p11.Error(p11.CKR_DEVICE_ERROR)))
+
+	_, err = c.Accounts(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 2, c.Calls("Accounts"))
+}
+
+func TestCryptoki_Latency(t *testing.T) {
+	c := open(t)
+	c.Latency = 20 * time.Millisecond
+
+	start := time.Now()
+	_, err := c.Accounts(context.Background())
+
+	require.NoError(t, err)
+	require.GreaterOrEqual(t, time.Since(start), c.Latency)
+}
+
+func TestCryptoki_RemoveToken(t *testing.T) {
+	ctx := context.Background()
+	c := open(t)
+	var events []pkcs11.TokenEvent
+	stop := c.WatchToken(time.Second, func(ev pkcs11.TokenEvent) { events = append(events, ev) })
+	defer stop()
+
+	c.RemoveToken()
+	_, err := c.Accounts(ctx)
+	require.ErrorIs(t, err, pkcs11.ErrTokenRemoved)
+
+	c.InsertToken()
+	_, err = c.Accounts(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []pkcs11.TokenEvent{{}, {Present: true, Slot: SlotID}}, events)
+}
+
+func TestCryptoki_RemoveToken_SessionClosed(t *testing.T) {
+	ctx := context.Background()
+	c := open(t)
+	require.NoError(t, c.CloseSession(ctx))
+
+	c.RemoveToken()
+	c.InsertToken()
+
+	_, err := c.Accounts(ctx)
+	require.ErrorIs(t, err, errNoSession)
+	require.False(t, c.LoginState().LoggedIn)
+}
+
+func TestCryptoki_Finalize(t *testing.T) {
+	ctx := context.Background()
+	c := open(t)
+
+	require.NoError(t, c.Finalize(ctx))
+
+	_, err := c.Accounts(ctx)
+	require.ErrorIs(t, err, pkcs11.ErrFinalized)
+	require.ErrorIs(t, c.OpenSession(ctx), pkcs11.ErrFinalized)
+}
@@ -0,0 +1,195 @@
+package pkcs11
+
+import (
+	"crypto/ecdsa"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"math/big"
+	"quorum-account-plugin-pkcs-11/internal/account/account"
+	"quorum-account-plugin-pkcs-11/internal/config"
+	"strings"
+
+	"github.com/miekg/pkcs11"
+)
+
+// Profile describes the quirks of a family of PKCS#11 modules, which the plugin works around.
+type Profile struct {
+	Name string
+	// Manufacturer is the prefix of the C_GetInfo manufacturerID of the modules the profile is detected for, or empty
+	// if the profile is only used when configured
+	Manufacturer string
+	// UnsupportedAttributes are left out of the templates of the objects the plugin creates, for modules which reject
+	// templates containing them
+	UnsupportedAttributes []uint
+	// FindObjectsBatch is the most object handles requested by each C_FindObjects call, or 0 if there is no limit
+	FindObjectsBatch int
+	// ImmutableID is set for modules on which the CKA_ID of an object cannot be changed once it is created.  Imported
+	// keys are created with their CKA_ID set; key pairs cannot be generated, as their address is only known once they
+	// are created.
+	ImmutableID bool
+	// PublicKeyInfo is set if the public key of a generated key pair is read from CKA_PUBLIC_KEY_INFO, which was added
+	// in PKCS#11 2.40, rather than CKA_EC_POINT
+	PublicKeyInfo bool
+	// DERSignatures is set for modules which may return ECDSA signatures DER encoded, rather than as r || s
+	DERSignatures bool
+	// ContextSpecificLogin is set if the module supports CKU_CONTEXT_SPECIFIC logins, as needed to authenticate the
+	// use of keys with CKA_ALWAYS_AUTHENTICATE set, see config.UnlockEntry.Credential
+	ContextSpecificLogin bool
+}
+
+// profiles are the built-in profiles, by name.  Their names are config.Profiles.
+var profiles = map[string]*Profile{
+	config.ProfileSoftHSM2: {
+		Name:                 config.ProfileSoftHSM2,
+		Manufacturer:         "SoftHSM",
+		ContextSpecificLogin: true,
+	},
+	config.ProfileGeneric220: {
+		Name:                 config.ProfileGeneric220,
+		DERSignatures:        true,
+		ContextSpecificLogin: true,
+	},
+	config.ProfileGeneric240: {
+		Name:                 config.ProfileGeneric240,
+		PublicKeyInfo:        true,
+		ContextSpecificLogin: true,
+	},
+	// cloud HSM modules restrict the attributes of EC keys to those needed to sign, limit the size of each page of
+	// search results and do not allow objects to be modified
+	config.ProfileCloudHSM: {
+		Name:                  config.ProfileCloudHSM,
+		UnsupportedAttributes: []uint{pkcs11.CKA_ENCRYPT, pkcs11.CKA_DECRYPT, pkcs11.CKA_WRAP},
+		FindObjectsBatch:      32,
+		ImmutableID:           true,
+		DERSignatures:         true,
+	},
+}
+
+// infoSource is the part of the PKCS#11 API used to detect the profile of a module.  It is implemented by
+// *pkcs11.Ctx.
+type infoSource interface {
+	GetInfo() (pkcs11.Info, error)
+}
+
+// selectProfile returns the profile named name or, if name is empty, the profile detected from the C_GetInfo of the
+// module: the profile for its manufacturer, or else the generic profile for the version of PKCS#11 it implements.
+func selectProfile(src infoSource, name string) (*Profile, error) {
+	if name != "" {
+		p, ok := profiles[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown PKCS#11 module profile %q", name)
+		}
+		return p, nil
+	}
+	info, err := src.GetInfo()
+	if err != nil {
+		return nil, fmt.Errorf("unable to detect PKCS#11 module profile: %w", err)
+	}
+	for _, p := range profiles {
+		if p.Manufacturer != "" && strings.HasPrefix(strings.TrimSpace(info.ManufacturerID), p.Manufacturer) {
+			return p, nil
+		}
+	}
+	if v := info.CryptokiVersion; v.Major > 2 || (v.Major == 2 && v.Minor >= 40) {
+		return profiles[config.ProfileGeneric240], nil
+	}
+	return profiles[config.ProfileGeneric220], nil
+}
+
+// template returns attrs without the attributes the module does not support.
+func (p *Profile) template(attrs ...*pkcs11.Attribute) []*pkcs11.Attribute {
+	template := make([]*pkcs11.Attribute, 0, len(attrs))
+	for _, a := range attrs {
+		if !p.unsupported(a.Type) {
+			template = append(template, a)
+		}
+	}
+	return template
+}
+
+func (p *Profile) unsupported(attr uint) bool {
+	for _, u := range p.UnsupportedAttributes {
+		if u == attr {
+			return true
+		}
+	}
+	return false
+}
+
+// publicKeyAttribute is the attribute the public key of a generated key pair is read from.
+func (p *Profile) publicKeyAttribute() uint {
+	if p.PublicKeyInfo {
+		return pkcs11.CKA_PUBLIC_KEY_INFO
+	}
+	return pkcs11.CKA_EC_POINT
+}
+
+// publicKey parses the public key read from the attribute attr, either CKA_PUBLIC_KEY_INFO or CKA_EC_POINT.
+func publicKey(attr *pkcs11.Attribute) (*ecdsa.PublicKey, error) {
+	if attr.Type != pkcs11.CKA_PUBLIC_KEY_INFO {
+		return account.ECPointToPublicKey(attr.Value)
+	}
+	var info struct {
+		Algorithm pkix.AlgorithmIdentifier
+		PublicKey asn1.BitString
+	}
+	if rest, err := asn1.Unmarshal(attr.Value, &info); err != nil || len(rest) > 0 {
+		return nil, errors.New("invalid CKA_PUBLIC_KEY_INFO: expected a DER SubjectPublicKeyInfo")
+	}
+	return account.ECPointToPublicKey(info.PublicKey.RightAlign())
+}
+
+// signature returns sig, as returned by C_Sign, as r || s.  A signature of any other length is an error, unless the
+// module may return signatures DER encoded and sig is a DER ECDSA-Sig-Value.
+func (p *Profile) signature(sig []byte) ([]byte, error) {
+	if len(sig) == 2*ecKeySize/8 {
+		return sig, nil
+	}
+	if !p.DERSignatures {
+		return nil, fmt.Errorf("invalid signature: expected %v bytes", 2*ecKeySize/8)
+	}
+	var rs struct{ R, S *big.Int }
+	if rest, err := asn1.Unmarshal(sig, &rs); err != nil || len(rest) > 0 || rs.R.Sign() <= 0 || rs.S.Sign() <= 0 ||
+		rs.R.BitLen() > ecKeySize || rs.S.BitLen() > ecKeySize {
+		return nil, fmt.Errorf("invalid signature: expected %v bytes or a DER ECDSA-Sig-Value", 2*ecKeySize/8)
+	}
+	raw := make([]byte, 2*ecKeySize/8)
+	rs.R.FillBytes(raw[:ecKeySize/8])
+	rs.S.FillBytes(raw[ecKeySize/8:])
+	return raw, nil
+}
+
+// objectFinder is the part of the PKCS#11 API used by findObjectHandles.  It is implemented by *pkcs11.Ctx.
+type objectFinder interface {
+	FindObjects(sh pkcs11.SessionHandle, max int) ([]pkcs11.ObjectHandle, bool, error)
+}
+
+// findObjectsBatch is the number of handles requested by each C_FindObjects call when all of the objects found are
+// wanted, unless the profile limits it further.
+const findObjectsBatch = 100
+
+// findObjectHandles returns up to max handles, or all handles if max is 0, of the objects found by the search
+// initialized in session, requesting at most batch handles per C_FindObjects call if batch is not 0.
+func findObjectHandles(src objectFinder, session pkcs11.SessionHandle, max, batch int) ([]pkcs11.ObjectHandle, error) {
+	var handles []pkcs11.ObjectHandle
+	for max == 0 || len(handles) < max {
+		n := max - len(handles)
+		if max == 0 {
+			n = findObjectsBatch
+		}
+		if batch > 0 && n > batch {
+			n = batch
+		}
+		found, _, err := src.FindObjects(session, n)
+		if err != nil {
+			return nil, err
+		}
+		handles = append(handles, found...)
+		if len(found) < n {
+			break
+		}
+	}
+	return handles, nil
+}
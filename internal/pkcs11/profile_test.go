@@ -0,0 +1,201 @@
+package pkcs11
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"math/big"
+	"quorum-account-plugin-pkcs-11/internal/account/account"
+	"quorum-account-plugin-pkcs-11/internal/config"
+	"testing"
+
+	"github.com/miekg/pkcs11"
+	"github.com/stretchr/testify/require"
+)
+
+type stubInfo struct {
+	info pkcs11.Info
+	err  error
+}
+
+func (s stubInfo) GetInfo() (pkcs11.Info, error) {
+	return s.info, s.err
+}
+
+func TestProfiles(t *testing.T) {
+	require.Len(t, profiles, len(config.Profiles))
+	for _, name := range config.Profiles {
+		require.Equal(t, name, profiles[name].Name)
+	}
+}
+
+func TestSelectProfile(t *testing.T) {
+	tests := map[string]struct {
+		info pkcs11.Info
+		name string
+		want string
+	}{
+		"configured":   {info: pkcs11.Info{ManufacturerID: "SoftHSM"}, name: config.ProfileCloudHSM, want: config.ProfileCloudHSM},
+		"manufacturer": {info: pkcs11.Info{ManufacturerID: "SoftHSM                         ", CryptokiVersion: pkcs11.Version{Major: 2, Minor: 40}}, want: config.ProfileSoftHSM2},
+		"2.40":         {info: pkcs11.Info{ManufacturerID: "Vendor", CryptokiVersion: pkcs11.Version{Major: 2, Minor: 40}}, want: config.ProfileGeneric240},
+		"3.0":          {info: pkcs11.Info{ManufacturerID: "Vendor", CryptokiVersion: pkcs11.Version{Major: 3}}, want: config.ProfileGeneric240},
+		"2.20":         {info: pkcs11.Info{ManufacturerID: "Vendor", CryptokiVersion: pkcs11.Version{Major: 2, Minor: 20}}, want: config.ProfileGeneric220},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, err := selectProfile(stubInfo{info: tt.info}, tt.name)
+
+			require.NoError(t, err)
+			require.Equal(t, tt.want, got.Name)
+		})
+	}
+}
+
+func TestSelectProfile_Errors(t *testing.T) {
+	_, err := selectProfile(stubInfo{}, "hsm")
+	require.EqualError(t, err, `unknown PKCS#11 module profile "hsm"`)
+
+	_, err = selectProfile(stubInfo{err: pkcs11.Error(pkcs11.CKR_GENERAL_ERROR)}, "")
+	require.True(t, errors.Is(err, pkcs11.Error(pkcs11.CKR_GENERAL_ERROR)))
+}
+
+func TestProfile_Template(t *testing.T) {
+	got := profiles[config.ProfileCloudHSM].template(
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PRIVATE_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_SIGN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_DECRYPT, false),
+	)
+
+	require.Equal(t, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PRIVATE_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_SIGN, true),
+	}, got)
+	require.Len(t, profiles[config.ProfileSoftHSM2].template(pkcs11.NewAttribute(pkcs11.CKA_DECRYPT, false)), 1)
+}
+
+func testKey(t *testing.T) *ecdsa.PrivateKey {
+	key, err := account.NewKeyFromHexString("0x1fe8f1ad4053326db20529257ac9401f2e6c769ef1d736b8c2f5aba5f787c72b")
+	require.NoError(t, err)
+	return key
+}
+
+func TestPublicKey(t *testing.T) {
+	key := testKey(t)
+	point := elliptic.Marshal(key.Curve, key.X, key.Y)
+	ecPoint, err := asn1.Marshal(point)
+	require.NoError(t, err)
+	info, err := asn1.Marshal(struct {
+		Algorithm pkix.AlgorithmIdentifier
+		PublicKey asn1.BitString
+	}{
+		Algorithm: pkix.AlgorithmIdentifier{Algorithm: asn1.ObjectIdentifier{1, 2, 840, 10045, 2, 1}},
+		PublicKey: asn1.BitString{Bytes: point, BitLength: 8 * len(point)},
+	})
+	require.NoError(t, err)
+
+	for _, attr := range []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_EC_POINT, ecPoint),
+		pkcs11.NewAttribute(pkcs11.CKA_PUBLIC_KEY_INFO, info),
+	} {
+		got, err := publicKey(attr)
+		require.NoError(t, err)
+		require.Equal(t, &key.PublicKey, got)
+	}
+
+	_, err = publicKey(pkcs11.NewAttribute(pkcs11.CKA_PUBLIC_KEY_INFO, ecPoint))
+	require.EqualError(t, err, "invalid CKA_PUBLIC_KEY_INFO: expected a DER SubjectPublicKeyInfo")
+}
+
+func TestProfile_Signature(t *testing.T) {
+	r, s := big.NewInt(1), new(big.Int).Lsh(big.NewInt(1), 255)
+	der, err := asn1.Marshal(struct{ R, S *big.Int }{r, s})
+	require.NoError(t, err)
+	raw := make([]byte, 64)
+	r.FillBytes(raw[:32])
+	s.FillBytes(raw[32:])
+
+	got, err := profiles[config.ProfileCloudHSM].signature(der)
+	require.NoError(t, err)
+	require.Equal(t, raw, got)
+
+	got, err = profiles[config.ProfileCloudHSM].signature(raw)
+	require.NoError(t, err)
+	require.Equal(t, raw, got)
+
+	_, err = profiles[config.ProfileCloudHSM].signature([]byte{1, 2, 3})
+	require.EqualError(t, err, "invalid signature: expected 64 bytes or a DER ECDSA-Sig-Value")
+
+	// signatures are only parsed for modules which may return them DER encoded
+	_, err = profiles[config.ProfileSoftHSM2].signature(der)
+	require.EqualError(t, err, "invalid signature: expected 64 bytes")
+	got, err = profiles[config.ProfileSoftHSM2].signature(raw)
+	require.NoError(t, err)
+	require.Equal(t, raw, got)
+}
+
+func FuzzProfile_Signature(f *testing.F) {
+	r, s := big.NewInt(1), new(big.Int).Lsh(big.NewInt(1), 255)
+	der, err := asn1.Marshal(struct{ R, S *big.Int }{r, s})
+	require.NoError(f, err)
+	negative, err := asn1.Marshal(struct{ R, S *big.Int }{big.NewInt(-1), s})
+	require.NoError(f, err)
+	long, err := asn1.Marshal(struct{ R, S *big.Int }{r, new(big.Int).Lsh(big.NewInt(1), 256)})
+	require.NoError(f, err)
+	for _, seed := range [][]byte{nil, {1, 2, 3}, make([]byte, 64), der, negative, long, append(der, 0)} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, sig []byte) {
+		for name, p := range profiles {
+			got, err := p.signature(sig)
+			if err == nil {
+				require.Len(t, got, 64, name)
+			}
+		}
+	})
+}
+
+// stubFinder is a module with objects handles [1, objects] found by any search.  It records the max of each
+// C_FindObjects call.
+type stubFinder struct {
+	objects int
+	found   int
+	calls   []int
+}
+
+func (s *stubFinder) FindObjects(_ pkcs11.SessionHandle, max int) ([]pkcs11.ObjectHandle, bool, error) {
+	s.calls = append(s.calls, max)
+	var handles []pkcs11.ObjectHandle
+	for ; s.found < s.objects && len(handles) < max; s.found++ {
+		handles = append(handles, pkcs11.ObjectHandle(s.found+1))
+	}
+	return handles, false, nil
+}
+
+func TestFindObjectHandles(t *testing.T) {
+	tests := map[string]struct {
+		objects, max, batch int
+		wantFound           int
+		wantCalls           []int
+	}{
+		"unlimited":       {objects: 70, max: 100, wantFound: 70, wantCalls: []int{100}},
+		"batches":         {objects: 70, max: 100, batch: 32, wantFound: 70, wantCalls: []int{32, 32, 32}},
+		"exact batches":   {objects: 64, max: 100, batch: 32, wantFound: 64, wantCalls: []int{32, 32, 32}},
+		"max":             {objects: 70, max: 40, batch: 32, wantFound: 40, wantCalls: []int{32, 8}},
+		"batch above max": {objects: 5, max: 1, batch: 32, wantFound: 1, wantCalls: []int{1}},
+		"all":             {objects: 250, wantFound: 250, wantCalls: []int{100, 100, 100}},
+		"all in batches":  {objects: 70, batch: 32, wantFound: 70, wantCalls: []int{32, 32, 32}},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			finder := &stubFinder{objects: tt.objects}
+
+			got, err := findObjectHandles(finder, 0, tt.max, tt.batch)
+
+			require.NoError(t, err)
+			require.Len(t, got, tt.wantFound)
+			require.Equal(t, tt.wantCalls, finder.calls)
+		})
+	}
+}
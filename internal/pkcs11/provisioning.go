@@ -0,0 +1,161 @@
+package pkcs11
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"quorum-account-plugin-pkcs-11/internal/config"
+	"quorum-account-plugin-pkcs-11/internal/secure"
+
+	"github.com/miekg/pkcs11"
+)
+
+// TokenAdmin performs Security Officer and user PIN provisioning operations on the tokens of a PKCS#11 library.
+// Unlike Cryptoki it does not hold a logged-in session; each operation opens and closes the sessions it needs.
+type TokenAdmin struct {
+	ctx  *pkcs11.Ctx
+	path string
+}
+
+// NewTokenAdmin loads and initializes the PKCS#11 library at libPath.  Close must be called once the TokenAdmin is no
+// longer needed.
+func NewTokenAdmin(libPath string) (*TokenAdmin, error) {
+	return NewLibraryTokenAdmin(config.Pkcs11Library{Path: &url.URL{Scheme: "file", Path: libPath}})
+}
+
+// NewLibraryTokenAdmin loads and initializes the PKCS#11 library l, with its initialize args and environment, as
+// NewCryptoki does.  Close must be called once the TokenAdmin is no longer needed.
+func NewLibraryTokenAdmin(l config.Pkcs11Library) (*TokenAdmin, error) {
+	if _, err := os.Stat(l.Path.Path); os.IsNotExist(err) {
+		return nil, err
+	}
+
+	ctx, err := loadModule(l)
+	if err != nil {
+		return nil, err
+	}
+	return &TokenAdmin{ctx: ctx, path: l.Path.Path}, nil
+}
+
+// Close finalizes, unless it is still in use by a Cryptoki, and unloads the PKCS#11 library.
+func (t *TokenAdmin) Close() error {
+	return unloadModule(t.path, t.ctx, t.ctx.Finalize)
+}
+
+// InitToken initializes the token in slotID (C_InitToken), setting its label and Security Officer PIN.  Any objects
+// already stored on the token are destroyed.
+func (t *TokenAdmin) InitToken(slotID uint, soPIN *secure.Buffer, label string) error {
+	if label == "" {
+		return errors.New("token label must be set")
+	}
+	if soPIN.Len() == 0 {
+		return errors.New("SO PIN must be set")
+	}
+	return t.ctx.InitToken(slotID, soPIN.UnsafeString(), label)
+}
+
+// InitPIN logs in to the token labelled slotLabel as Security Officer and sets the normal user's PIN (C_InitPIN).
+func (t *TokenAdmin) InitPIN(slotLabel string, soPIN, userPIN *secure.Buffer) error {
+	if userPIN.Len() == 0 {
+		return errors.New("user PIN must be set")
+	}
+	return t.withSession(slotLabel, pkcs11.CKU_SO, soPIN, func(session pkcs11.SessionHandle) error {
+		return t.ctx.InitPIN(session, userPIN.UnsafeString())
+	})
+}
+
+// SetPIN changes the PIN of the given user type (pkcs11.CKU_USER or pkcs11.CKU_SO) on the token labelled slotLabel
+// (C_SetPIN).
+func (t *TokenAdmin) SetPIN(slotLabel string, userType uint, oldPIN, newPIN *secure.Buffer) error {
+	if newPIN.Len() == 0 {
+		return errors.New("new PIN must be set")
+	}
+	return t.withSession(slotLabel, userType, oldPIN, func(session pkcs11.SessionHandle) error {
+		return t.ctx.SetPIN(session, oldPIN.UnsafeString(), newPIN.UnsafeString())
+	})
+}
+
+// FreeSlot returns the first slot holding a token which has not been initialized, as SoftHSM always has, for InitToken.
+func (t *TokenAdmin) FreeSlot() (uint, error) {
+	slots, err := t.ctx.GetSlotList(true)
+	if err != nil {
+		return 0, err
+	}
+	for _, s := range slots {
+		info, err := t.ctx.GetTokenInfo(s)
+		if err == nil && info.Flags&pkcs11.CKF_TOKEN_INITIALIZED == 0 {
+			return s, nil
+		}
+	}
+	return 0, fmt.Errorf("no free slot in %v", slots)
+}
+
+// DestroyObjects destroys every object labelled label on the token in slotID (C_DestroyObject), returning how many were
+// destroyed.  It does not login: login state is shared by all of the sessions of the process, so private objects are
+// only found while a Cryptoki using the same library is logged in to the token.
+func (t *TokenAdmin) DestroyObjects(slotID uint, label string) (int, error) {
+	session, err := t.ctx.OpenSession(slotID, pkcs11.CKF_SERIAL_SESSION|pkcs11.CKF_RW_SESSION)
+	if err != nil {
+		return 0, err
+	}
+	defer t.ctx.CloseSession(session)
+
+	if err := t.ctx.FindObjectsInit(session, []*pkcs11.Attribute{pkcs11.NewAttribute(pkcs11.CKA_LABEL, label)}); err != nil {
+		return 0, err
+	}
+	objects, err := findObjectHandles(t.ctx, session, 0, findObjectsBatch)
+	t.ctx.FindObjectsFinal(session)
+	if err != nil {
+		return 0, err
+	}
+	for i, o := range objects {
+		if err := t.ctx.DestroyObject(session, o); err != nil {
+			return i, err
+		}
+	}
+	return len(objects), nil
+}
+
+// withSession opens a R/W session on the token labelled slotLabel, logs in as userType and calls fn.  The session is
+// logged out and closed before returning.
+func (t *TokenAdmin) withSession(slotLabel string, userType uint, pin *secure.Buffer, fn func(pkcs11.SessionHandle) error) error {
+	slot, err := findSlot(t.ctx, slotLabel)
+	if err != nil {
+		return err
+	}
+	session, err := t.ctx.OpenSession(slot, pkcs11.CKF_SERIAL_SESSION|pkcs11.CKF_RW_SESSION)
+	if err != nil {
+		return err
+	}
+	defer t.ctx.CloseSession(session)
+
+	if err := t.ctx.Login(session, userType, pin.UnsafeString()); err != nil {
+		return err
+	}
+	defer t.ctx.Logout(session)
+
+	return fn(session)
+}
+
+// slotFinder is the part of the PKCS#11 API used by findSlot.  It is implemented by *pkcs11.Ctx.
+type slotFinder interface {
+	GetSlotList(tokenPresent bool) ([]uint, error)
+	GetTokenInfo(slotID uint) (pkcs11.TokenInfo, error)
+}
+
+// findSlot returns the ID of the first slot containing a token with the given label.
+func findSlot(ctx slotFinder, label string) (uint, error) {
+	slots, err := ctx.GetSlotList(true)
+	if err != nil {
+		return 0, err
+	}
+	for _, s := range slots {
+		info, err := ctx.GetTokenInfo(s)
+		if err != nil || info.Label != label {
+			continue
+		}
+		return s, nil
+	}
+	return 0, fmt.Errorf("%w: %q", ErrTokenNotFound, label)
+}
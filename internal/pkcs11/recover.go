@@ -0,0 +1,40 @@
+package pkcs11
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/jpmorganchase/quorum/crypto/secp256k1"
+)
+
+// hashSize is the size in bytes of the Keccak-256 hashes signed by SignHash
+const hashSize = 32
+
+// recoverableSignature converts sig, a CKM_ECDSA signature of hash as r || s, to the [R || S || V] form with the low S
+// value required by Ethereum, finding the recovery ID V which recovers the public key pub.
+func recoverableSignature(sig, hash []byte, pub *ecdsa.PublicKey) ([]byte, error) {
+	if len(sig) != 2*ecKeySize/8 {
+		return nil, fmt.Errorf("invalid signature: expected %v bytes", 2*ecKeySize/8)
+	}
+	r, s := new(big.Int).SetBytes(sig[:ecKeySize/8]), new(big.Int).SetBytes(sig[ecKeySize/8:])
+	n := secp256k1.S256().Params().N
+	if s.Cmp(new(big.Int).Rsh(n, 1)) > 0 {
+		s.Sub(n, s)
+	}
+
+	want := elliptic.Marshal(pub.Curve, pub.X, pub.Y)
+	recoverable := make([]byte, 2*ecKeySize/8+1)
+	r.FillBytes(recoverable[:ecKeySize/8])
+	s.FillBytes(recoverable[ecKeySize/8 : 2*ecKeySize/8])
+	for v := byte(0); v < 2; v++ {
+		recoverable[2*ecKeySize/8] = v
+		if got, err := secp256k1.RecoverPubkey(hash, recoverable); err == nil && bytes.Equal(got, want) {
+			return recoverable, nil
+		}
+	}
+	return nil, errors.New("the public key of the account cannot be recovered from the signature")
+}
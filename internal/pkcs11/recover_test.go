@@ -0,0 +1,49 @@
+package pkcs11
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"math/big"
+	"testing"
+
+	"github.com/jpmorganchase/quorum/crypto/secp256k1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecoverableSignature(t *testing.T) {
+	key, err := ecdsa.GenerateKey(secp256k1.S256(), rand.Reader)
+	require.NoError(t, err)
+	hash := make([]byte, hashSize)
+	_, err = rand.Read(hash)
+	require.NoError(t, err)
+	r, s, err := ecdsa.Sign(rand.Reader, key, hash)
+	require.NoError(t, err)
+
+	raw := make([]byte, 64)
+	r.FillBytes(raw[:32])
+	s.FillBytes(raw[32:])
+	// the high S value of the same signature
+	high := make([]byte, 64)
+	r.FillBytes(high[:32])
+	new(big.Int).Sub(secp256k1.S256().Params().N, s).FillBytes(high[32:])
+
+	for name, sig := range map[string][]byte{"raw": raw, "high S": high} {
+		t.Run(name, func(t *testing.T) {
+			got, err := recoverableSignature(sig, hash, &key.PublicKey)
+			require.NoError(t, err)
+			require.Len(t, got, 65)
+			require.LessOrEqual(t, new(big.Int).SetBytes(got[32:64]).Cmp(new(big.Int).Rsh(secp256k1.S256().Params().N, 1)), 0)
+			recovered, err := secp256k1.RecoverPubkey(hash, got)
+			require.NoError(t, err)
+			require.Equal(t, elliptic.Marshal(key.Curve, key.X, key.Y), recovered)
+		})
+	}
+
+	other, err := ecdsa.GenerateKey(secp256k1.S256(), rand.Reader)
+	require.NoError(t, err)
+	_, err = recoverableSignature(raw, hash, &other.PublicKey)
+	require.Error(t, err)
+	_, err = recoverableSignature([]byte{1, 2, 3}, hash, &key.PublicKey)
+	require.Error(t, err)
+}
@@ -0,0 +1,203 @@
+package pkcs11
+
+import (
+	"errors"
+	"quorum-account-plugin-pkcs-11/internal/logging"
+	"sync"
+	"time"
+
+	"github.com/miekg/pkcs11"
+)
+
+const (
+	// waitReturnedEarly is how soon a blocking wait for a slot event must return for it to be counted as not having
+	// blocked
+	waitReturnedEarly = 100 * time.Millisecond
+	// maxEarlyReturns is the number of consecutive blocking waits returning early after which the library is assumed not
+	// to support them.  pkcs11.Ctx.WaitForSlotEvent does not return the CKR of C_WaitForSlotEvent, so
+	// CKR_FUNCTION_NOT_SUPPORTED can only be recognized by the wait returning straight away.
+	maxEarlyReturns = 3
+)
+
+// TokenEvent describes the removal or re-insertion of the token.
+type TokenEvent struct {
+	// Present is set if the token was re-inserted, and unset if it was removed
+	Present bool
+	// Slot is the ID of the slot the token was re-inserted in
+	Slot uint
+	// Err is set if the session could not be reopened after the token was re-inserted
+	Err error
+}
+
+// slotEventSource is the part of the PKCS#11 API used to watch the slots.  It is implemented by *pkcs11.Ctx.
+type slotEventSource interface {
+	slotFinder
+	WaitForSlotEvent(flags uint) chan pkcs11.SlotEvent
+}
+
+// slotWatcher watches for the removal and re-insertion of the token labelled label.  It waits for slot events with a
+// blocking C_WaitForSlotEvent, through the module's slotEvents, and checks for the token whenever one is reported and
+// every interval, in case an event is missed.  If events is nil, or the library does not support blocking waits, it
+// only checks every interval, first taking any pending slot event with a non-blocking C_WaitForSlotEvent, as some
+// libraries only update their slot list once its events have been taken.
+type slotWatcher struct {
+	source   slotEventSource
+	events   *slotEvents
+	label    string
+	interval time.Duration
+	// changed is called from the watcher's goroutine when the token is removed or re-inserted
+	changed func(present bool, slot uint)
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func newSlotWatcher(source slotEventSource, events *slotEvents, label string, interval time.Duration, changed func(present bool, slot uint)) *slotWatcher {
+	return &slotWatcher{
+		source:   source,
+		events:   events,
+		label:    label,
+		interval: interval,
+		changed:  changed,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+func (w *slotWatcher) start() {
+	_, err := findSlot(w.source, w.label)
+	present := err == nil
+
+	var events <-chan struct{}
+	unsubscribe := func() {}
+	if w.events != nil {
+		events, unsubscribe = w.events.subscribe(w.source)
+	}
+
+	go func() {
+		defer close(w.done)
+		defer unsubscribe()
+
+		t := time.NewTicker(w.interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-w.stop:
+				return
+			case _, ok := <-events:
+				if !ok {
+					// the library does not support blocking waits
+					events = nil
+				}
+			case <-t.C:
+				if events == nil {
+					// a non-blocking wait returns straight away, so stop never waits for longer than a check
+					<-w.source.WaitForSlotEvent(pkcs11.CKF_DONT_BLOCK)
+				}
+			}
+			w.poll(&present)
+		}
+	}()
+}
+
+// shutdown stops the watcher, waiting for any change in progress to be handled.
+func (w *slotWatcher) shutdown() {
+	close(w.stop)
+	<-w.done
+}
+
+// poll checks whether the token is present, calling changed if that differs from *present.
+func (w *slotWatcher) poll(present *bool) {
+	slot, err := findSlot(w.source, w.label)
+	if err != nil && !errors.Is(err, ErrTokenNotFound) {
+		logging.L().Warn("unable to check for the token", "slotLabel", w.label, "error", err)
+		return
+	}
+	if now := err == nil; now != *present {
+		*present = now
+		w.changed(now, slot)
+	}
+}
+
+// slotEvents makes the blocking C_WaitForSlotEvent calls of a module, one at a time, for all of the watchers of its
+// tokens, passing each event on to every watcher subscribed.  A blocking wait cannot be cancelled, it only returns on a
+// slot event or when the module is finalized, so when the last watcher unsubscribes the wait in progress is left to
+// return and the next watcher to subscribe uses it.  However often its watchers are restarted, a module never has more
+// than one wait in progress.
+type slotEvents struct {
+	mu sync.Mutex
+	// subs are the subscribed watchers' channels, and the source of each.  Each wait uses the source of a subscriber, so
+	// that it never uses a Ctx which has been destroyed.
+	subs    map[chan struct{}]slotEventSource
+	waiting bool
+	// unsupported is set once blocking waits are found not to be supported by the library
+	unsupported bool
+}
+
+func newSlotEvents() *slotEvents {
+	return &slotEvents{subs: make(map[chan struct{}]slotEventSource)}
+}
+
+// subscribe returns a channel receiving a value after each slot event, using source to wait for them, and a func to
+// unsubscribe.  The channel is closed if the library does not support blocking waits.
+func (e *slotEvents) subscribe(source slotEventSource) (<-chan struct{}, func()) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	ch := make(chan struct{}, 1)
+	if e.unsupported {
+		close(ch)
+		return ch, func() {}
+	}
+	e.subs[ch] = source
+	if !e.waiting {
+		e.waiting = true
+		go e.wait(source)
+	}
+	return ch, func() {
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		delete(e.subs, ch)
+	}
+}
+
+// wait makes blocking waits with source, and then with the source of any subscriber, until there are no subscribers.
+func (e *slotEvents) wait(source slotEventSource) {
+	var early int
+	for {
+		start := time.Now()
+		<-source.WaitForSlotEvent(0)
+
+		e.mu.Lock()
+		if time.Since(start) < waitReturnedEarly {
+			early++
+		} else {
+			early = 0
+		}
+		if early == maxEarlyReturns {
+			e.unsupported = true
+			for ch := range e.subs {
+				close(ch)
+				delete(e.subs, ch)
+			}
+			e.waiting = false
+			e.mu.Unlock()
+			logging.L().Info("PKCS#11 library does not support blocking waits for slot events, polling for the token instead")
+			return
+		}
+		source = nil
+		for ch, s := range e.subs {
+			select {
+			case ch <- struct{}{}:
+			default:
+			}
+			source = s
+		}
+		if source == nil {
+			e.waiting = false
+			e.mu.Unlock()
+			return
+		}
+		e.mu.Unlock()
+	}
+}
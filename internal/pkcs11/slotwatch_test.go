@@ -0,0 +1,190 @@
+package pkcs11
+
+import (
+	"quorum-account-plugin-pkcs-11/internal/pkcs11/moduletest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/pkcs11"
+	"github.com/stretchr/testify/require"
+)
+
+// stubSlots has a single slot, 1, containing the token labelled "my_label" while present is set.  Waits for slot
+// events return immediately, as they do with CKF_DONT_BLOCK.
+type stubSlots struct {
+	mu      sync.Mutex
+	present bool
+	waits   int
+	// blockingWaits counts the waits made without CKF_DONT_BLOCK
+	blockingWaits int
+}
+
+func (s *stubSlots) GetSlotList(tokenPresent bool) ([]uint, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if tokenPresent && !s.present {
+		return nil, nil
+	}
+	return []uint{1}, nil
+}
+
+func (s *stubSlots) GetTokenInfo(slotID uint) (pkcs11.TokenInfo, error) {
+	return pkcs11.TokenInfo{Label: "my_label"}, nil
+}
+
+func (s *stubSlots) WaitForSlotEvent(flags uint) chan pkcs11.SlotEvent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.waits++
+	if flags&pkcs11.CKF_DONT_BLOCK == 0 {
+		s.blockingWaits++
+	}
+	ch := make(chan pkcs11.SlotEvent, 1)
+	ch <- pkcs11.SlotEvent{}
+	close(ch)
+	return ch
+}
+
+func (s *stubSlots) setPresent(present bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.present = present
+}
+
+func (s *stubSlots) waitCounts() (waits, blocking int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.waits, s.blockingWaits
+}
+
+func watch(t *testing.T, source slotEventSource, slotEvents *slotEvents, interval time.Duration) chan TokenEvent {
+	events := make(chan TokenEvent, 10)
+	w := newSlotWatcher(source, slotEvents, "my_label", interval, func(present bool, slot uint) {
+		events <- TokenEvent{Present: present, Slot: slot}
+	})
+	w.start()
+	t.Cleanup(w.shutdown)
+	return events
+}
+
+func nextEvent(t *testing.T, events chan TokenEvent) TokenEvent {
+	select {
+	case ev := <-events:
+		return ev
+	case <-time.After(5 * time.Second):
+		t.Fatal("no token event")
+		return TokenEvent{}
+	}
+}
+
+func TestSlotWatcher_Polls(t *testing.T) {
+	slots := &stubSlots{present: true}
+	events := watch(t, slots, nil, 10*time.Millisecond)
+
+	slots.setPresent(false)
+	require.Equal(t, TokenEvent{Present: false}, nextEvent(t, events))
+	slots.setPresent(true)
+	require.Equal(t, TokenEvent{Present: true, Slot: 1}, nextEvent(t, events))
+
+	// pending slot events are taken before each check, without blocking
+	waits, blocking := slots.waitCounts()
+	require.NotZero(t, waits)
+	require.Zero(t, blocking)
+}
+
+func TestSlotWatcher_Shutdown(t *testing.T) {
+	slots := &stubSlots{present: true}
+	w := newSlotWatcher(slots, nil, "my_label", 10*time.Millisecond, func(bool, uint) {})
+	w.start()
+	require.Eventually(t, func() bool { waits, _ := slots.waitCounts(); return waits > 0 }, time.Second, time.Millisecond)
+
+	w.shutdown()
+
+	// no check is in progress or started once shutdown returns
+	waits, _ := slots.waitCounts()
+	time.Sleep(50 * time.Millisecond)
+	got, _ := slots.waitCounts()
+	require.Equal(t, waits, got)
+}
+
+func TestSlotWatcher_Blocking(t *testing.T) {
+	m := moduletest.New("my_label", "1234")
+	// the token is only checked when a slot event is reported
+	events := watch(t, m, newSlotEvents(), time.Hour)
+	require.Eventually(t, func() bool { return m.Waits() == 1 }, time.Second, time.Millisecond)
+
+	m.RemoveToken()
+	require.Equal(t, TokenEvent{Present: false}, nextEvent(t, events))
+	require.Eventually(t, func() bool { return m.Waits() == 1 }, time.Second, time.Millisecond)
+	m.InsertToken()
+	require.Equal(t, TokenEvent{Present: true, Slot: moduletest.SlotID}, nextEvent(t, events))
+}
+
+func TestSlotWatcher_BlockingNotSupported(t *testing.T) {
+	m := moduletest.New("my_label", "1234")
+	unsupported := moduletest.Result{Err: pkcs11.Error(pkcs11.CKR_FUNCTION_NOT_SUPPORTED)}
+	m.Queue("C_WaitForSlotEvent", unsupported, unsupported, unsupported)
+	slotEvents := newSlotEvents()
+	events := watch(t, m, slotEvents, 10*time.Millisecond)
+
+	m.RemoveToken()
+	require.Equal(t, TokenEvent{Present: false}, nextEvent(t, events))
+	require.Eventually(t, func() bool {
+		slotEvents.mu.Lock()
+		defer slotEvents.mu.Unlock()
+		return slotEvents.unsupported
+	}, time.Second, time.Millisecond)
+
+	// the library is then polled, without blocking
+	m.InsertToken()
+	require.Equal(t, TokenEvent{Present: true, Slot: moduletest.SlotID}, nextEvent(t, events))
+	var blocking, nonBlocking int
+	for _, c := range m.Calls() {
+		if c.Fn == "C_WaitForSlotEvent" && c.Flags == 0 {
+			blocking++
+		} else if c.Fn == "C_WaitForSlotEvent" {
+			nonBlocking++
+		}
+	}
+	require.Equal(t, maxEarlyReturns, blocking)
+	require.NotZero(t, nonBlocking)
+}
+
+func TestSlotWatcher_Restart(t *testing.T) {
+	m := moduletest.New("my_label", "1234")
+	slotEvents := newSlotEvents()
+
+	for i := 0; i < 5; i++ {
+		w := newSlotWatcher(m, slotEvents, "my_label", time.Hour, func(bool, uint) {})
+		w.start()
+		require.Eventually(t, func() bool { return m.Waits() == 1 }, time.Second, time.Millisecond)
+		w.shutdown()
+	}
+
+	// the wait left in progress by the first watcher is used by the next, so there is never more than one
+	require.Equal(t, 1, m.Waits())
+	// and it returns when the module is finalized
+	require.NoError(t, m.Finalize())
+	require.Eventually(t, func() bool {
+		slotEvents.mu.Lock()
+		defer slotEvents.mu.Unlock()
+		return !slotEvents.waiting
+	}, time.Second, time.Millisecond)
+}
+
+func TestAccountManager_TokenChanged_LockOnRemoval(t *testing.T) {
+	a := &accountManager{onRemoval: "lock", unlocked: map[string]*lockableKey{"aa": {}, "bb": {}}}
+
+	a.tokenChanged(TokenEvent{Present: false})
+
+	require.Zero(t, a.UnlockedCount())
+}
+
+func TestAccountManager_TokenChanged_KeepOnRemoval(t *testing.T) {
+	a := &accountManager{onRemoval: "keep", unlocked: map[string]*lockableKey{"aa": {}, "bb": {}}}
+
+	a.tokenChanged(TokenEvent{Present: false})
+
+	require.Equal(t, 2, a.UnlockedCount())
+}
@@ -0,0 +1,222 @@
+package pkcs11
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/miekg/pkcs11"
+)
+
+// Status is the machine-readable status of the plugin, returned by Quorum's personal_listWallets as JSON.
+type Status struct {
+	Library  *LibraryStatus    `json:"library,omitempty"`
+	Slot     *SlotStatus       `json:"slot,omitempty"`
+	Token    *TokenStatus      `json:"token,omitempty"`
+	Login    LoginStatus       `json:"login"`
+	Sessions SessionStats      `json:"sessions"`
+	Unlocked []UnlockedAccount `json:"unlockedAccounts"`
+	Health   *Health           `json:"health,omitempty"`
+	// Capabilities is unset until a session has been opened
+	Capabilities *Capabilities `json:"capabilities,omitempty"`
+	// RecentErrors is filled in by the server, which sees the errors returned to Quorum
+	RecentErrors *RecentErrors `json:"recentErrors,omitempty"`
+	// Reload is filled in by the server, which reloads the config
+	Reload *ReloadStatus `json:"reload,omitempty"`
+	// Errors describes any part of the status which could not be read from the token
+	Errors []string `json:"errors,omitempty"`
+}
+
+// LibraryStatus is the C_GetInfo information of the PKCS#11 library.
+type LibraryStatus struct {
+	CryptokiVersion string `json:"cryptokiVersion"`
+	Manufacturer    string `json:"manufacturer"`
+	Description     string `json:"description"`
+	Version         string `json:"version"`
+	// Profile is the name of the profile of the library's quirks, see Profile
+	Profile string `json:"profile"`
+}
+
+// SlotStatus is the C_GetSlotInfo information of the slot the session is open on.
+type SlotStatus struct {
+	ID              uint     `json:"id"`
+	Description     string   `json:"description"`
+	Manufacturer    string   `json:"manufacturer"`
+	Flags           []string `json:"flags"`
+	HardwareVersion string   `json:"hardwareVersion"`
+	FirmwareVersion string   `json:"firmwareVersion"`
+}
+
+// TokenStatus is the C_GetTokenInfo information of the token.  Counts and memory sizes the token does not report are
+// omitted.
+type TokenStatus struct {
+	Label        string   `json:"label"`
+	Manufacturer string   `json:"manufacturer"`
+	Model        string   `json:"model"`
+	SerialNumber string   `json:"serialNumber"`
+	Flags        []string `json:"flags"`
+	PINCountLow  bool     `json:"pinCountLow"`
+	PINFinalTry  bool     `json:"pinFinalTry"`
+	PINLocked    bool     `json:"pinLocked"`
+	Sessions     struct {
+		Open      *uint `json:"open,omitempty"`
+		Max       *uint `json:"max,omitempty"`
+		ReadWrite *uint `json:"readWrite,omitempty"`
+		MaxRW     *uint `json:"maxReadWrite,omitempty"`
+	} `json:"sessions"`
+	Memory struct {
+		FreePublic   *uint `json:"freePublic,omitempty"`
+		TotalPublic  *uint `json:"totalPublic,omitempty"`
+		FreePrivate  *uint `json:"freePrivate,omitempty"`
+		TotalPrivate *uint `json:"totalPrivate,omitempty"`
+	} `json:"memory"`
+	HardwareVersion string `json:"hardwareVersion"`
+	FirmwareVersion string `json:"firmwareVersion"`
+}
+
+// LoginStatus is the LoginState of the plugin.
+type LoginStatus struct {
+	LoggedIn    bool       `json:"loggedIn"`
+	Blocked     bool       `json:"blocked"`
+	Failures    int        `json:"failures"`
+	LastFailure *time.Time `json:"lastFailure,omitempty"`
+	LastError   string     `json:"lastError,omitempty"`
+}
+
+// ReloadStatus is the outcome of the last reload of the config file.
+type ReloadStatus struct {
+	Time time.Time `json:"time"`
+	// Trigger is what caused the reload: a change to the file, or SIGHUP
+	Trigger string `json:"trigger"`
+	// Changed lists the config sections which changed, see config.Sections
+	Changed []string `json:"changed"`
+	// Error is set if the new config was rejected or could not be applied
+	Error string `json:"error,omitempty"`
+}
+
+// UnlockedAccount is an unlocked account and, if it is unlocked for a limited time, when it will be locked.
+type UnlockedAccount struct {
+	Address   string     `json:"address"`
+	Expires   *time.Time `json:"expires,omitempty"`
+	Remaining string     `json:"remaining,omitempty"`
+}
+
+// RecentErrors counts the errors returned to Quorum over the last Window by reason, e.g. ACCOUNT_LOCKED or
+// CKR_DEVICE_ERROR.
+type RecentErrors struct {
+	Window string         `json:"window"`
+	Counts map[string]int `json:"counts"`
+}
+
+func newLibraryStatus(info pkcs11.Info, profile *Profile) *LibraryStatus {
+	return &LibraryStatus{
+		CryptokiVersion: version(info.CryptokiVersion),
+		Manufacturer:    info.ManufacturerID,
+		Description:     info.LibraryDescription,
+		Version:         version(info.LibraryVersion),
+		Profile:         profile.Name,
+	}
+}
+
+func newSlotStatus(id uint, info pkcs11.SlotInfo) *SlotStatus {
+	return &SlotStatus{
+		ID:              id,
+		Description:     info.SlotDescription,
+		Manufacturer:    info.ManufacturerID,
+		Flags:           flagNames(info.Flags, slotFlags),
+		HardwareVersion: version(info.HardwareVersion),
+		FirmwareVersion: version(info.FirmwareVersion),
+	}
+}
+
+func newTokenStatus(info pkcs11.TokenInfo) *TokenStatus {
+	t := &TokenStatus{
+		Label:           info.Label,
+		Manufacturer:    info.ManufacturerID,
+		Model:           info.Model,
+		SerialNumber:    info.SerialNumber,
+		Flags:           flagNames(info.Flags, tokenFlags),
+		PINCountLow:     info.Flags&pkcs11.CKF_USER_PIN_COUNT_LOW != 0,
+		PINFinalTry:     info.Flags&pkcs11.CKF_USER_PIN_FINAL_TRY != 0,
+		PINLocked:       info.Flags&pkcs11.CKF_USER_PIN_LOCKED != 0,
+		HardwareVersion: version(info.HardwareVersion),
+		FirmwareVersion: version(info.FirmwareVersion),
+	}
+	t.Sessions.Open = available(info.SessionCount)
+	t.Sessions.Max = available(info.MaxSessionCount)
+	t.Sessions.ReadWrite = available(info.RwSessionCount)
+	t.Sessions.MaxRW = available(info.MaxRwSessionCount)
+	t.Memory.FreePublic = available(info.FreePublicMemory)
+	t.Memory.TotalPublic = available(info.TotalPublicMemory)
+	t.Memory.FreePrivate = available(info.FreePrivateMemory)
+	t.Memory.TotalPrivate = available(info.TotalPrivateMemory)
+	return t
+}
+
+func newLoginStatus(s LoginState) LoginStatus {
+	l := LoginStatus{
+		LoggedIn:  s.LoggedIn,
+		Blocked:   s.Blocked,
+		Failures:  s.Failures,
+		LastError: s.LastError,
+	}
+	if !s.LastFailure.IsZero() {
+		l.LastFailure = &s.LastFailure
+	}
+	return l
+}
+
+// available returns nil for CK_UNAVAILABLE_INFORMATION.  CK_EFFECTIVELY_INFINITE, used for maximum counts, is 0.
+func available(v uint) *uint {
+	if v == pkcs11.CK_UNAVAILABLE_INFORMATION {
+		return nil
+	}
+	return &v
+}
+
+func version(v pkcs11.Version) string {
+	return fmt.Sprintf("%v.%v", v.Major, v.Minor)
+}
+
+type flag struct {
+	value uint
+	name  string
+}
+
+var slotFlags = []flag{
+	{pkcs11.CKF_TOKEN_PRESENT, "CKF_TOKEN_PRESENT"},
+	{pkcs11.CKF_REMOVABLE_DEVICE, "CKF_REMOVABLE_DEVICE"},
+	{pkcs11.CKF_HW_SLOT, "CKF_HW_SLOT"},
+}
+
+var tokenFlags = []flag{
+	{pkcs11.CKF_RNG, "CKF_RNG"},
+	{pkcs11.CKF_WRITE_PROTECTED, "CKF_WRITE_PROTECTED"},
+	{pkcs11.CKF_LOGIN_REQUIRED, "CKF_LOGIN_REQUIRED"},
+	{pkcs11.CKF_USER_PIN_INITIALIZED, "CKF_USER_PIN_INITIALIZED"},
+	{pkcs11.CKF_RESTORE_KEY_NOT_NEEDED, "CKF_RESTORE_KEY_NOT_NEEDED"},
+	{pkcs11.CKF_CLOCK_ON_TOKEN, "CKF_CLOCK_ON_TOKEN"},
+	{pkcs11.CKF_PROTECTED_AUTHENTICATION_PATH, "CKF_PROTECTED_AUTHENTICATION_PATH"},
+	{pkcs11.CKF_DUAL_CRYPTO_OPERATIONS, "CKF_DUAL_CRYPTO_OPERATIONS"},
+	{pkcs11.CKF_TOKEN_INITIALIZED, "CKF_TOKEN_INITIALIZED"},
+	{pkcs11.CKF_SECONDARY_AUTHENTICATION, "CKF_SECONDARY_AUTHENTICATION"},
+	{pkcs11.CKF_USER_PIN_COUNT_LOW, "CKF_USER_PIN_COUNT_LOW"},
+	{pkcs11.CKF_USER_PIN_FINAL_TRY, "CKF_USER_PIN_FINAL_TRY"},
+	{pkcs11.CKF_USER_PIN_LOCKED, "CKF_USER_PIN_LOCKED"},
+	{pkcs11.CKF_USER_PIN_TO_BE_CHANGED, "CKF_USER_PIN_TO_BE_CHANGED"},
+	{pkcs11.CKF_SO_PIN_COUNT_LOW, "CKF_SO_PIN_COUNT_LOW"},
+	{pkcs11.CKF_SO_PIN_FINAL_TRY, "CKF_SO_PIN_FINAL_TRY"},
+	{pkcs11.CKF_SO_PIN_LOCKED, "CKF_SO_PIN_LOCKED"},
+	{pkcs11.CKF_SO_PIN_TO_BE_CHANGED, "CKF_SO_PIN_TO_BE_CHANGED"},
+	{pkcs11.CKF_ERROR_STATE, "CKF_ERROR_STATE"},
+}
+
+// flagNames returns the names of the flags set in v.
+func flagNames(v uint, flags []flag) []string {
+	names := make([]string, 0, len(flags))
+	for _, f := range flags {
+		if v&f.value != 0 {
+			names = append(names, f.name)
+		}
+	}
+	return names
+}
@@ -0,0 +1,59 @@
+package pkcs11
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/miekg/pkcs11"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewTokenStatus(t *testing.T) {
+	got := newTokenStatus(pkcs11.TokenInfo{
+		Label:              "my_label",
+		Flags:              pkcs11.CKF_TOKEN_INITIALIZED | pkcs11.CKF_USER_PIN_COUNT_LOW,
+		SessionCount:       1,
+		MaxSessionCount:    pkcs11.CK_EFFECTIVELY_INFINITE,
+		RwSessionCount:     pkcs11.CK_UNAVAILABLE_INFORMATION,
+		FreePublicMemory:   1024,
+		TotalPublicMemory:  pkcs11.CK_UNAVAILABLE_INFORMATION,
+		FreePrivateMemory:  pkcs11.CK_UNAVAILABLE_INFORMATION,
+		TotalPrivateMemory: pkcs11.CK_UNAVAILABLE_INFORMATION,
+		FirmwareVersion:    pkcs11.Version{Major: 2, Minor: 6},
+	})
+
+	require.Equal(t, []string{"CKF_TOKEN_INITIALIZED", "CKF_USER_PIN_COUNT_LOW"}, got.Flags)
+	require.True(t, got.PINCountLow)
+	require.False(t, got.PINLocked)
+	require.Equal(t, "2.6", got.FirmwareVersion)
+
+	b, err := json.Marshal(got)
+	require.NoError(t, err)
+	require.Contains(t, string(b), `"sessions":{"open":1,"max":0,"maxReadWrite":0}`)
+	require.Contains(t, string(b), `"memory":{"freePublic":1024}`)
+}
+
+func TestNewLoginStatus(t *testing.T) {
+	require.Nil(t, newLoginStatus(LoginState{LoggedIn: true}).LastFailure)
+
+	failed := time.Now()
+	got := newLoginStatus(LoginState{Failures: 1, LastFailure: failed, LastError: "CKR_PIN_INCORRECT"})
+	require.Equal(t, failed, *got.LastFailure)
+	require.Equal(t, 1, got.Failures)
+}
+
+func TestAccountManager_UnlockedAccounts(t *testing.T) {
+	now := time.Now()
+	a := &accountManager{unlocked: map[string]*lockableKey{
+		"bb": {expires: now.Add(90 * time.Second)},
+		"aa": {},
+	}}
+
+	got := a.unlockedAccounts(now)
+
+	require.Len(t, got, 2)
+	require.Equal(t, UnlockedAccount{Address: "0xaa"}, got[0])
+	require.Equal(t, "0xbb", got[1].Address)
+	require.Equal(t, "1m30s", got[1].Remaining)
+}
@@ -0,0 +1,46 @@
+package pkcs11
+
+import (
+	"context"
+	"errors"
+	"quorum-account-plugin-pkcs-11/internal/tracing"
+	"sync/atomic"
+
+	"github.com/miekg/pkcs11"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = tracing.Tracer()
+
+const (
+	attrAddress   = attribute.Key("account.address")
+	attrSlot      = attribute.Key("pkcs11.slot")
+	attrMechanism = attribute.Key("pkcs11.mechanism")
+	// attrResult is the CKR_ name of the value returned by a PKCS#11 function
+	attrResult = attribute.Key("pkcs11.result")
+)
+
+// startCall starts the span of a call to the PKCS#11 function fn, e.g. C_Sign.
+func (p *pkcs11Wrapper) startCall(ctx context.Context, fn string, attrs ...attribute.KeyValue) trace.Span {
+	attrs = append(attrs, attrSlot.Int64(atomic.LoadInt64(&p.slot)))
+	_, span := tracer.Start(ctx, fn, trace.WithAttributes(attrs...))
+	return span
+}
+
+// endSpan ends span, recording the outcome of its operation.
+func endSpan(span trace.Span, err *error) {
+	var ckr pkcs11.Error
+	switch {
+	case *err == nil:
+		span.SetAttributes(attrResult.String("CKR_OK"))
+	case errors.As(*err, &ckr):
+		span.SetAttributes(attrResult.String(CKRName(ckr)))
+	}
+	if *err != nil {
+		span.RecordError(*err)
+		span.SetStatus(codes.Error, (*err).Error())
+	}
+	span.End()
+}
@@ -0,0 +1,135 @@
+package pkcs11
+
+import (
+	"context"
+	"fmt"
+	"quorum-account-plugin-pkcs-11/internal/account/account"
+	"quorum-account-plugin-pkcs-11/internal/config"
+	"quorum-account-plugin-pkcs-11/internal/logging"
+	"reflect"
+	"strings"
+
+	"github.com/miekg/pkcs11"
+)
+
+type credentialKey struct{}
+
+// withCredential returns a context which makes Cryptoki.Sign authenticate the use of the key with credential, see
+// config.UnlockEntry.Credential.
+func withCredential(ctx context.Context, credential *config.EnvironmentVariable) context.Context {
+	return context.WithValue(ctx, credentialKey{}, credential)
+}
+
+func credentialFrom(ctx context.Context) *config.EnvironmentVariable {
+	credential, _ := ctx.Value(credentialKey{}).(*config.EnvironmentVariable)
+	return credential
+}
+
+// contextLogin authenticates the use of the key of the operation just initialized with credential.  p.mu must be held.
+func (p *pkcs11Wrapper) contextLogin(ctx context.Context, credential *config.EnvironmentVariable) (err error) {
+	pin, err := credential.GetSecret()
+	if err != nil {
+		return err
+	}
+	defer pin.Destroy()
+
+	call := p.startCall(ctx, "C_Login")
+	err = p.Context.Login(p.Session, pkcs11.CKU_CONTEXT_SPECIFIC, pin.UnsafeString())
+	endSpan(call, &err)
+	return err
+}
+
+// applyUnlockList applies the changes to the unlock list since it was last applied: it unlocks the accounts selected by
+// the entries which have been added or changed, and locks the accounts unlocked by a previous list which are no longer
+// selected.  The accounts selected by unchanged entries are left as they are, so accounts locked since, or whose timed
+// unlock is running, are not unlocked again.  The first time it is called all entries are applied.  It fails with
+// ErrUnlockUnresolved, without changing which accounts are unlocked, if an entry which is not optional selects no
+// account.  The session must be open.
+func (a *accountManager) applyUnlockList(ctx context.Context) error {
+	a.mu.Lock()
+	list, applied, listApplied := a.unlockList, a.appliedList, a.listApplied
+	a.mu.Unlock()
+	if listApplied && reflect.DeepEqual(list, applied) {
+		return nil
+	}
+
+	labels, err := a.wrapper.KeyLabels(ctx)
+	if err != nil {
+		return fmt.Errorf("unable to resolve unlock list: %w", err)
+	}
+
+	var (
+		selected   = make(map[account.Address]config.UnlockEntry)
+		changed    = make(map[account.Address]config.UnlockEntry)
+		unresolved []string
+	)
+	for i, e := range list {
+		sel, err := e.Selector()
+		if err != nil {
+			// the config has been validated
+			return err
+		}
+		isChanged := !listApplied || !containsEntry(applied, e)
+		var n int
+		for addr, label := range labels {
+			if sel.Matches(addr, label) {
+				selected[addr] = e
+				if isChanged {
+					changed[addr] = e
+				}
+				n++
+			}
+		}
+		if n == 0 && !e.Optional {
+			unresolved = append(unresolved, fmt.Sprintf("unlock[%d] %q", i, e.Account))
+		}
+	}
+	if len(unresolved) > 0 {
+		return fmt.Errorf("%w: %v", ErrUnlockUnresolved, strings.Join(unresolved, ", "))
+	}
+
+	a.mu.Lock()
+	previous := a.listUnlocked
+	a.appliedList, a.listApplied = list, true
+	a.listUnlocked = make(map[account.Address]bool, len(selected))
+	a.credentials = make(map[account.Address]*config.EnvironmentVariable)
+	for addr, e := range selected {
+		a.listUnlocked[addr] = true
+		if e.Credential != nil {
+			a.credentials[addr] = e.Credential
+		}
+	}
+	a.mu.Unlock()
+
+	for addr := range previous {
+		if _, ok := selected[addr]; !ok {
+			a.Lock(ctx, addr)
+		}
+	}
+	for addr, e := range changed {
+		a.unlock(addr, e.Duration)
+		logging.L().Info("unlocked account", "address", addr.ToHexString(), "selector", e.Account, "duration", e.Duration.String())
+	}
+	return nil
+}
+
+// containsEntry reports whether list has an entry equal to e.
+func containsEntry(list []config.UnlockEntry, e config.UnlockEntry) bool {
+	for _, l := range list {
+		if reflect.DeepEqual(l, e) {
+			return true
+		}
+	}
+	return false
+}
+
+// withAccountCredential returns ctx with the credential configured for acctAddr, if any.
+func (a *accountManager) withAccountCredential(ctx context.Context, acctAddr account.Address) context.Context {
+	a.mu.Lock()
+	credential := a.credentials[acctAddr]
+	a.mu.Unlock()
+	if credential == nil {
+		return ctx
+	}
+	return withCredential(ctx, credential)
+}
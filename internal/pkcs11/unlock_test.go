@@ -0,0 +1,105 @@
+package pkcs11
+
+import (
+	"context"
+	"net/url"
+	"quorum-account-plugin-pkcs-11/internal/account/account"
+	"quorum-account-plugin-pkcs-11/internal/config"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// stubKeys is a Cryptoki with an open session on a token holding the keys in labels.  Calling any other method panics.
+type stubKeys struct {
+	Cryptoki
+	labels map[account.Address]string
+}
+
+func (s *stubKeys) KeyLabels(context.Context) (map[account.Address]string, error) {
+	return s.labels, nil
+}
+
+func (s *stubKeys) Sessions() SessionStats {
+	return SessionStats{Open: 1}
+}
+
+func addr(t *testing.T, hex string) account.Address {
+	a, err := account.NewAddressFromHexString(hex)
+	require.NoError(t, err)
+	return a
+}
+
+func newUnlockTestManager(t *testing.T) *accountManager {
+	return &accountManager{
+		wrapper: &stubKeys{labels: map[account.Address]string{
+			addr(t, "0x0000000000000000000000000000000000000001"): "validator-1",
+			addr(t, "0x0000000000000000000000000000000000000002"): "validator-2",
+			addr(t, "0x0000000000000000000000000000000000000003"): "signer",
+		}},
+		unlocked: make(map[string]*lockableKey),
+	}
+}
+
+func TestAccountManager_Reconfigure_Unlock(t *testing.T) {
+	a := newUnlockTestManager(t)
+
+	err := a.Reconfigure(context.Background(), config.Config{Unlock: []config.UnlockEntry{
+		{Account: "label:validator-*", Duration: time.Hour},
+		{Account: "0x0000000000000000000000000000000000000003"},
+		{Account: "label:missing", Optional: true},
+	}})
+
+	require.NoError(t, err)
+	unlocked := a.unlockedAccounts(time.Now())
+	require.Len(t, unlocked, 3)
+	require.Equal(t, "0x0000000000000000000000000000000000000001", unlocked[0].Address)
+	require.NotNil(t, unlocked[0].Expires)
+	require.Equal(t, "0x0000000000000000000000000000000000000003", unlocked[2].Address)
+	require.Nil(t, unlocked[2].Expires)
+}
+
+func TestAccountManager_Reconfigure_LocksDroppedAccounts(t *testing.T) {
+	a := newUnlockTestManager(t)
+	require.NoError(t, a.Reconfigure(context.Background(), config.Config{Unlock: []config.UnlockEntry{{Account: "label:validator-*"}}}))
+
+	require.NoError(t, a.Reconfigure(context.Background(), config.Config{Unlock: []config.UnlockEntry{{Account: "pkcs11:object=validator-2"}}}))
+
+	unlocked := a.unlockedAccounts(time.Now())
+	require.Len(t, unlocked, 1)
+	require.Equal(t, "0x0000000000000000000000000000000000000002", unlocked[0].Address)
+}
+
+func TestAccountManager_Reconfigure_Unresolved(t *testing.T) {
+	a := newUnlockTestManager(t)
+	require.NoError(t, a.Reconfigure(context.Background(), config.Config{Unlock: []config.UnlockEntry{{Account: "label:signer"}}}))
+
+	err := a.Reconfigure(context.Background(), config.Config{Unlock: []config.UnlockEntry{
+		{Account: "label:validator-*"},
+		{Account: "label:missing"},
+		{Account: "0x00000000000000000000000000000000000000ff"},
+	}})
+
+	require.ErrorIs(t, err, ErrUnlockUnresolved)
+	require.EqualError(t, err, `unlock entry selects no account: unlock[1] "label:missing", unlock[2] "0x00000000000000000000000000000000000000ff"`)
+	// the accounts unlocked by the previous list are unchanged
+	unlocked := a.unlockedAccounts(time.Now())
+	require.Len(t, unlocked, 1)
+	require.Equal(t, "0x0000000000000000000000000000000000000003", unlocked[0].Address)
+}
+
+func TestAccountManager_WithAccountCredential(t *testing.T) {
+	a := newUnlockTestManager(t)
+	credential := config.EnvironmentVariable(url.URL{Scheme: "env", Host: "VALIDATOR_PIN"})
+	require.NoError(t, a.Reconfigure(context.Background(), config.Config{Unlock: []config.UnlockEntry{
+		{Account: "label:validator-1", Credential: &credential},
+		{Account: "label:validator-2"},
+	}}))
+
+	ctx := a.withAccountCredential(context.Background(), addr(t, "0x0000000000000000000000000000000000000001"))
+	require.Same(t, &credential, credentialFrom(ctx))
+
+	ctx = a.withAccountCredential(context.Background(), addr(t, "0x0000000000000000000000000000000000000002"))
+	require.Nil(t, credentialFrom(ctx))
+}
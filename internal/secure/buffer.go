@@ -0,0 +1,155 @@
+// Package secure provides memory for secrets (PINs and private key material) which is kept out of swap and core dumps
+// where the platform allows, and which is wiped as soon as it is no longer needed.
+//
+// Go strings are immutable and may be copied by the runtime, so secrets should be held in a Buffer from the point they
+// enter the plugin and only be exposed as a string (see UnsafeString) for the duration of a call that requires one.
+package secure
+
+import (
+	"math/big"
+	"sync"
+)
+
+const redacted = "[REDACTED]"
+
+// release returns memory obtained from alloc, it is a variable so that tests can inspect memory before it is released
+var release = free
+
+// Buffer is a fixed-size byte buffer for secret data.  A Buffer must be destroyed with Destroy once it is no longer
+// needed.  The zero value is an empty, destroyed Buffer.
+type Buffer struct {
+	mu sync.Mutex
+	// mem is the whole allocation, data is the part of it in use
+	mem  []byte
+	data []byte
+}
+
+// NewBuffer allocates a zeroed Buffer of size bytes.
+func NewBuffer(size int) (*Buffer, error) {
+	if size == 0 {
+		return &Buffer{data: []byte{}}, nil
+	}
+	mem, err := alloc(size)
+	if err != nil {
+		return nil, err
+	}
+	return &Buffer{mem: mem, data: mem[:size]}, nil
+}
+
+// FromBytes copies src into a new Buffer and wipes src.
+func FromBytes(src []byte) (*Buffer, error) {
+	b, err := NewBuffer(len(src))
+	if err != nil {
+		Wipe(src)
+		return nil, err
+	}
+	copy(b.data, src)
+	Wipe(src)
+	return b, nil
+}
+
+// FromString copies s into a new Buffer.  The memory backing s cannot be wiped so FromString should only be used where
+// the secret is unavoidably received as a string (e.g. from an environment variable or a decoded request).
+func FromString(s string) (*Buffer, error) {
+	b, err := NewBuffer(len(s))
+	if err != nil {
+		return nil, err
+	}
+	copy(b.data, s)
+	return b, nil
+}
+
+// Bytes returns the contents of the Buffer.  The returned slice aliases the Buffer's memory and must not be used after
+// Destroy is called.
+func (b *Buffer) Bytes() []byte {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.data
+}
+
+// UnsafeString returns the contents of the Buffer as a string without copying them.  The string aliases the Buffer's
+// memory and so is only valid, and only immutable, until Destroy is called.  It must not be retained.
+func (b *Buffer) UnsafeString() string {
+	byt := b.Bytes()
+	if len(byt) == 0 {
+		return ""
+	}
+	return unsafeString(byt)
+}
+
+func (b *Buffer) Len() int {
+	return len(b.Bytes())
+}
+
+// Equal reports whether the contents of b and o are the same.
+func (b *Buffer) Equal(o *Buffer) bool {
+	x, y := b.Bytes(), o.Bytes()
+	if len(x) != len(y) {
+		return false
+	}
+	var v byte
+	for i := range x {
+		v |= x[i] ^ y[i]
+	}
+	return v == 0
+}
+
+// Copy returns a new Buffer with the same contents as b.
+func (b *Buffer) Copy() (*Buffer, error) {
+	byt := b.Bytes()
+	c, err := NewBuffer(len(byt))
+	if err != nil {
+		return nil, err
+	}
+	copy(c.data, byt)
+	return c, nil
+}
+
+// Destroy wipes and releases the Buffer's memory.  It is safe to call Destroy more than once and on a nil Buffer.
+func (b *Buffer) Destroy() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	Wipe(b.data)
+	if b.mem != nil {
+		Wipe(b.mem)
+		release(b.mem)
+	}
+	b.mem, b.data = nil, nil
+}
+
+// String implements fmt.Stringer so that a Buffer accidentally passed to a logger or formatted error never reveals its
+// contents.
+func (b *Buffer) String() string {
+	return redacted
+}
+
+// GoString implements fmt.GoStringer for the same reason as String.
+func (b *Buffer) GoString() string {
+	return redacted
+}
+
+// Wipe overwrites b with zeros.
+func Wipe(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
+
+// WipeBigInt overwrites the absolute value of i with zeros.
+func WipeBigInt(i *big.Int) {
+	if i == nil {
+		return
+	}
+	words := i.Bits()
+	for j := range words {
+		words[j] = 0
+	}
+	i.SetInt64(0)
+}
@@ -0,0 +1,39 @@
+package secure
+
+import (
+	"os"
+	"quorum-account-plugin-pkcs-11/internal/logging"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+var warnMlock sync.Once
+
+// alloc maps anonymous memory outside of the Go heap so that it is never moved or copied by the garbage collector.  The
+// pages are locked in RAM and excluded from core dumps.
+func alloc(size int) ([]byte, error) {
+	pageSize := os.Getpagesize()
+	length := (size + pageSize - 1) / pageSize * pageSize
+
+	mem, err := unix.Mmap(-1, 0, length, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_PRIVATE|unix.MAP_ANONYMOUS)
+	if err != nil {
+		return nil, err
+	}
+	if err := unix.Madvise(mem, unix.MADV_DONTDUMP); err != nil {
+		unix.Munmap(mem)
+		return nil, err
+	}
+	if err := unix.Mlock(mem); err != nil {
+		// mlock is limited by RLIMIT_MEMLOCK; the memory is still wiped on release and excluded from core dumps
+		warnMlock.Do(func() {
+			logging.L().Warn("unable to lock secret memory, secrets may be swapped to disk", "error", err)
+		})
+	}
+	return mem, nil
+}
+
+func free(mem []byte) {
+	_ = unix.Munlock(mem)
+	_ = unix.Munmap(mem)
+}
@@ -0,0 +1,128 @@
+package secure
+
+import (
+	"fmt"
+	"math/big"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func requireZero(t *testing.T, b []byte) {
+	for i := range b {
+		require.Zerof(t, b[i], "byte %v not wiped", i)
+	}
+}
+
+// captureRelease replaces release for the duration of the test, recording a copy of each released allocation
+func captureRelease(t *testing.T) *[][]byte {
+	var released [][]byte
+	release = func(mem []byte) {
+		released = append(released, append([]byte(nil), mem...))
+		free(mem)
+	}
+	t.Cleanup(func() { release = free })
+	return &released
+}
+
+func TestNewBuffer(t *testing.T) {
+	b, err := NewBuffer(32)
+	require.NoError(t, err)
+	defer b.Destroy()
+
+	require.Equal(t, 32, b.Len())
+	requireZero(t, b.Bytes())
+}
+
+func TestNewBuffer_Empty(t *testing.T) {
+	b, err := NewBuffer(0)
+	require.NoError(t, err)
+
+	require.Equal(t, 0, b.Len())
+	require.Equal(t, "", b.UnsafeString())
+	b.Destroy()
+}
+
+func TestFromBytes_WipesSource(t *testing.T) {
+	src := []byte("123456")
+
+	b, err := FromBytes(src)
+	require.NoError(t, err)
+	defer b.Destroy()
+
+	require.Equal(t, []byte("123456"), b.Bytes())
+	requireZero(t, src)
+}
+
+func TestFromString(t *testing.T) {
+	b, err := FromString("123456")
+	require.NoError(t, err)
+	defer b.Destroy()
+
+	require.Equal(t, "123456", b.UnsafeString())
+}
+
+func TestBuffer_Destroy_WipesMemory(t *testing.T) {
+	released := captureRelease(t)
+
+	b, err := FromString("123456")
+	require.NoError(t, err)
+	b.Destroy()
+
+	require.Nil(t, b.Bytes())
+	require.Len(t, *released, 1)
+	requireZero(t, (*released)[0])
+
+	// destroying again is a no-op
+	b.Destroy()
+	require.Len(t, *released, 1)
+}
+
+func TestBuffer_DestroyNil(t *testing.T) {
+	var b *Buffer
+	b.Destroy()
+	require.Nil(t, b.Bytes())
+}
+
+func TestBuffer_Equal(t *testing.T) {
+	a, _ := FromString("1234")
+	b, _ := FromString("1234")
+	c, _ := FromString("5678")
+	defer a.Destroy()
+	defer b.Destroy()
+	defer c.Destroy()
+
+	require.True(t, a.Equal(b))
+	require.False(t, a.Equal(c))
+}
+
+func TestBuffer_Copy(t *testing.T) {
+	a, _ := FromString("1234")
+	b, err := a.Copy()
+	require.NoError(t, err)
+	a.Destroy()
+	defer b.Destroy()
+
+	require.Equal(t, "1234", b.UnsafeString())
+}
+
+func TestBuffer_FormattingIsRedacted(t *testing.T) {
+	b, _ := FromString("123456")
+	defer b.Destroy()
+
+	for _, verb := range []string{"%v", "%s", "%+v", "%#v"} {
+		require.Equal(t, redacted, fmt.Sprintf(verb, b), verb)
+	}
+}
+
+func TestWipeBigInt(t *testing.T) {
+	i := new(big.Int).SetBytes([]byte{1, 2, 3, 4, 5, 6, 7, 8, 9})
+	words := i.Bits()
+
+	WipeBigInt(i)
+
+	for _, w := range words {
+		require.Zero(t, w)
+	}
+	require.Zero(t, i.Sign())
+}
@@ -0,0 +1,8 @@
+package secure
+
+import "unsafe"
+
+// unsafeString converts b to a string which shares b's memory.
+func unsafeString(b []byte) string {
+	return *(*string)(unsafe.Pointer(&b))
+}
@@ -0,0 +1,206 @@
+package server
+
+import (
+	"errors"
+	"quorum-account-plugin-pkcs-11/internal/pkcs11"
+	"strconv"
+
+	p11 "github.com/miekg/pkcs11"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// errorDomain is the errdetails.ErrorInfo domain of all errors returned by the plugin.
+const errorDomain = "quorum-account-plugin-pkcs-11"
+
+// Every error returned by the plugin's gRPC services carries an errdetails.ErrorInfo whose Reason identifies the cause
+// of the error.  The identifiers are part of the plugin's API: existing identifiers must not be changed or reused.
+//
+//	Reason                gRPC code            Cause
+//	NOT_CONFIGURED        Unavailable          a request was received before the plugin was initialized, or after its
+//	                                           PKCS#11 library was finalized
+//	INVALID_CONFIG        InvalidArgument      the plugin or new account configuration is invalid, or an unlock entry
+//	                                           selects no account on the token
+//	INVALID_REQUEST       InvalidArgument      the request is malformed, e.g. an invalid address or key
+//	ACCOUNT_NOT_FOUND     NotFound             the account is not stored on the token
+//	ACCOUNT_LOCKED        FailedPrecondition   the account must be unlocked before it can sign
+//	KEY_NOT_FOUND         NotFound             the account's private key is not stored on the token
+//	TOKEN_NOT_FOUND       Unavailable          no token with the configured label is present
+//	PIN_LOCKED            PermissionDenied     the user PIN is locked and must be reset by the Security Officer
+//	PIN_FINAL_TRY         FailedPrecondition   login was not attempted as a failure would lock the user PIN
+//	LOGIN_BLOCKED         PermissionDenied     login was not attempted as the configured PIN has already failed
+//	UNSUPPORTED           Unimplemented        the token lacks a mechanism needed by the operation
+//	CKR_*                 see ckrCodes         a PKCS#11 function returned the named CKR_ value
+//	INTERNAL              Internal             any other error
+//
+// Where known, the ErrorInfo metadata also contains:
+//
+//	operation             the gRPC method, e.g. Sign
+//	pkcs11Operation       the plugin's PKCS#11 operation, e.g. OpenSession
+//	slot                  the ID of the slot in use
+//	slotLabel             the label of the configured token
+const (
+	ReasonNotConfigured   = "NOT_CONFIGURED"
+	ReasonInvalidConfig   = "INVALID_CONFIG"
+	ReasonInvalidRequest  = "INVALID_REQUEST"
+	ReasonAccountNotFound = "ACCOUNT_NOT_FOUND"
+	ReasonAccountLocked   = "ACCOUNT_LOCKED"
+	ReasonKeyNotFound     = "KEY_NOT_FOUND"
+	ReasonTokenNotFound   = "TOKEN_NOT_FOUND"
+	ReasonPINLocked       = "PIN_LOCKED"
+	ReasonPINFinalTry     = "PIN_FINAL_TRY"
+	ReasonLoginBlocked    = "LOGIN_BLOCKED"
+	ReasonUnsupported     = "UNSUPPORTED"
+	ReasonInternal        = "INTERNAL"
+)
+
+// pluginErrors maps the plugin's own errors to their reason and gRPC code.  They are checked in order, before any
+// PKCS#11 error they wrap.
+var pluginErrors = []struct {
+	err    error
+	reason string
+	code   codes.Code
+}{
+	{pkcs11.ErrPINLocked, ReasonPINLocked, codes.PermissionDenied},
+	{pkcs11.ErrPINFinalTry, ReasonPINFinalTry, codes.FailedPrecondition},
+	{pkcs11.ErrLoginBlocked, ReasonLoginBlocked, codes.PermissionDenied},
+	{pkcs11.ErrUnsupported, ReasonUnsupported, codes.Unimplemented},
+	{pkcs11.ErrFinalized, ReasonNotConfigured, codes.Unavailable},
+	{pkcs11.ErrUnlockUnresolved, ReasonInvalidConfig, codes.InvalidArgument},
+	{pkcs11.ErrInvalidHash, ReasonInvalidRequest, codes.InvalidArgument},
+	{pkcs11.ErrAccountNotFound, ReasonAccountNotFound, codes.NotFound},
+	{pkcs11.ErrAccountLocked, ReasonAccountLocked, codes.FailedPrecondition},
+	{pkcs11.ErrKeyNotFound, ReasonKeyNotFound, codes.NotFound},
+	{pkcs11.ErrTokenNotFound, ReasonTokenNotFound, codes.Unavailable},
+}
+
+// ckrCodes maps PKCS#11 return values to gRPC codes.  Return values not listed map to codes.Internal.
+var ckrCodes = map[p11.Error]codes.Code{
+	// the token or library cannot currently be used; retrying later, or after the token is reconnected, may succeed
+	p11.CKR_TOKEN_NOT_PRESENT:            codes.Unavailable,
+	p11.CKR_TOKEN_NOT_RECOGNIZED:         codes.Unavailable,
+	p11.CKR_DEVICE_REMOVED:               codes.Unavailable,
+	p11.CKR_DEVICE_ERROR:                 codes.Unavailable,
+	p11.CKR_SESSION_CLOSED:               codes.Unavailable,
+	p11.CKR_SESSION_HANDLE_INVALID:       codes.Unavailable,
+	p11.CKR_CRYPTOKI_NOT_INITIALIZED:     codes.Unavailable,
+	p11.CKR_SLOT_ID_INVALID:              codes.Unavailable,
+	p11.CKR_FUNCTION_CANCELED:            codes.Aborted,
+	p11.CKR_CANT_LOCK:                    codes.Unavailable,
+	p11.CKR_NEED_TO_CREATE_THREADS:       codes.Unavailable,
+	p11.CKR_CRYPTOKI_ALREADY_INITIALIZED: codes.FailedPrecondition,
+
+	// authentication and authorisation
+	p11.CKR_PIN_INCORRECT:                  codes.PermissionDenied,
+	p11.CKR_PIN_INVALID:                    codes.PermissionDenied,
+	p11.CKR_PIN_LEN_RANGE:                  codes.PermissionDenied,
+	p11.CKR_PIN_EXPIRED:                    codes.PermissionDenied,
+	p11.CKR_PIN_LOCKED:                     codes.PermissionDenied,
+	p11.CKR_USER_NOT_LOGGED_IN:             codes.PermissionDenied,
+	p11.CKR_KEY_FUNCTION_NOT_PERMITTED:     codes.PermissionDenied,
+	p11.CKR_ATTRIBUTE_SENSITIVE:            codes.PermissionDenied,
+	p11.CKR_USER_PIN_NOT_INITIALIZED:       codes.FailedPrecondition,
+	p11.CKR_USER_ALREADY_LOGGED_IN:         codes.FailedPrecondition,
+	p11.CKR_USER_ANOTHER_ALREADY_LOGGED_IN: codes.FailedPrecondition,
+	p11.CKR_USER_TOO_MANY_TYPES:            codes.FailedPrecondition,
+
+	// the token or session is not in a state that allows the operation
+	p11.CKR_TOKEN_WRITE_PROTECTED:     codes.FailedPrecondition,
+	p11.CKR_SESSION_READ_ONLY:         codes.FailedPrecondition,
+	p11.CKR_SESSION_READ_ONLY_EXISTS:  codes.FailedPrecondition,
+	p11.CKR_OPERATION_ACTIVE:          codes.FailedPrecondition,
+	p11.CKR_OPERATION_NOT_INITIALIZED: codes.FailedPrecondition,
+	p11.CKR_SESSION_EXISTS:            codes.FailedPrecondition,
+
+	// the token has run out of a resource
+	p11.CKR_HOST_MEMORY:   codes.ResourceExhausted,
+	p11.CKR_DEVICE_MEMORY: codes.ResourceExhausted,
+	p11.CKR_SESSION_COUNT: codes.ResourceExhausted,
+
+	// the module does not support what was asked of it
+	p11.CKR_FUNCTION_NOT_SUPPORTED:  codes.Unimplemented,
+	p11.CKR_MECHANISM_INVALID:       codes.Unimplemented,
+	p11.CKR_MECHANISM_PARAM_INVALID: codes.Unimplemented,
+	p11.CKR_CURVE_NOT_SUPPORTED:     codes.Unimplemented,
+	p11.CKR_DOMAIN_PARAMS_INVALID:   codes.Unimplemented,
+	p11.CKR_KEY_TYPE_INCONSISTENT:   codes.Unimplemented,
+	p11.CKR_ATTRIBUTE_TYPE_INVALID:  codes.Unimplemented,
+
+	// the request, or data derived from it, was rejected by the token
+	p11.CKR_ARGUMENTS_BAD:           codes.InvalidArgument,
+	p11.CKR_DATA_INVALID:            codes.InvalidArgument,
+	p11.CKR_DATA_LEN_RANGE:          codes.InvalidArgument,
+	p11.CKR_ATTRIBUTE_VALUE_INVALID: codes.InvalidArgument,
+	p11.CKR_ATTRIBUTE_READ_ONLY:     codes.InvalidArgument,
+	p11.CKR_TEMPLATE_INCOMPLETE:     codes.InvalidArgument,
+	p11.CKR_TEMPLATE_INCONSISTENT:   codes.InvalidArgument,
+
+	// the object no longer exists
+	p11.CKR_OBJECT_HANDLE_INVALID: codes.NotFound,
+	p11.CKR_KEY_HANDLE_INVALID:    codes.NotFound,
+}
+
+// toStatus converts an error returned while handling the gRPC method op into a gRPC status error with an
+// errdetails.ErrorInfo describing its cause.
+func toStatus(op string, err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+
+	meta := map[string]string{"operation": op}
+	var opErr *pkcs11.OperationError
+	if errors.As(err, &opErr) {
+		meta["pkcs11Operation"] = opErr.Op
+		meta["slotLabel"] = opErr.SlotLabel
+		if opErr.Slot >= 0 {
+			meta["slot"] = strconv.Itoa(opErr.Slot)
+		}
+	}
+
+	for _, e := range pluginErrors {
+		if errors.Is(err, e.err) {
+			return newStatus(e.code, e.reason, err.Error(), meta)
+		}
+	}
+
+	var ckr p11.Error
+	if errors.As(err, &ckr) {
+		code, ok := ckrCodes[ckr]
+		if !ok {
+			code = codes.Internal
+		}
+		return newStatus(code, pkcs11.CKRName(ckr), err.Error(), meta)
+	}
+
+	return newStatus(codes.Internal, ReasonInternal, err.Error(), meta)
+}
+
+// newStatus creates a gRPC status error with an errdetails.ErrorInfo for reason.
+func newStatus(code codes.Code, reason, msg string, meta map[string]string) error {
+	s := status.New(code, msg)
+	withDetails, err := s.WithDetails(&errdetails.ErrorInfo{
+		Reason:   reason,
+		Domain:   errorDomain,
+		Metadata: meta,
+	})
+	if err != nil {
+		return s.Err()
+	}
+	return withDetails.Err()
+}
+
+func notConfigured(op string) error {
+	return newStatus(codes.Unavailable, ReasonNotConfigured, "not configured", map[string]string{"operation": op})
+}
+
+func invalidConfig(op string, err error) error {
+	return newStatus(codes.InvalidArgument, ReasonInvalidConfig, err.Error(), map[string]string{"operation": op})
+}
+
+func invalidRequest(op string, err error) error {
+	return newStatus(codes.InvalidArgument, ReasonInvalidRequest, err.Error(), map[string]string{"operation": op})
+}
@@ -0,0 +1,100 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"quorum-account-plugin-pkcs-11/internal/pkcs11"
+	"testing"
+
+	p11 "github.com/miekg/pkcs11"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func errorInfo(t *testing.T, err error) (codes.Code, *errdetails.ErrorInfo) {
+	s, ok := status.FromError(err)
+	require.True(t, ok)
+	require.Len(t, s.Details(), 1)
+	info, ok := s.Details()[0].(*errdetails.ErrorInfo)
+	require.True(t, ok)
+	require.Equal(t, errorDomain, info.Domain)
+	return s.Code(), info
+}
+
+func TestToStatus_CKR(t *testing.T) {
+	err := &pkcs11.OperationError{
+		Op:        "OpenSession",
+		Slot:      3,
+		SlotLabel: "my token",
+		Err:       p11.Error(p11.CKR_TOKEN_NOT_PRESENT),
+	}
+
+	code, info := errorInfo(t, toStatus("Open", err))
+
+	require.Equal(t, codes.Unavailable, code)
+	require.Equal(t, "CKR_TOKEN_NOT_PRESENT", info.Reason)
+	require.Equal(t, map[string]string{
+		"operation":       "Open",
+		"pkcs11Operation": "OpenSession",
+		"slot":            "3",
+		"slotLabel":       "my token",
+	}, info.Metadata)
+}
+
+func TestToStatus_CKRCodes(t *testing.T) {
+	tests := map[p11.Error]codes.Code{
+		p11.CKR_PIN_INCORRECT:            codes.PermissionDenied,
+		p11.CKR_USER_PIN_NOT_INITIALIZED: codes.FailedPrecondition,
+		p11.CKR_DEVICE_MEMORY:            codes.ResourceExhausted,
+		p11.CKR_MECHANISM_INVALID:        codes.Unimplemented,
+		p11.CKR_DATA_LEN_RANGE:           codes.InvalidArgument,
+		p11.CKR_GENERAL_ERROR:            codes.Internal,
+	}
+	for ckr, want := range tests {
+		t.Run(ckr.Error(), func(t *testing.T) {
+			code, _ := errorInfo(t, toStatus("Sign", fmt.Errorf("wrapped: %w", ckr)))
+			require.Equal(t, want, code)
+		})
+	}
+}
+
+func TestToStatus_PluginErrors(t *testing.T) {
+	tests := []struct {
+		err        error
+		wantCode   codes.Code
+		wantReason string
+	}{
+		{pkcs11.ErrAccountNotFound, codes.NotFound, ReasonAccountNotFound},
+		{pkcs11.ErrAccountLocked, codes.FailedPrecondition, ReasonAccountLocked},
+		{pkcs11.ErrPINFinalTry, codes.FailedPrecondition, ReasonPINFinalTry},
+		{fmt.Errorf("%w: key generation: CKM_EC_KEY_PAIR_GEN is not supported", pkcs11.ErrUnsupported), codes.Unimplemented, ReasonUnsupported},
+		{fmt.Errorf("%w: unlock[0] \"label:validator-*\"", pkcs11.ErrUnlockUnresolved), codes.InvalidArgument, ReasonInvalidConfig},
+		{fmt.Errorf("%w, not 3 bytes", pkcs11.ErrInvalidHash), codes.InvalidArgument, ReasonInvalidRequest},
+		// ErrTokenRemoved wraps ErrTokenNotFound
+		{pkcs11.ErrTokenRemoved, codes.Unavailable, ReasonTokenNotFound},
+		// the plugin's reason takes precedence over the CKR value it wraps
+		{fmt.Errorf("%w: %v", pkcs11.ErrPINLocked, p11.Error(p11.CKR_PIN_LOCKED)), codes.PermissionDenied, ReasonPINLocked},
+		{errors.New("something unexpected"), codes.Internal, ReasonInternal},
+	}
+	for _, tt := range tests {
+		t.Run(tt.wantReason, func(t *testing.T) {
+			code, info := errorInfo(t, toStatus("Sign", tt.err))
+			require.Equal(t, tt.wantCode, code)
+			require.Equal(t, tt.wantReason, info.Reason)
+			require.Equal(t, "Sign", info.Metadata["operation"])
+		})
+	}
+}
+
+func TestToStatus_Nil(t *testing.T) {
+	require.NoError(t, toStatus("Sign", nil))
+}
+
+func TestErrorDetails(t *testing.T) {
+	require.Equal(t, "", errorDetails(nil).GetReason())
+	require.Equal(t, ReasonNotConfigured, errorDetails(notConfigured("Sign")).GetReason())
+	require.Equal(t, "CKR_DEVICE_ERROR", errorDetails(toStatus("Sign", p11.Error(p11.CKR_DEVICE_ERROR))).GetReason())
+	require.Equal(t, ReasonInternal, errorDetails(errors.New("not a status")).GetReason())
+}
@@ -3,7 +3,7 @@ package server
 import (
 	"context"
 	"fmt"
-	"log"
+	"quorum-account-plugin-pkcs-11/internal/logging"
 
 	"github.com/hashicorp/go-plugin"
 	"github.com/jpmorganchase/quorum-account-plugin-sdk-go/proto"
@@ -11,10 +11,19 @@ import (
 	"google.golang.org/grpc"
 )
 
+const defaultProtocolVersion = 1
+
+// HandshakeConfig is the go-plugin handshake expected by Quorum's plugin manager when it starts the plugin.
+var HandshakeConfig = plugin.HandshakeConfig{
+	ProtocolVersion:  defaultProtocolVersion,
+	MagicCookieKey:   "QUORUM_PLUGIN_MAGIC_COOKIE",
+	MagicCookieValue: "CB9F51969613126D93468868990F77A8470EB9177503C5A38D437FEFF7786E0941152E05C06A9A3313391059132A7F9CED86C0783FE63A8B38F01623C8257664",
+}
+
 func (p *HashicorpPlugin) GRPCServer(_ *plugin.GRPCBroker, s *grpc.Server) error {
-	log.Println("[INFO] Register Initializer")
+	logging.L().Info("registering service", "service", "Initializer")
 	proto_common.RegisterPluginInitializerServer(s, p)
-	log.Println("[INFO] Register PKCS#11 AccountManager")
+	logging.L().Info("registering service", "service", "AccountService")
 	proto.RegisterAccountServiceServer(s, p)
 	return nil
 }
@@ -2,44 +2,205 @@ package server
 
 import (
 	"context"
-	"encoding/json"
-	"log"
+	"errors"
+	"fmt"
 	"quorum-account-plugin-pkcs-11/internal/config"
+	"quorum-account-plugin-pkcs-11/internal/control"
+	"quorum-account-plugin-pkcs-11/internal/logging"
+	"quorum-account-plugin-pkcs-11/internal/metrics"
 	"quorum-account-plugin-pkcs-11/internal/pkcs11"
+	"quorum-account-plugin-pkcs-11/internal/tracing"
 	"time"
 
 	"github.com/jpmorganchase/quorum-account-plugin-sdk-go/proto_common"
-	"google.golang.org/grpc/codes"
-	"google.golang.org/grpc/status"
 )
 
-func (p *HashicorpPlugin) Init(_ context.Context, req *proto_common.PluginInitialization_Request) (*proto_common.PluginInitialization_Response, error) {
+// Init configures the plugin.  If the plugin has already been configured, the requests in progress are completed before
+// the new configuration takes effect.  If the AccountManager for the new configuration cannot be built, the previous
+// one is kept; see apply.
+func (p *HashicorpPlugin) Init(ctx context.Context, req *proto_common.PluginInitialization_Request) (*proto_common.PluginInitialization_Response, error) {
 	startTime := time.Now()
 	defer func() {
-		log.Println("[INFO] plugin initialization took", time.Now().Sub(startTime).Round(time.Microsecond))
+		logging.L().Info("plugin initialization complete", "operation", "Init", "duration", time.Now().Sub(startTime).Round(time.Microsecond))
 	}()
 
-	conf := new(config.Config)
+	conf, err := parseConfig(req.GetRawConfiguration())
+	if err != nil {
+		return nil, invalidConfig("Init", err)
+	}
 
-	if err := json.Unmarshal(req.GetRawConfiguration(), conf); err != nil {
-		return nil, status.Errorf(codes.InvalidArgument, "unable to unmarshal account plugin config: if provided as a file, ensure file:// scheme is included in path:  err = %v", err.Error())
+	if err := p.drain(ctx); err != nil {
+		return nil, toStatus("Init", err)
 	}
+	defer p.mu.Unlock()
 
-	if err := conf.Validate(); err != nil {
-		return nil, status.Errorf(codes.InvalidArgument, err.Error())
+	// Init restarts everything, whether or not its config has changed
+	if err := p.apply(ctx, conf, config.Sections); err != nil {
+		return nil, invalidConfig("Init", err)
 	}
+	return &proto_common.PluginInitialization_Response{}, nil
+}
 
-	pkcs11Wrapper, err := pkcs11.NewCryptoki(conf.Library)
+// parseConfig decodes and validates a config.
+func parseConfig(raw []byte) (*config.Config, error) {
+	conf, err := config.Parse(raw)
 	if err != nil {
-		return nil, status.Errorf(codes.InvalidArgument, err.Error())
+		var errs config.Errors
+		if errors.As(err, &errs) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("unable to unmarshal account plugin config: if provided as a file, ensure file:// scheme is included in path:  err = %v", err.Error())
+	}
+	return conf, nil
+}
+
+// apply makes conf the plugin's config, restarting the parts of the plugin configured by the changed config sections.
+// A change to the library section rebuilds the AccountManager, see rebuild.  If a section cannot be applied the
+// sections after it are not applied either, and p.conf records the config actually in effect so that the next reload
+// is compared against it.  p.mu must be held for writing.
+func (p *HashicorpPlugin) apply(ctx context.Context, conf *config.Config, changed []string) (err error) {
+	isChanged := make(map[string]bool, len(changed))
+	for _, s := range changed {
+		isChanged[s] = true
+	}
+
+	var applied config.Config
+	if p.conf != nil {
+		applied = *p.conf
+	}
+	defer func() {
+		if err != nil {
+			p.conf = &applied
+		}
+	}()
+
+	if isChanged[config.SectionLogLevel] {
+		level := conf.LogLevel
+		if level == "" {
+			level = "info"
+		}
+		if err := logging.SetLevel(level); err != nil {
+			return err
+		}
+		applied.LogLevel = conf.LogLevel
+	}
+
+	switch {
+	case isChanged[config.SectionLibrary] || p.acctManager == nil:
+		if err := p.rebuild(ctx, conf); err != nil {
+			return err
+		}
+	case isChanged[config.SectionUnlock] || isChanged[config.SectionHealthCheck] || isChanged[config.SectionSlotEvents]:
+		if err := p.acctManager.Reconfigure(ctx, *conf); err != nil {
+			return err
+		}
 	}
+	applied.Library, applied.Unlock, applied.HealthCheck, applied.SlotEvents = conf.Library, conf.Unlock, conf.HealthCheck, conf.SlotEvents
 
+	if isChanged[config.SectionControlSocket] {
+		if p.control != nil {
+			p.control.Close()
+			p.control = nil
+		}
+		applied.ControlSocket = nil
+		if conf.ControlSocket != nil {
+			l, err := control.Listen(conf.ControlSocket.Path)
+			if err != nil {
+				return fmt.Errorf("unable to open control socket: %v", err)
+			}
+			p.control = l
+			go control.Serve(l, p)
+		}
+		applied.ControlSocket = conf.ControlSocket
+	}
+
+	if isChanged[config.SectionMetrics] {
+		if p.metricsServer != nil {
+			p.metricsServer.Close()
+			p.metricsServer = nil
+		}
+		applied.Metrics = nil
+		if conf.Metrics != nil {
+			if p.metrics == nil {
+				p.metrics = metrics.New(func() metrics.Source {
+					p.mu.RLock()
+					defer p.mu.RUnlock()
+					return p.acctManager
+				})
+			}
+			srv, err := p.metrics.Serve(conf.Metrics.ListenAddress)
+			if err != nil {
+				return fmt.Errorf("unable to open metrics listener: %v", err)
+			}
+			p.metricsServer = srv
+		}
+		applied.Metrics = conf.Metrics
+	}
+
+	if isChanged[config.SectionTracing] {
+		if p.stopTracing != nil {
+			if err := p.stopTracing(ctx); err != nil {
+				logging.L().Warn("unable to flush spans", "error", err)
+			}
+			p.stopTracing = nil
+		}
+		applied.Tracing = nil
+		if conf.Tracing != nil {
+			stop, err := tracing.Start(ctx, *conf.Tracing)
+			if err != nil {
+				return fmt.Errorf("unable to start trace exporter: %v", err)
+			}
+			p.stopTracing = stop
+		}
+		applied.Tracing = conf.Tracing
+	}
+
+	if isChanged[config.SectionConfigFile] {
+		if p.configWatcher != nil {
+			p.configWatcher.close()
+			p.configWatcher = nil
+		}
+		if conf.ConfigFile != nil {
+			p.configWatcher = p.watchConfig(conf.ConfigFile.Path)
+		}
+	}
+
+	p.conf = conf
+	return nil
+}
+
+// rebuild replaces the AccountManager with one for conf.  The new AccountManager is built, and its session opened if the
+// previous session was open, before the previous one is shut down, so that the previous one is kept if the new one
+// cannot be used.  A library used by both is initialized once and shared by them, so changes to its initialize args or
+// environment only take effect once it is no longer in use.
+func (p *HashicorpPlugin) rebuild(ctx context.Context, conf *config.Config) error {
+	pkcs11Wrapper, err := pkcs11.NewCryptoki(conf.Library)
+	if err != nil {
+		return err
+	}
 	am, err := pkcs11.NewAccountManager(pkcs11Wrapper, *conf)
 	if err != nil {
-		return nil, status.Errorf(codes.InvalidArgument, err.Error())
+		pkcs11Wrapper.Finalize(ctx)
+		return err
 	}
 
+	old := p.acctManager
+	if old != nil && old.Sessions().Open > 0 {
+		if err := am.Open(ctx); err != nil {
+			shutdownCtx, cancel := context.WithTimeout(ctx, finalizeTimeout)
+			defer cancel()
+			am.Shutdown(shutdownCtx)
+			return fmt.Errorf("unable to open session: %w", err)
+		}
+	}
 	p.acctManager = am
 
-	return &proto_common.PluginInitialization_Response{}, nil
+	if old != nil {
+		shutdownCtx, cancel := context.WithTimeout(ctx, finalizeTimeout)
+		defer cancel()
+		if err := old.Shutdown(shutdownCtx); err != nil {
+			logging.L().Error("unable to shut down previous configuration", "error", err)
+		}
+	}
+	return nil
 }
@@ -0,0 +1,80 @@
+package server
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"quorum-account-plugin-pkcs-11/internal/logging"
+	"quorum-account-plugin-pkcs-11/internal/tracing"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	otelcodes "go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/status"
+)
+
+var tracer = tracing.Tracer()
+
+// begin starts handling the gRPC method op.  It returns the context to pass to the AccountManager, carrying the span
+// of the method as a child of any trace propagated by Quorum, and a func to be deferred with a pointer to the method's
+// error result which logs the outcome, records it in the plugin's metrics and ends the span.  fields are additional
+// key/value pairs to log and add to the span, e.g. the account address.
+//
+// The plugin's mu is held for reading until the returned func is called.
+func (p *HashicorpPlugin) begin(ctx context.Context, op string, fields ...interface{}) (context.Context, func(*error)) {
+	p.mu.RLock()
+	start := time.Now()
+
+	attrs := []attribute.KeyValue{attribute.String("rpc.system", "grpc"), attribute.String("rpc.method", op)}
+	for i := 0; i+1 < len(fields); i += 2 {
+		attrs = append(attrs, attribute.String(fmt.Sprint(fields[i]), fmt.Sprint(fields[i+1])))
+	}
+	ctx, span := tracer.Start(tracing.Extract(ctx), "AccountService/"+op, trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(attrs...))
+
+	return ctx, func(err *error) {
+		defer p.mu.RUnlock()
+		defer span.End()
+
+		duration := time.Since(start)
+		info := errorDetails(*err)
+		p.metrics.Observe(op, start, info.GetReason())
+		if *err != nil {
+			p.recentErrors.add(time.Now(), info.GetReason())
+		}
+
+		fields = append([]interface{}{"operation", op, "duration", duration}, fields...)
+		if *err == nil {
+			logging.L().Debug("operation completed", fields...)
+			return
+		}
+		if slot, ok := info.GetMetadata()["slot"]; ok {
+			fields = append(fields, "slot", slot)
+		}
+		logging.L().Error("operation failed", append(fields, "reason", info.GetReason(), "error", *err)...)
+
+		span.SetAttributes(attribute.String("error.reason", info.GetReason()))
+		span.RecordError(*err)
+		span.SetStatus(otelcodes.Error, (*err).Error())
+	}
+}
+
+// errorDetails returns the errdetails.ErrorInfo of an error created by toStatus, or nil if err is nil.
+func errorDetails(err error) *errdetails.ErrorInfo {
+	if err == nil {
+		return nil
+	}
+	s, _ := status.FromError(err)
+	for _, d := range s.Details() {
+		if info, ok := d.(*errdetails.ErrorInfo); ok {
+			return info
+		}
+	}
+	return &errdetails.ErrorInfo{Reason: ReasonInternal, Domain: errorDomain}
+}
+
+// hexAddress formats an account address received in a request for logging.
+func hexAddress(addr []byte) string {
+	return "0x" + hex.EncodeToString(addr)
+}
@@ -5,51 +5,71 @@ import (
 	"encoding/json"
 	"quorum-account-plugin-pkcs-11/internal/account/account"
 	"quorum-account-plugin-pkcs-11/internal/config"
+	"quorum-account-plugin-pkcs-11/internal/pkcs11"
 	"time"
 
 	"github.com/jpmorganchase/quorum-account-plugin-sdk-go/proto"
-	"google.golang.org/grpc/codes"
-	"google.golang.org/grpc/status"
 )
 
 func (p *HashicorpPlugin) isInitialized() bool {
 	return p.acctManager != nil
 }
 
-func (p *HashicorpPlugin) Status(_ context.Context, _ *proto.StatusRequest) (*proto.StatusResponse, error) {
+func (p *HashicorpPlugin) Status(ctx context.Context, _ *proto.StatusRequest) (_ *proto.StatusResponse, err error) {
+	ctx, done := p.begin(ctx, "Status")
+	defer done(&err)
 	if !p.isInitialized() {
-		return nil, status.Error(codes.Unavailable, "not configured")
+		return nil, notConfigured("Status")
 	}
-	s, err := p.acctManager.Status()
+	s, err := p.acctManager.Status(ctx)
 	if err != nil {
-		return nil, status.Error(codes.Internal, err.Error())
+		return nil, toStatus("Status", err)
 	}
-	return &proto.StatusResponse{Status: s}, nil
+	s.RecentErrors = &pkcs11.RecentErrors{
+		Window: recentErrorWindow.String(),
+		Counts: p.recentErrors.counts(time.Now()),
+	}
+	s.Reload = p.lastReload
+	b, err := json.Marshal(s)
+	if err != nil {
+		return nil, toStatus("Status", err)
+	}
+	return &proto.StatusResponse{Status: string(b)}, nil
 }
 
-func (p *HashicorpPlugin) Open(_ context.Context, _ *proto.OpenRequest) (*proto.OpenResponse, error) {
+func (p *HashicorpPlugin) Open(ctx context.Context, _ *proto.OpenRequest) (_ *proto.OpenResponse, err error) {
+	ctx, done := p.begin(ctx, "Open")
+	defer done(&err)
 	if !p.isInitialized() {
-		return nil, status.Error(codes.Unavailable, "not configured")
+		return nil, notConfigured("Open")
 	}
-	err := p.acctManager.Open()
-	return &proto.OpenResponse{}, err
+	if err := p.acctManager.Open(ctx); err != nil {
+		return nil, toStatus("Open", err)
+	}
+	return &proto.OpenResponse{}, nil
 }
 
-func (p *HashicorpPlugin) Close(_ context.Context, _ *proto.CloseRequest) (*proto.CloseResponse, error) {
+func (p *HashicorpPlugin) Close(ctx context.Context, _ *proto.CloseRequest) (_ *proto.CloseResponse, err error) {
+	ctx, done := p.begin(ctx, "Close")
+	defer done(&err)
 	if !p.isInitialized() {
-		return nil, status.Error(codes.Unavailable, "not configured")
+		return nil, notConfigured("Close")
+	}
+	if err := p.acctManager.Close(ctx); err != nil {
+		return nil, toStatus("Close", err)
 	}
-	err := p.acctManager.Close()
-	return &proto.CloseResponse{}, err
+	return &proto.CloseResponse{}, nil
 }
 
-func (p *HashicorpPlugin) Accounts(_ context.Context, _ *proto.AccountsRequest) (*proto.AccountsResponse, error) {
+func (p *HashicorpPlugin) Accounts(ctx context.Context, _ *proto.AccountsRequest) (_ *proto.AccountsResponse, err error) {
+	ctx, done := p.begin(ctx, "Accounts")
+	defer done(&err)
 	if !p.isInitialized() {
-		return nil, status.Error(codes.Unavailable, "not configured")
+		return nil, notConfigured("Accounts")
 	}
-	accts, err := p.acctManager.Accounts()
+	accts, err := p.acctManager.Accounts(ctx)
 	if err != nil {
-		return nil, status.Error(codes.Internal, err.Error())
+		return nil, toStatus("Accounts", err)
 	}
 	protoAccts := make([]*proto.Account, 0, len(accts))
 	for _, a := range accts {
@@ -59,113 +79,129 @@ func (p *HashicorpPlugin) Accounts(_ context.Context, _ *proto.AccountsRequest)
 	return &proto.AccountsResponse{Accounts: protoAccts}, nil
 }
 
-func (p *HashicorpPlugin) Contains(_ context.Context, req *proto.ContainsRequest) (*proto.ContainsResponse, error) {
+func (p *HashicorpPlugin) Contains(ctx context.Context, req *proto.ContainsRequest) (_ *proto.ContainsResponse, err error) {
+	ctx, done := p.begin(ctx, "Contains", "address", hexAddress(req.Address))
+	defer done(&err)
 	if !p.isInitialized() {
-		return nil, status.Error(codes.Unavailable, "not configured")
+		return nil, notConfigured("Contains")
 	}
 	addr, err := account.NewAddress(req.Address)
 	if err != nil {
-		return nil, status.Error(codes.InvalidArgument, err.Error())
+		return nil, invalidRequest("Contains", err)
 	}
-	isContained := p.acctManager.Contains(addr)
+	isContained := p.acctManager.Contains(ctx, addr)
 
 	return &proto.ContainsResponse{IsContained: isContained}, nil
 }
 
-func (p *HashicorpPlugin) Sign(_ context.Context, req *proto.SignRequest) (*proto.SignResponse, error) {
+func (p *HashicorpPlugin) Sign(ctx context.Context, req *proto.SignRequest) (_ *proto.SignResponse, err error) {
+	ctx, done := p.begin(ctx, "Sign", "address", hexAddress(req.Address))
+	defer done(&err)
 	if !p.isInitialized() {
-		return nil, status.Error(codes.Unavailable, "not configured")
+		return nil, notConfigured("Sign")
 	}
 	addr, err := account.NewAddress(req.Address)
 	if err != nil {
-		return nil, status.Error(codes.InvalidArgument, err.Error())
+		return nil, invalidRequest("Sign", err)
 	}
-	result, err := p.acctManager.Sign(addr, req.ToSign)
+	result, err := p.acctManager.Sign(ctx, addr, req.ToSign)
 	if err != nil {
-		return nil, status.Error(codes.Internal, err.Error())
+		return nil, toStatus("Sign", err)
 	}
 	return &proto.SignResponse{Sig: result}, nil
 }
 
-func (p *HashicorpPlugin) UnlockAndSign(_ context.Context, req *proto.UnlockAndSignRequest) (*proto.SignResponse, error) {
+func (p *HashicorpPlugin) UnlockAndSign(ctx context.Context, req *proto.UnlockAndSignRequest) (_ *proto.SignResponse, err error) {
+	ctx, done := p.begin(ctx, "UnlockAndSign", "address", hexAddress(req.Address))
+	defer done(&err)
 	if !p.isInitialized() {
-		return nil, status.Error(codes.Unavailable, "not configured")
+		return nil, notConfigured("UnlockAndSign")
 	}
 	addr, err := account.NewAddress(req.Address)
 	if err != nil {
-		return nil, status.Error(codes.InvalidArgument, err.Error())
+		return nil, invalidRequest("UnlockAndSign", err)
 	}
-	result, err := p.acctManager.UnlockAndSign(addr, req.ToSign)
+	result, err := p.acctManager.UnlockAndSign(ctx, addr, req.ToSign)
 	if err != nil {
-		return nil, status.Error(codes.Internal, err.Error())
+		return nil, toStatus("UnlockAndSign", err)
 	}
 	return &proto.SignResponse{Sig: result}, nil
 }
 
-func (p *HashicorpPlugin) TimedUnlock(_ context.Context, req *proto.TimedUnlockRequest) (*proto.TimedUnlockResponse, error) {
+func (p *HashicorpPlugin) TimedUnlock(ctx context.Context, req *proto.TimedUnlockRequest) (_ *proto.TimedUnlockResponse, err error) {
+	ctx, done := p.begin(ctx, "TimedUnlock", "address", hexAddress(req.Address))
+	defer done(&err)
 	if !p.isInitialized() {
-		return nil, status.Error(codes.Unavailable, "not configured")
+		return nil, notConfigured("TimedUnlock")
 	}
 	addr, err := account.NewAddress(req.Address)
 	if err != nil {
-		return nil, status.Error(codes.InvalidArgument, err.Error())
+		return nil, invalidRequest("TimedUnlock", err)
 	}
-	if err := p.acctManager.TimedUnlock(addr, time.Duration(req.Duration)); err != nil {
-		return nil, status.Error(codes.Internal, err.Error())
+	if err := p.acctManager.TimedUnlock(ctx, addr, time.Duration(req.Duration)); err != nil {
+		return nil, toStatus("TimedUnlock", err)
 	}
 	return &proto.TimedUnlockResponse{}, nil
 }
 
-func (p *HashicorpPlugin) Lock(_ context.Context, req *proto.LockRequest) (*proto.LockResponse, error) {
+func (p *HashicorpPlugin) Lock(ctx context.Context, req *proto.LockRequest) (_ *proto.LockResponse, err error) {
+	ctx, done := p.begin(ctx, "Lock", "address", hexAddress(req.Address))
+	defer done(&err)
 	if !p.isInitialized() {
-		return nil, status.Error(codes.Unavailable, "not configured")
+		return nil, notConfigured("Lock")
 	}
 	addr, err := account.NewAddress(req.Address)
 	if err != nil {
-		return nil, status.Error(codes.InvalidArgument, err.Error())
+		return nil, invalidRequest("Lock", err)
 	}
-	p.acctManager.Lock(addr)
+	p.acctManager.Lock(ctx, addr)
 	return &proto.LockResponse{}, nil
 }
 
-func (p *HashicorpPlugin) NewAccount(_ context.Context, req *proto.NewAccountRequest) (*proto.NewAccountResponse, error) {
+func (p *HashicorpPlugin) NewAccount(ctx context.Context, req *proto.NewAccountRequest) (_ *proto.NewAccountResponse, err error) {
+	ctx, done := p.begin(ctx, "NewAccount")
+	defer done(&err)
 	if !p.isInitialized() {
-		return nil, status.Error(codes.Unavailable, "not configured")
+		return nil, notConfigured("NewAccount")
 	}
 	conf := new(config.NewAccount)
 	if err := json.Unmarshal(req.NewAccountConfig, conf); err != nil {
-		return nil, status.Errorf(codes.InvalidArgument, err.Error())
+		return nil, invalidConfig("NewAccount", err)
 	}
 	if err := conf.Validate(); err != nil {
-		return nil, status.Errorf(codes.InvalidArgument, err.Error())
+		return nil, invalidConfig("NewAccount", err)
 	}
-	acct, err := p.acctManager.NewAccount(*conf)
+	acct, err := p.acctManager.NewAccount(ctx, *conf)
 	if err != nil {
-		return nil, status.Errorf(codes.Internal, err.Error())
+		return nil, toStatus("NewAccount", err)
 	}
 	return &proto.NewAccountResponse{
 		Account: acct.ToProtoAccount(),
 	}, nil
 }
 
-func (p *HashicorpPlugin) ImportRawKey(_ context.Context, req *proto.ImportRawKeyRequest) (*proto.ImportRawKeyResponse, error) {
+func (p *HashicorpPlugin) ImportRawKey(ctx context.Context, req *proto.ImportRawKeyRequest) (_ *proto.ImportRawKeyResponse, err error) {
+	ctx, done := p.begin(ctx, "ImportRawKey")
+	defer done(&err)
 	if !p.isInitialized() {
-		return nil, status.Error(codes.Unavailable, "not configured")
+		return nil, notConfigured("ImportRawKey")
 	}
 	conf := new(config.NewAccount)
 	if err := json.Unmarshal(req.NewAccountConfig, conf); err != nil {
-		return nil, status.Error(codes.InvalidArgument, err.Error())
+		return nil, invalidConfig("ImportRawKey", err)
 	}
 	if err := conf.Validate(); err != nil {
-		return nil, status.Error(codes.InvalidArgument, err.Error())
+		return nil, invalidConfig("ImportRawKey", err)
 	}
 	privateKey, err := account.NewKeyFromHexString(req.RawKey)
+	// the hex key string cannot be wiped, but drop the reference to it so that it can be collected
+	req.RawKey = ""
 	if err != nil {
-		return nil, status.Error(codes.InvalidArgument, err.Error())
+		return nil, invalidRequest("ImportRawKey", err)
 	}
-	acct, err := p.acctManager.ImportPrivateKey(privateKey, *conf)
+	acct, err := p.acctManager.ImportPrivateKey(ctx, privateKey, *conf)
 	if err != nil {
-		return nil, status.Error(codes.Internal, err.Error())
+		return nil, toStatus("ImportRawKey", err)
 	}
 	return &proto.ImportRawKeyResponse{
 		Account: acct.ToProtoAccount(),
@@ -0,0 +1,104 @@
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"encoding/json"
+	"testing"
+
+	"quorum-account-plugin-pkcs-11/internal/account/account"
+	"quorum-account-plugin-pkcs-11/internal/config"
+	"quorum-account-plugin-pkcs-11/internal/pkcs11"
+	"quorum-account-plugin-pkcs-11/internal/pkcs11/pkcs11test"
+
+	"github.com/jpmorganchase/quorum-account-plugin-sdk-go/proto"
+	"github.com/jpmorganchase/quorum/crypto/secp256k1"
+	p11 "github.com/miekg/pkcs11"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/sha3"
+	"google.golang.org/grpc/codes"
+)
+
+// newFakePlugin returns a plugin configured with an AccountManager using a fake token, and opens it.
+func newFakePlugin(t *testing.T) (*HashicorpPlugin, *pkcs11test.Cryptoki) {
+	token := pkcs11test.New("test")
+	am, err := pkcs11.NewAccountManager(token, config.Config{})
+	require.NoError(t, err)
+	p := &HashicorpPlugin{acctManager: am}
+	t.Cleanup(func() { p.Shutdown(context.Background()) })
+
+	_, err = p.Open(context.Background(), &proto.OpenRequest{})
+	require.NoError(t, err)
+	return p, token
+}
+
+func TestPlugin_NewAccountAndSign(t *testing.T) {
+	ctx := context.Background()
+	p, _ := newFakePlugin(t)
+
+	newAcct, err := p.NewAccount(ctx, &proto.NewAccountRequest{NewAccountConfig: []byte(`{"secretName": "validator-1"}`)})
+	require.NoError(t, err)
+	addr := newAcct.Account.Address
+
+	contains, err := p.Contains(ctx, &proto.ContainsRequest{Address: addr})
+	require.NoError(t, err)
+	require.True(t, contains.IsContained)
+
+	// Quorum signs the Keccak-256 hash of a transaction, and recovers the signer's address from the signature
+	d := sha3.NewLegacyKeccak256()
+	d.Write([]byte("msg"))
+	hash := d.Sum(nil)
+	_, err = p.Sign(ctx, &proto.SignRequest{Address: addr, ToSign: hash})
+	code, info := errorInfo(t, err)
+	require.Equal(t, codes.FailedPrecondition, code)
+	require.Equal(t, ReasonAccountLocked, info.Reason)
+
+	_, err = p.TimedUnlock(ctx, &proto.TimedUnlockRequest{Address: addr})
+	require.NoError(t, err)
+	sig, err := p.Sign(ctx, &proto.SignRequest{Address: addr, ToSign: hash})
+	require.NoError(t, err)
+	require.Len(t, sig.Sig, 65)
+	pub, err := secp256k1.RecoverPubkey(hash, sig.Sig)
+	require.NoError(t, err)
+	x, y := elliptic.Unmarshal(secp256k1.S256(), pub)
+	signer, err := account.PublicKeyToAddress(&ecdsa.PublicKey{Curve: secp256k1.S256(), X: x, Y: y})
+	require.NoError(t, err)
+	require.Equal(t, addr, signer.ToBytes())
+
+	_, err = p.Sign(ctx, &proto.SignRequest{Address: addr, ToSign: []byte("msg")})
+	code, info = errorInfo(t, err)
+	require.Equal(t, codes.InvalidArgument, code)
+	require.Equal(t, ReasonInvalidRequest, info.Reason)
+
+	status, err := p.Status(ctx, &proto.StatusRequest{})
+	require.NoError(t, err)
+	var s pkcs11.Status
+	require.NoError(t, json.Unmarshal([]byte(status.Status), &s))
+	wantAddr, err := account.NewAddress(addr)
+	require.NoError(t, err)
+	require.Equal(t, []pkcs11.UnlockedAccount{{Address: "0x" + wantAddr.ToHexString()}}, s.Unlocked)
+}
+
+func TestPlugin_TokenErrors(t *testing.T) {
+	ctx := context.Background()
+	p, token := newFakePlugin(t)
+
+	token.MaxKeys = 1
+	_, err := p.NewAccount(ctx, &proto.NewAccountRequest{NewAccountConfig: []byte(`{"secretName": "a"}`)})
+	require.NoError(t, err)
+	_, err = p.NewAccount(ctx, &proto.NewAccountRequest{NewAccountConfig: []byte(`{"secretName": "b"}`)})
+	_, info := errorInfo(t, err)
+	require.Equal(t, "CKR_DEVICE_MEMORY", info.Reason)
+
+	token.FailNext("Accounts", p11.Error(p11.CKR_DEVICE_ERROR))
+	_, err = p.Accounts(ctx, &proto.AccountsRequest{})
+	_, info = errorInfo(t, err)
+	require.Equal(t, "CKR_DEVICE_ERROR", info.Reason)
+	require.Equal(t, "Accounts", info.Metadata["operation"])
+
+	token.RemoveToken()
+	_, err = p.Accounts(ctx, &proto.AccountsRequest{})
+	_, info = errorInfo(t, err)
+	require.Equal(t, ReasonTokenNotFound, info.Reason)
+}
@@ -0,0 +1,57 @@
+package server
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// recentErrorWindow is the period over which Status reports the errors returned by the plugin
+	recentErrorWindow = 15 * time.Minute
+	// maxRecentErrors bounds the memory used to count recent errors; the oldest are dropped first
+	maxRecentErrors = 1000
+)
+
+type errorEvent struct {
+	at     time.Time
+	reason string
+}
+
+// recentErrors counts the errors returned by the plugin's gRPC methods over the last recentErrorWindow.
+type recentErrors struct {
+	mu     sync.Mutex
+	events []errorEvent
+}
+
+func (r *recentErrors) add(now time.Time, reason string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.expire(now)
+	if len(r.events) == maxRecentErrors {
+		r.events = r.events[1:]
+	}
+	r.events = append(r.events, errorEvent{at: now, reason: reason})
+}
+
+// counts returns the number of errors by reason.
+func (r *recentErrors) counts(now time.Time) map[string]int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.expire(now)
+	counts := make(map[string]int)
+	for _, e := range r.events {
+		counts[e.reason]++
+	}
+	return counts
+}
+
+// expire drops the events older than recentErrorWindow.  r.mu must be held.
+func (r *recentErrors) expire(now time.Time) {
+	i := 0
+	for i < len(r.events) && now.Sub(r.events[i].at) > recentErrorWindow {
+		i++
+	}
+	r.events = r.events[i:]
+}
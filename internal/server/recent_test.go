@@ -0,0 +1,32 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecentErrors(t *testing.T) {
+	var r recentErrors
+	start := time.Now()
+
+	r.add(start, ReasonAccountLocked)
+	r.add(start.Add(time.Minute), ReasonAccountLocked)
+	r.add(start.Add(2*time.Minute), "CKR_DEVICE_ERROR")
+
+	require.Equal(t, map[string]int{ReasonAccountLocked: 2, "CKR_DEVICE_ERROR": 1}, r.counts(start.Add(2*time.Minute)))
+	require.Equal(t, map[string]int{ReasonAccountLocked: 1, "CKR_DEVICE_ERROR": 1}, r.counts(start.Add(recentErrorWindow+30*time.Second)))
+	require.Empty(t, r.counts(start.Add(time.Hour)))
+}
+
+func TestRecentErrors_Bounded(t *testing.T) {
+	var r recentErrors
+	now := time.Now()
+
+	for i := 0; i < maxRecentErrors+10; i++ {
+		r.add(now, ReasonInternal)
+	}
+
+	require.Equal(t, maxRecentErrors, r.counts(now)[ReasonInternal])
+}
@@ -0,0 +1,119 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"os/signal"
+	"quorum-account-plugin-pkcs-11/internal/config"
+	"quorum-account-plugin-pkcs-11/internal/logging"
+	"quorum-account-plugin-pkcs-11/internal/pkcs11"
+	"syscall"
+	"time"
+)
+
+// configPollInterval is how often the config file is checked for changes.
+const configPollInterval = 2 * time.Second
+
+const (
+	triggerFile   = "file"
+	triggerSIGHUP = "SIGHUP"
+)
+
+// configWatcher reloads the config file when its content changes or the plugin receives SIGHUP.
+type configWatcher struct {
+	path string
+	stop chan struct{}
+}
+
+// watchConfig starts watching the config file at path.  The file's content when the watcher starts is taken to be the
+// current config.
+func (p *HashicorpPlugin) watchConfig(path string) *configWatcher {
+	w := &configWatcher{path: path, stop: make(chan struct{})}
+	sum, _ := fileSum(path)
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		defer signal.Stop(hup)
+
+		t := time.NewTicker(configPollInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-w.stop:
+				return
+			case <-hup:
+				sum, _ = fileSum(path)
+				p.reload(w, triggerSIGHUP)
+			case <-t.C:
+				// the file is compared by content, as editors and config management tools often replace the file
+				// rather than writing to it
+				newSum, err := fileSum(path)
+				if err != nil || bytes.Equal(newSum, sum) {
+					continue
+				}
+				sum = newSum
+				p.reload(w, triggerFile)
+			}
+		}
+	}()
+	return w
+}
+
+// close stops the watcher.  It does not wait for a reload in progress, which may be the caller; reload does nothing
+// once its watcher has been replaced.
+func (w *configWatcher) close() {
+	close(w.stop)
+}
+
+func fileSum(path string) ([]byte, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(b)
+	return sum[:], nil
+}
+
+// reload re-reads the config file watched by w and applies the sections that have changed.  The outcome is audited
+// and reported in Status.
+func (p *HashicorpPlugin) reload(w *configWatcher, trigger string) {
+	ctx := context.Background()
+	if err := p.drain(ctx); err != nil {
+		return
+	}
+	defer p.mu.Unlock()
+
+	if p.configWatcher != w {
+		// the plugin has been reconfigured or shut down since the reload was triggered
+		return
+	}
+
+	status := &pkcs11.ReloadStatus{Time: time.Now(), Trigger: trigger, Changed: []string{}}
+	p.lastReload = status
+
+	raw, err := os.ReadFile(w.path)
+	if err != nil {
+		status.Error = fmt.Sprintf("unable to read config file: %v", err)
+	} else if conf, err := parseConfig(raw); err != nil {
+		status.Error = fmt.Sprintf("invalid config: %v", err)
+	} else {
+		status.Changed = config.Diff(*p.conf, *conf)
+		if len(status.Changed) > 0 {
+			if err := p.apply(ctx, conf, status.Changed); err != nil {
+				status.Error = err.Error()
+			}
+		}
+	}
+
+	if status.Error != "" {
+		logging.L().Error("config reload failed", "trigger", trigger, "changed", status.Changed, "error", status.Error)
+		logging.Audit("config reload failed", "trigger", trigger, "changed", status.Changed, "error", status.Error)
+		return
+	}
+	logging.L().Info("config reloaded", "trigger", trigger, "changed", status.Changed)
+	logging.Audit("config reloaded", "trigger", trigger, "changed", status.Changed)
+}
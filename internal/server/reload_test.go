@@ -0,0 +1,157 @@
+package server
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"quorum-account-plugin-pkcs-11/internal/config"
+	"quorum-account-plugin-pkcs-11/internal/logging"
+	"quorum-account-plugin-pkcs-11/internal/pkcs11"
+	"quorum-account-plugin-pkcs-11/internal/testutil"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// reconfigurableManager is an AccountManager recording the configs passed to Reconfigure.  Calling any other method
+// panics.
+type reconfigurableManager struct {
+	pkcs11.AccountManager
+	reconfigured []config.Config
+}
+
+func (m *reconfigurableManager) Reconfigure(_ context.Context, conf config.Config) error {
+	m.reconfigured = append(m.reconfigured, conf)
+	return nil
+}
+
+func writeConfig(t *testing.T, path, conf string) {
+	require.NoError(t, os.WriteFile(path, []byte(conf), 0600))
+}
+
+func TestReload(t *testing.T) {
+	defer testutil.UnsetAll()
+	testutil.SetSlotLabel("my_label")
+	defer logging.SetLevel("info")
+
+	path := filepath.Join(t.TempDir(), "config.json")
+	initial := `{"library": {"path": "file:///path/to/lib", "slotLabel": "env://SLOT_LABEL"}, "configFile": "file://` + path + `"}`
+	writeConfig(t, path, initial)
+	conf, err := parseConfig([]byte(initial))
+	require.NoError(t, err)
+
+	am := &reconfigurableManager{}
+	w := &configWatcher{path: path}
+	p := &HashicorpPlugin{acctManager: am, conf: conf, configWatcher: w}
+
+	writeConfig(t, path, `{"library": {"path": "file:///path/to/lib", "slotLabel": "env://SLOT_LABEL"}, "configFile": "file://`+path+`",
+		"unlock": ["0x4d6d744b6da435b5bbdde2526dc20e9a41cb72e5"], "logLevel": "debug"}`)
+	p.reload(w, triggerSIGHUP)
+
+	require.Equal(t, triggerSIGHUP, p.lastReload.Trigger)
+	require.Equal(t, []string{config.SectionUnlock, config.SectionLogLevel}, p.lastReload.Changed)
+	require.Empty(t, p.lastReload.Error)
+	require.Len(t, am.reconfigured, 1)
+	require.Equal(t, []config.UnlockEntry{{Account: "0x4d6d744b6da435b5bbdde2526dc20e9a41cb72e5"}}, am.reconfigured[0].Unlock)
+	require.Equal(t, "debug", p.conf.LogLevel)
+	require.True(t, logging.L().IsDebug())
+}
+
+func TestReload_InvalidConfig(t *testing.T) {
+	defer testutil.UnsetAll()
+	testutil.SetSlotLabel("my_label")
+
+	path := filepath.Join(t.TempDir(), "config.json")
+	initial := `{"library": {"path": "file:///path/to/lib", "slotLabel": "env://SLOT_LABEL"}, "configFile": "file://` + path + `"}`
+	conf, err := parseConfig([]byte(initial))
+	require.NoError(t, err)
+
+	am := &reconfigurableManager{}
+	w := &configWatcher{path: path}
+	p := &HashicorpPlugin{acctManager: am, conf: conf, configWatcher: w}
+
+	writeConfig(t, path, `{"library": {"path": "lib", "slotLabel": "env://SLOT_LABEL"}}`)
+	p.reload(w, triggerFile)
+
+	require.Equal(t, "invalid config: library.path: "+config.InvalidLibraryPath, p.lastReload.Error)
+	require.Same(t, conf, p.conf)
+	require.Empty(t, am.reconfigured)
+}
+
+func TestReload_LibraryFails(t *testing.T) {
+	defer testutil.UnsetAll()
+	testutil.SetSlotLabel("my_label")
+	defer logging.SetLevel("info")
+
+	path := filepath.Join(t.TempDir(), "config.json")
+	initial := `{"library": {"path": "file:///path/to/lib", "slotLabel": "env://SLOT_LABEL"}, "configFile": "file://` + path + `"}`
+	conf, err := parseConfig([]byte(initial))
+	require.NoError(t, err)
+
+	am := &reconfigurableManager{}
+	w := &configWatcher{path: path}
+	p := &HashicorpPlugin{acctManager: am, conf: conf, configWatcher: w}
+
+	changed := `{"library": {"path": "file:///path/to/missing/lib", "slotLabel": "env://SLOT_LABEL"}, "configFile": "file://` + path + `",
+		"logLevel": "debug"}`
+	writeConfig(t, path, changed)
+	p.reload(w, triggerFile)
+
+	require.Equal(t, []string{config.SectionLibrary, config.SectionLogLevel}, p.lastReload.Changed)
+	require.NotEmpty(t, p.lastReload.Error)
+	// the previous AccountManager is kept, and is not shut down
+	require.Same(t, am, p.acctManager)
+	// the config records what was applied before the failure
+	require.Equal(t, conf.Library, p.conf.Library)
+	require.Equal(t, "debug", p.conf.LogLevel)
+
+	// so the library is retried by the next reload
+	p.reload(w, triggerSIGHUP)
+	require.Equal(t, []string{config.SectionLibrary}, p.lastReload.Changed)
+}
+
+func TestApply_TracingRestarted(t *testing.T) {
+	defer testutil.UnsetAll()
+	testutil.SetSlotLabel("my_label")
+
+	// every section but the library, which needs a real PKCS#11 library, is applied as by Init
+	var sections []string
+	for _, s := range config.Sections {
+		if s != config.SectionLibrary {
+			sections = append(sections, s)
+		}
+	}
+	p := &HashicorpPlugin{acctManager: &reconfigurableManager{}}
+	dir := t.TempDir()
+	for _, file := range []string{"first.json", "second.json"} {
+		conf, err := parseConfig([]byte(`{"library": {"path": "file:///path/to/lib", "slotLabel": "env://SLOT_LABEL"},
+			"tracing": {"exporter": "file", "file": "file://` + filepath.Join(dir, file) + `"}}`))
+		require.NoError(t, err)
+		require.NoError(t, p.apply(context.Background(), conf, sections))
+	}
+	defer func() {
+		if p.stopTracing != nil {
+			p.stopTracing(context.Background())
+		}
+	}()
+
+	// the spans of requests after the exporter is restarted are exported by the new exporter
+	_, end := p.begin(context.Background(), "Status")
+	var err error
+	end(&err)
+	stop := p.stopTracing
+	p.stopTracing = nil
+	require.NoError(t, stop(context.Background()))
+
+	spans, err := os.ReadFile(filepath.Join(dir, "second.json"))
+	require.NoError(t, err)
+	require.Contains(t, string(spans), "AccountService/Status")
+}
+
+func TestReload_StaleWatcher(t *testing.T) {
+	p := &HashicorpPlugin{configWatcher: &configWatcher{}}
+
+	p.reload(&configWatcher{}, triggerFile)
+
+	require.Nil(t, p.lastReload)
+}
@@ -1,11 +1,108 @@
 package server
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
 	"github.com/hashicorp/go-plugin"
+	"quorum-account-plugin-pkcs-11/internal/config"
+	"quorum-account-plugin-pkcs-11/internal/metrics"
 	"quorum-account-plugin-pkcs-11/internal/pkcs11"
+	"quorum-account-plugin-pkcs-11/internal/secure"
 )
 
 type HashicorpPlugin struct {
 	plugin.Plugin
+
+	// mu is held for reading by each request and for writing by Init and Shutdown, so that the AccountManager is only
+	// replaced or shut down once the requests using it have completed
+	mu          sync.RWMutex
 	acctManager pkcs11.AccountManager
+	control     net.Listener
+
+	// metrics is created by the first Init configuring a metrics listener and is kept across later Inits
+	metrics       *metrics.Metrics
+	metricsServer io.Closer
+
+	recentErrors recentErrors
+
+	// stopTracing flushes and stops the trace exporter started by Init, if any
+	stopTracing func(context.Context) error
+
+	// conf is the config last applied by Init or a reload
+	conf          *config.Config
+	configWatcher *configWatcher
+	lastReload    *pkcs11.ReloadStatus
+}
+
+// finalizeTimeout is how long Init waits for the previous AccountManager to finalize its PKCS#11 library.
+const finalizeTimeout = 10 * time.Second
+
+// Shutdown tears the plugin down when its process is stopped: it waits for requests in progress, finalizes the PKCS#11
+// library, and stops the control socket, metrics listener and trace exporter.
+func (p *HashicorpPlugin) Shutdown(ctx context.Context) error {
+	if err := p.drain(ctx); err != nil {
+		return err
+	}
+	defer p.mu.Unlock()
+
+	var errs []error
+	if p.acctManager != nil {
+		errs = append(errs, p.acctManager.Shutdown(ctx))
+		p.acctManager = nil
+	}
+	if p.control != nil {
+		p.control.Close()
+		p.control = nil
+	}
+	if p.metricsServer != nil {
+		p.metricsServer.Close()
+		p.metricsServer = nil
+	}
+	if p.stopTracing != nil {
+		errs = append(errs, p.stopTracing(ctx))
+		p.stopTracing = nil
+	}
+	if p.configWatcher != nil {
+		p.configWatcher.close()
+		p.configWatcher = nil
+	}
+	p.conf = nil
+	return errors.Join(errs...)
+}
+
+// drain acquires mu for writing, waiting for the requests in progress to complete.  If ctx is done first an error is
+// returned and mu is released as soon as it is acquired.
+func (p *HashicorpPlugin) drain(ctx context.Context) error {
+	locked := make(chan struct{})
+	go func() {
+		p.mu.Lock()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+		return nil
+	case <-ctx.Done():
+		go func() {
+			<-locked
+			p.mu.Unlock()
+		}()
+		return fmt.Errorf("requests in progress did not complete: %w", ctx.Err())
+	}
+}
+
+// RotatePIN implements control.Handler
+func (p *HashicorpPlugin) RotatePIN(ctx context.Context, newPIN *secure.Buffer) error {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if !p.isInitialized() {
+		newPIN.Destroy()
+		return errors.New("not configured")
+	}
+	return p.acctManager.RotatePIN(ctx, newPIN)
 }
@@ -0,0 +1,86 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"quorum-account-plugin-pkcs-11/internal/pkcs11"
+
+	"github.com/jpmorganchase/quorum-account-plugin-sdk-go/proto"
+	"github.com/stretchr/testify/require"
+)
+
+// blockingManager is an AccountManager whose Status blocks until release is closed.  Calling any method other than
+// Status and Shutdown panics.
+type blockingManager struct {
+	pkcs11.AccountManager
+	inStatus chan struct{}
+	release  chan struct{}
+	shutdown chan struct{}
+}
+
+func (m *blockingManager) Status(context.Context) (pkcs11.Status, error) {
+	close(m.inStatus)
+	<-m.release
+	return pkcs11.Status{}, nil
+}
+
+func (m *blockingManager) Shutdown(context.Context) error {
+	close(m.shutdown)
+	return nil
+}
+
+func newBlockingManager() *blockingManager {
+	return &blockingManager{inStatus: make(chan struct{}), release: make(chan struct{}), shutdown: make(chan struct{})}
+}
+
+func TestShutdown_WaitsForRequests(t *testing.T) {
+	am := newBlockingManager()
+	p := &HashicorpPlugin{acctManager: am}
+
+	go p.Status(context.Background(), &proto.StatusRequest{})
+	<-am.inStatus
+
+	shutdownErr := make(chan error)
+	go func() {
+		shutdownErr <- p.Shutdown(context.Background())
+	}()
+
+	select {
+	case <-am.shutdown:
+		t.Fatal("AccountManager shut down while a request was in progress")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(am.release)
+	require.NoError(t, <-shutdownErr)
+	<-am.shutdown
+	require.False(t, p.isInitialized())
+
+	_, err := p.Status(context.Background(), &proto.StatusRequest{})
+	_, info := errorInfo(t, err)
+	require.Equal(t, ReasonNotConfigured, info.Reason)
+}
+
+func TestShutdown_Deadline(t *testing.T) {
+	am := newBlockingManager()
+	p := &HashicorpPlugin{acctManager: am}
+
+	go p.Status(context.Background(), &proto.StatusRequest{})
+	<-am.inStatus
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	require.ErrorIs(t, p.Shutdown(ctx), context.DeadlineExceeded)
+
+	// requests are accepted again once the request in progress completes
+	close(am.release)
+	require.Eventually(t, func() bool {
+		if !p.mu.TryLock() {
+			return false
+		}
+		p.mu.Unlock()
+		return true
+	}, time.Second, time.Millisecond)
+}
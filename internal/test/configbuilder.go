@@ -12,6 +12,7 @@ type ConfigBuilder struct {
 	libraryPath string
 	slotLabel   string
 	slotPIN     string
+	environment map[string]string
 	unlock      []string
 }
 
@@ -30,6 +31,11 @@ func (b *ConfigBuilder) WithSlotPIN(s string) *ConfigBuilder {
 	return b
 }
 
+func (b *ConfigBuilder) WithEnvironment(env map[string]string) *ConfigBuilder {
+	b.environment = env
+	return b
+}
+
 func (b *ConfigBuilder) WithUnlock(s []string) *ConfigBuilder {
 	b.unlock = s
 	return b
@@ -58,12 +64,18 @@ func (b *ConfigBuilder) Build(t *testing.T) config.Config {
 		slotPinEnv = config.EnvironmentVariable(*slotPin)
 	}
 
+	var unlock []config.UnlockEntry
+	for _, u := range b.unlock {
+		unlock = append(unlock, config.UnlockEntry{Account: u})
+	}
+
 	return config.Config{
 		Library: config.Pkcs11Library{
-			Path:      path,
-			SlotLabel: &slotLabelEnv,
-			SlotPin:   &slotPinEnv,
+			Path:        path,
+			SlotLabel:   &slotLabelEnv,
+			SlotPin:     &slotPinEnv,
+			Environment: b.environment,
 		},
-		Unlock: b.unlock,
+		Unlock: unlock,
 	}
 }
@@ -2,6 +2,7 @@ package test
 
 import (
 	"errors"
+	"os/exec"
 	"testing"
 
 	"github.com/hashicorp/go-plugin"
@@ -11,6 +12,12 @@ type ITContext struct {
 	Client         *plugin.GRPCClient
 	Server         *plugin.GRPCServer
 	AccountManager *hashicorpPluginGRPCClient
+
+	// process is the client of the plugin subprocess started by StartPluginProcess, cmd the subprocess, and stdout
+	// anything the plugin writes to stdout after the handshake
+	process *plugin.Client
+	cmd     *exec.Cmd
+	stdout  syncBuffer
 }
 
 // starts a plugin server and client, returning the client
@@ -36,6 +43,9 @@ func (c *ITContext) StartPlugin(t *testing.T) error {
 }
 
 func (c *ITContext) Cleanup() {
+	if c.process != nil {
+		c.process.Kill()
+	}
 	if c.Client != nil {
 		c.Client.Close()
 	}
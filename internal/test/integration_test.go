@@ -8,20 +8,27 @@ import (
 	"github.com/jpmorganchase/quorum-account-plugin-sdk-go/proto_common"
 	"github.com/stretchr/testify/require"
 	"quorum-account-plugin-pkcs-11/internal/config"
-	"quorum-account-plugin-pkcs-11/internal/testutil"
+	"quorum-account-plugin-pkcs-11/internal/pkcs11"
+	"quorum-account-plugin-pkcs-11/internal/test/softhsm"
 	"strings"
 	"testing"
 )
 
-func setupPlugin(t *testing.T, ctx *ITContext, args ...map[string]string) {
+// setupPlugin starts the plugin and initializes it to use tok.
+func setupPlugin(t *testing.T, ctx *ITContext, tok *softhsm.Token, args ...map[string]string) {
 	err := ctx.StartPlugin(t)
 	require.NoError(t, err)
+	initPlugin(t, ctx, tok, args...)
+}
 
+// initPlugin initializes the started plugin to use tok.
+func initPlugin(t *testing.T, ctx *ITContext, tok *softhsm.Token, args ...map[string]string) {
 	configBuilder := &ConfigBuilder{}
 	configBuilder.
-		WithLibraryPath(fmt.Sprintf("file://%v", "/usr/local/lib/softhsm/libsofthsm2.so")).
-		WithSlotLabel(fmt.Sprintf("file://%v", "SLOT_LABEL")).
-		WithSlotPIN(fmt.Sprintf("file://%v", "SLOT_PIN"))
+		WithLibraryPath(tok.Library.Path.String()).
+		WithSlotLabel(tok.Library.SlotLabel.String()).
+		WithSlotPIN(tok.Library.SlotPin.String()).
+		WithEnvironment(tok.Library.Environment)
 
 	if args != nil {
 		if unlock, ok := args[0]["unlock"]; ok {
@@ -31,6 +38,7 @@ func setupPlugin(t *testing.T, ctx *ITContext, args ...map[string]string) {
 	conf := configBuilder.Build(t)
 
 	rawConf, err := json.Marshal(&conf)
+	require.NoError(t, err)
 
 	_, err = ctx.AccountManager.Init(context.Background(), &proto_common.PluginInitialization_Request{
 		RawConfiguration: rawConf,
@@ -55,64 +63,50 @@ func TestPlugin_Init_InvalidPluginConfig_libpath(t *testing.T) {
 		RawConfiguration: []byte(noLibPathConf),
 	})
 
-	require.EqualError(t, err, "rpc error: code = InvalidArgument desc = "+config.InvalidLibraryPath)
+	require.EqualError(t, err, "rpc error: code = InvalidArgument desc = library.path: "+config.InvalidLibraryPath+"; library.slotLabel: "+config.MissingValue)
 }
 
 func TestPlugin_Init_InvalidPluginConfig_slotlabel(t *testing.T) {
+	t.Parallel()
+	lib, err := softhsm.FindLibrary()
+	if err != nil {
+		t.Skipf("SoftHSM is not installed: %v", err)
+	}
 	ctx := new(ITContext)
 	defer ctx.Cleanup()
 
-	err := ctx.StartPlugin(t)
+	err = ctx.StartPlugin(t)
 	require.NoError(t, err)
 
-	noLibPathConf := `{
+	noLibPathConf := fmt.Sprintf(`{
 	"library": {
-		"path": "file:///usr/local/lib/softhsm/libsofthsm2.so"
+		"path": "file://%v"
 	}
-}`
+}`, lib)
 
 	_, err = ctx.AccountManager.Init(context.Background(), &proto_common.PluginInitialization_Request{
 		RawConfiguration: []byte(noLibPathConf),
 	})
 
-	require.EqualError(t, err, "rpc error: code = InvalidArgument desc = "+config.MissingSlotLabel)
+	require.EqualError(t, err, "rpc error: code = InvalidArgument desc = library.slotLabel: "+config.MissingValue)
 }
 
 func TestPlugin_Init_ValidPluginConfig(t *testing.T) {
+	t.Parallel()
+	tok := softhsm.NewToken(t)
 	ctx := new(ITContext)
 	defer ctx.Cleanup()
 
-	defer testutil.UnsetAll()
-	testutil.SetSlotLabel("some label")
-	testutil.SetSlotPIN("987654321")
-
-	err := ctx.StartPlugin(t)
-	require.NoError(t, err)
-
-	noLibPathConf := `{
-	"library": {
-		"path": "file:///usr/local/lib/softhsm/libsofthsm2.so",
-		"slotLabel": "env://SLOT_LABEL",
-		"slotPin": "env://SLOT_PIN"
-	}
-}`
-
-	_, err = ctx.AccountManager.Init(context.Background(), &proto_common.PluginInitialization_Request{
-		RawConfiguration: []byte(noLibPathConf),
-	})
-
-	require.NoError(t, err)
+	setupPlugin(t, ctx, tok)
 }
 
 func TestPlugin_Status_NoAccounts(t *testing.T) {
+	t.Parallel()
+	tok := softhsm.NewToken(t)
 	ctx := new(ITContext)
 	defer ctx.Cleanup()
 
-	defer testutil.UnsetAll()
-	testutil.SetSlotLabel("Quorum Plugin Test 1")
-	testutil.SetSlotPIN("123456")
-
-	setupPlugin(t, ctx)
+	setupPlugin(t, ctx, tok)
 	_, err := ctx.AccountManager.Open(context.Background(), &proto.OpenRequest{})
 	require.NoError(t, err)
 
@@ -120,18 +114,20 @@ func TestPlugin_Status_NoAccounts(t *testing.T) {
 	resp, err := ctx.AccountManager.Status(context.Background(), &proto.StatusRequest{})
 	require.NoError(t, err)
 
-	require.Equal(t, "0 unlocked account(s)", resp.Status)
+	var status pkcs11.Status
+	require.NoError(t, json.Unmarshal([]byte(resp.Status), &status))
+	require.Empty(t, status.Unlocked)
+	require.True(t, status.Login.LoggedIn)
+	require.Equal(t, tok.Label, status.Token.Label)
 }
 
 func TestPlugin_Accounts_NoAccounts(t *testing.T) {
+	t.Parallel()
+	tok := softhsm.NewToken(t)
 	ctx := new(ITContext)
 	defer ctx.Cleanup()
 
-	defer testutil.UnsetAll()
-	testutil.SetSlotLabel("Quorum Plugin Test 1")
-	testutil.SetSlotPIN("123456")
-
-	setupPlugin(t, ctx)
+	setupPlugin(t, ctx, tok)
 	_, err := ctx.AccountManager.Open(context.Background(), &proto.OpenRequest{})
 	require.NoError(t, err)
 
@@ -143,18 +139,16 @@ func TestPlugin_Accounts_NoAccounts(t *testing.T) {
 }
 
 func TestPlugin_Accounts_NewAccount(t *testing.T) {
+	t.Parallel()
+	tok := softhsm.NewToken(t)
 	ctx := new(ITContext)
 	defer ctx.Cleanup()
 
-	defer testutil.UnsetAll()
-	testutil.SetSlotLabel("Quorum Plugin Test 1")
-	testutil.SetSlotPIN("123456")
-
 	newAcctConf := `{
 		"secretName": "newAcct"
 	}`
 
-	setupPlugin(t, ctx)
+	setupPlugin(t, ctx, tok)
 	_, err := ctx.AccountManager.Open(context.Background(), &proto.OpenRequest{})
 	require.NoError(t, err)
 
@@ -164,4 +158,10 @@ func TestPlugin_Accounts_NewAccount(t *testing.T) {
 
 	require.NotNil(t, resp)
 	require.Len(t, resp.Account.Address, 20)
+
+	// the account is on the token
+	accts, err := ctx.AccountManager.Accounts(context.Background(), &proto.AccountsRequest{})
+	require.NoError(t, err)
+	require.Len(t, accts.Accounts, 1)
+	require.Equal(t, resp.Account.Address, accts.Accounts[0].Address)
 }
@@ -0,0 +1,113 @@
+package test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"quorum-account-plugin-pkcs-11/internal/server"
+	"sync"
+	"testing"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/go-plugin"
+)
+
+// pluginPackage is the import path of the plugin's main package
+const pluginPackage = "quorum-account-plugin-pkcs-11"
+
+// buildPlugin builds the plugin binary in a directory removed when t ends, skipping t if the go command is not found.
+func buildPlugin(t *testing.T) string {
+	t.Helper()
+	goCmd, err := exec.LookPath("go")
+	if err != nil {
+		t.Skipf("go command not found: %v", err)
+	}
+	bin := filepath.Join(t.TempDir(), "quorum-account-plugin-pkcs-11")
+	out, err := exec.Command(goCmd, "build", "-o", bin, pluginPackage).CombinedOutput()
+	if err != nil {
+		t.Fatalf("unable to build plugin: %v\n%s", err, out)
+	}
+	return bin
+}
+
+// StartPluginProcess builds the plugin and starts it as a subprocess, connecting to it with the go-plugin handshake and
+// gRPC over mTLS as Quorum's plugin manager does.  Unlike StartPlugin, this checks the magic cookie, the handshake
+// written to stdout and the process boundary.  The plugin's logs are written to the test log.
+func (c *ITContext) StartPluginProcess(t *testing.T) error {
+	bin := buildPlugin(t)
+
+	c.cmd = exec.Command(bin)
+	c.process = plugin.NewClient(&plugin.ClientConfig{
+		HandshakeConfig:  server.HandshakeConfig,
+		Plugins:          map[string]plugin.Plugin{"impl": new(testableHashicorpPlugin)},
+		Cmd:              c.cmd,
+		AllowedProtocols: []plugin.Protocol{plugin.ProtocolGRPC},
+		AutoMTLS:         true,
+		SyncStdout:       &c.stdout,
+		Logger: hclog.New(&hclog.LoggerOptions{
+			Name:   "plugin",
+			Output: testWriter{t},
+			Level:  hclog.Debug,
+		}),
+	})
+
+	rpcClient, err := c.process.Client()
+	if err != nil {
+		return err
+	}
+	raw, err := rpcClient.Dispense("impl")
+	if err != nil {
+		return err
+	}
+	acctman, ok := raw.(hashicorpPluginGRPCClient)
+	if !ok {
+		return errors.New("unable to get plugin grpc client")
+	}
+	c.AccountManager = &acctman
+	return nil
+}
+
+// StopPluginProcess asks the plugin started by StartPluginProcess to shut down, as Quorum does when it stops, and waits
+// for it to exit.  go-plugin kills the plugin if it has not exited 2s after being asked to.  It returns anything the
+// plugin wrote to stdout after the handshake, and the state of the exited process.
+func (c *ITContext) StopPluginProcess() (string, *os.ProcessState, error) {
+	if c.process == nil {
+		return "", nil, errors.New("plugin process not started")
+	}
+	c.process.Kill()
+	if c.cmd.ProcessState == nil {
+		return "", nil, fmt.Errorf("plugin process %v has not exited", c.cmd.Process.Pid)
+	}
+	return c.stdout.String(), c.cmd.ProcessState, nil
+}
+
+// syncBuffer is a bytes.Buffer which can be written to while it is read.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// testWriter writes to the test log.
+type testWriter struct {
+	t *testing.T
+}
+
+func (w testWriter) Write(p []byte) (int, error) {
+	w.t.Log(string(bytes.TrimRight(p, "\n")))
+	return len(p), nil
+}
@@ -0,0 +1,89 @@
+package test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"math/big"
+	"quorum-account-plugin-pkcs-11/internal/account/account"
+	"quorum-account-plugin-pkcs-11/internal/pkcs11"
+	"quorum-account-plugin-pkcs-11/internal/test/softhsm"
+	"testing"
+
+	"github.com/jpmorganchase/quorum-account-plugin-sdk-go/proto"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPluginProcess_AccountFlow(t *testing.T) {
+	t.Parallel()
+	tok := softhsm.NewToken(t)
+	ctx := new(ITContext)
+	defer ctx.Cleanup()
+	bg := context.Background()
+
+	require.NoError(t, ctx.StartPluginProcess(t))
+	initPlugin(t, ctx, tok)
+
+	_, err := ctx.AccountManager.Open(bg, &proto.OpenRequest{})
+	require.NoError(t, err)
+	resp, err := ctx.AccountManager.Status(bg, &proto.StatusRequest{})
+	require.NoError(t, err)
+	var status pkcs11.Status
+	require.NoError(t, json.Unmarshal([]byte(resp.Status), &status))
+	require.True(t, status.Login.LoggedIn)
+	require.Equal(t, tok.Label, status.Token.Label)
+
+	// new and imported accounts are listed
+	newAcct, err := ctx.AccountManager.NewAccount(bg, &proto.NewAccountRequest{NewAccountConfig: []byte(`{"secretName": "newAcct"}`)})
+	require.NoError(t, err)
+	rawKey := "1fe8f1ad4053326db20529257ac9401f2e6c769ef1d736b8c2f5aba5f787c72b"
+	key, err := account.NewKeyFromHexString(rawKey)
+	require.NoError(t, err)
+	imported, err := ctx.AccountManager.ImportRawKey(bg, &proto.ImportRawKeyRequest{
+		RawKey:           rawKey,
+		NewAccountConfig: []byte(`{"secretName": "imported"}`),
+	})
+	require.NoError(t, err)
+	wantAddr, err := hex.DecodeString("6038dc01869425004ca0b8370f6c81cf464213b3")
+	require.NoError(t, err)
+	require.Equal(t, wantAddr, imported.Account.Address)
+
+	accts, err := ctx.AccountManager.Accounts(bg, &proto.AccountsRequest{})
+	require.NoError(t, err)
+	var addrs [][]byte
+	for _, a := range accts.Accounts {
+		addrs = append(addrs, a.Address)
+	}
+	require.ElementsMatch(t, [][]byte{newAcct.Account.Address, imported.Account.Address}, addrs)
+	contains, err := ctx.AccountManager.Contains(bg, &proto.ContainsRequest{Address: imported.Account.Address})
+	require.NoError(t, err)
+	require.True(t, contains.IsContained)
+
+	// signing needs the account to be unlocked
+	// Quorum signs a 32 byte hash
+	hash := sha256.Sum256([]byte("to sign"))
+	toSign := hash[:]
+	_, err = ctx.AccountManager.Sign(bg, &proto.SignRequest{Address: imported.Account.Address, ToSign: toSign})
+	require.Error(t, err)
+	_, err = ctx.AccountManager.TimedUnlock(bg, &proto.TimedUnlockRequest{Address: imported.Account.Address})
+	require.NoError(t, err)
+	sig, err := ctx.AccountManager.Sign(bg, &proto.SignRequest{Address: imported.Account.Address, ToSign: toSign})
+	require.NoError(t, err)
+	require.Len(t, sig.Sig, 65)
+	require.True(t, ecdsa.Verify(&key.PublicKey, toSign, new(big.Int).SetBytes(sig.Sig[:32]), new(big.Int).SetBytes(sig.Sig[32:64])))
+	_, err = ctx.AccountManager.Lock(bg, &proto.LockRequest{Address: imported.Account.Address})
+	require.NoError(t, err)
+	_, err = ctx.AccountManager.Sign(bg, &proto.SignRequest{Address: imported.Account.Address, ToSign: toSign})
+	require.Error(t, err)
+
+	_, err = ctx.AccountManager.Close(bg, &proto.CloseRequest{})
+	require.NoError(t, err)
+
+	// stdout is reserved for the handshake, and the plugin exits by itself when asked to shut down
+	stdout, state, err := ctx.StopPluginProcess()
+	require.NoError(t, err)
+	require.Empty(t, stdout)
+	require.True(t, state.Success(), "plugin process exited with %v", state)
+}
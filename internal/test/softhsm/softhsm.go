@@ -0,0 +1,178 @@
+// Package softhsm provides SoftHSM tokens for tests which use a real PKCS#11 library.  Each test gets its own copy of
+// the library, config and token directory, so tests using it can run in parallel and always start from an empty token.
+package softhsm
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"quorum-account-plugin-pkcs-11/internal/config"
+	"quorum-account-plugin-pkcs-11/internal/pkcs11"
+	"quorum-account-plugin-pkcs-11/internal/secure"
+	"strings"
+	"testing"
+)
+
+// LibraryEnv is the environment variable which, if set, is the path of libsofthsm2 rather than one of LibraryPaths.
+const LibraryEnv = "SOFTHSM2_LIB"
+
+// LibraryPaths are the usual paths of libsofthsm2 on Linux, in the order they are checked.
+var LibraryPaths = []string{
+	"/usr/lib/softhsm/libsofthsm2.so",
+	"/usr/local/lib/softhsm/libsofthsm2.so",
+	"/usr/lib/x86_64-linux-gnu/softhsm/libsofthsm2.so",
+	"/usr/lib/aarch64-linux-gnu/softhsm/libsofthsm2.so",
+	"/usr/lib64/pkcs11/libsofthsm2.so",
+	"/usr/lib64/softhsm/libsofthsm2.so",
+	"/usr/lib/pkcs11/libsofthsm2.so",
+}
+
+// FindLibrary returns the path of libsofthsm2: the value of LibraryEnv if it is set, or else the first of
+// LibraryPaths which exists.
+func FindLibrary() (string, error) {
+	if path, ok := os.LookupEnv(LibraryEnv); ok {
+		if _, err := os.Stat(path); err != nil {
+			return "", fmt.Errorf("%v: %w", LibraryEnv, err)
+		}
+		return path, nil
+	}
+	for _, path := range LibraryPaths {
+		if _, err := os.Stat(path); err == nil {
+			return path, nil
+		}
+	}
+	return "", fmt.Errorf("libsofthsm2 not found in %v; set %v to its path", strings.Join(LibraryPaths, ", "), LibraryEnv)
+}
+
+// Token is an initialized SoftHSM token with no objects, created for a single test.
+type Token struct {
+	// Library is the config of the test's copy of libsofthsm2, which reads the test's SOFTHSM2_CONF, with SlotLabel
+	// and SlotPin referring to environment variables holding Label and PIN
+	Library config.Pkcs11Library
+	// Label, PIN and SOPIN are the random label, user PIN and Security Officer PIN of the token
+	Label, PIN, SOPIN string
+	// Dir holds the test's SoftHSM config and token directory
+	Dir string
+}
+
+// NewToken creates a SoftHSM token for t, skipping t if SoftHSM is not installed.  The token is initialized with
+// C_InitToken and C_InitPIN, and is removed, with the environment variables referred to by its config, when t ends.
+func NewToken(t testing.TB) *Token {
+	t.Helper()
+	lib, err := FindLibrary()
+	if err != nil {
+		t.Skipf("SoftHSM is not installed: %v", err)
+	}
+
+	dir := t.TempDir()
+	tokenDir := filepath.Join(dir, "tokens")
+	if err := os.Mkdir(tokenDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	conf := filepath.Join(dir, "softhsm2.conf")
+	err = os.WriteFile(conf, []byte(fmt.Sprintf(`directories.tokendir = %v
+objectstore.backend = file
+log.level = ERROR
+slots.removable = false
+`, tokenDir)), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a module can only be initialized once per process, with the config read by its first C_Initialize, so each test
+	// loads its own copy of the library
+	path := filepath.Join(dir, "libsofthsm2.so")
+	if err := copyFile(path, lib); err != nil {
+		t.Fatal(err)
+	}
+
+	tok := &Token{
+		Label: "test-" + random(t, 8),
+		PIN:   random(t, 8),
+		SOPIN: random(t, 8),
+		Dir:   dir,
+	}
+	tok.Library = config.Pkcs11Library{
+		Path:        &url.URL{Scheme: "file", Path: path},
+		SlotLabel:   setEnv(t, "SLOT_LABEL", tok.Label),
+		SlotPin:     setEnv(t, "SLOT_PIN", tok.PIN),
+		Environment: map[string]string{"SOFTHSM2_CONF": conf},
+		Profile:     config.ProfileSoftHSM2,
+	}
+	if err := tok.init(); err != nil {
+		t.Fatalf("unable to initialize SoftHSM token: %v", err)
+	}
+	return tok
+}
+
+// init initializes the token in the free slot, which SoftHSM always has, and sets its user PIN.
+func (tok *Token) init() error {
+	ta, err := pkcs11.NewLibraryTokenAdmin(tok.Library)
+	if err != nil {
+		return err
+	}
+	defer ta.Close()
+
+	free, err := ta.FreeSlot()
+	if err != nil {
+		return err
+	}
+
+	so, err := secure.FromString(tok.SOPIN)
+	if err != nil {
+		return err
+	}
+	defer so.Destroy()
+	pin, err := secure.FromString(tok.PIN)
+	if err != nil {
+		return err
+	}
+	defer pin.Destroy()
+	if err := ta.InitToken(free, so, tok.Label); err != nil {
+		return fmt.Errorf("C_InitToken: %w", err)
+	}
+	if err := ta.InitPIN(tok.Label, so, pin); err != nil {
+		return fmt.Errorf("C_InitPIN: %w", err)
+	}
+	return nil
+}
+
+// setEnv sets an environment variable, with a random name starting with prefix so that it is only used by t, to value
+// until t ends and returns a reference to it.
+func setEnv(t testing.TB, prefix, value string) *config.EnvironmentVariable {
+	name := fmt.Sprintf("%v_%v", prefix, strings.ToUpper(random(t, 4)))
+	if err := os.Setenv(name, value); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Unsetenv(name) })
+	return &config.EnvironmentVariable{Scheme: "env", Host: name}
+}
+
+// random returns n random bytes in hex.
+func random(t testing.TB, n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		t.Fatal(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+func copyFile(dst, src string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0700)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,47 @@
+package softhsm
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"quorum-account-plugin-pkcs-11/internal/pkcs11"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFindLibrary_Env(t *testing.T) {
+	lib := filepath.Join(t.TempDir(), "libsofthsm2.so")
+	require.NoError(t, os.WriteFile(lib, nil, 0600))
+	t.Setenv(LibraryEnv, lib)
+
+	got, err := FindLibrary()
+	require.NoError(t, err)
+	require.Equal(t, lib, got)
+
+	t.Setenv(LibraryEnv, lib+".missing")
+	_, err = FindLibrary()
+	require.Error(t, err)
+}
+
+func TestNewToken(t *testing.T) {
+	for _, name := range []string{"a", "b"} {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			ctx := context.Background()
+			tok := NewToken(t)
+
+			c, err := pkcs11.NewCryptoki(tok.Library)
+			require.NoError(t, err)
+			defer c.Finalize(ctx)
+			require.NoError(t, c.OpenSession(ctx))
+
+			info, err := c.TokenInfo()
+			require.NoError(t, err)
+			require.Equal(t, tok.Label, info.Label)
+			accts, err := c.Accounts(ctx)
+			require.NoError(t, err)
+			require.Empty(t, accts)
+		})
+	}
+}
@@ -0,0 +1,135 @@
+// Package tracing configures OpenTelemetry tracing for the plugin.  Spans are created with Tracer throughout the
+// plugin; until Start is called they are discarded.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"quorum-account-plugin-pkcs-11/internal/config"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/embedded"
+	"google.golang.org/grpc/metadata"
+)
+
+const instrumentationName = "quorum-account-plugin-pkcs-11"
+
+// propagator reads the W3C trace context and baggage sent by Quorum in the gRPC request metadata.
+var propagator = propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{})
+
+// Tracer returns the plugin's tracer.  It may be kept in a package variable: each span is started by the tracer provider
+// installed at the time, as the provider is replaced each time Start is called.
+func Tracer() trace.Tracer {
+	return currentTracer{}
+}
+
+// currentTracer starts spans with the plugin's tracer from the current global tracer provider.  A tracer obtained from
+// the global provider before a provider is installed only delegates to the first provider ever installed, so keeping
+// one would drop every span once that provider is shut down by a reload.
+type currentTracer struct {
+	embedded.Tracer
+}
+
+func (currentTracer) Start(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	return otel.Tracer(instrumentationName).Start(ctx, name, opts...)
+}
+
+// Start installs a tracer provider exporting spans as configured by conf.  The returned func flushes any buffered
+// spans and stops the export; it must be called before Start is called again.
+func Start(ctx context.Context, conf config.Tracing) (func(context.Context) error, error) {
+	exporter, err := newExporter(ctx, conf)
+	if err != nil {
+		return nil, err
+	}
+	return install(exporter), nil
+}
+
+func newExporter(ctx context.Context, conf config.Tracing) (sdktrace.SpanExporter, error) {
+	switch conf.Exporter {
+	case config.OTLPExporter:
+		return otlptracegrpc.New(ctx, otlptracegrpc.WithEndpoint(conf.Endpoint), otlptracegrpc.WithInsecure())
+	case config.FileExporter:
+		f, err := os.OpenFile(conf.File.Path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			return nil, err
+		}
+		exporter, err := newWriterExporter(f)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		return &closingExporter{SpanExporter: exporter, closer: f}, nil
+	default:
+		return nil, fmt.Errorf("unknown trace exporter %q", conf.Exporter)
+	}
+}
+
+// newWriterExporter returns an exporter writing each span to w as a JSON document.
+func newWriterExporter(w io.Writer) (sdktrace.SpanExporter, error) {
+	return stdouttrace.New(stdouttrace.WithWriter(w))
+}
+
+// install makes exporter the destination of all spans and returns a func to flush and stop it.
+func install(exporter sdktrace.SpanExporter) func(context.Context) error {
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", instrumentationName))),
+	)
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagator)
+	return tp.Shutdown
+}
+
+// Extract returns ctx with the remote span context carried in its incoming gRPC metadata, if any.
+func Extract(ctx context.Context) context.Context {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return ctx
+	}
+	return propagator.Extract(ctx, metadataCarrier(md))
+}
+
+// metadataCarrier adapts gRPC metadata to a propagation.TextMapCarrier.
+type metadataCarrier metadata.MD
+
+func (c metadataCarrier) Get(key string) string {
+	if v := metadata.MD(c).Get(key); len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
+
+func (c metadataCarrier) Set(key, value string) {
+	metadata.MD(c).Set(key, value)
+}
+
+func (c metadataCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for k := range c {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// closingExporter closes the file written by the exporter when it is shut down.
+type closingExporter struct {
+	sdktrace.SpanExporter
+	closer io.Closer
+}
+
+func (e *closingExporter) Shutdown(ctx context.Context) error {
+	err := e.SpanExporter.Shutdown(ctx)
+	if cErr := e.closer.Close(); err == nil {
+		err = cErr
+	}
+	return err
+}
@@ -0,0 +1,61 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc/metadata"
+)
+
+func TestExtract(t *testing.T) {
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(
+		"traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+	))
+
+	sc := trace.SpanContextFromContext(Extract(ctx))
+
+	require.True(t, sc.IsRemote())
+	require.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", sc.TraceID().String())
+	require.Equal(t, "00f067aa0ba902b7", sc.SpanID().String())
+}
+
+func TestExtract_NoMetadata(t *testing.T) {
+	ctx := Extract(context.Background())
+
+	require.False(t, trace.SpanContextFromContext(ctx).IsValid())
+}
+
+func TestWriterExporter(t *testing.T) {
+	var buf bytes.Buffer
+	exporter, err := newWriterExporter(&buf)
+	require.NoError(t, err)
+	stop := install(exporter)
+
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(
+		"traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+	))
+	ctx, parent := Tracer().Start(Extract(ctx), "AccountService/Sign")
+	_, child := Tracer().Start(ctx, "C_Sign")
+	child.End()
+	parent.End()
+
+	require.NoError(t, stop(context.Background()))
+
+	var spans []map[string]interface{}
+	dec := json.NewDecoder(&buf)
+	for dec.More() {
+		var span map[string]interface{}
+		require.NoError(t, dec.Decode(&span))
+		spans = append(spans, span)
+	}
+	require.Len(t, spans, 2)
+	require.Equal(t, "C_Sign", spans[0]["Name"])
+	require.Equal(t, "AccountService/Sign", spans[1]["Name"])
+	for _, span := range spans {
+		require.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", span["SpanContext"].(map[string]interface{})["TraceID"])
+	}
+}
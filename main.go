@@ -1,31 +1,61 @@
 package main
 
 import (
-	"log"
+	"context"
 	"os"
+	"os/signal"
+	"quorum-account-plugin-pkcs-11/internal/admin"
+	"quorum-account-plugin-pkcs-11/internal/logging"
 	"quorum-account-plugin-pkcs-11/internal/server"
+	"syscall"
+	"time"
 
+	"github.com/hashicorp/go-hclog"
 	"github.com/hashicorp/go-plugin"
 )
 
-const defaultProtocolVersion = 1
+//go:generate sh -c "go run . config schema > config.schema.json"
 
-var (
-	defaultHandshakeConfig = plugin.HandshakeConfig{
-		ProtocolVersion:  defaultProtocolVersion,
-		MagicCookieKey:   "QUORUM_PLUGIN_MAGIC_COOKIE",
-		MagicCookieValue: "CB9F51969613126D93468868990F77A8470EB9177503C5A38D437FEFF7786E0941152E05C06A9A3313391059132A7F9CED86C0783FE63A8B38F01623C8257664",
-	}
-)
+// shutdownTimeout bounds the teardown of the plugin.  go-plugin kills the plugin process if it has not exited 2s after
+// being asked to shut down.
+const shutdownTimeout = 2 * time.Second
 
 func main() {
-	log.SetFlags(0)          // remove timestamp when logging to host process
-	log.SetOutput(os.Stderr) // host process listens to stderr to log
+	// Quorum starts the plugin without arguments; any arguments are an operator running an admin command
+	if len(os.Args) > 1 {
+		os.Exit(admin.Run(os.Args[1:], os.Stdout, os.Stderr))
+	}
+
+	// host process listens to stderr to log; stdout is reserved for the go-plugin handshake
+	logger := logging.New(os.Stderr, hclog.Info)
+	logging.SetDefault(logger)
+
+	impl := &server.HashicorpPlugin{}
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGTERM)
+		<-sig
+		logging.L().Info("received SIGTERM, shutting down")
+		shutdown(impl)
+		os.Exit(0)
+	}()
+
 	plugin.Serve(&plugin.ServeConfig{
-		HandshakeConfig: defaultHandshakeConfig,
+		HandshakeConfig: server.HandshakeConfig,
 		Plugins: map[string]plugin.Plugin{
-			"impl": &server.HashicorpPlugin{},
+			"impl": impl,
 		},
 		GRPCServer: plugin.DefaultGRPCServer,
+		Logger:     logger,
 	})
+	// Serve returns once the host process has asked the plugin to shut down
+	shutdown(impl)
+}
+
+func shutdown(impl *server.HashicorpPlugin) {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := impl.Shutdown(ctx); err != nil {
+		logging.L().Error("plugin shutdown failed", "error", err)
+	}
 }